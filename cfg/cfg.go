@@ -2,14 +2,24 @@
 This pkg is a system-wide configuration, no detail is too large or small,
 all inclusive and nicely global.
 
+The vars in this file are defaults, they can be overridden with a config
+file, env vars and flags without recompiling; see ./load.go.
+
 */
 package cfg
 
 import (
 	"time"
+	"trypo/core/api"
 	"trypo/core/eventloop"
 	"trypo/pkg/arbiter"
+	"trypo/pkg/kmeans/centroid"
+	"trypo/pkg/kmeans/centroidmanager"
+	"trypo/pkg/kmeans/rpc"
+	"trypo/pkg/logging"
+	"trypo/pkg/mathutils"
 	"trypo/pkg/searchutils"
+	"trypo/pkg/tlsutils"
 )
 
 // Alias.
@@ -32,6 +42,93 @@ var OtherAddrRPC = []Addr{
 // Address for the API / web server used as a user-facing interface.
 var LocalAddrAPI = Addr{"localhost", "3501"}
 
+// Config for the API / web server (core/api), see docs for api.APIConfig.
+var API = api.APIConfig{
+	Addr:         LocalAddrAPI,
+	RPCAddrs:     OtherAddrRPC,
+	ReadTimeout:  time.Second * 5,
+	WriteTimeout: time.Second * 5,
+	// Set to &ELT to enable the admin route for tuning the event loop at
+	// runtime (see core/api/admin.go).
+	EventLoop: nil,
+	// Set to enable the admin routes for running maintenance tasks on
+	// demand (see core/api/maintenance.go). All admin routes then require
+	// the header 'Authorization: Bearer <AdminToken>'. Preferably set with
+	// the env var TRYPO_API_ADMIN_TOKEN rather than in a config file.
+	AdminToken: "",
+	// Set to require bearer tokens for the data routes, with per-namespace
+	// read and write access (see core/api/auth.go). E.g:
+	//	[]api.APIKey{{Token: "abc", Read: []string{"*"}, Write: []string{"a"}}}
+	Keys: nil,
+	// Set Cert and Key (PEM file paths) to serve HTTPS. CA is for verifying
+	// client certificates, which are required if ClientAuth is set.
+	TLS: tlsutils.Files{},
+}
+
+// Secret shared by all nodes in the RPC network. When set, nodes only accept
+// connections from peers that know it, through a handshake (see
+// pkg/rpcutils/auth.go). Must be the same in all nodes; preferably set with
+// the env var TRYPO_RPC_SECRET rather than in a config file.
+var RPC_SECRET = ""
+
+// TLS for the RPC network, used both by the server of this node and when
+// calling other nodes (the certificate is then a client certificate). Set
+// Cert and Key (PEM file paths) to enable, and CA to verify peers against
+// (the system roots are used otherwise). If ClientAuth is set, the server
+// only accepts clients with certificates signed by CA. All nodes in the
+// network must agree on whether TLS is used.
+var RPC_TLS = tlsutils.Files{}
+
+// Limits for namespaces (keys), where "*" is for all namespaces without
+// their own. Datapoints and bytes are limited in each node, write and query
+// rates in each API server; see rpc.Quota. Empty means no limits. E.g:
+//	rpc.Quotas{"*": {MaxDPs: 100000, WriteRate: 100}}
+var QUOTAS = rpc.Quotas{}
+
+// Expiry policies for namespaces (keys), where "*" is for all namespaces
+// without their own: the default time to live of datapoints that are added
+// without an expiry, and whether lookups push expiry forward (as a touch
+// does); see rpc.TTL. Empty means that datapoints only expire as set by
+// clients. E.g:
+//	rpc.TTLs{"*": {Default: time.Hour * 24}, "sessions": {Default: time.Minute * 30, RefreshOnRead: true}}
+var TTLS = rpc.TTLs{}
+
+// Relative weight of this node compared to the others, e.g 2 for a node with
+// twice the memory of a node with 1. Load balancing gives each node a share of
+// the data that is proportional to its capacity.
+var NODE_CAPACITY = 1.0
+
+// Bytes of data (vectors and payloads, in all namespaces) that load balancing
+// won't take this node beyond. Zero means no limit. Note that inserts aren't
+// limited by this, see QUOTAS for that.
+var NODE_MEM_HIGH_WATER = 0
+
+// How long a graceful shutdown (on SIGINT/SIGTERM) may take before the
+// process exits anyway. See cmd/service.
+var SHUTDOWN_TIMEOUT = time.Second * 30
+
+// If true, the data of this node is moved to the other nodes (OtherAddrRPC)
+// on a graceful shutdown, through the same mechanism as load balancing.
+var SHUTDOWN_HANDOFF = false
+
+// Path of a file where the data of this node is persisted on a graceful
+// shutdown (whatever wasn't handed off, see SHUTDOWN_HANDOFF), and is loaded
+// from on startup. Empty disables persistence.
+var SNAPSHOT_PATH = ""
+
+// How often the config file (if any) is checked for changes, which are then
+// applied to the running system (only event loop tuning, see ./reload.go).
+// Zero disables this.
+var CONFIG_WATCH_INTERVAL = time.Second * 5
+
+// Events below this level are dropped by the system-wide logger (see
+// pkg/logging), one of debug, info, warn and error.
+var LOG_LEVEL = logging.LevelInfo
+
+// Output format of the system-wide logger, logfmt or JSON (one event per
+// line in both cases).
+var LOG_FORMAT = logging.FormatLogfmt
+
 /*
 --------------------------------------------------------------------------------
 	These are search funcs for "k nearest neighbours", basically the
@@ -64,62 +161,74 @@ var ELT = eventloop.EventLoopConfig{
 	// All addresses in the network, should include LocalAddr.
 	RemoteAddrs: OtherAddrRPC,
 
-	// Timeout for each loop interation.
-	TimeoutLoop: time.Second * 5,
-	// Timeout for each task in the event loop.
-	TimeoutStep: time.Second * 5,
-
-	// Each task in the event loop will be skippable such that not everything has
-	// to run in each loop iteration. This is useful when some tasks are recource
-	// and/or time intensive (more than others) and should run infrequently.
-	// Example:
-	//	int=1 : run on each loop.
-	//	int=2 : run every second loop.
-	//	int=3 : run every third loop.
-	//	etc...
-	// Values over 1000 will never be ran.
-	TaskSkip: eventloop.EventLoopTaskSkipConfig{
+	// Each task in the event loop runs on its own schedule, independently
+	// of the other tasks (so a slow task doesn't delay the others). A
+	// schedule is either an interval ('Every') or a cron expression
+	// ('Cron', e.g "*/15 * * * *"), with an optional random delay
+	// ('Jitter'), a limit for how many runs of the task can be in progress
+	// at once ('MaxConcurrency', runs are skipped when it's reached) and a
+	// timeout for each run ('Timeout', zero means none). A zero schedule
+	// disables the task. Example:
+	//	eventloop.TaskSchedule{Every: time.Minute, Jitter: time.Second * 10}
+	//	eventloop.TaskSchedule{Cron: "0 3 * * *", Timeout: time.Hour}
+	Schedules: eventloop.EventLoopSchedules{
 		// Expire triggers datapoint expiration in the whole network.
 		// Not necessary to always do this, as moving dataponts will
 		// often auto-expire them, though this isn't garanteed.
-		Expire: 20,
+		Expire: eventloop.TaskSchedule{
+			Every: time.Minute * 10, Jitter: time.Second * 30, MaxConcurrency: 1, Timeout: time.Minute * 5,
+		},
 		// MemTrim triggers memory reduction in the whole network.
 		// In practice, this means that slices containing datapoints
 		// and centroids have their capacity reduced. Not necessary
 		// to always do this, since slices might be re-populated with
 		// new data, thout that is not garuanteed.
-		MemTrim: 10,
+		MemTrim: eventloop.TaskSchedule{
+			Every: time.Minute * 5, Jitter: time.Second * 30, MaxConcurrency: 1, Timeout: time.Minute * 5,
+		},
 		// DistributeDataPointsFast triggers the hasty movement of
 		// datapoints within the network. It is a way of attracting
 		// dps to some best-fit node, but with an accuracy/speed
 		// tradeoff (also see DistributeDataPointsFast field). It
 		// moved dps on a node granularity. The actual amount to
 		// distribute is set in EventLoopConfig.
-		DistributeDataPointsFast: 4,
+		DistributeDataPointsFast: eventloop.TaskSchedule{
+			Every: time.Minute * 2, Jitter: time.Second * 10, MaxConcurrency: 1, Timeout: time.Minute * 2,
+		},
 		// DistributeDataPointsAccurate triggers movement of datapoints
 		// within the network with highest possible accuracy, though at
 		// the cost of speed. It is an alternative to DistributeDataPointsFast
 		// and works on a Centroid granularity (contained by nodes), as opposed
 		// to just nodes. The actual amount to distribute is set in EventLoopConfig.
-		DistributeDataPointsAccurate: 8,
+		DistributeDataPointsAccurate: eventloop.TaskSchedule{
+			Every: time.Minute * 5, Jitter: time.Second * 30, MaxConcurrency: 1, Timeout: time.Minute * 5,
+		},
 		// DistributeDataPointsInternal triggers movement of datapoints
 		// within each node in the network, as opposed to between nodes.
 		// It can be thought of as data integrity on a node-level. The
 		// actual amount to distribute is set in EventLoopConfig.
-		DistributeDataPointsInternal: 3,
+		DistributeDataPointsInternal: eventloop.TaskSchedule{
+			Every: time.Minute * 2, Jitter: time.Second * 10, MaxConcurrency: 1, Timeout: time.Minute * 2,
+		},
 		// SplitCentroids triggers procedures in the network that splits
 		// centroids if they are too big. The threshold values are specified
 		// in EventLoopConfig.
-		SplitCentroids: 3,
+		SplitCentroids: eventloop.TaskSchedule{
+			Every: time.Minute * 2, Jitter: time.Second * 10, MaxConcurrency: 1, Timeout: time.Minute * 2,
+		},
 		// MergeCentroids triggers procedures in the network that merges
 		// centroids if they are too small. The threshold values are
 		// specified in EventLoopConfig.
-		MergeCentroids: 3,
+		MergeCentroids: eventloop.TaskSchedule{
+			Every: time.Minute * 2, Jitter: time.Second * 10, MaxConcurrency: 1, Timeout: time.Minute * 2,
+		},
 		// LoadBalancing triggers load-balancing in the network.
-		LoadBalancing: 7,
+		LoadBalancing: eventloop.TaskSchedule{
+			Every: time.Minute * 5, Jitter: time.Second * 30, MaxConcurrency: 1, Timeout: time.Minute * 5,
+		},
 		// Meta triggers polling of metadata for the logger ('L' field in
 		// EventLoopConfig, data is passed to the LogMeta method).
-		Meta: 1,
+		Meta: eventloop.TaskSchedule{Every: time.Second * 10, MaxConcurrency: 1},
 	},
 
 	// Specifies how many datapoints each node in the network should
@@ -156,6 +265,13 @@ var ELT = eventloop.EventLoopConfig{
 	// in which centroids will be merged.
 	MergeCentroidsMax: 100,
 
+	// Load balancing gives each node a share of the data (bytes) in each
+	// namespace that is proportional to its capacity (see NODE_CAPACITY).
+	// A node only takes data from others if it's below its share by more
+	// than this fraction of it, such that data isn't moved back and forth
+	// over small differences. Must be in [0, 1).
+	LoadBalancingMargin: 0.2,
+
 	// The logger interface in this pkg has two methods, on of them
 	// (named 'LogMeta') receves a MetaData type as arg, which has
 	// some metadata for nodes. This metadata is pulled from the
@@ -166,11 +282,45 @@ var ELT = eventloop.EventLoopConfig{
 	// defined in this config type). Also see docs for Logger interface
 	// and MetaData type.
 	LogLocalOnly: true,
+	// If true, the default logger redraws a table with metadata for all
+	// nodes in the terminal (the "live dashboard"), instead of writing
+	// structured events (see LOG_LEVEL and LOG_FORMAT). Only compatible
+	// with unix-based systems.
+	Dashboard: false,
+	// Names of built-in tasks which shouldn't run at all, e.g
+	// []string{"merge", "split"}. See eventloop.BuiltinTasks for all
+	// names. Custom tasks can be added with ELT.Register before the event
+	// loop is started.
+	DisabledTasks: nil,
+	// Adaptive mode, where metrics pulled from the network (skew in
+	// datapoint counts between nodes, variation in centroid sizes, insert
+	// rate and query latency) decide how often the balancing, distribution,
+	// split and merge tasks run relative to their schedules. Tasks speed
+	// up (at most MaxSpeedup times) when a metric crosses its threshold,
+	// e.g after a bulk load, and back off (at most MaxBackoff times) while
+	// the network is stable. A threshold of 0 disables that metric.
+	// Decisions are logged, and visible in the admin API.
+	Adaptive: eventloop.AdaptiveConfig{
+		Enabled:             false,
+		Every:               time.Second * 30,
+		MaxSpeedup:          4,
+		MaxBackoff:          4,
+		SkewThreshold:       0.5,
+		SizeCVThreshold:     1,
+		InsertRateThreshold: 100,
+		LatencyThreshold:    time.Millisecond * 50,
+	},
 	// Logger for the event loop. See docs for Logger interface. If nil,
-	// then this field is set as a default logger in this pkg, it'll simply
-	// log events in the terminal. At the moment of writing, the default
-	// logger is only compatible with unix-based systems.
+	// then this field is set as a default logger in this pkg, which writes
+	// to the system-wide logger (or draws the dashboard, see above).
 	L: nil,
+	// Clock for the schedules of tasks, nil means the wall clock (unless
+	// the process-wide clock in pkg/clock is changed). Only meant for
+	// simulations, see eventloop.Simulation.
+	Clock: nil,
+	// Random source for the jitter of schedules, nil means the global
+	// source in math/rand. Only meant for simulations.
+	Rand: nil,
 }
 
 /*
@@ -185,3 +335,26 @@ var KMEANS_INITCAP = 100
 
 // This specifies how many datapoints a centroid can have before it is split in half.
 var KMEANS_CENTROID_DP_THRESHOLD = 10000
+
+// This specifies whether or not vectors should be stored in a quantized form
+// (int8 or float16 with a scale and offset), which reduces memory at the cost
+// of precision. The zero value keeps vectors as float64. Example:
+//	mathutils.QuantConfig{Kind: mathutils.QuantInt8, Scope: mathutils.QuantPerDimension}
+var KMEANS_QUANTIZATION = mathutils.QuantConfig{}
+
+// This configures a graph index for large centroids, such that lookups don't
+// have to scan all datapoints in them (at the cost of approximate results).
+// Centroids with at least 'Threshold' datapoints use the index. See docs for
+// pkg/kmeans/centroid.IndexConfig. Threshold=0 (the default) disables the
+// index, since it changes query results. Example:
+//	centroid.IndexConfig{Threshold: 2000, M: 8, EF: 32}
+var KMEANS_CENTROID_INDEX = centroid.IndexConfig{Threshold: 0, M: 8, EF: 32}
+
+// This configures coarse routing over the centroids in a namespace, such that
+// finding the nearest centroids doesn't require comparing against all of them
+// (at the cost of approximate results). Centroids are grouped under 'super-
+// centroids' once there are at least 'Threshold' of them. See docs for
+// pkg/kmeans/centroidmanager.RouterConfig. Threshold=0 (the default) disables
+// routing, since it changes query results. Example:
+//	centroidmanager.RouterConfig{Threshold: 1000, GroupSize: 64, Probe: 4}
+var KMEANS_CENTROID_ROUTER = centroidmanager.RouterConfig{Threshold: 0, GroupSize: 64, Probe: 4}
@@ -0,0 +1,1120 @@
+/*
+This file contains a loader for the package-level vars in ./cfg.go, such that
+deployments don't have to edit source and recompile. Values are taken from
+(in increasing order of precedence):
+
+ 1. The defaults, i.e the package-level vars in ./cfg.go.
+ 2. A JSON config file (see ./example.json).
+ 3. Environment variables, named TRYPO_<KEY>; e.g TRYPO_EVENTLOOP_SCHEDULES_META_EVERY.
+ 4. Command-line flags, named -<key>; e.g -eventloop.schedules.meta.every=10s.
+
+Keys are the dotted JSON paths of the Config type (lowercase), lists are
+comma-separated in env vars and flags, and durations use time.ParseDuration
+syntax (e.g "5s") everywhere. Use Load to get a Config, then Config.Apply to
+set the package-level vars.
+*/
+package cfg
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"trypo/core/api"
+	"trypo/core/eventloop"
+	"trypo/pkg/kmeans/rpc"
+	"trypo/pkg/logging"
+	"trypo/pkg/mathutils"
+	"trypo/pkg/searchutils"
+	"trypo/pkg/tlsutils"
+)
+
+// Prefix for environment variables that override config values.
+const envPrefix = "TRYPO_"
+
+// Duration is a time.Duration which is written as a string (e.g "5s") in
+// config files, env vars and flags.
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// APIKeys is a list of api.APIKey which is written as a list of objects in
+// config files, and in a compact form in env vars and flags: keys separated
+// by ";", each as "<token>=<scope>,<scope>,..." where a scope is
+// "read:<namespace>" or "write:<namespace>". Example:
+//
+//	TRYPO_API_KEYS="k1=read:*;k2=read:a,write:a"
+type APIKeys []api.APIKey
+
+// MarshalJSON implements json.Marshaler.
+func (k APIKeys) MarshalJSON() ([]byte, error) {
+	if k == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]api.APIKey(k))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (k *APIKeys) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, (*[]api.APIKey)(k))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (k APIKeys) MarshalText() ([]byte, error) {
+	keys := make([]string, 0, len(k))
+	for _, key := range k {
+		var scopes []string
+		for _, ns := range key.Read {
+			scopes = append(scopes, "read:"+ns)
+		}
+		for _, ns := range key.Write {
+			scopes = append(scopes, "write:"+ns)
+		}
+		keys = append(keys, key.Token+"="+strings.Join(scopes, ","))
+	}
+	return []byte(strings.Join(keys, ";")), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (k *APIKeys) UnmarshalText(b []byte) error {
+	var keys APIKeys
+	for _, s := range strings.Split(string(b), ";") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return errors.New("want <token>=<scope>,<scope>,... for each key")
+		}
+		key := api.APIKey{Token: parts[0]}
+		for _, scope := range strings.Split(parts[1], ",") {
+			scope = strings.TrimSpace(scope)
+			switch {
+			case scope == "":
+			case strings.HasPrefix(scope, "read:"):
+				key.Read = append(key.Read, strings.TrimPrefix(scope, "read:"))
+			case strings.HasPrefix(scope, "write:"):
+				key.Write = append(key.Write, strings.TrimPrefix(scope, "write:"))
+			default:
+				// Not quoted in the error, since it is next to a token.
+				return errors.New("scopes must be read:<namespace> or write:<namespace>")
+			}
+		}
+		keys = append(keys, key)
+	}
+	*k = keys
+	return nil
+}
+
+// Quotas is rpc.Quotas, which is written as an object (keys are namespaces)
+// in config files, and in a compact form in env vars and flags: quotas
+// separated by ";", each as "<namespace>=<limit>:<value>,..." where limits
+// are the JSON keys of rpc.Quota. Example:
+//
+//	TRYPO_QUOTAS="*=max_dps:100000;hot=max_dps:1000000,write_rate:500"
+type Quotas rpc.Quotas
+
+// Limits of rpc.Quota in the compact form of Quotas.
+var quotaLimits = map[string]func(q *rpc.Quota) interface{}{
+	"max_dps":    func(q *rpc.Quota) interface{} { return &q.MaxDPs },
+	"max_bytes":  func(q *rpc.Quota) interface{} { return &q.MaxBytes },
+	"write_rate": func(q *rpc.Quota) interface{} { return &q.WriteRate },
+	"query_rate": func(q *rpc.Quota) interface{} { return &q.QueryRate },
+}
+
+// MarshalJSON implements json.Marshaler.
+func (q Quotas) MarshalJSON() ([]byte, error) {
+	if q == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(rpc.Quotas(q))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (q *Quotas) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, (*rpc.Quotas)(q))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (q Quotas) MarshalText() ([]byte, error) {
+	var res []string
+	for _, ns := range keys(q) {
+		quota := q[ns]
+		var limits []string
+		for _, name := range keys(quotaLimits) {
+			v := reflect.ValueOf(quotaLimits[name](&quota)).Elem()
+			if !v.IsZero() {
+				limits = append(limits, fmt.Sprintf("%v:%v", name, v.Interface()))
+			}
+		}
+		res = append(res, ns+"="+strings.Join(limits, ","))
+	}
+	return []byte(strings.Join(res, ";")), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (q *Quotas) UnmarshalText(b []byte) error {
+	quotas := make(Quotas)
+	for _, s := range strings.Split(string(b), ";") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("want <namespace>=<limit>:<value>,... for each quota, got %q", s)
+		}
+		var quota rpc.Quota
+		for _, limit := range strings.Split(parts[1], ",") {
+			if limit = strings.TrimSpace(limit); limit == "" {
+				continue
+			}
+			kv := strings.SplitN(limit, ":", 2)
+			ptr, ok := quotaLimits[kv[0]]
+			if !ok || len(kv) != 2 {
+				return fmt.Errorf("unknown limit %q (want one of %v)", kv[0], keys(quotaLimits))
+			}
+			f := field{v: reflect.ValueOf(ptr(&quota)).Elem()}
+			if err := f.set(kv[1]); err != nil {
+				return fmt.Errorf("%v: %v", kv[0], err)
+			}
+		}
+		quotas[parts[0]] = quota
+	}
+	*q = quotas
+	return nil
+}
+
+// TTLs is rpc.TTLs, which is written as an object (keys are namespaces) in
+// config files, and in a compact form in env vars and flags: TTLs separated
+// by ";", each as "<namespace>=<default>", followed by ",refresh_on_read" if
+// lookups should refresh expiry. Example:
+//
+//	TRYPO_TTLS="*=24h;sessions=30m,refresh_on_read"
+type TTLs rpc.TTLs
+
+// MarshalJSON implements json.Marshaler.
+func (t TTLs) MarshalJSON() ([]byte, error) {
+	if t == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(rpc.TTLs(t))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *TTLs) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, (*rpc.TTLs)(t))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t TTLs) MarshalText() ([]byte, error) {
+	var res []string
+	for _, ns := range keys(t) {
+		s := ns + "=" + t[ns].Default.String()
+		if t[ns].RefreshOnRead {
+			s += ",refresh_on_read"
+		}
+		res = append(res, s)
+	}
+	return []byte(strings.Join(res, ";")), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (t *TTLs) UnmarshalText(b []byte) error {
+	ttls := make(TTLs)
+	for _, s := range strings.Split(string(b), ";") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("want <namespace>=<default>[,refresh_on_read] for each ttl, got %q", s)
+		}
+		opts := strings.Split(parts[1], ",")
+		var ttl rpc.TTL
+		var err error
+		if ttl.Default, err = time.ParseDuration(strings.TrimSpace(opts[0])); err != nil {
+			return fmt.Errorf("%v: %v", parts[0], err)
+		}
+		for _, opt := range opts[1:] {
+			if opt = strings.TrimSpace(opt); opt != "refresh_on_read" {
+				return fmt.Errorf("unknown ttl option %q (want refresh_on_read)", opt)
+			}
+			ttl.RefreshOnRead = true
+		}
+		ttls[parts[0]] = ttl
+	}
+	*t = ttls
+	return nil
+}
+
+// Config is a serializable form of all package-level vars in this pkg. See
+// docs of the vars in ./cfg.go for details about each value.
+type Config struct {
+	// Addresses are in "host:port" form.
+	LocalAddrRPC string   `json:"local_addr_rpc" help:"host:port of the rpc server of this node"`
+	OtherAddrRPC []string `json:"other_addrs_rpc" help:"host:port of all rpc servers in the network, including this node"`
+	LocalAddrAPI string   `json:"local_addr_api" help:"host:port of the http api"`
+
+	// Zero disables watching of the config file.
+	WatchInterval Duration `json:"watch_interval" help:"how often the config file is checked for changes, 0 disables"`
+
+	// Path of the config file this was loaded from (by Load), if any.
+	Path string `json:"-"`
+
+	API       APISection       `json:"api"`
+	RPC       RPCSection       `json:"rpc"`
+	EventLoop EventLoopSection `json:"eventloop"`
+	KMeans    KMeansSection    `json:"kmeans"`
+	Node      NodeSection      `json:"node"`
+	Shutdown  ShutdownSection  `json:"shutdown"`
+	Log       LogSection       `json:"log"`
+
+	// Limits for namespaces, see rpc.Quota.
+	Quotas Quotas `json:"quotas" help:"limits per namespace, e.g *=max_dps:100000;hot=write_rate:500"`
+	// Expiry policies for namespaces, see rpc.TTL.
+	TTLs TTLs `json:"ttls" help:"default expiry per namespace, e.g *=24h;sessions=30m,refresh_on_read"`
+}
+
+// LogSection is the serializable form of LOG_LEVEL and LOG_FORMAT.
+type LogSection struct {
+	Level  logging.Level  `json:"level" help:"lowest level of logged events (debug, info, warn or error)"`
+	Format logging.Format `json:"format" help:"log format (logfmt or json)"`
+}
+
+// APISection is the serializable form of API (except addresses).
+type APISection struct {
+	ReadTimeout  Duration `json:"read_timeout" help:"max duration for reading an http request"`
+	WriteTimeout Duration `json:"write_timeout" help:"max duration for writing an http response"`
+	// Enables the admin route for event loop tuning.
+	Admin bool `json:"admin" help:"enable the admin route for event loop tuning"`
+	// Enables the admin routes for maintenance tasks, and is then required
+	// for all admin routes.
+	AdminToken string `json:"admin_token" help:"bearer token for the admin routes, enables the maintenance routes"`
+	// Bearer tokens for the data routes, see api.APIConfig.Keys.
+	Keys APIKeys    `json:"keys" help:"bearer tokens for the data routes, e.g k1=read:*;k2=read:a,write:a"`
+	TLS  TLSSection `json:"tls"`
+}
+
+// RPCSection is the serializable form of RPC_SECRET and RPC_TLS.
+type RPCSection struct {
+	Secret string     `json:"secret" help:"secret shared by all nodes, peers without it are rejected"`
+	TLS    TLSSection `json:"tls"`
+}
+
+// TLSSection is the serializable form of tlsutils.Files.
+type TLSSection struct {
+	Cert       string `json:"cert" help:"certificate file (PEM), enables tls together with key"`
+	Key        string `json:"key" help:"private key file (PEM)"`
+	CA         string `json:"ca" help:"CA file (PEM) for verifying peers"`
+	ClientAuth bool   `json:"client_auth" help:"require client certificates signed by the CA"`
+}
+
+func tlsSection(f tlsutils.Files) TLSSection {
+	return TLSSection{Cert: f.Cert, Key: f.Key, CA: f.CA, ClientAuth: f.ClientAuth}
+}
+
+func (s TLSSection) files() tlsutils.Files {
+	return tlsutils.Files{Cert: s.Cert, Key: s.Key, CA: s.CA, ClientAuth: s.ClientAuth}
+}
+
+// NodeSection is the serializable form of NODE_CAPACITY and
+// NODE_MEM_HIGH_WATER.
+type NodeSection struct {
+	Capacity     float64 `json:"capacity" help:"relative weight of this node in load balancing"`
+	MemHighWater int     `json:"mem_high_water" help:"bytes that load balancing won't take this node beyond, 0 means no limit"`
+}
+
+// ShutdownSection is the serializable form of the SHUTDOWN_* vars and
+// SNAPSHOT_PATH.
+type ShutdownSection struct {
+	Timeout      Duration `json:"timeout" help:"max duration of a graceful shutdown"`
+	Handoff      bool     `json:"handoff" help:"move the data of this node to the others on shutdown"`
+	SnapshotPath string   `json:"snapshot_path" help:"file the data is saved to on shutdown and loaded from on start, empty disables"`
+}
+
+// EventLoopSection is the serializable form of ELT (except addresses and
+// the logger).
+type EventLoopSection struct {
+	Schedules SchedulesSection `json:"schedules"`
+
+	DistributeDataPointsFastN     int `json:"distribute_dps_fast_n" help:"datapoints each node distributes per fast distribution run"`
+	DistributeDataPointsAccurateN int `json:"distribute_dps_accurate_n" help:"datapoints each node distributes per accurate distribution run"`
+	DistributeDataPointsInternalN int `json:"distribute_dps_internal_n" help:"datapoints each node distributes internally per run"`
+
+	SplitCentroidsMin int `json:"split_centroids_min" help:"lower end of the centroid sizes that are split"`
+	SplitCentroidsMax int `json:"split_centroids_max" help:"upper end of the centroid sizes that are split"`
+	MergeCentroidsMin int `json:"merge_centroids_min" help:"lower end of the centroid sizes that are merged"`
+	MergeCentroidsMax int `json:"merge_centroids_max" help:"upper end of the centroid sizes that are merged"`
+
+	LoadBalancingMargin float64 `json:"load_balancing_margin" help:"fraction below its share a node must be before it takes data, in [0, 1)"`
+
+	LogLocalOnly bool `json:"log_local_only" help:"pull metadata for logging from this node only"`
+	Dashboard    bool `json:"dashboard" help:"draw a live dashboard in the terminal instead of logging events"`
+	// Names of built-in tasks, see eventloop.BuiltinTasks.
+	DisabledTasks []string `json:"disabled_tasks" help:"names of built-in event loop tasks that don't run"`
+
+	Adaptive AdaptiveSection `json:"adaptive"`
+}
+
+// AdaptiveSection is the serializable form of ELT.Adaptive.
+type AdaptiveSection struct {
+	Enabled             bool     `json:"enabled" help:"adapt how often maintenance tasks run to metrics from the network"`
+	Every               Duration `json:"every" help:"how often metrics are pulled and tasks are adapted"`
+	MaxSpeedup          float64  `json:"max_speedup" help:"max factor by which tasks run more often than scheduled"`
+	MaxBackoff          float64  `json:"max_backoff" help:"max factor by which tasks run less often than scheduled"`
+	SkewThreshold       float64  `json:"skew_threshold" help:"skew in datapoint counts between nodes that speeds up balancing, 0 disables"`
+	SizeCVThreshold     float64  `json:"size_cv_threshold" help:"variation in centroid sizes that speeds up split and merge, 0 disables"`
+	InsertRateThreshold float64  `json:"insert_rate_threshold" help:"inserts per second that speed up all adapted tasks, 0 disables"`
+	LatencyThreshold    Duration `json:"latency_threshold" help:"query latency that speeds up splitting, 0 disables"`
+}
+
+// SchedulesSection is the serializable form of ELT.Schedules.
+type SchedulesSection struct {
+	Expire                       ScheduleSection `json:"expire"`
+	MemTrim                      ScheduleSection `json:"mem_trim"`
+	DistributeDataPointsFast     ScheduleSection `json:"distribute_dps_fast"`
+	DistributeDataPointsAccurate ScheduleSection `json:"distribute_dps_accurate"`
+	DistributeDataPointsInternal ScheduleSection `json:"distribute_dps_internal"`
+	SplitCentroids               ScheduleSection `json:"split_centroids"`
+	MergeCentroids               ScheduleSection `json:"merge_centroids"`
+	LoadBalancing                ScheduleSection `json:"load_balancing"`
+	Meta                         ScheduleSection `json:"meta"`
+}
+
+// byName returns all schedules by their json name.
+func (s *SchedulesSection) byName() map[string]*ScheduleSection {
+	return map[string]*ScheduleSection{
+		"expire":                  &s.Expire,
+		"mem_trim":                &s.MemTrim,
+		"distribute_dps_fast":     &s.DistributeDataPointsFast,
+		"distribute_dps_accurate": &s.DistributeDataPointsAccurate,
+		"distribute_dps_internal": &s.DistributeDataPointsInternal,
+		"split_centroids":         &s.SplitCentroids,
+		"merge_centroids":         &s.MergeCentroids,
+		"load_balancing":          &s.LoadBalancing,
+		"meta":                    &s.Meta,
+	}
+}
+
+func schedulesSection(s eventloop.EventLoopSchedules) SchedulesSection {
+	return SchedulesSection{
+		Expire:                       scheduleSection(s.Expire),
+		MemTrim:                      scheduleSection(s.MemTrim),
+		DistributeDataPointsFast:     scheduleSection(s.DistributeDataPointsFast),
+		DistributeDataPointsAccurate: scheduleSection(s.DistributeDataPointsAccurate),
+		DistributeDataPointsInternal: scheduleSection(s.DistributeDataPointsInternal),
+		SplitCentroids:               scheduleSection(s.SplitCentroids),
+		MergeCentroids:               scheduleSection(s.MergeCentroids),
+		LoadBalancing:                scheduleSection(s.LoadBalancing),
+		Meta:                         scheduleSection(s.Meta),
+	}
+}
+
+func (s *SchedulesSection) schedules() eventloop.EventLoopSchedules {
+	return eventloop.EventLoopSchedules{
+		Expire:                       s.Expire.schedule(),
+		MemTrim:                      s.MemTrim.schedule(),
+		DistributeDataPointsFast:     s.DistributeDataPointsFast.schedule(),
+		DistributeDataPointsAccurate: s.DistributeDataPointsAccurate.schedule(),
+		DistributeDataPointsInternal: s.DistributeDataPointsInternal.schedule(),
+		SplitCentroids:               s.SplitCentroids.schedule(),
+		MergeCentroids:               s.MergeCentroids.schedule(),
+		LoadBalancing:                s.LoadBalancing.schedule(),
+		Meta:                         s.Meta.schedule(),
+	}
+}
+
+// ScheduleSection is the serializable form of an eventloop.TaskSchedule.
+type ScheduleSection struct {
+	Every          Duration `json:"every" help:"interval between runs of the task, a zero schedule disables it"`
+	Cron           string   `json:"cron" help:"cron expression for runs of the task, instead of every"`
+	Jitter         Duration `json:"jitter" help:"max random delay of each run"`
+	MaxConcurrency int      `json:"max_concurrency" help:"max runs in progress at once, others are skipped"`
+	Timeout        Duration `json:"timeout" help:"max duration of each run, 0 means none"`
+}
+
+func scheduleSection(s eventloop.TaskSchedule) ScheduleSection {
+	return ScheduleSection{
+		Every:          Duration(s.Every),
+		Cron:           s.Cron,
+		Jitter:         Duration(s.Jitter),
+		MaxConcurrency: s.MaxConcurrency,
+		Timeout:        Duration(s.Timeout),
+	}
+}
+
+func (s *ScheduleSection) schedule() eventloop.TaskSchedule {
+	return eventloop.TaskSchedule{
+		Every:          time.Duration(s.Every),
+		Cron:           s.Cron,
+		Jitter:         time.Duration(s.Jitter),
+		MaxConcurrency: s.MaxConcurrency,
+		Timeout:        time.Duration(s.Timeout),
+	}
+}
+
+// KMeansSection is the serializable form of the KMEANS_* vars and the
+// search funcs.
+type KMeansSection struct {
+	InitCap             int `json:"init_cap" help:"initial capacity of the centroid slice in each namespace"`
+	CentroidDPThreshold int `json:"centroid_dp_threshold" help:"datapoints a centroid can have before it is split in half"`
+	// Name of the search funcs, see searchFuncs in this file.
+	Search string `json:"search" help:"search funcs (cosine or euclidean), custom keeps the ones set in code"`
+
+	// One of "none", "int8" or "float16".
+	QuantizationKind string `json:"quantization_kind" help:"how vectors are stored (none, int8 or float16)"`
+	// One of "dimension" or "centroid".
+	QuantizationScope string `json:"quantization_scope" help:"scale and offset of quantization per dimension or centroid"`
+
+	IndexThreshold int `json:"index_threshold" help:"datapoints a centroid must have before lookups use a graph index, 0 disables"`
+	IndexM         int `json:"index_m" help:"neighbours of each node in the graph index"`
+	IndexEF        int `json:"index_ef" help:"beam size of searches in the graph index"`
+
+	RouterThreshold int `json:"router_threshold" help:"centroids a namespace must have before they are grouped for routing, 0 disables"`
+	RouterGroupSize int `json:"router_group_size" help:"centroids in each routing group"`
+	RouterProbe     int `json:"router_probe" help:"routing groups searched per lookup"`
+}
+
+// searchFuncs maps names (KMeansSection.Search) to KNN & KFN search funcs.
+var searchFuncs = map[string][2]knnSearchFunc{
+	"cosine":    {searchutils.KNNCos, searchutils.KFNCos},
+	"euclidean": {searchutils.KNNEuc, searchutils.KFNEuc},
+}
+
+// Name (KMeansSection.Search) for search funcs that aren't in searchFuncs,
+// i.e KNN_SEARCH_FUNC and KFN_SEARCH_FUNC were set to something else in
+// code. Apply keeps them as they are.
+const customSearch = "custom"
+
+// Same signature as KNN_SEARCH_FUNC and KFN_SEARCH_FUNC.
+type knnSearchFunc = func([]float64, func() ([]float64, bool), int) []int
+
+var quantKinds = map[string]mathutils.QuantKind{
+	"none":    mathutils.QuantNone,
+	"int8":    mathutils.QuantInt8,
+	"float16": mathutils.QuantFloat16,
+}
+
+var quantScopes = map[string]mathutils.QuantScope{
+	"dimension": mathutils.QuantPerDimension,
+	"centroid":  mathutils.QuantPerCentroid,
+}
+
+// nameOf does a reverse lookup in a map with string keys, returns "" if the
+// value isn't found.
+func nameOf(m interface{}, v interface{}) string {
+	iter := reflect.ValueOf(m).MapRange()
+	for iter.Next() {
+		if iter.Value().Interface() == v {
+			return iter.Key().String()
+		}
+	}
+	return ""
+}
+
+// funcName returns the name of a search func in searchFuncs, or customSearch
+// if it isn't there.
+func funcName(f knnSearchFunc) string {
+	p := reflect.ValueOf(f).Pointer()
+	for name, fs := range searchFuncs {
+		if reflect.ValueOf(fs[0]).Pointer() == p {
+			return name
+		}
+	}
+	return customSearch
+}
+
+/*
+--------------------------------------------------------------------------------
+Conversion between Config and the package-level vars.
+--------------------------------------------------------------------------------
+*/
+
+// Default returns a Config representing the current package-level vars.
+func Default() Config {
+	// The tuning can be changed by a running event loop, see Reload.
+	t := ELT.Tuning()
+	c := Config{
+		LocalAddrRPC:  LocalAddrRPC.ToStr(),
+		LocalAddrAPI:  LocalAddrAPI.ToStr(),
+		WatchInterval: Duration(CONFIG_WATCH_INTERVAL),
+		API: APISection{
+			ReadTimeout:  Duration(API.ReadTimeout),
+			WriteTimeout: Duration(API.WriteTimeout),
+			Admin:        API.EventLoop != nil,
+			AdminToken:   API.AdminToken,
+			Keys:         append(APIKeys{}, API.Keys...),
+			TLS:          tlsSection(API.TLS),
+		},
+		RPC: RPCSection{
+			Secret: RPC_SECRET,
+			TLS:    tlsSection(RPC_TLS),
+		},
+		EventLoop: EventLoopSection{
+			Schedules:                     schedulesSection(t.Schedules),
+			DistributeDataPointsFastN:     t.DistributeDataPointsFastN,
+			DistributeDataPointsAccurateN: t.DistributeDataPointsAccurateN,
+			DistributeDataPointsInternalN: t.DistributeDataPointsInternalN,
+			SplitCentroidsMin:             t.SplitCentroidsMin,
+			SplitCentroidsMax:             t.SplitCentroidsMax,
+			MergeCentroidsMin:             t.MergeCentroidsMin,
+			MergeCentroidsMax:             t.MergeCentroidsMax,
+			LoadBalancingMargin:           t.LoadBalancingMargin,
+			LogLocalOnly:                  ELT.LogLocalOnly,
+			Dashboard:                     ELT.Dashboard,
+			DisabledTasks:                 append([]string{}, ELT.DisabledTasks...),
+			Adaptive: AdaptiveSection{
+				Enabled:             ELT.Adaptive.Enabled,
+				Every:               Duration(ELT.Adaptive.Every),
+				MaxSpeedup:          ELT.Adaptive.MaxSpeedup,
+				MaxBackoff:          ELT.Adaptive.MaxBackoff,
+				SkewThreshold:       ELT.Adaptive.SkewThreshold,
+				SizeCVThreshold:     ELT.Adaptive.SizeCVThreshold,
+				InsertRateThreshold: ELT.Adaptive.InsertRateThreshold,
+				LatencyThreshold:    Duration(ELT.Adaptive.LatencyThreshold),
+			},
+		},
+		KMeans: KMeansSection{
+			InitCap:             KMEANS_INITCAP,
+			CentroidDPThreshold: KMEANS_CENTROID_DP_THRESHOLD,
+			Search:              funcName(KNN_SEARCH_FUNC),
+			QuantizationKind:    nameOf(quantKinds, KMEANS_QUANTIZATION.Kind),
+			QuantizationScope:   nameOf(quantScopes, KMEANS_QUANTIZATION.Scope),
+			IndexThreshold:      KMEANS_CENTROID_INDEX.Threshold,
+			IndexM:              KMEANS_CENTROID_INDEX.M,
+			IndexEF:             KMEANS_CENTROID_INDEX.EF,
+			RouterThreshold:     KMEANS_CENTROID_ROUTER.Threshold,
+			RouterGroupSize:     KMEANS_CENTROID_ROUTER.GroupSize,
+			RouterProbe:         KMEANS_CENTROID_ROUTER.Probe,
+		},
+		Node: NodeSection{
+			Capacity:     NODE_CAPACITY,
+			MemHighWater: NODE_MEM_HIGH_WATER,
+		},
+		Shutdown: ShutdownSection{
+			Timeout:      Duration(SHUTDOWN_TIMEOUT),
+			Handoff:      SHUTDOWN_HANDOFF,
+			SnapshotPath: SNAPSHOT_PATH,
+		},
+		Log: LogSection{
+			Level:  LOG_LEVEL,
+			Format: LOG_FORMAT,
+		},
+		Quotas: make(Quotas, len(QUOTAS)),
+		TTLs:   make(TTLs, len(TTLS)),
+	}
+	for ns, quota := range QUOTAS {
+		c.Quotas[ns] = quota
+	}
+	for ns, ttl := range TTLS {
+		c.TTLs[ns] = ttl
+	}
+	for _, addr := range OtherAddrRPC {
+		c.OtherAddrRPC = append(c.OtherAddrRPC, addr.ToStr())
+	}
+	return c
+}
+
+// parseAddr parses a "host:port" string into an Addr.
+func parseAddr(s string) (Addr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return Addr{}, err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return Addr{}, fmt.Errorf("invalid port %q", port)
+	}
+	return Addr{IP: host, Port: port}, nil
+}
+
+// Validate checks all values of a Config, the returned error lists all
+// invalid values (one per line), or is nil if everything is fine.
+func (c *Config) Validate() error {
+	var errs []string
+	fail := func(key, format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	addr := func(key, s string) {
+		if _, err := parseAddr(s); err != nil {
+			fail(key, "invalid address %q (want host:port): %v", s, err)
+		}
+	}
+	positive := func(key string, v Duration) {
+		if v <= 0 {
+			fail(key, "must be > 0, got %v", time.Duration(v))
+		}
+	}
+	min := func(key string, v, min int) {
+		if v < min {
+			fail(key, "must be >= %v, got %v", min, v)
+		}
+	}
+
+	addr("local_addr_rpc", c.LocalAddrRPC)
+	addr("local_addr_api", c.LocalAddrAPI)
+	if len(c.OtherAddrRPC) == 0 {
+		fail("other_addrs_rpc", "must contain at least one address")
+	}
+	hasLocal := false
+	for _, s := range c.OtherAddrRPC {
+		addr("other_addrs_rpc", s)
+		hasLocal = hasLocal || s == c.LocalAddrRPC
+	}
+	if !hasLocal {
+		fail("other_addrs_rpc", "must include local_addr_rpc (%v)", c.LocalAddrRPC)
+	}
+
+	if c.WatchInterval < 0 {
+		fail("watch_interval", "must be >= 0, got %v", time.Duration(c.WatchInterval))
+	}
+	positive("api.read_timeout", c.API.ReadTimeout)
+	positive("api.write_timeout", c.API.WriteTimeout)
+
+	el := &c.EventLoop
+	for k, s := range el.Schedules.byName() {
+		if err := s.schedule().Validate(); err != nil {
+			fail("eventloop.schedules."+k, "%v", err)
+		}
+	}
+	min("eventloop.distribute_dps_fast_n", el.DistributeDataPointsFastN, 0)
+	min("eventloop.distribute_dps_accurate_n", el.DistributeDataPointsAccurateN, 0)
+	min("eventloop.distribute_dps_internal_n", el.DistributeDataPointsInternalN, 0)
+	if el.SplitCentroidsMin > el.SplitCentroidsMax {
+		fail("eventloop.split_centroids_min", "must be <= split_centroids_max (%v), got %v",
+			el.SplitCentroidsMax, el.SplitCentroidsMin)
+	}
+	if el.MergeCentroidsMin > el.MergeCentroidsMax {
+		fail("eventloop.merge_centroids_min", "must be <= merge_centroids_max (%v), got %v",
+			el.MergeCentroidsMax, el.MergeCentroidsMin)
+	}
+	if el.LoadBalancingMargin < 0 || el.LoadBalancingMargin >= 1 {
+		fail("eventloop.load_balancing_margin", "must be in [0, 1), got %v", el.LoadBalancingMargin)
+	}
+	for _, name := range el.DisabledTasks {
+		if !contains(eventloop.BuiltinTasks(), name) {
+			fail("eventloop.disabled_tasks", "unknown task %q (want one of %v)",
+				name, eventloop.BuiltinTasks())
+		}
+	}
+	if ad := &el.Adaptive; ad.Enabled {
+		positive("eventloop.adaptive.every", ad.Every)
+		atLeastOne := func(key string, v float64) {
+			if v < 1 {
+				fail(key, "must be >= 1, got %v", v)
+			}
+		}
+		atLeastOne("eventloop.adaptive.max_speedup", ad.MaxSpeedup)
+		atLeastOne("eventloop.adaptive.max_backoff", ad.MaxBackoff)
+	}
+
+	km := &c.KMeans
+	min("kmeans.init_cap", km.InitCap, 0)
+	min("kmeans.centroid_dp_threshold", km.CentroidDPThreshold, 0)
+	if _, ok := searchFuncs[km.Search]; !ok && km.Search != customSearch {
+		fail("kmeans.search", "unknown search func %q (want one of %v or %v)",
+			km.Search, keys(searchFuncs), customSearch)
+	}
+	if _, ok := quantKinds[km.QuantizationKind]; !ok {
+		fail("kmeans.quantization_kind", "unknown kind %q (want one of %v)",
+			km.QuantizationKind, keys(quantKinds))
+	}
+	if _, ok := quantScopes[km.QuantizationScope]; !ok {
+		fail("kmeans.quantization_scope", "unknown scope %q (want one of %v)",
+			km.QuantizationScope, keys(quantScopes))
+	}
+	min("kmeans.index_threshold", km.IndexThreshold, 0)
+	min("kmeans.index_m", km.IndexM, 0)
+	min("kmeans.index_ef", km.IndexEF, 0)
+	min("kmeans.router_threshold", km.RouterThreshold, 0)
+	min("kmeans.router_group_size", km.RouterGroupSize, 0)
+	min("kmeans.router_probe", km.RouterProbe, 0)
+
+	for i, key := range c.API.Keys {
+		if key.Token == "" {
+			fail("api.keys", "key %v has an empty token", i)
+		}
+	}
+
+	if err := c.API.TLS.files().Check(); err != nil {
+		fail("api.tls", "%v", err)
+	}
+	if err := c.RPC.TLS.files().Check(); err != nil {
+		fail("rpc.tls", "%v", err)
+	}
+
+	if c.Node.Capacity <= 0 {
+		fail("node.capacity", "must be > 0, got %v", c.Node.Capacity)
+	}
+	min("node.mem_high_water", c.Node.MemHighWater, 0)
+
+	positive("shutdown.timeout", c.Shutdown.Timeout)
+
+	for _, ns := range keys(c.Quotas) {
+		q := c.Quotas[ns]
+		if q.MaxDPs < 0 || q.MaxBytes < 0 || q.WriteRate < 0 || q.QueryRate < 0 {
+			fail("quotas", "limits for namespace %q must be >= 0", ns)
+		}
+	}
+	for _, ns := range keys(c.TTLs) {
+		if c.TTLs[ns].Default < 0 {
+			fail("ttls", "default for namespace %q must be >= 0", ns)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Strings(errs)
+	return errors.New("invalid config:\n\t" + strings.Join(errs, "\n\t"))
+}
+
+// keys returns the sorted keys of a map with string keys.
+func keys(m interface{}) []string {
+	var res []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		res = append(res, k.String())
+	}
+	sort.Strings(res)
+	return res
+}
+
+// contains returns true if 's' is in 'list'.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply validates the Config and sets all package-level vars accordingly.
+// Nothing is changed if validation fails. This is intended to be used before
+// the event loop (ELT) is started, see Reload for changes at runtime.
+func (c *Config) Apply() error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	// Validated above, so errs are ignored from here.
+	LocalAddrRPC, _ = parseAddr(c.LocalAddrRPC)
+	LocalAddrAPI, _ = parseAddr(c.LocalAddrAPI)
+	OtherAddrRPC = nil
+	for _, s := range c.OtherAddrRPC {
+		addr, _ := parseAddr(s)
+		OtherAddrRPC = append(OtherAddrRPC, addr)
+	}
+
+	API.Addr = LocalAddrAPI
+	API.RPCAddrs = OtherAddrRPC
+	API.ReadTimeout = time.Duration(c.API.ReadTimeout)
+	API.WriteTimeout = time.Duration(c.API.WriteTimeout)
+	API.EventLoop = nil
+	if c.API.Admin {
+		API.EventLoop = &ELT
+	}
+	API.AdminToken = c.API.AdminToken
+	API.Keys = nil
+	if len(c.API.Keys) != 0 {
+		API.Keys = append([]api.APIKey{}, c.API.Keys...)
+	}
+	API.TLS = c.API.TLS.files()
+	RPC_SECRET = c.RPC.Secret
+	RPC_TLS = c.RPC.TLS.files()
+	CONFIG_WATCH_INTERVAL = time.Duration(c.WatchInterval)
+
+	el := &c.EventLoop
+	ELT.LocalAddr = LocalAddrRPC
+	ELT.RemoteAddrs = OtherAddrRPC
+	ELT.Schedules = el.Schedules.schedules()
+	ELT.DistributeDataPointsFastN = el.DistributeDataPointsFastN
+	ELT.DistributeDataPointsAccurateN = el.DistributeDataPointsAccurateN
+	ELT.DistributeDataPointsInternalN = el.DistributeDataPointsInternalN
+	ELT.SplitCentroidsMin = el.SplitCentroidsMin
+	ELT.SplitCentroidsMax = el.SplitCentroidsMax
+	ELT.MergeCentroidsMin = el.MergeCentroidsMin
+	ELT.MergeCentroidsMax = el.MergeCentroidsMax
+	ELT.LoadBalancingMargin = el.LoadBalancingMargin
+	ELT.LogLocalOnly = el.LogLocalOnly
+	ELT.Dashboard = el.Dashboard
+	ELT.DisabledTasks = nil
+	if len(el.DisabledTasks) != 0 {
+		ELT.DisabledTasks = append([]string{}, el.DisabledTasks...)
+	}
+	ELT.Adaptive = eventloop.AdaptiveConfig{
+		Enabled:             el.Adaptive.Enabled,
+		Every:               time.Duration(el.Adaptive.Every),
+		MaxSpeedup:          el.Adaptive.MaxSpeedup,
+		MaxBackoff:          el.Adaptive.MaxBackoff,
+		SkewThreshold:       el.Adaptive.SkewThreshold,
+		SizeCVThreshold:     el.Adaptive.SizeCVThreshold,
+		InsertRateThreshold: el.Adaptive.InsertRateThreshold,
+		LatencyThreshold:    time.Duration(el.Adaptive.LatencyThreshold),
+	}
+
+	km := &c.KMeans
+	KMEANS_INITCAP = km.InitCap
+	KMEANS_CENTROID_DP_THRESHOLD = km.CentroidDPThreshold
+	if km.Search != customSearch {
+		KNN_SEARCH_FUNC = searchFuncs[km.Search][0]
+		KFN_SEARCH_FUNC = searchFuncs[km.Search][1]
+	}
+	KMEANS_QUANTIZATION.Kind = quantKinds[km.QuantizationKind]
+	KMEANS_QUANTIZATION.Scope = quantScopes[km.QuantizationScope]
+	KMEANS_CENTROID_INDEX.Threshold = km.IndexThreshold
+	KMEANS_CENTROID_INDEX.M = km.IndexM
+	KMEANS_CENTROID_INDEX.EF = km.IndexEF
+	KMEANS_CENTROID_ROUTER.Threshold = km.RouterThreshold
+	KMEANS_CENTROID_ROUTER.GroupSize = km.RouterGroupSize
+	KMEANS_CENTROID_ROUTER.Probe = km.RouterProbe
+
+	NODE_CAPACITY = c.Node.Capacity
+	NODE_MEM_HIGH_WATER = c.Node.MemHighWater
+
+	SHUTDOWN_TIMEOUT = time.Duration(c.Shutdown.Timeout)
+	SHUTDOWN_HANDOFF = c.Shutdown.Handoff
+	SNAPSHOT_PATH = c.Shutdown.SnapshotPath
+
+	LOG_LEVEL = c.Log.Level
+	LOG_FORMAT = c.Log.Format
+
+	QUOTAS = make(rpc.Quotas, len(c.Quotas))
+	for ns, quota := range c.Quotas {
+		QUOTAS[ns] = quota
+	}
+	API.Quotas = nil
+	if len(QUOTAS) != 0 {
+		API.Quotas = QUOTAS
+	}
+
+	TTLS = make(rpc.TTLs, len(c.TTLs))
+	for ns, ttl := range c.TTLs {
+		TTLS[ns] = ttl
+	}
+	return nil
+}
+
+/*
+--------------------------------------------------------------------------------
+Loading (file, env, flags).
+--------------------------------------------------------------------------------
+*/
+
+// field is a leaf value in a Config, addressed by a dotted key.
+type field struct {
+	key string
+	v   reflect.Value
+	// Usage text for flags, from the help tag.
+	help string
+}
+
+// fields returns all leaf values of a Config (recursively), with keys made
+// from json tags and usage text from help tags. Values are settable.
+func (c *Config) fields() []field {
+	var res []field
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			key := prefix + strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if key == prefix+"-" {
+				continue
+			}
+			fv := v.Field(i)
+			if fv.Kind() == reflect.Struct {
+				walk(key+".", fv)
+				continue
+			}
+			res = append(res, field{key, fv, t.Field(i).Tag.Get("help")})
+		}
+	}
+	walk("", reflect.ValueOf(c).Elem())
+	return res
+}
+
+// set parses a string into a leaf value.
+func (f *field) set(s string) error {
+	if u, ok := f.v.Addr().Interface().(interface{ UnmarshalText([]byte) error }); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch f.v.Kind() {
+	case reflect.String:
+		f.v.SetString(s)
+	case reflect.Int:
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("not an integer: %q", s)
+		}
+		f.v.SetInt(int64(v))
+	case reflect.Float64:
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", s)
+		}
+		f.v.SetFloat(v)
+	case reflect.Bool:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("not a bool: %q", s)
+		}
+		f.v.SetBool(v)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %v", f.v.Type())
+	}
+	return nil
+}
+
+// String returns the value as it would be written in an env var or flag.
+func (f *field) String() string {
+	if !f.v.IsValid() {
+		return "" // Zero flagValue, see flag.PrintDefaults.
+	}
+	if m, ok := f.v.Interface().(interface{ MarshalText() ([]byte, error) }); ok {
+		b, _ := m.MarshalText()
+		return string(b)
+	}
+	if f.v.Kind() == reflect.Slice {
+		return strings.Join(f.v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(f.v.Interface())
+}
+
+// envName returns the env var name for a key, e.g "eventloop.schedules.meta.every"
+// becomes "TRYPO_EVENTLOOP_SCHEDULES_META_EVERY".
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// LoadFile overrides values in c with values from a JSON file. Keys that
+// are not part of Config are reported as errors, to catch typos.
+func (c *Config) LoadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config file %v: %v", path, err)
+	}
+	return nil
+}
+
+// LoadEnv overrides values in c with env vars (see envName), where 'env' is
+// in the form returned by os.Environ.
+func (c *Config) LoadEnv(env []string) error {
+	vars := make(map[string]string, len(env))
+	for _, kv := range env {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			vars[kv[:i]] = kv[i+1:]
+		}
+	}
+	for _, f := range c.fields() {
+		s, ok := vars[envName(f.key)]
+		if !ok {
+			continue
+		}
+		if err := f.set(s); err != nil {
+			return fmt.Errorf("env %v: %v", envName(f.key), err)
+		}
+	}
+	return nil
+}
+
+// flagValue adapts a field to flag.Value. The raw string is kept such that
+// it can be set again on top of file and env values, see Load.
+type flagValue struct {
+	field
+	raw string
+}
+
+func (v *flagValue) Set(s string) error {
+	v.raw = s
+	return v.set(s)
+}
+
+// String returns the value like field.String, except for secret keys (see
+// secretKeys), which are left empty such that -help doesn't print them as
+// defaults.
+func (v *flagValue) String() string {
+	if secretKeys[v.key] {
+		return ""
+	}
+	return v.field.String()
+}
+
+// Load creates a Config from defaults (see Default), then overrides values
+// from a JSON file (if the -config flag is given), env vars, and finally the
+// command-line flags in 'args' (e.g os.Args[1:]). Env is in the form returned
+// by os.Environ. The returned Config is validated.
+func Load(args []string, env []string) (Config, error) {
+	c := Default()
+
+	// Flags are parsed into a scratch Config first (to find the config file
+	// and report bad values early), then set again on top of file and env.
+	scratch := Default()
+	fs := flag.NewFlagSet("trypo", flag.ContinueOnError)
+	path := fs.String("config", "", "path to a JSON config file")
+	for _, f := range scratch.fields() {
+		fs.Var(&flagValue{field: f}, f.key, fmt.Sprintf("%v (env %v)", f.help, envName(f.key)))
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	if *path != "" {
+		if err := c.LoadFile(*path); err != nil {
+			return c, err
+		}
+		c.Path = *path
+	}
+	if err := c.LoadEnv(env); err != nil {
+		return c, err
+	}
+
+	// Second pass, only values that were explicitly set.
+	fields := make(map[string]field)
+	for _, f := range c.fields() {
+		fields[f.key] = f
+	}
+	var err error
+	fs.Visit(func(fl *flag.Flag) {
+		f, ok := fields[fl.Name]
+		if !ok || err != nil {
+			return
+		}
+		if e := f.set(fl.Value.(*flagValue).raw); e != nil {
+			err = fmt.Errorf("flag -%v: %v", fl.Name, e)
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
@@ -0,0 +1,509 @@
+package cfg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"trypo/pkg/logging"
+)
+
+/*
+--------------------------------------------------------------------------------
+Section for utils.
+--------------------------------------------------------------------------------
+*/
+
+// writeFile writes 's' to a file in a temp dir and returns the path.
+func writeFile(t *testing.T, s string) string {
+	path := filepath.Join(t.TempDir(), "cfg.json")
+	if err := ioutil.WriteFile(path, []byte(s), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	return path
+}
+
+// restore resets all package-level vars after a test that calls Apply.
+func restore(t *testing.T) {
+	c := Default()
+	t.Cleanup(func() {
+		if err := c.Apply(); err != nil {
+			t.Fatalf("failed to restore: %v", err)
+		}
+	})
+}
+
+/*
+--------------------------------------------------------------------------------
+Section for tests.
+--------------------------------------------------------------------------------
+*/
+
+func TestDefault(t *testing.T) {
+	c := Default()
+	if err := c.Validate(); err != nil {
+		t.Fatalf("defaults should be valid: %v", err)
+	}
+	if c.EventLoop.Schedules.Expire.schedule() != ELT.Schedules.Expire ||
+		time.Duration(c.EventLoop.Schedules.Meta.Every) != ELT.Schedules.Meta.Every ||
+		c.KMeans.Search != "cosine" || c.LocalAddrRPC != "localhost:3500" {
+		t.Fatalf("defaults don't match package vars: %+v", c)
+	}
+
+	// Applying defaults should be a no-op.
+	restore(t)
+	elt, api := ELT, API
+	if err := c.Apply(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if !reflect.DeepEqual(elt, ELT) || !reflect.DeepEqual(api, API) {
+		t.Fatalf("applying defaults changed package vars")
+	}
+}
+
+func TestExampleFile(t *testing.T) {
+	b, err := ioutil.ReadFile("example.json")
+	if err != nil {
+		t.Fatalf("failed to read example: %v", err)
+	}
+	want, _ := json.MarshalIndent(Default(), "", "\t")
+	if string(b) != string(want)+"\n" {
+		t.Fatalf("example.json is out of sync with Default")
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, `{
+		"eventloop": {"schedules": {"meta": {"every": "1s", "jitter": "2s", "max_concurrency": 5}}},
+		"kmeans": {"search": "euclidean"}
+	}`)
+	env := []string{
+		"TRYPO_EVENTLOOP_SCHEDULES_META_JITTER=3s",
+		"TRYPO_EVENTLOOP_SCHEDULES_META_MAX_CONCURRENCY=6",
+		"TRYPO_EVENTLOOP_ADAPTIVE_SKEW_THRESHOLD=0.25",
+		"TRYPO_LOG_FORMAT=json",
+		"TRYPO_OTHER_ADDRS_RPC=localhost:3500, localhost:3600",
+		"UNRELATED=1",
+	}
+	args := []string{"-config", path, "-eventloop.schedules.meta.max_concurrency=7",
+		"-eventloop.disabled_tasks=merge, split"}
+
+	c, err := Load(args, env)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// File only.
+	if c.EventLoop.Schedules.Meta.Every != Duration(time.Second) || c.KMeans.Search != "euclidean" {
+		t.Fatalf("file values not loaded: %+v", c)
+	}
+	// File overridden by env.
+	if c.EventLoop.Schedules.Meta.Jitter != Duration(time.Second*3) {
+		t.Fatalf("env didn't override file: %v", c.EventLoop.Schedules.Meta.Jitter)
+	}
+	if !reflect.DeepEqual(c.OtherAddrRPC, []string{"localhost:3500", "localhost:3600"}) {
+		t.Fatalf("unexpected list from env: %v", c.OtherAddrRPC)
+	}
+	if c.EventLoop.Adaptive.SkewThreshold != 0.25 {
+		t.Fatalf("float from env not loaded: %v", c.EventLoop.Adaptive.SkewThreshold)
+	}
+	if c.Log.Format != logging.FormatJSON {
+		t.Fatalf("text value from env not loaded: %v", c.Log.Format)
+	}
+	// Env overridden by flag.
+	if c.EventLoop.Schedules.Meta.MaxConcurrency != 7 {
+		t.Fatalf("flag didn't override env: %v", c.EventLoop.Schedules.Meta.MaxConcurrency)
+	}
+	// Untouched.
+	if c.EventLoop.Schedules.Expire.schedule() != ELT.Schedules.Expire {
+		t.Fatalf("default was changed: %+v", c.EventLoop.Schedules.Expire)
+	}
+
+	restore(t)
+	if err := c.Apply(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if ELT.Schedules.Meta.Jitter != time.Second*3 || ELT.Schedules.Meta.MaxConcurrency != 7 ||
+		len(ELT.RemoteAddrs) != 2 || len(API.RPCAddrs) != 2 ||
+		ELT.RemoteAddrs[1] != (Addr{IP: "localhost", Port: "3600"}) ||
+		!reflect.DeepEqual(ELT.DisabledTasks, []string{"merge", "split"}) ||
+		LOG_FORMAT != logging.FormatJSON {
+		t.Fatalf("apply didn't set package vars: %+v", ELT)
+	}
+	// Can't compare funcs directly.
+	if funcName(KNN_SEARCH_FUNC) != "euclidean" {
+		t.Fatalf("search func wasn't set")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  []string
+		file string
+		want []string // Substrings of the error.
+	}{
+		{
+			name: "unknown file key",
+			file: `{"eventloop": {"timeout_lopo": "1s"}}`,
+			want: []string{"timeout_lopo"},
+		},
+		{
+			name: "bad env value",
+			env:  []string{"TRYPO_KMEANS_INIT_CAP=lots"},
+			want: []string{"TRYPO_KMEANS_INIT_CAP", "not an integer"},
+		},
+		{
+			name: "bad float value",
+			env:  []string{"TRYPO_EVENTLOOP_ADAPTIVE_MAX_SPEEDUP=fast"},
+			want: []string{"TRYPO_EVENTLOOP_ADAPTIVE_MAX_SPEEDUP", "not a number"},
+		},
+		{
+			name: "bad log level",
+			args: []string{"-log.level=loud"},
+			want: []string{"log.level", "unknown log level"},
+		},
+		{
+			name: "bad flag value",
+			args: []string{"-api.read_timeout=5"},
+			want: []string{"api.read_timeout"},
+		},
+		{
+			name: "bad api keys",
+			env:  []string{"TRYPO_API_KEYS=s3cret=admin:*"},
+			want: []string{"TRYPO_API_KEYS", "read:<namespace>"},
+		},
+		{
+			name: "empty api key token",
+			file: `{"api": {"keys": [{"read": ["*"]}]}}`,
+			want: []string{"api.keys: key 0 has an empty token"},
+		},
+		{
+			name: "bad quota limit",
+			env:  []string{"TRYPO_QUOTAS=a=max_dp:5"},
+			want: []string{"TRYPO_QUOTAS", `unknown limit "max_dp"`},
+		},
+		{
+			name: "negative quota",
+			file: `{"quotas": {"a": {"write_rate": -1}}}`,
+			want: []string{`quotas: limits for namespace "a" must be >= 0`},
+		},
+		{
+			name: "bad ttl option",
+			env:  []string{"TRYPO_TTLS=a=1h,refresh"},
+			want: []string{"TRYPO_TTLS", `unknown ttl option "refresh"`},
+		},
+		{
+			name: "negative ttl",
+			file: `{"ttls": {"a": {"default": "-1h"}}}`,
+			want: []string{`ttls: default for namespace "a" must be >= 0`},
+		},
+		{
+			name: "unknown flag",
+			args: []string{"-nope=1"},
+			want: []string{"nope"},
+		},
+		{
+			name: "validation",
+			args: []string{
+				"-eventloop.schedules.meta.every=-1s",
+				"-eventloop.schedules.expire.every=0s",
+				"-eventloop.schedules.expire.cron=* * *",
+				"-eventloop.split_centroids_min=10",
+				"-eventloop.split_centroids_max=5",
+				"-eventloop.disabled_tasks=merge,nope",
+				"-eventloop.adaptive.enabled=true",
+				"-eventloop.adaptive.every=0s",
+				"-eventloop.adaptive.max_speedup=0.5",
+				"-eventloop.load_balancing_margin=1",
+				"-node.capacity=0",
+				"-kmeans.search=manhattan",
+				"-local_addr_api=localhost",
+				"-other_addrs_rpc=localhost:3600",
+				"-rpc.tls.cert=cert.pem",
+				"-api.tls.client_auth=true",
+			},
+			want: []string{
+				"eventloop.schedules.meta",
+				"eventloop.schedules.expire: cron",
+				"eventloop.split_centroids_min",
+				"eventloop.disabled_tasks: unknown task \"nope\"",
+				"eventloop.adaptive.every",
+				"eventloop.adaptive.max_speedup",
+				"eventloop.load_balancing_margin: must be in [0, 1)",
+				"node.capacity",
+				"kmeans.search",
+				"local_addr_api",
+				"other_addrs_rpc: must include local_addr_rpc",
+				"rpc.tls: cert and key must be set together",
+				"api.tls: ca and client_auth require cert and key",
+			},
+		},
+	}
+	for _, test := range tests {
+		args := test.args
+		if test.file != "" {
+			args = append([]string{"-config", writeFile(t, test.file)}, args...)
+		}
+		_, err := Load(args, test.env)
+		if err == nil {
+			t.Fatalf("%v: expected an error", test.name)
+		}
+		for _, s := range test.want {
+			if !strings.Contains(err.Error(), s) {
+				t.Fatalf("%v: error doesn't mention %q: %v", test.name, s, err)
+			}
+		}
+		if strings.Contains(err.Error(), "s3cret") {
+			t.Fatalf("%v: error contains a secret: %v", test.name, err)
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	restore(t)
+	file := writeFile(t, `{"api": {"keys": [{"token": "a", "read": ["*"]}]}}`)
+	c, err := Load([]string{"-config", file}, nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if len(c.API.Keys) != 1 || c.API.Keys[0].Token != "a" || c.API.Keys[0].Read[0] != "*" {
+		t.Fatalf("unexpected keys from file: %+v", c.API.Keys)
+	}
+
+	// Env overrides the whole list.
+	env := []string{
+		"TRYPO_API_KEYS=a=read:*; b=read:x,write:x,read:y",
+		"TRYPO_RPC_SECRET=s3cret",
+	}
+	c, err = Load([]string{"-config", file}, env)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	want := APIKeys{
+		{Token: "a", Read: []string{"*"}},
+		{Token: "b", Read: []string{"x", "y"}, Write: []string{"x"}},
+	}
+	if !reflect.DeepEqual(c.API.Keys, want) {
+		t.Fatalf("unexpected keys from env: %+v", c.API.Keys)
+	}
+	if b, _ := c.API.Keys.MarshalText(); string(b) != "a=read:*;b=read:x,read:y,write:x" {
+		t.Fatalf("unexpected text: %s", b)
+	}
+
+	if err := c.Apply(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if len(API.Keys) != 2 || API.Keys[1].Token != "b" || RPC_SECRET != "s3cret" {
+		t.Fatalf("unexpected package vars: %+v, %q", API.Keys, RPC_SECRET)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	restore(t)
+	file := writeFile(t, `{"quotas": {"a": {"max_dps": 10}, "*": {"query_rate": 2.5}}}`)
+	c, err := Load([]string{"-config", file}, nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if c.Quotas["a"].MaxDPs != 10 || c.Quotas["*"].QueryRate != 2.5 {
+		t.Fatalf("unexpected quotas from file: %+v", c.Quotas)
+	}
+
+	// Env overrides all quotas.
+	c, err = Load([]string{"-config", file}, []string{"TRYPO_QUOTAS=b=max_bytes:100,write_rate:0.5"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	want := Quotas{"b": {MaxBytes: 100, WriteRate: 0.5}}
+	if !reflect.DeepEqual(c.Quotas, want) {
+		t.Fatalf("unexpected quotas from env: %+v", c.Quotas)
+	}
+	if b, _ := c.Quotas.MarshalText(); string(b) != "b=max_bytes:100,write_rate:0.5" {
+		t.Fatalf("unexpected text: %s", b)
+	}
+
+	if err := c.Apply(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if QUOTAS["b"].MaxBytes != 100 || API.Quotas["b"].WriteRate != 0.5 {
+		t.Fatalf("unexpected package vars: %+v, %+v", QUOTAS, API.Quotas)
+	}
+}
+
+func TestTTLs(t *testing.T) {
+	restore(t)
+	file := writeFile(t, `{"ttls": {"a": {"default": "1h"}, "*": {"default": "24h", "refresh_on_read": true}}}`)
+	c, err := Load([]string{"-config", file}, nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	want := TTLs{"a": {Default: time.Hour}, "*": {Default: time.Hour * 24, RefreshOnRead: true}}
+	if !reflect.DeepEqual(c.TTLs, want) {
+		t.Fatalf("unexpected ttls from file: %+v", c.TTLs)
+	}
+
+	// Env overrides all ttls.
+	c, err = Load([]string{"-config", file}, []string{"TRYPO_TTLS=b=30m,refresh_on_read"})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	want = TTLs{"b": {Default: time.Minute * 30, RefreshOnRead: true}}
+	if !reflect.DeepEqual(c.TTLs, want) {
+		t.Fatalf("unexpected ttls from env: %+v", c.TTLs)
+	}
+	if b, _ := c.TTLs.MarshalText(); string(b) != "b=30m0s,refresh_on_read" {
+		t.Fatalf("unexpected text: %s", b)
+	}
+
+	if err := c.Apply(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if !TTLS["b"].RefreshOnRead || TTLS.For("other").Default != 0 {
+		t.Fatalf("unexpected package var: %+v", TTLS)
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	restore(t)
+	c := Default()
+	c.EventLoop.Schedules.Meta.Jitter = -1
+	c.KMeans.InitCap = 12345
+	if err := c.Apply(); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if KMEANS_INITCAP == 12345 {
+		t.Fatalf("package vars changed despite invalid config")
+	}
+}
+
+func TestReload(t *testing.T) {
+	restore(t)
+	path := writeFile(t, `{"eventloop": {"schedules": {"expire": {"every": "3m"}}}}`)
+	args := []string{"-config", path}
+	c, err := Load(args, nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := c.Apply(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// Tunable & non-tunable change.
+	err = ioutil.WriteFile(path, []byte(`{
+		"local_addr_api": "localhost:4000",
+		"api": {"admin_token": "s3cret"},
+		"rpc": {"secret": "s3cret"},
+		"node": {"capacity": 2},
+		"eventloop": {
+			"schedules": {"expire": {"every": "9m"}},
+			"load_balancing_margin": 0.3,
+			"adaptive": {"enabled": true}
+		}
+	}`), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	changes, err := Reload(args, nil)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	want := []string{
+		"Schedules.Expire.Every: 3m0s -> 9m0s",
+		"LoadBalancingMargin: 0.2 -> 0.3",
+		"local_addr_api: localhost:3501 -> localhost:4000 (requires restart)",
+		"api.admin_token: changed (requires restart)", // Value isn't logged.
+		"rpc.secret: changed (requires restart)",
+		"eventloop.adaptive.enabled: false -> true (requires restart)",
+		"node.capacity: 1 -> 2 (requires restart)",
+	}
+	if strings.Join(changes, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	if ELT.Schedules.Expire.Every != time.Minute*9 || LocalAddrAPI.Port != "3501" {
+		t.Fatalf("unexpected package vars after reload")
+	}
+
+	// Invalid, nothing should change.
+	if err := ioutil.WriteFile(path, []byte(`{"eventloop": {"schedules": {"expire": {"cron": "nope"}}}}`), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := Reload(args, nil); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if ELT.Schedules.Expire.Every != time.Minute*9 {
+		t.Fatalf("invalid reload changed tuning")
+	}
+}
+
+// Secrets set in cfg.go (or applied from a file/env) aren't printed by -help.
+func TestFlagDefaultsSecret(t *testing.T) {
+	restore(t)
+	RPC_SECRET = "s3cret"
+	API.AdminToken = "s3cret"
+	c := Default()
+	c.API.Keys = APIKeys{{Token: "s3cret", Read: []string{"*"}}}
+	for _, f := range c.fields() {
+		v := flagValue{field: f}
+		switch {
+		case secretKeys[f.key] && v.String() != "":
+			t.Fatalf("flag default of %v is shown: %q", f.key, v.String())
+		case f.key == "node.capacity" && v.String() != "1":
+			t.Fatalf("unexpected flag default of %v: %q", f.key, v.String())
+		}
+	}
+}
+
+// All flags have usage text (see the help tags of Config).
+func TestFlagHelp(t *testing.T) {
+	c := Default()
+	for _, f := range c.fields() {
+		if f.help == "" {
+			t.Fatalf("no help text for %v", f.key)
+		}
+	}
+}
+
+// Search funcs set in code which aren't in searchFuncs are kept as they are.
+func TestCustomSearchFunc(t *testing.T) {
+	restore(t)
+	called := false
+	KNN_SEARCH_FUNC = func(v []float64, vecs func() ([]float64, bool), k int) []int {
+		called = true
+		return nil
+	}
+	c := Default()
+	if c.KMeans.Search != customSearch {
+		t.Fatalf("unexpected search func name: %q", c.KMeans.Search)
+	}
+	if err := c.Apply(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if KNN_SEARCH_FUNC(nil, nil, 0); !called {
+		t.Fatalf("custom search func was replaced")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := writeFile(t, `{}`)
+	called := make(chan struct{}, 10)
+	stop := Watch(path, time.Millisecond, func() { called <- struct{}{} })
+	defer stop()
+
+	select {
+	case <-called:
+		t.Fatalf("called without change")
+	case <-time.After(time.Millisecond * 20):
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"kmeans": {}}`), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatalf("not called after change")
+	}
+}
@@ -0,0 +1,133 @@
+/*
+This file contains runtime reconfiguration, i.e re-loading config (file, env
+and flags, see ./load.go) while the system is running. Only the tuning of the
+event loop (see core/eventloop.EventLoopTuning) can be changed at runtime,
+other values require a restart.
+*/
+package cfg
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"trypo/core/eventloop"
+)
+
+// Tuning returns the part of c.EventLoop which can be changed at runtime.
+func (c *Config) Tuning() eventloop.EventLoopTuning {
+	el := &c.EventLoop
+	return eventloop.EventLoopTuning{
+		Schedules:                     el.Schedules.schedules(),
+		DistributeDataPointsFastN:     el.DistributeDataPointsFastN,
+		DistributeDataPointsAccurateN: el.DistributeDataPointsAccurateN,
+		DistributeDataPointsInternalN: el.DistributeDataPointsInternalN,
+		SplitCentroidsMin:             el.SplitCentroidsMin,
+		SplitCentroidsMax:             el.SplitCentroidsMax,
+		MergeCentroidsMin:             el.MergeCentroidsMin,
+		MergeCentroidsMax:             el.MergeCentroidsMax,
+		LoadBalancingMargin:           el.LoadBalancingMargin,
+	}
+}
+
+// Keys (see Config.fields) in EventLoopSection which are _not_ part of the
+// tuning, i.e can't be changed at runtime.
+var restartKeys = map[string]bool{
+	"eventloop.log_local_only": true,
+	"eventloop.disabled_tasks": true,
+	"eventloop.dashboard":      true,
+}
+
+// Like restartKeys, but for all keys with these prefixes.
+var restartPrefixes = []string{
+	"eventloop.adaptive.",
+}
+
+// Keys with values that must not be logged, e.g in the changes returned by
+// Reload or as flag defaults (see flagValue.String).
+var secretKeys = map[string]bool{
+	"api.admin_token": true,
+	"api.keys":        true,
+	"rpc.secret":      true,
+}
+
+// tunable returns true if the value with 'key' can be changed at runtime.
+func tunable(key string) bool {
+	for _, prefix := range restartPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+	return strings.HasPrefix(key, "eventloop.") && !restartKeys[key]
+}
+
+// Reload loads config like Load (with the current package-level vars as
+// defaults), and passes the new tuning to the event loop with ELT.Retune.
+// Returns a description of each changed value, where changes that can't be
+// applied at runtime are marked with "(requires restart)". Nothing is
+// changed if the config is invalid.
+func Reload(args []string, env []string) ([]string, error) {
+	current := Default()
+	c, err := Load(args, env)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	currentFields := make(map[string]field)
+	for _, f := range current.fields() {
+		currentFields[f.key] = f
+	}
+	for _, f := range c.fields() {
+		old := currentFields[f.key]
+		if f.String() == old.String() || tunable(f.key) {
+			continue
+		}
+		if secretKeys[f.key] {
+			changes = append(changes, fmt.Sprintf("%v: changed (requires restart)", f.key))
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%v: %v -> %v (requires restart)",
+			f.key, old.String(), f.String()))
+	}
+
+	tuned, err := ELT.Retune(c.Tuning())
+	if err != nil {
+		return nil, err
+	}
+	return append(tuned, changes...), nil
+}
+
+// Watch polls the file at 'path' every 'interval', and calls 'fn' when its
+// modification time or size has changed (including when it is created or
+// removed). Returns a func for stopping the watch.
+func Watch(path string, interval time.Duration, fn func()) func() {
+	stat := func() (time.Time, int64, bool) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, 0, false
+		}
+		return info.ModTime(), info.Size(), true
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		mod, size, exists := stat()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			m, s, e := stat()
+			if m.Equal(mod) && s == size && e == exists {
+				continue
+			}
+			mod, size, exists = m, s, e
+			fn()
+		}
+	}()
+	return func() { close(stop) }
+}
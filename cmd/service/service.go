@@ -1,16 +1,41 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"trypo/cfg"
 	"trypo/core/api"
 	"trypo/core/eventloop"
 	"trypo/pkg/kmeans/centroidmanager"
 	"trypo/pkg/kmeans/rpc"
+	"trypo/pkg/logging"
+	"trypo/pkg/rpcutils"
 )
 
 func main() {
 
+	// Overrides defaults in cfg pkg with config file, env vars and flags.
+	c, err := cfg.Load(os.Args[1:], os.Environ())
+	if err == nil {
+		err = c.Apply()
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logging.SetDefault(logging.New(os.Stderr, cfg.LOG_LEVEL, cfg.LOG_FORMAT))
+	log := logging.Default().With(logging.Node(cfg.LocalAddrRPC.ToStr()))
+
 	// Used for spawning CentroidManager instances by the rpc node,
 	cmSpawner := func(vec []float64) *centroidmanager.CentroidManager {
 		args := centroidmanager.NewCentroidManagerArgs{
@@ -19,6 +44,9 @@ func main() {
 			CentroidDPThreshold: cfg.KMEANS_CENTROID_DP_THRESHOLD,
 			KNNSearchFunc:       cfg.KNN_SEARCH_FUNC,
 			KFNSearchFunc:       cfg.KFN_SEARCH_FUNC,
+			Quantization:        cfg.KMEANS_QUANTIZATION,
+			Index:               cfg.KMEANS_CENTROID_INDEX,
+			Router:              cfg.KMEANS_CENTROID_ROUTER,
 		}
 		cm, ok := centroidmanager.NewCentroidManager(args)
 		if !ok {
@@ -27,26 +55,143 @@ func main() {
 		return &cm
 	}
 
-	// RPC node spawn.
+	// RPC node spawn, with data from the last shutdown (if any).
 	rpcNode := rpc.NewKMeansServer(cfg.LocalAddrRPC.ToStr(), cmSpawner)
+	rpcNode.Quotas = cfg.QUOTAS
+	rpcNode.TTLs = cfg.TTLS
+	rpcNode.Capacity = cfg.NODE_CAPACITY
+	rpcNode.MemHighWater = cfg.NODE_MEM_HIGH_WATER
+	if cfg.SNAPSHOT_PATH != "" {
+		n, err := rpc.LoadSnapshotFile(rpcNode, cfg.SNAPSHOT_PATH)
+		if err != nil {
+			log.Error("failed to load snapshot", logging.Err(err))
+			os.Exit(1)
+		}
+		log.Info("loaded snapshot", logging.F("dps", n), logging.F("path", cfg.SNAPSHOT_PATH))
+	}
+	// Same secret and TLS for the server and for clients in this process.
+	rpcutils.SetSecret(cfg.RPC_SECRET)
+	tlsServer, err := cfg.RPC_TLS.ServerConfig()
+	if err == nil {
+		var tlsClient *tls.Config
+		tlsClient, err = cfg.RPC_TLS.ClientConfig()
+		rpcutils.SetTLS(tlsServer, tlsClient)
+	}
+	if err != nil {
+		log.Error("failed to set up rpc tls", logging.Err(err))
+		os.Exit(1)
+	}
 	rpcStop, err := rpc.StartListen(rpcNode)
 	if err != nil {
-		panic("failed to start rpc node")
+		log.Error("failed to start rpc node", logging.Err(err))
+		os.Exit(1)
 	}
-	defer rpcStop()
 
 	// Will panic by itself if setup is shabby.
 	eltStop := eventloop.EventLoop(&cfg.ELT)
-	defer eltStop()
+
+	// Event loop tuning is reloaded when the config file changes.
+	watchStop := func() {}
+	if c.Path != "" && cfg.CONFIG_WATCH_INTERVAL > 0 {
+		watchStop = cfg.Watch(c.Path, cfg.CONFIG_WATCH_INTERVAL, func() {
+			changes, err := cfg.Reload(os.Args[1:], os.Environ())
+			if err != nil {
+				log.Error("config reload failed", logging.Err(err))
+				return
+			}
+			for _, change := range changes {
+				log.Info("config reloaded", logging.F("change", change))
+			}
+		})
+	}
 
 	// WAPI for user-facing interface.
-	err = api.Start(api.APIConfig{
-		Addr:         cfg.LocalAddrAPI,
-		RPCAddrs:     cfg.OtherAddrRPC,
-		ReadTimeout:  time.Second * 5,
-		WriteTimeout: time.Second * 5,
-	})
+	server, err := api.NewServer(cfg.API)
 	if err != nil {
-		panic(err)
+		log.Error("failed to set up api server", logging.Err(err))
+		os.Exit(1)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- api.ListenAndServe(server) }()
+
+	// Run until signalled (or the API server fails). A second signal
+	// during shutdown kills the process (default behaviour is restored).
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case s := <-sig:
+		log.Info("shutting down", logging.F("signal", s))
+	case err := <-serveErr:
+		log.Error("api server failed, shutting down", logging.Err(err))
 	}
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+
+	// Force exit if the shutdown takes too long.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.SHUTDOWN_TIMEOUT)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Error("shutdown timed out", logging.Duration(cfg.SHUTDOWN_TIMEOUT))
+			os.Exit(1)
+		}
+	}()
+
+	shutdown(ctx, shutdownArgs{
+		log:       log,
+		server:    server,
+		rpcNode:   rpcNode,
+		rpcStop:   rpcStop,
+		eltStop:   eltStop,
+		watchStop: watchStop,
+	})
+}
+
+type shutdownArgs struct {
+	log       *logging.Logger
+	server    *http.Server
+	rpcNode   *rpc.KMeansServer
+	rpcStop   func()
+	eltStop   func()
+	watchStop func()
+}
+
+// shutdown stops everything started in main, in an order such that no data
+// is lost: API traffic is stopped first (in-flight requests are finished),
+// then the event loop (its current task is finished), then data is handed
+// off to other nodes and/or persisted (while the RPC node still serves, since
+// other nodes pull data from it), and finally the RPC node is stopped.
+func shutdown(ctx context.Context, args shutdownArgs) {
+	log := args.log
+	args.watchStop()
+
+	if err := args.server.Shutdown(ctx); err != nil {
+		log.Warn("api shutdown failed", logging.Err(err))
+	}
+	log.Info("api stopped")
+
+	args.eltStop()
+	log.Info("event loop stopped")
+
+	if cfg.SHUTDOWN_HANDOFF {
+		peers := make([]string, 0, len(cfg.OtherAddrRPC))
+		for _, addr := range cfg.OtherAddrRPC {
+			peers = append(peers, addr.ToStr())
+		}
+		start := time.Now()
+		n, ok := rpc.Handoff(args.rpcNode, peers)
+		log.Info("handed off datapoints to peers", logging.F("dps", n),
+			logging.Duration(time.Since(start)), logging.F("all_reached", ok))
+	}
+
+	if cfg.SNAPSHOT_PATH != "" {
+		if err := rpc.SaveSnapshotFile(args.rpcNode, cfg.SNAPSHOT_PATH); err != nil {
+			log.Error("failed to save snapshot", logging.Err(err))
+		} else {
+			log.Info("saved snapshot", logging.F("path", cfg.SNAPSHOT_PATH))
+		}
+	}
+
+	args.rpcStop()
+	log.Info("rpc node stopped")
 }
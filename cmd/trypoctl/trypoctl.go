@@ -0,0 +1,491 @@
+/*
+Command trypoctl shows the status of a trypo network and runs operations on
+it, talking to the RPC nodes directly (-rpc, defaults to the addresses in the
+cfg pkg) or to the API of any node (-api), which then asks all nodes it knows.
+Config is loaded like in cmd/service, from a file (-config) and TRYPO_* env
+vars (see cfg/load.go), including the RPC secret and TLS settings. With
+-api, HTTPS is used if api.tls is configured, and the first of api.keys is
+sent unless -token is given.
+
+Usage:
+
+	trypoctl [flags] status [-watch interval]
+	trypoctl [flags] namespaces
+	trypoctl [flags] export [-namespace ns] file
+	trypoctl [flags] import [-node addr] file
+	trypoctl [flags] run [-namespace ns] task
+
+'status' shows data per node and namespace, and whether nodes are healthy
+(exits with status 1 if any node isn't, unless watching). 'export' writes
+the data in all nodes (or one namespace) to a snapshot file, which 'import'
+sends to a single node (the first healthy one by default); the event loop
+then spreads it over the network. 'run' runs a maintenance task (expire,
+memtrim, split, merge, distri internal, distri fast or distri accurate) in
+all healthy nodes right away, with the tuning in the cfg pkg. All commands
+write JSON instead of tables with -json.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"trypo/cfg"
+	"trypo/core/cluster"
+	"trypo/pkg/kmeans/rpc"
+	"trypo/pkg/logging"
+	"trypo/pkg/rpcutils"
+)
+
+// opts are the flags that come before the command.
+type opts struct {
+	rpcAddrs []cluster.Addr
+	apiAddr  string
+	apiToken string
+	apiTLS   *tls.Config
+	timeout  time.Duration
+	json     bool
+}
+
+func main() {
+	fs := flag.NewFlagSet("trypoctl", flag.ExitOnError)
+	config := fs.String("config", "", "path to a JSON config file (see cfg pkg)")
+	rpcAddrs := fs.String("rpc", "", "comma-separated RPC addresses of all nodes (default: from config)")
+	apiAddr := fs.String("api", "", "API address of any node, used instead of -rpc")
+	apiToken := fs.String("token", "", "API key for -api (default: the first in config)")
+	timeout := fs.Duration("timeout", time.Second*2, "how long each node has to reply")
+	asJSON := fs.Bool("json", false, "write JSON instead of tables")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: trypoctl [flags] status|namespaces|export|import|run [args]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	var args []string
+	if *config != "" {
+		args = []string{"-config", *config}
+	}
+	c, err := cfg.Load(args, os.Environ())
+	if err == nil {
+		err = c.Apply()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	// Failed calls are reported in the output, so only errors are logged.
+	logging.SetDefault(logging.New(os.Stderr, logging.LevelError, cfg.LOG_FORMAT))
+	rpcutils.SetSecret(cfg.RPC_SECRET)
+	rpcTLS, err := cfg.RPC_TLS.ClientConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	rpcutils.SetTLS(nil, rpcTLS)
+	// HTTPS if the API uses TLS, verified with the same CA.
+	apiTLS, err := cfg.API.TLS.ClientConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *apiToken == "" && len(cfg.API.Keys) != 0 {
+		*apiToken = cfg.API.Keys[0].Token
+	}
+	if *rpcAddrs == "" {
+		*rpcAddrs = strings.Join(addrStrs(cfg.OtherAddrRPC), ",")
+	}
+
+	o := opts{
+		apiAddr:  *apiAddr,
+		apiToken: *apiToken,
+		apiTLS:   apiTLS,
+		timeout:  *timeout,
+		json:     *asJSON,
+	}
+	for _, s := range strings.Split(*rpcAddrs, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		addr, err := parseAddr(s)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -rpc address %q: %v\n", s, err)
+			os.Exit(2)
+		}
+		o.rpcAddrs = append(o.rpcAddrs, addr)
+	}
+
+	commands := map[string]func(opts, []string) error{
+		"status":     status,
+		"namespaces": namespaces,
+		"export":     export,
+		"import":     importSnapshot,
+		"run":        run,
+	}
+	if fs.NArg() == 0 || commands[fs.Arg(0)] == nil {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := commands[fs.Arg(0)](o, fs.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+/*
+--------------------------------------------------------------------------------
+Commands.
+--------------------------------------------------------------------------------
+*/
+
+// errUnhealthy is returned by 'status' if some node isn't healthy.
+var errUnhealthy = errors.New("not all nodes are healthy")
+
+func status(o opts, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	watch := fs.Duration("watch", 0, "refresh at this interval until interrupted")
+	fs.Parse(args)
+
+	for {
+		s, err := o.collect()
+		if err != nil {
+			return err
+		}
+		if *watch <= 0 {
+			if err := o.write(s, func(w io.Writer) { writeStatus(w, s) }); err != nil {
+				return err
+			}
+			if s.Healthy() != len(s.Nodes) {
+				return errUnhealthy
+			}
+			return nil
+		}
+		if !o.json {
+			// Clear the terminal (ANSI), such that the table is redrawn.
+			fmt.Print("\033[H\033[2J")
+			fmt.Printf("%v (every %v)\n\n", time.Now().Format(time.RFC3339), *watch)
+		}
+		if err := o.write(s, func(w io.Writer) { writeStatus(w, s) }); err != nil {
+			return err
+		}
+		time.Sleep(*watch)
+	}
+}
+
+func namespaces(o opts, args []string) error {
+	s, err := o.collect()
+	if err != nil {
+		return err
+	}
+	return o.write(s.Namespaces, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAMESPACE\tNODES\tDPS\tCENTROIDS\tSIZE MIN/P50/P90/MAX\tSIZE MEAN")
+		for _, ns := range sortedKeys(s.Namespaces) {
+			total := s.Namespaces[ns]
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%.1f\n", ns, total.Nodes, total.DPs,
+				total.Centroids, sizes(total.CentroidSizes), total.CentroidSizes.Mean)
+		}
+		tw.Flush()
+	})
+}
+
+func export(o opts, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "only export this namespace")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: trypoctl export [-namespace ns] file")
+	}
+
+	s, err := o.collect()
+	if err != nil {
+		return err
+	}
+	if s.Healthy() != len(s.Nodes) {
+		return fmt.Errorf("can't export: %v", errUnhealthy)
+	}
+	var snapshots []io.Reader
+	for _, node := range s.Nodes {
+		if _, ok := node.Namespaces[*namespace]; *namespace != "" && !ok {
+			continue
+		}
+		var err error
+		b := rpc.KMeansClient(node.Addr, *namespace, &err).Export()
+		if err != nil {
+			return fmt.Errorf("export from %v: %v", node.Addr, err)
+		}
+		snapshots = append(snapshots, bytes.NewReader(b))
+	}
+
+	var b bytes.Buffer
+	n, err := rpc.MergeSnapshots(&b, snapshots...)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fs.Arg(0), b.Bytes(), 0644); err != nil {
+		return err
+	}
+	return o.write(map[string]interface{}{"dps": n, "nodes": len(snapshots)}, func(w io.Writer) {
+		fmt.Fprintf(w, "exported %v datapoints from %v nodes to %v\n", n, len(snapshots), fs.Arg(0))
+	})
+}
+
+func importSnapshot(o opts, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	node := fs.String("node", "", "RPC address of the node to import into (default: first healthy)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: trypoctl import [-node addr] file")
+	}
+
+	b, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *node == "" {
+		s, err := o.collect()
+		if err != nil {
+			return err
+		}
+		for _, n := range s.Nodes {
+			if n.Healthy {
+				*node = n.Addr
+				break
+			}
+		}
+		if *node == "" {
+			return errors.New("no healthy node to import into")
+		}
+	}
+
+	n := rpc.KMeansClient(*node, "", &err).Import(b)
+	if err != nil {
+		return fmt.Errorf("import into %v: %v", *node, err)
+	}
+	return o.write(map[string]interface{}{"dps": n, "node": *node}, func(w io.Writer) {
+		fmt.Fprintf(w, "imported %v datapoints into %v\n", n, *node)
+	})
+}
+
+// Maintenance tasks for 'run', by the names of the event loop tasks (see
+// core/eventloop.BuiltinTasks). 'addrs' are the nodes with the namespace.
+var tasks = map[string]func(addr, namespace string, addrs []string, err *error){
+	"expire": func(addr, namespace string, _ []string, err *error) {
+		rpc.KMeansClient(addr, namespace, err).Expire()
+	},
+	"memtrim": func(addr, namespace string, _ []string, err *error) {
+		rpc.KMeansClient(addr, namespace, err).MemTrim()
+	},
+	"split": func(addr, namespace string, _ []string, err *error) {
+		t := cfg.ELT.Tuning()
+		rpc.KMeansClient(addr, namespace, err).SplitCentroids(t.SplitCentroidsMin, t.SplitCentroidsMax)
+	},
+	"merge": func(addr, namespace string, _ []string, err *error) {
+		t := cfg.ELT.Tuning()
+		rpc.KMeansClient(addr, namespace, err).MergeCentroids(t.MergeCentroidsMin, t.MergeCentroidsMax)
+	},
+	"distri internal": func(addr, namespace string, _ []string, err *error) {
+		n := cfg.ELT.Tuning().DistributeDataPointsInternalN
+		rpc.KMeansClient(addr, namespace, err).DistributeDataPointsInternal(n)
+	},
+	"distri fast": func(addr, namespace string, addrs []string, err *error) {
+		n := cfg.ELT.Tuning().DistributeDataPointsFastN
+		rpc.KMeansClient(addr, namespace, err).DistributeDataPointsFast(addrs, n)
+	},
+	"distri accurate": func(addr, namespace string, addrs []string, err *error) {
+		n := cfg.ELT.Tuning().DistributeDataPointsAccurateN
+		rpc.KMeansClient(addr, namespace, err).DistributeDataPointsAccurate(addrs, n)
+	},
+}
+
+// taskResult is the outcome of a task in a node, for one namespace.
+type taskResult struct {
+	Node      string `json:"node"`
+	Namespace string `json:"namespace"`
+	Error     string `json:"error,omitempty"`
+}
+
+func run(o opts, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	namespace := fs.String("namespace", "", "only run for this namespace (default: all)")
+	fs.Parse(args)
+	task := strings.Join(fs.Args(), " ") // e.g 'run distri fast'.
+	f, ok := tasks[task]
+	if !ok {
+		return fmt.Errorf("unknown task %q (want one of %v)", task, strings.Join(sortedKeys(tasks), ", "))
+	}
+
+	s, err := o.collect()
+	if err != nil {
+		return err
+	}
+	// Nodes for each namespace, used by the distri tasks.
+	nsAddrs := make(map[string][]string)
+	for _, node := range s.Nodes {
+		for ns := range node.Namespaces {
+			nsAddrs[ns] = append(nsAddrs[ns], node.Addr)
+		}
+	}
+
+	var results []taskResult
+	failed := false
+	for _, node := range s.Nodes {
+		for _, ns := range sortedKeys(node.Namespaces) {
+			if *namespace != "" && ns != *namespace {
+				continue
+			}
+			var err error
+			f(node.Addr, ns, nsAddrs[ns], &err)
+			res := taskResult{Node: node.Addr, Namespace: ns}
+			if err != nil {
+				res.Error = err.Error()
+				failed = true
+			}
+			results = append(results, res)
+		}
+	}
+
+	err = o.write(results, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NODE\tNAMESPACE\tRESULT")
+		for _, res := range results {
+			result := "ok"
+			if res.Error != "" {
+				result = res.Error
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", res.Node, res.Namespace, result)
+		}
+		tw.Flush()
+	})
+	if err == nil && failed {
+		err = fmt.Errorf("task %q failed in some nodes", task)
+	}
+	if err == nil && s.Healthy() != len(s.Nodes) {
+		err = fmt.Errorf("task %q wasn't run in all nodes: %v", task, errUnhealthy)
+	}
+	return err
+}
+
+/*
+--------------------------------------------------------------------------------
+Utils.
+--------------------------------------------------------------------------------
+*/
+
+// collect returns the status of all nodes, from the API if o.apiAddr is
+// set, otherwise from o.rpcAddrs.
+func (o *opts) collect() (cluster.Status, error) {
+	if o.apiAddr == "" {
+		return cluster.Collect(o.rpcAddrs, o.timeout), nil
+	}
+
+	var s cluster.Status
+	client := http.Client{Timeout: o.timeout * 2}
+	scheme := "http://"
+	if o.apiTLS != nil {
+		scheme = "https://"
+		client.Transport = &http.Transport{TLSClientConfig: o.apiTLS}
+	}
+	req, err := http.NewRequest(http.MethodGet, scheme+o.apiAddr+"/api/status", nil)
+	if err != nil {
+		return s, err
+	}
+	if o.apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+o.apiToken)
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		return s, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return s, fmt.Errorf("api replied with %v", r.Status)
+	}
+	return s, json.NewDecoder(r.Body).Decode(&s)
+}
+
+// write writes 'v' as JSON to stdout if o.json is set, otherwise calls
+// 'table' with stdout.
+func (o *opts) write(v interface{}, table func(io.Writer)) error {
+	if !o.json {
+		table(os.Stdout)
+		return nil
+	}
+	return json.NewEncoder(os.Stdout).Encode(v)
+}
+
+// writeStatus writes tables for nodes and for each namespace in each node.
+func writeStatus(w io.Writer, s cluster.Status) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tHEALTH\tLATENCY\tNAMESPACES\tDPS\tCENTROIDS")
+	for _, node := range s.Nodes {
+		if !node.Healthy {
+			fmt.Fprintf(tw, "%v\tdown (%v)\t%v\t-\t-\t-\n", node.Addr, node.Error,
+				node.Latency.Round(time.Microsecond))
+			continue
+		}
+		dps, centroids := 0, 0
+		for _, ns := range node.Namespaces {
+			dps += ns.DPs
+			centroids += ns.Centroids
+		}
+		fmt.Fprintf(tw, "%v\tok\t%v\t%v\t%v\t%v\n", node.Addr,
+			node.Latency.Round(time.Microsecond), len(node.Namespaces), dps, centroids)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tNAMESPACE\tDPS\tCENTROIDS\tSIZE MIN/P50/P90/MAX\tSIZE MEAN\tVEC NORM\tINSERTS\tQUERY LATENCY")
+	for _, node := range s.Nodes {
+		for _, name := range sortedKeys(node.Namespaces) {
+			ns := node.Namespaces[name]
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%.1f\t%.3f\t%v\t%v\n", node.Addr, name,
+				ns.DPs, ns.Centroids, sizes(ns.CentroidSizes), ns.CentroidSizes.Mean,
+				ns.VecNorm, ns.Inserts, ns.QueryLatency.Round(time.Microsecond))
+		}
+	}
+	tw.Flush()
+}
+
+// sizes formats a centroid size distribution.
+func sizes(d cluster.SizeDist) string {
+	return fmt.Sprintf("%v/%v/%v/%v", d.Min, d.P50, d.P90, d.Max)
+}
+
+func parseAddr(s string) (cluster.Addr, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return cluster.Addr{}, errors.New("want host:port")
+	}
+	return cluster.Addr{IP: s[:i], Port: s[i+1:]}, nil
+}
+
+func addrStrs(addrs []cluster.Addr) []string {
+	res := make([]string, len(addrs))
+	for i, addr := range addrs {
+		res[i] = addr.ToStr()
+	}
+	return res
+}
+
+// sortedKeys returns the keys of a map with string keys, sorted.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
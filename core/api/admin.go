@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Handles '/admin/eventloop'. GET replies with the current event loop tuning
+// (see core/eventloop.EventLoopTuning) as JSON. POST takes a (partial) tuning
+// in the same form, i.e values that are left out are unchanged, which is
+// applied immediately (see EventLoopConfig.Retune). The reply to a POST is a JSON
+// list of changed values, or a plain-text error with a bad request status if
+// the tuning is invalid.
+func (h *handler) eventLoopTuning(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		b, _ := json.Marshal(h.EventLoop.Tuning())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	case http.MethodPost:
+		tuning := h.EventLoop.Tuning()
+		if !h.tryUnpackRequestOptions(w, r, &tuning) {
+			return
+		}
+		changes, err := h.EventLoop.Retune(tuning)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if changes == nil {
+			changes = []string{}
+		}
+		b, _ := json.Marshal(changes)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Handles '/admin/eventloop/adaptive'. GET replies with the latest metrics and
+// decisions of the adaptive event loop mode (see core/eventloop.AdaptiveState)
+// as JSON.
+func (h *handler) eventLoopAdaptive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, _ := json.Marshal(h.EventLoop.AdaptiveState())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
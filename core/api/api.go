@@ -1,6 +1,7 @@
 /*
 The api package defines a JSON/POST API for the system, using std net/http.
-See routes in ./handler.go.
+See routes in ./handler.go. Metrics for the whole process (see pkg/metrics)
+are served on '/metrics', in the Prometheus text format.
 
 */
 package api
@@ -9,7 +10,10 @@ import (
 	"errors"
 	"net/http"
 	"time"
+	"trypo/core/eventloop"
 	"trypo/pkg/arbiter"
+	"trypo/pkg/kmeans/rpc"
+	"trypo/pkg/tlsutils"
 )
 
 // Alias for readability.
@@ -28,29 +32,97 @@ type APIConfig struct {
 	// approximate nearest neighs search). Should contain addr for local rpc
 	// instance, not to be confused with the Addr field of this struct.
 	RPCAddrs []Addr
+
+	// EventLoop is optional, and enables the '/admin/eventloop' route for
+	// changing the tuning of a running event loop (see ./admin.go).
+	EventLoop *eventloop.EventLoopConfig
+
+	// AdminToken is optional, and enables the '/api/admin/*' routes for
+	// running maintenance tasks on demand (see ./maintenance.go). Requests
+	// to all admin routes must then have the header
+	// 'Authorization: Bearer <AdminToken>'.
+	AdminToken string
+
+	// Keys is optional. If set, requests to the '/api/dp/*' routes must have
+	// the header 'Authorization: Bearer <Token>' for a key with access to
+	// the namespace of the request (see APIKey), and '/api/status' requires
+	// any of the keys. '/metrics' is not affected.
+	Keys []APIKey
+
+	// Quotas is optional, and limits the write and query rates of namespaces
+	// (see rpc.Quota), for requests to this server. Requests over the limit
+	// get a 429 status. Puts get a 507 status if all nodes that were tried
+	// are at the quota of the namespace, which is enforced by the nodes.
+	Quotas rpc.Quotas
+
+	// TLS is optional, the server uses HTTPS if TLS.Cert is set (and then
+	// requires client certificates if TLS.ClientAuth is set).
+	TLS tlsutils.Files
 }
 
 func (cfg *APIConfig) check() error {
 	if cfg.RPCAddrs == nil {
 		return errors.New("unexpected nil for RPCAddrs field in APIConfig")
 	}
+	if err := cfg.TLS.Check(); err != nil {
+		return errors.New("invalid TLS field in APIConfig: " + err.Error())
+	}
+	for _, key := range cfg.Keys {
+		if key.Token == "" {
+			return errors.New("unexpected empty token in Keys field of APIConfig")
+		}
+	}
 	return nil
 }
 
-// Start starts a http.Server which is intended to be used to interface the trypo system.
-func Start(cfg APIConfig) error {
+// NewServer sets up (but doesn't start) a http.Server which is intended to be
+// used to interface the trypo system. Start it with ListenAndServe (in this
+// pkg, such that TLS is used if configured), and use Shutdown on the returned
+// server for stopping it gracefully (in-flight requests are finished).
+func NewServer(cfg APIConfig) (*http.Server, error) {
 	if err := cfg.check(); err != nil {
-		return err
+		return nil, err
 	}
 
-	h := handler{RPCAddrs: cfg.RPCAddrs}
-	h.setRoutes()
+	h := handler{
+		RPCAddrs:   cfg.RPCAddrs,
+		EventLoop:  cfg.EventLoop,
+		AdminToken: cfg.AdminToken,
+		Keys:       cfg.Keys,
+		Quotas:     cfg.Quotas,
+	}
+	mux := http.NewServeMux()
+	h.setRoutes(mux)
 
-	s := http.Server{
+	tlsConfig, err := cfg.TLS.ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
 		Addr:         cfg.Addr.ToStr(),
+		Handler:      mux,
 		ReadTimeout:  cfg.ReadTimeout,
 		WriteTimeout: cfg.WriteTimeout,
-	}
+		TLSConfig:    tlsConfig,
+	}, nil
+}
 
+// ListenAndServe starts a server from NewServer, with HTTPS if it has a TLS
+// config. Blocks until the server fails or is shut down.
+func ListenAndServe(s *http.Server) error {
+	if s.TLSConfig != nil {
+		// Certificates are in the config.
+		return s.ListenAndServeTLS("", "")
+	}
 	return s.ListenAndServe()
 }
+
+// Start starts a http.Server which is intended to be used to interface the trypo
+// system. Blocks until the server fails, see NewServer for more control.
+func Start(cfg APIConfig) error {
+	s, err := NewServer(cfg)
+	if err != nil {
+		return err
+	}
+	return ListenAndServe(s)
+}
@@ -4,21 +4,28 @@ import (
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+	"trypo/core/cluster"
+	"trypo/core/eventloop"
 	"trypo/core/testutils"
+	"trypo/pkg/kmeans/rpc"
 	"trypo/pkg/mathutils"
+	"trypo/pkg/tlsutils"
 )
 
 // For the http server.
-var apiAddr = Addr{"localhost", "3000"}
+var apiAddr = Addr{"localhost", "3020"}
 
 // RPC addresses.
 var rpcAddrs = []Addr{
-	{"localhost", "3001"},
-	{"localhost", "3002"},
-	{"localhost", "3003"},
+	{"localhost", "3021"},
+	{"localhost", "3022"},
+	{"localhost", "3023"},
 }
 
 var namespace = "test"
@@ -34,24 +41,28 @@ func postData(url string, data interface{}) (*http.Response, error) {
 	return r, err
 }
 
-// Test '/api/dp/put' and '/api/dp/query' endpoints.
+// Test '/api/dp/put', '/api/dp/query' and '/api/dp/touch' endpoints.
 func TestDataPoint(t *testing.T) {
 	network.Reset()
 	defer network.Reset()
 
-	// Start http server.
-	go func() {
-		err := Start(APIConfig{
-			Addr:         apiAddr,
-			ReadTimeout:  time.Second * 5,
-			WriteTimeout: time.Second * 5,
-			RPCAddrs:     rpcAddrs,
-		})
-		t.Log(err)
-	}()
-
-	// Give server some time to load.
-	time.Sleep(1)
+	// Start http server. Listening before serving, such that requests below
+	// don't race with the server startup.
+	s, err := NewServer(APIConfig{
+		Addr:         apiAddr,
+		ReadTimeout:  time.Second * 5,
+		WriteTimeout: time.Second * 5,
+		RPCAddrs:     rpcAddrs,
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		t.Fatalf("listen err: %v", err)
+	}
+	go s.Serve(ln)
+	defer s.Close()
 
 	// Used for putting and querying.
 	dp := DP{Vec: []float64{1, 2, 3}, Expires: time.Now().Add(time.Hour)}
@@ -106,6 +117,426 @@ func TestDataPoint(t *testing.T) {
 		t.Fatalf("didn't get expected response dp vec")
 	}
 
+	// Touch.
+	touchArgs := struct {
+		Namespace string    `json:"namespace"`
+		QueryVec  []float64 `json:"queryVec"`
+		N         int       `json:"n"`
+		TTL       string    `json:"ttl"`
+	}{
+		Namespace: namespace,
+		QueryVec:  dp.Vec,
+		N:         3,
+		TTL:       "1h",
+	}
+	r, err = postData("http://"+apiAddr.ToStr()+"/api/dp/touch", touchArgs)
+	if err != nil {
+		t.Fatalf("post err (touch): %v", err)
+	}
+	var touchResp struct {
+		Touched int `json:"touched"`
+	}
+	body, _ = ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &touchResp); err != nil || touchResp.Touched != 1 {
+		t.Fatalf("unexpected touch resp: %s, %v", body, err)
+	}
+	touchArgs.TTL = "soon"
+	if r, _ := postData("http://"+apiAddr.ToStr()+"/api/dp/touch", touchArgs); r.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid ttl wasn't rejected: %v", r.StatusCode)
+	}
+}
+
+// Test '/admin/eventloop' endpoint (without a running event loop).
+func TestAdminEventLoop(t *testing.T) {
+	elt := eventloop.EventLoopConfig{
+		Schedules: eventloop.EventLoopSchedules{
+			Expire: eventloop.TaskSchedule{Every: time.Second, MaxConcurrency: 1},
+			Meta:   eventloop.TaskSchedule{Every: time.Second, MaxConcurrency: 1},
+		},
+		SplitCentroidsMax: 10,
+		MergeCentroidsMax: 10,
+	}
+	h := handler{RPCAddrs: rpcAddrs, EventLoop: &elt}
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.eventLoopTuning(w, httptest.NewRequest(method, "/admin/eventloop", strings.NewReader(body)))
+		return w
+	}
+
+	// Partial update.
+	w := do(http.MethodPost, `{"schedules": {"expire": {"every": "5s"}}, "merge_centroids_max": 20}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %v", w.Code)
+	}
+	var changes []string
+	if err := json.Unmarshal(w.Body.Bytes(), &changes); err != nil || len(changes) != 2 {
+		t.Fatalf("unexpected changes: %v (err: %v)", w.Body.String(), err)
+	}
+	if elt.Schedules.Expire.Every != time.Second*5 || elt.Schedules.Expire.MaxConcurrency != 1 ||
+		elt.MergeCentroidsMax != 20 || elt.Schedules.Meta.Every != time.Second {
+		t.Fatalf("unexpected tuning after update: %+v", elt.Tuning())
+	}
+
+	// Invalid.
+	if w := do(http.MethodPost, `{"split_centroids_min": 11}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected bad request, got %v", w.Code)
+	}
+	if w := do(http.MethodPost, `not json`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected bad request, got %v", w.Code)
+	}
+
+	// Get.
+	w = do(http.MethodGet, "")
+	var got eventloop.EventLoopTuning
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got != elt.Tuning() {
+		t.Fatalf("unexpected get response: %v (err: %v)", w.Body.String(), err)
+	}
+}
+
+func TestAdminEventLoopAdaptive(t *testing.T) {
+	h := handler{RPCAddrs: rpcAddrs, EventLoop: &eventloop.EventLoopConfig{}}
+	w := httptest.NewRecorder()
+	h.eventLoopAdaptive(w, httptest.NewRequest(http.MethodGet, "/admin/eventloop/adaptive", nil))
+	var got eventloop.AdaptiveState
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Decisions == nil {
+		t.Fatalf("unexpected get response: %v (err: %v)", w.Body.String(), err)
+	}
+
+	w = httptest.NewRecorder()
+	h.eventLoopAdaptive(w, httptest.NewRequest(http.MethodPost, "/admin/eventloop/adaptive", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected method not allowed, got %v", w.Code)
+	}
+}
+
+// Test '/metrics' endpoint, with requests to other routes.
+func TestMetrics(t *testing.T) {
+	network.Reset()
+	defer network.Reset()
+
+	h := handler{RPCAddrs: rpcAddrs}
+	mux := http.NewServeMux()
+	h.setRoutes(mux)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	putArgs := map[string]interface{}{
+		"namespace": "metrics",
+		"dp":        DP{Vec: []float64{1, 2, 3}, Expires: time.Now().Add(time.Hour)},
+	}
+	if _, err := postData(s.URL+"/api/dp/put", putArgs); err != nil {
+		t.Fatalf("post err (put): %v", err)
+	}
+	if _, err := postData(s.URL+"/api/dp/query", "not an object"); err != nil {
+		t.Fatalf("post err (query): %v", err)
+	}
+
+	r, err := http.Get(s.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("get err: %v", err)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	// Metrics are global, so other tests in this pkg are counted as well.
+	want := []string{
+		`trypo_api_requests_total{route="/api/dp/put",code="200"}`,
+		`trypo_api_requests_total{route="/api/dp/query",code="400"} 1`,
+		`trypo_api_request_duration_seconds_count{route="/api/dp/put"}`,
+		`,namespace="metrics"} 1`, // trypo_datapoints, in any node.
+		`trypo_rpc_calls_total{method="KMeansServer.AddDataPoint"`,
+	}
+	for _, s := range want {
+		if !strings.Contains(string(body), s) {
+			t.Fatalf("metrics don't contain %q:\n%s", s, body)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	network.Reset()
+	defer network.Reset()
+
+	h := handler{RPCAddrs: rpcAddrs}
+	mux := http.NewServeMux()
+	h.setRoutes(mux)
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	putArgs := map[string]interface{}{
+		"namespace": "status",
+		"dp":        DP{Vec: []float64{1, 2, 3}, Expires: time.Now().Add(time.Hour)},
+	}
+	if _, err := postData(s.URL+"/api/dp/put", putArgs); err != nil {
+		t.Fatalf("post err (put): %v", err)
+	}
+
+	r, err := http.Get(s.URL + "/api/status")
+	if err != nil {
+		t.Fatalf("get err: %v", err)
+	}
+	var status cluster.Status
+	if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+		t.Fatalf("unexpected body: %v", err)
+	}
+	if len(status.Nodes) != len(rpcAddrs) || status.Healthy() != len(rpcAddrs) {
+		t.Fatalf("unexpected nodes: %+v", status.Nodes)
+	}
+	if total := status.Namespaces["status"]; total.Nodes != 1 || total.DPs != 1 {
+		t.Fatalf("unexpected namespace total: %+v", total)
+	}
+
+	r, _ = http.Post(s.URL+"/api/status", "application/json", nil)
+	if r.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status for POST: %v", r.StatusCode)
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	network.Reset()
+	defer network.Reset()
+
+	// No token, no routes.
+	mux := http.NewServeMux()
+	(&handler{RPCAddrs: rpcAddrs}).setRoutes(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/admin/split", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("admin route without a token: %v", w.Code)
+	}
+
+	h := handler{RPCAddrs: rpcAddrs, EventLoop: &eventloop.EventLoopConfig{}, AdminToken: "s3cret"}
+	mux = http.NewServeMux()
+	h.setRoutes(mux)
+	do := func(route, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, route, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if w := do("/api/admin/expire", token, `{"namespace":"maint"}`); w.Code != http.StatusUnauthorized {
+			t.Fatalf("unexpected status for token %q: %v", token, w.Code)
+		}
+		if w := do("/admin/eventloop", token, `{}`); w.Code != http.StatusUnauthorized {
+			t.Fatalf("eventloop route wasn't protected for token %q: %v", token, w.Code)
+		}
+	}
+	bad := []string{
+		`{}`,
+		`{"namespace":"maint","node":"localhost:1"}`,
+		`{"namespace":"maint","min":3,"max":1}`,
+	}
+	for _, body := range bad {
+		if w := do("/api/admin/split", "s3cret", body); w.Code != http.StatusBadRequest {
+			t.Fatalf("unexpected status for %s: %v", body, w.Code)
+		}
+	}
+	if w := do("/api/admin/distribute", "s3cret", `{"namespace":"maint","mode":"x"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status for a bad mode: %v", w.Code)
+	}
+
+	node := rpcAddrs[0].ToStr()
+	for i := 0; i < 4; i++ {
+		dp := rpc.DataPoint{Vec: []float64{float64(i), 1}, Expires: time.Now().Add(time.Hour)}
+		rpc.KMeansClient(node, "maint", nil).AddDataPoint(dp)
+	}
+	results := func(w *httptest.ResponseRecorder) []maintenanceResult {
+		var res []maintenanceResult
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &res) != nil {
+			t.Fatalf("unexpected reply: %v %s", w.Code, w.Body)
+		}
+		return res
+	}
+
+	res := results(do("/api/admin/split", "s3cret", `{"namespace":"maint","min":1,"max":10}`))
+	if len(res) != 1 || res[0].Node != node || res[0].DPsBefore != 4 || res[0].DPsAfter != 4 ||
+		res[0].CentroidsBefore != 1 || res[0].CentroidsAfter != 2 || res[0].Error != "" {
+		t.Fatalf("unexpected split result: %+v", res)
+	}
+
+	to := rpcAddrs[1].ToStr()
+	res = results(do("/api/admin/rebalance", "s3cret",
+		`{"namespace":"maint","node":"`+to+`","from":"`+node+`","n":10}`))
+	if len(res) != 1 || res[0].Node != to || res[0].Moved == 0 || res[0].DPsAfter != res[0].Moved {
+		t.Fatalf("unexpected rebalance result: %+v", res)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	network.Reset()
+	defer network.Reset()
+
+	h := handler{RPCAddrs: rpcAddrs, Keys: []APIKey{
+		{Token: "reader", Read: []string{"*"}},
+		{Token: "writer", Read: []string{"keys"}, Write: []string{"keys"}},
+	}}
+	mux := http.NewServeMux()
+	h.setRoutes(mux)
+	// GET if there's no body.
+	do := func(route, token, body string) int {
+		method := http.MethodPost
+		if body == "" {
+			method = http.MethodGet
+		}
+		r := httptest.NewRequest(method, route, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	put := `{"namespace":"keys","dp":{"vec":[1,2],"expires":"2100-01-01T00:00:00Z"}}`
+	query := `{"namespace":"keys","queryVec":[1,2],"n":1}`
+	drain := `{"namespace":"keys","queryVec":[1,2],"n":1,"drain":true}`
+	tests := []struct {
+		route, token, body string
+		want               int
+	}{
+		{"/api/dp/put", "", put, http.StatusUnauthorized},
+		{"/api/dp/put", "nope", put, http.StatusUnauthorized},
+		{"/api/dp/put", "reader", put, http.StatusForbidden},
+		{"/api/dp/put", "writer", put, http.StatusOK},
+		{"/api/dp/put", "writer", strings.Replace(put, `"keys"`, `"other"`, 1), http.StatusForbidden},
+		{"/api/dp/query", "", query, http.StatusUnauthorized},
+		{"/api/dp/query", "reader", query, http.StatusOK},
+		{"/api/dp/query", "reader", drain, http.StatusForbidden},
+		{"/api/dp/query", "writer", drain, http.StatusOK},
+		{"/api/dp/touch", "reader", query, http.StatusForbidden},
+		{"/api/dp/touch", "writer", query, http.StatusOK},
+		{"/api/status", "", "", http.StatusUnauthorized},
+		{"/api/status", "reader", "", http.StatusOK},
+		{"/metrics", "", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		if got := do(test.route, test.token, test.body); got != test.want {
+			t.Fatalf("%v with %q: got %v, want %v", test.route, test.token, got, test.want)
+		}
+	}
+
+	if _, err := NewServer(APIConfig{RPCAddrs: rpcAddrs, Keys: []APIKey{{Read: []string{"*"}}}}); err == nil {
+		t.Fatalf("expected an error for an empty token")
+	}
+}
+
+func TestTLS(t *testing.T) {
+	files, err := tlsutils.SelfSigned(t.TempDir(), "localhost")
+	if err != nil {
+		t.Fatalf("failed to generate certs: %v", err)
+	}
+	files.ClientAuth = true
+	addr := Addr{IP: "localhost", Port: "3024"}
+	s, err := NewServer(APIConfig{Addr: addr, RPCAddrs: rpcAddrs, TLS: files})
+	if err != nil {
+		t.Fatalf("failed to set up server: %v", err)
+	}
+	go ListenAndServe(s)
+	defer s.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	tlsConfig, _ := files.ClientConfig()
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	r, err := client.Get("https://" + addr.ToStr() + "/api/status")
+	if err != nil || r.StatusCode != http.StatusOK {
+		t.Fatalf("https request failed: %v", err)
+	}
+	r.Body.Close()
+
+	if r, err := http.Get("http://" + addr.ToStr() + "/api/status"); err == nil && r.StatusCode == http.StatusOK {
+		t.Fatalf("plain http request succeeded")
+	}
+	tlsConfig.Certificates = nil
+	client = http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	if _, err := client.Get("https://" + addr.ToStr() + "/api/status"); err == nil {
+		t.Fatalf("request without a client certificate succeeded")
+	}
+
+	if _, err := NewServer(APIConfig{RPCAddrs: rpcAddrs, TLS: tlsutils.Files{Cert: "x"}}); err == nil {
+		t.Fatalf("expected an error for a partial TLS config")
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	network.Reset()
+	defer network.Reset()
+	for _, addr := range rpcAddrs {
+		network.Nodes[addr].KMeansServer.Quotas = rpc.Quotas{"full": {MaxDPs: 1}}
+	}
+	defer func() {
+		for _, addr := range rpcAddrs {
+			network.Nodes[addr].KMeansServer.Quotas = nil
+		}
+	}()
+
+	h := handler{RPCAddrs: rpcAddrs, Quotas: rpc.Quotas{
+		"slow": {WriteRate: 1, QueryRate: 1},
+	}}
+	mux := http.NewServeMux()
+	h.setRoutes(mux)
+	do := func(route, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, route, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	put := `{"namespace":"slow","dp":{"vec":[1,2],"expires":"2100-01-01T00:00:00Z"}}`
+	query := `{"namespace":"slow","queryVec":[1,2],"n":1}`
+	for _, body := range []string{put, query} {
+		route := "/api/dp/put"
+		if body == query {
+			route = "/api/dp/query"
+		}
+		if w := do(route, body); w.Code != http.StatusOK {
+			t.Fatalf("first request to %v failed: %v", route, w.Code)
+		}
+		w := do(route, body)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Fatalf("second request to %v wasn't limited: %v", route, w.Code)
+		}
+	}
+	// Other namespaces aren't limited.
+	other := strings.Replace(put, `"slow"`, `"fast"`, 1)
+	for i := 0; i < 3; i++ {
+		if w := do("/api/dp/put", other); w.Code != http.StatusOK {
+			t.Fatalf("unlimited put failed: %v", w.Code)
+		}
+	}
+
+	// Every node has room for one dp.
+	full := strings.Replace(put, `"slow"`, `"full"`, 1)
+	for i := 0; i < len(rpcAddrs); i++ {
+		do("/api/dp/put", full)
+	}
+	if w := do("/api/dp/put", full); w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("put over node quotas: got %v", w.Code)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	now := time.Now()
+	// Bursts up to a second worth of tokens.
+	for i := 0; i < 2; i++ {
+		if !l.allow("k", 2, now) {
+			t.Fatalf("request %v in burst wasn't allowed", i)
+		}
+	}
+	if l.allow("k", 2, now) {
+		t.Fatalf("request over burst was allowed")
+	}
+	if !l.allow("k", 2, now.Add(time.Millisecond*500)) {
+		t.Fatalf("request after refill wasn't allowed")
+	}
+	// At least one token for low rates.
+	if !l.allow("low", 0.1, now) || l.allow("low", 0.1, now.Add(time.Second)) {
+		t.Fatalf("unexpected low rate limiting")
+	}
 }
 
 func TestCleanup(t *testing.T) {
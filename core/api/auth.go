@@ -0,0 +1,108 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// APIKey is a bearer token for the data routes, with the namespaces it may
+// be used for. "*" means all namespaces. See APIConfig.Keys.
+type APIKey struct {
+	Token string `json:"token"`
+	// Namespaces that can be queried.
+	Read []string `json:"read"`
+	// Namespaces that can be added to, or drained (with 'drain' in a query,
+	// which also requires Read).
+	Write []string `json:"write"`
+}
+
+// scope is an access type for a namespace, i.e read or write.
+type scope int
+
+const (
+	scopeRead scope = iota
+	scopeWrite
+)
+
+// allows returns true if the key has scope 's' for 'namespace'.
+func (k *APIKey) allows(s scope, namespace string) bool {
+	namespaces := k.Read
+	if s == scopeWrite {
+		namespaces = k.Write
+	}
+	for _, ns := range namespaces {
+		if ns == "*" || ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token in the header 'Authorization: Bearer <token>'.
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// tokenEqual compares tokens in constant time.
+func tokenEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// unauthorized replies with a 401 status.
+func unauthorized(w http.ResponseWriter, realm string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// requireToken wraps an admin handler such that requests must have the
+// header 'Authorization: Bearer <token>'.
+func requireToken(token string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tokenEqual(bearerToken(r), token) {
+			unauthorized(w, "trypo admin")
+			return
+		}
+		f(w, r)
+	}
+}
+
+// authorize checks that the request has an API key (see APIConfig.Keys)
+// with all 'scopes' for 'namespace', any key is enough if there are no
+// scopes. Replies with a 401 status if there's no such key, or a 403 if the
+// key doesn't have the scopes, and returns false. Always returns true if no
+// keys are configured.
+func (h *handler) authorize(w http.ResponseWriter, r *http.Request, namespace string, scopes ...scope) bool {
+	if len(h.Keys) == 0 {
+		return true
+	}
+	token := bearerToken(r)
+	var key *APIKey
+	for i := range h.Keys {
+		// No early return, such that the time doesn't depend on the match.
+		if tokenEqual(token, h.Keys[i].Token) {
+			key = &h.Keys[i]
+		}
+	}
+	if key == nil {
+		unauthorized(w, "trypo")
+		return false
+	}
+	for _, s := range scopes {
+		if !key.allows(s, namespace) {
+			http.Error(w, "forbidden for namespace "+namespace, http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// requireKey wraps a handler such that requests must have an API key (any
+// scope), if keys are configured. See handler.authorize.
+func (h *handler) requireKey(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.authorize(w, r, "") {
+			f(w, r)
+		}
+	}
+}
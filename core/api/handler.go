@@ -2,11 +2,15 @@ package api
 
 import (
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 	"trypo/core/dps"
+	"trypo/core/eventloop"
 	"trypo/pkg/kmeans/common"
+	"trypo/pkg/kmeans/rpc"
+	"trypo/pkg/logging"
+	"trypo/pkg/metrics"
 	"trypo/pkg/searchutils"
 )
 
@@ -16,16 +20,44 @@ type handler struct {
 	// approximate nearest neighs search). Should contain addr for the local rpc
 	// instance, not to be confused with the Addr (port) used for the API.
 	RPCAddrs []Addr
+	// Optional, see APIConfig.EventLoop.
+	EventLoop *eventloop.EventLoopConfig
+	// Optional, see APIConfig.AdminToken.
+	AdminToken string
+	// Optional, see APIConfig.Keys.
+	Keys []APIKey
+	// Optional, see APIConfig.Quotas.
+	Quotas  rpc.Quotas
+	limiter rateLimiter
 }
 
-func (h *handler) setRoutes() {
+func (h *handler) setRoutes(mux *http.ServeMux) {
 	routes := map[string]func(http.ResponseWriter, *http.Request){
 		"/api/dp/put":   h.putDataPoint,
 		"/api/dp/query": h.queryDataPoint,
+		"/api/dp/touch": h.touchDataPoint,
+		"/api/status":   h.requireKey(h.status),
+		"/metrics":      metrics.Default.Handler().ServeHTTP,
+	}
+	admin := make(map[string]func(http.ResponseWriter, *http.Request))
+	if h.EventLoop != nil {
+		admin["/admin/eventloop"] = h.eventLoopTuning
+		admin["/admin/eventloop/adaptive"] = h.eventLoopAdaptive
+	}
+	if h.AdminToken != "" {
+		for name, op := range maintenanceOps {
+			admin["/api/admin/"+name] = h.maintenance(op)
+		}
+	}
+	for k, v := range admin {
+		if h.AdminToken != "" {
+			v = requireToken(h.AdminToken, v)
+		}
+		routes[k] = v
 	}
 	for k, v := range routes {
-		http.Handle(k, http.HandlerFunc(v))
-		fmt.Printf("route '%v' is up.\n", k)
+		mux.Handle(k, instrument(k, v))
+		logging.Default().Debug("route is up", logging.F("route", k))
 	}
 }
 
@@ -58,13 +90,21 @@ func (h *handler) putDataPoint(w http.ResponseWriter, r *http.Request) {
 	if !h.tryUnpackRequestOptions(w, r, &opts) {
 		return
 	}
+	if !h.authorize(w, r, opts.Namespace, scopeWrite) {
+		return
+	}
+	if !h.limitRate(w, opts.Namespace, limitWrite) {
+		return
+	}
 
 	// pass to dps pkg.
+	var putErr error
 	args := dps.PutDataPointArgs{
 		AddrOptions:   h.RPCAddrs,
 		Namespace:     opts.Namespace,
 		DataPoint:     opts.DP.toDataPoint(),
 		KNNSearchFunc: searchutils.KNNCos,
+		Err:           &putErr,
 	}
 
 	putOk := false
@@ -81,10 +121,13 @@ func (h *handler) putDataPoint(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// reply.
-	switch putOk {
-	case true:
+	switch {
+	case putOk:
 		w.WriteHeader(http.StatusOK)
-	case false:
+	case rpc.IsQuotaErr(putErr):
+		// All nodes that were tried are full.
+		http.Error(w, "quota exceeded for namespace "+opts.Namespace, http.StatusInsufficientStorage)
+	default:
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 }
@@ -103,6 +146,17 @@ func (h *handler) queryDataPoint(w http.ResponseWriter, r *http.Request) {
 	if !h.tryUnpackRequestOptions(w, r, &opts) {
 		return
 	}
+	// Draining removes data, so it's a write as well.
+	scopes := []scope{scopeRead}
+	if opts.Drain {
+		scopes = append(scopes, scopeWrite)
+	}
+	if !h.authorize(w, r, opts.Namespace, scopes...) {
+		return
+	}
+	if !h.limitRate(w, opts.Namespace, limitQuery) {
+		return
+	}
 
 	// pass to dps pkg.
 	args := dps.GetDataPointsArgs{
@@ -132,3 +186,60 @@ func (h *handler) queryDataPoint(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write(b)
 }
+
+// Pass request to dps.TouchDataPointsX (core/dps/touchdps.go).
+func (h *handler) touchDataPoint(w http.ResponseWriter, r *http.Request) {
+	opts := struct {
+		Namespace string    `json:"namespace"`
+		Accurate  bool      `json:"accurate"`
+		QueryVec  []float64 `json:"queryVec"`
+		N         int       `json:"n"`
+		// Duration (e.g "1h"), empty means the default of the namespace.
+		TTL string `json:"ttl"`
+	}{}
+
+	// opts unpack.
+	if !h.tryUnpackRequestOptions(w, r, &opts) {
+		return
+	}
+	var ttl time.Duration
+	if opts.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(opts.TTL); err != nil || ttl < 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+	// Changes expiry, so it's a write.
+	if !h.authorize(w, r, opts.Namespace, scopeWrite) {
+		return
+	}
+	if !h.limitRate(w, opts.Namespace, limitWrite) {
+		return
+	}
+
+	// pass to dps pkg.
+	args := dps.TouchDataPointsArgs{
+		AddrOptions:   h.RPCAddrs,
+		Namespace:     opts.Namespace,
+		QueryVec:      opts.QueryVec,
+		N:             opts.N,
+		TTL:           ttl,
+		KNNSearchFunc: searchutils.KNNCos,
+	}
+
+	var n int
+	switch opts.Accurate {
+	case true:
+		n = dps.TouchDataPointsAccurate(args)
+	case false:
+		n = dps.TouchDataPointsFast(args)
+	}
+
+	// reply.
+	b, _ := json.Marshal(struct {
+		Touched int `json:"touched"`
+	}{n})
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
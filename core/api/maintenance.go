@@ -0,0 +1,261 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"trypo/pkg/kmeans/rpc"
+)
+
+// maintenanceReq is the JSON body for the '/api/admin/*' maintenance routes.
+// Which of the optional fields are used depends on the route.
+type maintenanceReq struct {
+	Namespace string `json:"namespace"`
+	// RPC address of the node to run in. Empty means all nodes (in RPCAddrs)
+	// that have the namespace.
+	Node string `json:"node"`
+	// Centroid size range for split and merge, see kmeansClient.SplitCentroids.
+	// Defaults to the event loop tuning, if APIConfig.EventLoop is set.
+	Min *int `json:"min"`
+	Max *int `json:"max"`
+	// Amount of datapoints for distribute and rebalance. Defaults to the event
+	// loop tuning for distribute.
+	N *int `json:"n"`
+	// "fast", "accurate" or "internal", for distribute.
+	Mode string `json:"mode"`
+	// RPC address of the node that centroids are taken from, for rebalance.
+	From string `json:"from"`
+}
+
+// maintenanceResult is what changed in a node for a maintenance route.
+type maintenanceResult struct {
+	Node            string `json:"node"`
+	DPsBefore       int    `json:"dps_before"`
+	DPsAfter        int    `json:"dps_after"`
+	CentroidsBefore int    `json:"centroids_before"`
+	CentroidsAfter  int    `json:"centroids_after"`
+	// Datapoints moved to other nodes (distribute fast/accurate) or to this
+	// node (rebalance).
+	Moved int    `json:"moved"`
+	Error string `json:"error,omitempty"`
+}
+
+// maintenanceOp is a maintenance route. 'prepare' validates the request and
+// sets defaults, 'run' calls the node at 'addr', where 'peers' are all nodes
+// with the namespace. Returns the amount of datapoints moved, if known.
+type maintenanceOp struct {
+	prepare func(h *handler, req *maintenanceReq) error
+	run     func(addr string, req *maintenanceReq, peers []string, err *error) int
+}
+
+// orTuning sets '*v' to 'def' if it's nil, or fails if there's no event loop
+// to take 'def' from.
+func (h *handler) orTuning(v **int, name string, def func() int) error {
+	if *v != nil {
+		return nil
+	}
+	if h.EventLoop == nil {
+		return errors.New(name + " is required")
+	}
+	d := def()
+	*v = &d
+	return nil
+}
+
+func (h *handler) rangeOrTuning(req *maintenanceReq, min, max func() int) error {
+	if err := h.orTuning(&req.Min, "min", min); err != nil {
+		return err
+	}
+	if err := h.orTuning(&req.Max, "max", max); err != nil {
+		return err
+	}
+	if *req.Min > *req.Max {
+		return errors.New("min must be <= max")
+	}
+	return nil
+}
+
+// Maintenance routes, by the last part of '/api/admin/<name>'.
+var maintenanceOps = map[string]maintenanceOp{
+	"split": {
+		prepare: func(h *handler, req *maintenanceReq) error {
+			return h.rangeOrTuning(req,
+				func() int { return h.EventLoop.Tuning().SplitCentroidsMin },
+				func() int { return h.EventLoop.Tuning().SplitCentroidsMax })
+		},
+		run: func(addr string, req *maintenanceReq, _ []string, err *error) int {
+			rpc.KMeansClient(addr, req.Namespace, err).SplitCentroids(*req.Min, *req.Max)
+			return 0
+		},
+	},
+	"merge": {
+		prepare: func(h *handler, req *maintenanceReq) error {
+			return h.rangeOrTuning(req,
+				func() int { return h.EventLoop.Tuning().MergeCentroidsMin },
+				func() int { return h.EventLoop.Tuning().MergeCentroidsMax })
+		},
+		run: func(addr string, req *maintenanceReq, _ []string, err *error) int {
+			rpc.KMeansClient(addr, req.Namespace, err).MergeCentroids(*req.Min, *req.Max)
+			return 0
+		},
+	},
+	"expire": {
+		run: func(addr string, req *maintenanceReq, _ []string, err *error) int {
+			rpc.KMeansClient(addr, req.Namespace, err).Expire()
+			return 0
+		},
+	},
+	"memtrim": {
+		run: func(addr string, req *maintenanceReq, _ []string, err *error) int {
+			rpc.KMeansClient(addr, req.Namespace, err).MemTrim()
+			return 0
+		},
+	},
+	"distribute": {
+		prepare: func(h *handler, req *maintenanceReq) error {
+			var def func() int
+			switch req.Mode {
+			case "fast":
+				def = func() int { return h.EventLoop.Tuning().DistributeDataPointsFastN }
+			case "accurate":
+				def = func() int { return h.EventLoop.Tuning().DistributeDataPointsAccurateN }
+			case "internal":
+				def = func() int { return h.EventLoop.Tuning().DistributeDataPointsInternalN }
+			default:
+				return errors.New(`mode must be "fast", "accurate" or "internal"`)
+			}
+			if err := h.orTuning(&req.N, "n", def); err != nil {
+				return err
+			}
+			if *req.N <= 0 {
+				return errors.New("n must be > 0")
+			}
+			return nil
+		},
+		run: func(addr string, req *maintenanceReq, peers []string, err *error) int {
+			client := rpc.KMeansClient(addr, req.Namespace, err)
+			switch req.Mode {
+			case "fast":
+				client.DistributeDataPointsFast(peers, *req.N)
+			case "accurate":
+				client.DistributeDataPointsAccurate(peers, *req.N)
+			case "internal":
+				// Within the node, so nothing is moved to other nodes.
+				client.DistributeDataPointsInternal(*req.N)
+			}
+			return 0
+		},
+	},
+	"rebalance": {
+		prepare: func(h *handler, req *maintenanceReq) error {
+			if req.Node == "" || req.From == "" {
+				return errors.New("node and from are required")
+			}
+			if req.Node == req.From {
+				return errors.New("node and from must differ")
+			}
+			if !h.isRPCAddr(req.From) {
+				return errors.New("from is not a known node")
+			}
+			if req.N == nil || *req.N <= 0 {
+				return errors.New("n must be > 0")
+			}
+			return nil
+		},
+		run: func(addr string, req *maintenanceReq, _ []string, err *error) int {
+			var clientErr error
+			n, ok := rpc.KMeansClient(addr, req.Namespace, &clientErr).StealCentroids(req.From, *req.N)
+			if clientErr == nil && !ok {
+				clientErr = errors.New("transfer failed (namespace or network issue)")
+			}
+			*err = clientErr
+			return n
+		},
+	},
+}
+
+// isRPCAddr returns true if 'addr' is in RPCAddrs.
+func (h *handler) isRPCAddr(addr string) bool {
+	for _, a := range h.RPCAddrs {
+		if a.ToStr() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Handles '/api/admin/<name>' for a maintenance op. Takes a POST with a
+// maintenanceReq, runs the op in the node(s) right away (i.e regardless of
+// the event loop schedules) and replies with a JSON list of
+// maintenanceResult, one per node. Replies with a plain-text error and a
+// bad request status if the request is invalid.
+func (h *handler) maintenance(op maintenanceOp) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req maintenanceReq
+		if !h.tryUnpackRequestOptions(w, r, &req) {
+			return
+		}
+		if req.Namespace == "" {
+			http.Error(w, "namespace is required", http.StatusBadRequest)
+			return
+		}
+		if req.Node != "" && !h.isRPCAddr(req.Node) {
+			http.Error(w, "node is not a known node", http.StatusBadRequest)
+			return
+		}
+		if op.prepare != nil {
+			if err := op.prepare(h, &req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Nodes with the namespace, and their state before the op.
+		before := make(map[string]rpc.MetaResp)
+		var peers []string
+		for _, addr := range h.RPCAddrs {
+			var err error
+			meta := rpc.KMeansClient(addr.ToStr(), "", &err).Meta()
+			if _, ok := meta.DPs[req.Namespace]; err == nil && ok {
+				before[addr.ToStr()] = meta
+				peers = append(peers, addr.ToStr())
+			}
+		}
+		targets := peers
+		if req.Node != "" {
+			targets = []string{req.Node}
+		}
+
+		results := make([]maintenanceResult, 0, len(targets))
+		for _, addr := range targets {
+			res := maintenanceResult{
+				Node:            addr,
+				DPsBefore:       before[addr].DPs[req.Namespace],
+				CentroidsBefore: before[addr].Centroids[req.Namespace],
+			}
+			var err error
+			res.Moved = op.run(addr, &req, peers, &err)
+			if err != nil {
+				res.Error = err.Error()
+			}
+			after := rpc.KMeansClient(addr, "", nil).Meta()
+			res.DPsAfter = after.DPs[req.Namespace]
+			res.CentroidsAfter = after.Centroids[req.Namespace]
+			if req.Mode == "fast" || req.Mode == "accurate" {
+				// Distributed datapoints are drained from this node.
+				if res.Moved = res.DPsBefore - res.DPsAfter; res.Moved < 0 {
+					res.Moved = 0
+				}
+			}
+			results = append(results, res)
+		}
+
+		b, _ := json.Marshal(results)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
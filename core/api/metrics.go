@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"trypo/pkg/logging"
+	"trypo/pkg/metrics"
+)
+
+// Metrics for requests to the API, labelled by route (e.g "/api/dp/put").
+var (
+	apiRequests = metrics.Default.Counter("trypo_api_requests_total",
+		"Requests to the API, by route and status code.", "route", "code")
+	apiLatency = metrics.Default.Histogram("trypo_api_request_duration_seconds",
+		"Duration of requests to the API.", metrics.DefBuckets, "route")
+)
+
+// statusRecorder keeps the status code written to a http.ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// instrument wraps a handler for 'route' such that requests are recorded in
+// the API metrics, and logged (server errors with warn level, others with
+// debug level).
+func instrument(route string, f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		f(&rec, r)
+		d := time.Since(start)
+		apiRequests.Inc(route, strconv.Itoa(rec.code))
+		apiLatency.Observe(d.Seconds(), route)
+
+		level := logging.LevelDebug
+		if rec.code >= http.StatusInternalServerError {
+			level = logging.LevelWarn
+		}
+		logging.Default().Log(level, "request", logging.F("route", route),
+			logging.F("method", r.Method), logging.F("code", rec.code), logging.Duration(d))
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+	"time"
+	"trypo/pkg/kmeans/rpc"
+)
+
+// Limits in rpc.Quota that are enforced by the API, also used as labels for
+// rpc.QuotaRejections.
+const (
+	limitWrite = "write_rate"
+	limitQuery = "query_rate"
+)
+
+// bucket is a token bucket, see rateLimiter.
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// rateLimiter keeps a token bucket for each limit and namespace, which fills
+// up with 'rate' tokens per second and holds up to a second worth of tokens
+// (at least one), such that short bursts are allowed. The zero value is
+// ready to use.
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*bucket
+}
+
+// allow takes a token from the bucket for 'key', returns false if it's empty.
+func (l *rateLimiter) allow(key string, rate float64, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	size := rate
+	if size < 1 {
+		size = 1
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: size, at: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.at).Seconds() * rate
+	if b.tokens > size {
+		b.tokens = size
+	}
+	b.at = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// limitRate checks the write or query rate (see limitWrite and limitQuery) of
+// 'namespace' against its quota (see APIConfig.Quotas). Replies with a 429
+// status and returns false if it's exceeded.
+func (h *handler) limitRate(w http.ResponseWriter, namespace, limit string) bool {
+	quota := h.Quotas.For(namespace)
+	rate := quota.QueryRate
+	if limit == limitWrite {
+		rate = quota.WriteRate
+	}
+	if rate <= 0 || h.limiter.allow(limit+"/"+namespace, rate, time.Now()) {
+		return true
+	}
+	rpc.QuotaRejections.Inc(namespace, limit)
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, limit+" exceeded for namespace "+namespace, http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,23 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+	"trypo/core/cluster"
+)
+
+// How long each node has to reply to a status request.
+const statusTimeout = time.Second * 2
+
+// Handles '/api/status'. GET replies with the status of all nodes in
+// RPCAddrs (see core/cluster.Status) as JSON.
+func (h *handler) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	b, _ := json.Marshal(cluster.Collect(h.RPCAddrs, statusTimeout))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
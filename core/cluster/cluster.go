@@ -0,0 +1,195 @@
+/*
+This pkg collects the status of nodes (pkg/kmeans/rpc) in a network, i.e the
+amounts of data per namespace, how datapoints are spread over centroids and
+whether nodes are reachable at all. It is used by the API (see the
+'/api/status' route in core/api) and by cmd/trypoctl.
+*/
+package cluster
+
+import (
+	"errors"
+	"sort"
+	"time"
+	"trypo/pkg/arbiter"
+	"trypo/pkg/kmeans/rpc"
+)
+
+// Alias for arbiter.Addr.
+type Addr = arbiter.Addr
+
+// SizeDist summarizes the amounts of datapoints in the Centroids of a
+// namespace (in a node or the entire network).
+type SizeDist struct {
+	Min  int     `json:"min"`
+	P50  int     `json:"p50"`
+	P90  int     `json:"p90"`
+	Max  int     `json:"max"`
+	Mean float64 `json:"mean"`
+}
+
+// sizeDist returns the distribution of 'sizes', which must be sorted.
+func sizeDist(sizes []int) SizeDist {
+	if len(sizes) == 0 {
+		return SizeDist{}
+	}
+	sum := 0
+	for _, size := range sizes {
+		sum += size
+	}
+	// Nearest-rank percentiles.
+	rank := func(p float64) int {
+		i := int(p*float64(len(sizes))+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+		return sizes[i]
+	}
+	return SizeDist{
+		Min:  sizes[0],
+		P50:  rank(0.5),
+		P90:  rank(0.9),
+		Max:  sizes[len(sizes)-1],
+		Mean: float64(sum) / float64(len(sizes)),
+	}
+}
+
+// NamespaceStatus is the status of a namespace in a node.
+type NamespaceStatus struct {
+	DPs           int      `json:"dps"`
+	Centroids     int      `json:"centroids"`
+	CentroidSizes SizeDist `json:"centroid_sizes"`
+	// Norm of the namespace vector (the mean of all Centroids).
+	VecNorm float64 `json:"vec_norm"`
+	// Datapoints added since the node started.
+	Inserts int `json:"inserts"`
+	// Moving average of the time spent on KNN lookups in the node.
+	QueryLatency time.Duration `json:"query_latency"`
+}
+
+// NodeStatus is the status of a node. A node is healthy if it replied to
+// the status request (within the timeout given to Collect), Error is the
+// reason if not.
+type NodeStatus struct {
+	Addr    string `json:"addr"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+	// Round-trip time of the status request.
+	Latency time.Duration `json:"latency"`
+	// Keys are namespaces, empty if the node isn't healthy.
+	Namespaces map[string]NamespaceStatus `json:"namespaces"`
+}
+
+// Status is the status of all nodes in a network (ordered by address), with
+// totals for each namespace (keys are namespaces).
+type Status struct {
+	Nodes      []NodeStatus              `json:"nodes"`
+	Namespaces map[string]NamespaceTotal `json:"namespaces"`
+}
+
+// Healthy returns the amount of healthy nodes.
+func (s *Status) Healthy() int {
+	n := 0
+	for _, node := range s.Nodes {
+		if node.Healthy {
+			n++
+		}
+	}
+	return n
+}
+
+// NamespaceTotal is the status of a namespace in all (healthy) nodes.
+type NamespaceTotal struct {
+	// Amount of nodes with the namespace.
+	Nodes         int      `json:"nodes"`
+	DPs           int      `json:"dps"`
+	Centroids     int      `json:"centroids"`
+	CentroidSizes SizeDist `json:"centroid_sizes"`
+}
+
+// Collect fetches the status of all nodes at 'addrs' concurrently. Nodes that
+// don't reply within 'timeout' are reported as unhealthy.
+func Collect(addrs []Addr, timeout time.Duration) Status {
+	type result struct {
+		node  NodeStatus
+		sizes map[string][]int
+	}
+	ch := make(chan result, len(addrs))
+	for _, addr := range addrs {
+		go func(addr Addr) {
+			node, sizes := collectNode(addr, timeout)
+			ch <- result{node, sizes}
+		}(addr)
+	}
+
+	status := Status{
+		Nodes:      make([]NodeStatus, 0, len(addrs)),
+		Namespaces: make(map[string]NamespaceTotal),
+	}
+	// Centroid sizes in all nodes, for the total distributions.
+	sizes := make(map[string][]int)
+	for range addrs {
+		res := <-ch
+		status.Nodes = append(status.Nodes, res.node)
+		for ns, nsStatus := range res.node.Namespaces {
+			total := status.Namespaces[ns]
+			total.Nodes++
+			total.DPs += nsStatus.DPs
+			total.Centroids += nsStatus.Centroids
+			status.Namespaces[ns] = total
+			sizes[ns] = append(sizes[ns], res.sizes[ns]...)
+		}
+	}
+	for ns, nsSizes := range sizes {
+		sort.Ints(nsSizes)
+		total := status.Namespaces[ns]
+		total.CentroidSizes = sizeDist(nsSizes)
+		status.Namespaces[ns] = total
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool {
+		return status.Nodes[i].Addr < status.Nodes[j].Addr
+	})
+	return status
+}
+
+// collectNode returns the status of the node at 'addr', and the sizes of all
+// its Centroids (keys are namespaces).
+func collectNode(addr Addr, timeout time.Duration) (NodeStatus, map[string][]int) {
+	type result struct {
+		meta rpc.MetaResp
+		err  error
+	}
+	// Buffered, such that the call can finish after a timeout.
+	ch := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		var err error
+		meta := rpc.KMeansClient(addr.ToStr(), "", &err).Meta()
+		ch <- result{meta, err}
+	}()
+
+	node := NodeStatus{Addr: addr.ToStr(), Namespaces: make(map[string]NamespaceStatus)}
+	var res result
+	select {
+	case res = <-ch:
+	case <-time.After(timeout):
+		res.err = errors.New("timed out")
+	}
+	node.Latency = time.Since(start)
+	if res.err != nil {
+		node.Error = res.err.Error()
+		return node, nil
+	}
+
+	node.Healthy = true
+	for ns, dps := range res.meta.DPs {
+		node.Namespaces[ns] = NamespaceStatus{
+			DPs:           dps,
+			Centroids:     res.meta.Centroids[ns],
+			CentroidSizes: sizeDist(res.meta.CentroidSizes[ns]),
+			VecNorm:       res.meta.VecNorm[ns],
+			Inserts:       res.meta.Inserts[ns],
+			QueryLatency:  res.meta.QueryLatency[ns],
+		}
+	}
+	return node, res.meta.CentroidSizes
+}
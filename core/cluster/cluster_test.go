@@ -0,0 +1,62 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+	"trypo/core/testutils"
+	"trypo/pkg/kmeans/common"
+	"trypo/pkg/kmeans/rpc"
+)
+
+var addrs = []Addr{
+	{IP: "localhost", Port: "3070"},
+	{IP: "localhost", Port: "3071"},
+}
+
+// Nothing listens here.
+var unreachable = Addr{IP: "localhost", Port: "3079"}
+
+func TestSizeDist(t *testing.T) {
+	d := sizeDist([]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+	if d != (SizeDist{Min: 1, P50: 5, P90: 9, Max: 10, Mean: 5.5}) {
+		t.Fatalf("unexpected dist: %+v", d)
+	}
+	if d := sizeDist([]int{4}); d != (SizeDist{Min: 4, P50: 4, P90: 4, Max: 4, Mean: 4}) {
+		t.Fatalf("unexpected dist for one centroid: %+v", d)
+	}
+	if d := sizeDist(nil); d != (SizeDist{}) {
+		t.Fatalf("unexpected dist for no centroids: %+v", d)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	network := testutils.NewTNetwork(addrs)
+	defer network.Stop()
+
+	for i, addr := range addrs {
+		for j := 0; j <= i; j++ {
+			dp := common.DataPoint{Vec: []float64{3, 4}}
+			rpc.KMeansClient(addr.ToStr(), "a", nil).AddDataPoint(dp)
+		}
+	}
+
+	status := Collect(append([]Addr{unreachable}, addrs...), time.Second)
+	if len(status.Nodes) != 3 || status.Healthy() != 2 {
+		t.Fatalf("unexpected nodes: %+v", status.Nodes)
+	}
+	// Ordered by addr.
+	bad, node := status.Nodes[2], status.Nodes[1]
+	if bad.Addr != unreachable.ToStr() || bad.Healthy || bad.Error == "" {
+		t.Fatalf("unreachable node wasn't reported: %+v", bad)
+	}
+	ns := node.Namespaces["a"]
+	if node.Addr != addrs[1].ToStr() || ns.DPs != 2 || ns.Centroids != 1 ||
+		ns.CentroidSizes.Max != 2 || ns.VecNorm != 5 || ns.Inserts != 2 {
+		t.Fatalf("unexpected node status: %+v", node)
+	}
+	total := status.Namespaces["a"]
+	if total.Nodes != 2 || total.DPs != 3 || total.Centroids != 2 ||
+		total.CentroidSizes != (SizeDist{Min: 1, P50: 1, P90: 2, Max: 2, Mean: 1.5}) {
+		t.Fatalf("unexpected total: %+v", total)
+	}
+}
@@ -11,7 +11,7 @@ package dps
 
 import (
 	"math/rand"
-	"time"
+	"sync"
 	"trypo/pkg/arbiter"
 	"trypo/pkg/kmeans/common"
 )
@@ -22,13 +22,33 @@ type DataPoint = common.DataPoint
 type vecGenerator = func() ([]float64, bool)
 type knnSearchFunc = func(targetVec []float64, vecs vecGenerator, k int) []int
 
+// Random source for shuffleAddrs, see SetRand.
+var rnd struct {
+	sync.Mutex
+	r *rand.Rand
+}
+
+// SetRand sets the random source used for picking nodes in this pkg (e.g
+// the random variants of adding datapoints), such that it can be seeded for
+// reproducible runs. Nil means the global source in math/rand (the default).
+func SetRand(r *rand.Rand) {
+	rnd.Lock()
+	defer rnd.Unlock()
+	rnd.r = r
+}
+
 func shuffleAddrs(addrs []Addr) []Addr {
 	res := make([]Addr, len(addrs))
 	copy(res, addrs)
 
+	rnd.Lock()
+	defer rnd.Unlock()
+	intn := rand.Intn
+	if rnd.r != nil {
+		intn = rnd.r.Intn
+	}
 	for i := 0; i < len(addrs); i++ {
-		rand.Seed(time.Now().UnixNano())
-		j := rand.Intn(len(addrs))
+		j := intn(len(addrs))
 		res[i], res[j] = res[j], res[i]
 	}
 	return res
@@ -12,9 +12,9 @@ import (
 )
 
 var addrs = []Addr{
-	{"localhost", "3000"},
-	{"localhost", "3001"},
-	{"localhost", "3002"},
+	{"localhost", "3040"},
+	{"localhost", "3041"},
+	{"localhost", "3042"},
 }
 var namespace = "test"
 var network = testutils.NewTNetwork(addrs)
@@ -301,6 +301,92 @@ func TestPutDataPointsAccurate(t *testing.T) {
 	}
 }
 
+func TestTouchDataPointsFast(t *testing.T) {
+	network.Reset()
+	defer network.Reset()
+
+	// Expiring dps, one in each node.
+	addrsVecs := map[Addr][]float64{
+		addrs[0]: vec(1, 1),
+		addrs[1]: vec(1, 2),
+		addrs[2]: vec(1, 3),
+	}
+	for addr, v := range addrsVecs {
+		client := rpc.KMeansClient(addr.ToStr(), namespace, nil)
+		dp := common.DataPoint{Vec: v, Expires: time.Now().Add(time.Hour), ExpireEnabled: true}
+		if !client.AddDataPoint(dp) {
+			t.Fatalf("unexpected 'not ok' for %v", addr.ToStr())
+		}
+	}
+
+	n := TouchDataPointsFast(TouchDataPointsArgs{
+		AddrOptions:   addrs,
+		Namespace:     namespace,
+		QueryVec:      vec(1, 2),
+		N:             1,
+		TTL:           time.Hour * 2,
+		KNNSearchFunc: searchutils.KNNCos,
+	})
+	if n != 1 {
+		t.Fatalf("want 1 touched dp, got %v", n)
+	}
+	for addr := range addrsVecs {
+		dp := network.UnwrapCM(addr, namespace).Centroids[0].DataPoints[0]
+		touched := time.Until(dp.Expires) > time.Hour
+		if touched != (addr == addrs[1]) {
+			t.Fatalf("unexpected expiry in %v: %v", addr.ToStr(), dp.Expires)
+		}
+	}
+}
+
+func TestDataPointsFaults(t *testing.T) {
+	network.Reset()
+	defer network.Reset()
+	for _, addr := range addrs {
+		network.Nodes[addr].KMeansServer.MigrationLease = time.Millisecond * 50
+		defer func(addr Addr) { network.Nodes[addr].KMeansServer.MigrationLease = 0 }(addr)
+	}
+
+	for i, addr := range addrs {
+		client := rpc.KMeansClient(addr.ToStr(), namespace, nil)
+		if !client.AddDataPoint(dp(vec(1, float64(i+1)), 0)) {
+			t.Fatalf("unexpected 'not ok' for %v", addr.ToStr())
+		}
+	}
+	lenDP := func() int { return len(network.DataPoints(namespace)) }
+
+	// The best fit is unreachable, so the dp goes to the next best.
+	network.Partition(addrs[2])
+	ok := PutDataPointFast(PutDataPointArgs{
+		AddrOptions:   addrs,
+		Namespace:     namespace,
+		DataPoint:     dp(vec(1, 3), 0),
+		KNNSearchFunc: searchutils.KNNCos,
+	})
+	if !ok || network.UnwrapCM(addrs[1], namespace).LenDP() != 2 {
+		t.Fatalf("dp wasn't put in the next best node")
+	}
+	network.Heal()
+
+	// Drained dps are put back if the response doesn't arrive.
+	network.SetFault(addrs[2], "KMeansServer.ReserveKNN", testutils.Fault{DropRate: 1})
+	dps := GetDataPointsFast(GetDataPointsArgs{
+		AddrOptions:   addrs[2:],
+		Namespace:     namespace,
+		QueryVec:      vec(1, 3),
+		N:             1,
+		Drain:         true,
+		KNNSearchFunc: searchutils.KNNCos,
+	})
+	if len(dps) != 0 || lenDP() != 3 {
+		t.Fatalf("unexpected drain: %v, %v left", dps, lenDP())
+	}
+	time.Sleep(time.Millisecond * 150)
+	if lenDP() != 4 {
+		t.Fatalf("dp was lost: %v left", lenDP())
+	}
+}
+
 func TestCleanup(t *testing.T) {
 	network.Stop()
 }
@@ -18,6 +18,10 @@ type PutDataPointArgs struct {
 
 	// KNNsearchFunc is used to find best-fit nodes to put dps in.
 	KNNSearchFunc knnSearchFunc
+
+	// Err is optional. If the dp isn't put anywhere, it is set to the error
+	// from the last node that was tried (e.g an rpc.QuotaErr), if any.
+	Err *error
 }
 
 func (a *PutDataPointArgs) toBestFitNodesArgs() nodes.BestFitNodesArgs {
@@ -29,13 +33,17 @@ func (a *PutDataPointArgs) toBestFitNodesArgs() nodes.BestFitNodesArgs {
 	}
 }
 
-func putDataPoint(addrOpt []Addr, namespace string, dp DataPoint) bool {
+func putDataPoint(addrOpt []Addr, namespace string, dp DataPoint, errp *error) bool {
 	for _, addr := range addrOpt {
-		client := rpc.KMeansClient(addr.ToStr(), namespace, nil)
+		var err error
+		client := rpc.KMeansClient(addr.ToStr(), namespace, &err)
 		ok := client.AddDataPoint(dp)
 		if ok {
 			return true
 		}
+		if errp != nil && err != nil {
+			*errp = err
+		}
 	}
 	return false
 }
@@ -43,7 +51,7 @@ func putDataPoint(addrOpt []Addr, namespace string, dp DataPoint) bool {
 // PutDataPointRand will put a dp in a random node.
 func PutDataPointRand(args PutDataPointArgs) bool {
 	addrs := shuffleAddrs(args.AddrOptions)
-	return putDataPoint(addrs, args.Namespace, args.DataPoint)
+	return putDataPoint(addrs, args.Namespace, args.DataPoint, args.Err)
 }
 
 // PutDataPointFast will put a dp in a remote node with haste and some accuracy.
@@ -51,12 +59,12 @@ func PutDataPointRand(args PutDataPointArgs) bool {
 // core/nodes.BestFitNodesFast(...).
 func PutDataPointFast(args PutDataPointArgs) bool {
 	addrs := nodes.BestFitNodesFast(args.toBestFitNodesArgs())
-	return putDataPoint(addrs, args.Namespace, args.DataPoint)
+	return putDataPoint(addrs, args.Namespace, args.DataPoint, args.Err)
 }
 
 // PutDataPointAccurate is similar to PutDataPointFast but differs by finding
 // 'best-fit' nodes with core/nodes.BestFitNodesAccurate(..).
 func PutDataPointAccurate(args PutDataPointArgs) bool {
 	addrs := nodes.BestFitNodesAccurate(args.toBestFitNodesArgs())
-	return putDataPoint(addrs, args.Namespace, args.DataPoint)
+	return putDataPoint(addrs, args.Namespace, args.DataPoint, args.Err)
 }
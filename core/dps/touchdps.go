@@ -0,0 +1,65 @@
+/*
+See file comment in dps.go
+*/
+package dps
+
+import (
+	"time"
+	"trypo/core/nodes"
+	"trypo/pkg/kmeans/rpc"
+)
+
+type TouchDataPointsArgs struct {
+	// AddrOptions contains addresses of nodes to be considered.
+	AddrOptions []Addr
+	// Namespace for data.
+	Namespace string
+	// QueryVec is used for finding the dps to touch (most similar).
+	QueryVec []float64
+	// N specifies how many dps to touch.
+	N int
+	// TTL is the new time to live of the touched dps, zero means the
+	// default of the namespace in each node (see rpc.TTL).
+	TTL time.Duration
+
+	// KNNsearchFunc is used to find best-fit nodes to touch dps in.
+	KNNSearchFunc knnSearchFunc
+}
+
+func (a *TouchDataPointsArgs) toBestFitNodesArgs() nodes.BestFitNodesArgs {
+	return nodes.BestFitNodesArgs{
+		AddrOpts:      a.AddrOptions,
+		Namespace:     a.Namespace,
+		Vec:           a.QueryVec,
+		KNNSearchFunc: a.KNNSearchFunc,
+	}
+}
+
+// touchDataPoints touches dps in 'addrs' (in order) until args.N have been
+// found, see rpc.KMeansServer.Touch. Returns the amount of found dps.
+func touchDataPoints(addrs []Addr, args TouchDataPointsArgs) int {
+	res := 0
+	for _, addr := range addrs {
+		client := rpc.KMeansClient(addr.ToStr(), args.Namespace, nil)
+		res += client.Touch(args.QueryVec, args.N-res, args.TTL)
+		if res >= args.N {
+			break
+		}
+	}
+	return res
+}
+
+// TouchDataPointsFast pushes the expiry of the dps that GetDataPointsFast would
+// fetch (with the same args) forward, see rpc.KMeansServer.Touch. Returns the
+// amount of dps that were found.
+func TouchDataPointsFast(args TouchDataPointsArgs) int {
+	addrs := nodes.BestFitNodesFast(args.toBestFitNodesArgs())
+	return touchDataPoints(addrs, args)
+}
+
+// TouchDataPointsAccurate is like TouchDataPointsFast, but with the nodes that
+// GetDataPointsAccurate would use.
+func TouchDataPointsAccurate(args TouchDataPointsArgs) int {
+	addrs := nodes.BestFitNodesAccurate(args.toBestFitNodesArgs())
+	return touchDataPoints(addrs, args)
+}
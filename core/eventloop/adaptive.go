@@ -0,0 +1,373 @@
+package eventloop
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"trypo/pkg/kmeans/rpc"
+	"trypo/pkg/logging"
+)
+
+// AdaptiveConfig configures the adaptive mode of the event loop. In this
+// mode, metrics are pulled from the network periodically (see ClusterMetrics)
+// and used for deciding how often some maintenance tasks run, relative to
+// their schedule, and how much data they move. Tasks speed up when a metric
+// is above its threshold (e.g after a bulk load), and back off gradually
+// while the cluster is stable. A threshold <= 0 disables that metric.
+type AdaptiveConfig struct {
+	// Enabled turns on the adaptive mode.
+	Enabled bool
+	// Every is how often metrics are pulled and decisions are made.
+	Every time.Duration
+
+	// MaxSpeedup is the max factor by which a task runs more often (and
+	// moves more data) than its schedule says. Clamped to >= 1.
+	MaxSpeedup float64
+	// MaxBackoff is the max factor by which a task runs less often than
+	// its schedule says, when the cluster is stable. Clamped to >= 1.
+	MaxBackoff float64
+
+	// SkewThreshold is for ClusterMetrics.Skew, drives load balancing
+	// and distribution of datapoints between nodes.
+	SkewThreshold float64
+	// SizeCVThreshold is for ClusterMetrics.CentroidSizeCV, drives
+	// splitting and merging of centroids.
+	SizeCVThreshold float64
+	// InsertRateThreshold is for ClusterMetrics.InsertRate, drives all
+	// adapted tasks (bulk loads need all kinds of maintenance).
+	InsertRateThreshold float64
+	// LatencyThreshold is for ClusterMetrics.QueryLatency, drives
+	// splitting of centroids (smaller centroids are faster to search).
+	LatencyThreshold time.Duration
+}
+
+func (cfg *AdaptiveConfig) validate() {
+	if cfg.Enabled && cfg.Every <= 0 {
+		panic("invalid eventloop adaptive config: Every must be > 0")
+	}
+	cfg.MaxSpeedup = math.Max(cfg.MaxSpeedup, 1)
+	cfg.MaxBackoff = math.Max(cfg.MaxBackoff, 1)
+}
+
+// ClusterMetrics are the metrics used by the adaptive mode, computed from
+// the Meta data of nodes (see pkg/kmeans/rpc.MetaResp).
+type ClusterMetrics struct {
+	// Skew is the coefficient of variation (stddev / mean) of datapoint
+	// counts between all nodes, for the namespace where it is highest.
+	Skew float64 `json:"skew"`
+	// CentroidSizeCV is the coefficient of variation of datapoint counts
+	// in centroids of the local node, for the namespace where it is highest.
+	CentroidSizeCV float64 `json:"centroid_size_cv"`
+	// InsertRate is the amount of datapoints added to the local node per
+	// second (all namespaces), since the previous metrics.
+	InsertRate float64 `json:"insert_rate"`
+	// QueryLatency is the average time spent on lookups in the local node,
+	// for the namespace where it is highest.
+	QueryLatency time.Duration `json:"query_latency"`
+}
+
+// TaskDecision is what the adaptive mode decided for a task.
+type TaskDecision struct {
+	// Factor > 1 means that the task runs more often than its schedule
+	// says (and moves more data), < 1 means less often.
+	Factor float64 `json:"factor"`
+	// Paused is true if the task doesn't run at all.
+	Paused bool `json:"paused"`
+	// Reason is a short description of why the decision was made.
+	Reason string `json:"reason"`
+
+	// The signal that sped up the task, if any (see observeDecisions).
+	signal string
+}
+
+// String is used for logging.
+func (d TaskDecision) String() string {
+	if d.Paused {
+		return "paused (" + d.Reason + ")"
+	}
+	return fmt.Sprintf("x%.2f (%v)", d.Factor, d.Reason)
+}
+
+// AdaptiveState is the latest metrics and decisions of the adaptive mode.
+type AdaptiveState struct {
+	Metrics ClusterMetrics `json:"metrics"`
+	// Keys are task names.
+	Decisions map[string]TaskDecision `json:"decisions"`
+	Updated   time.Time               `json:"updated"`
+}
+
+// AdaptiveState returns the latest metrics and decisions of the adaptive
+// mode. Decisions is empty if the mode is disabled or hasn't run yet. Safe
+// to call while the event loop is running.
+func (cfg *EventLoopConfig) AdaptiveState() AdaptiveState {
+	res := AdaptiveState{Decisions: make(map[string]TaskDecision)}
+	if cfg.internal == nil {
+		return res
+	}
+	cfg.internal.Lock()
+	defer cfg.internal.Unlock()
+	res.Metrics = cfg.internal.adaptive.metrics
+	res.Updated = cfg.internal.adaptive.updated
+	for k, v := range cfg.internal.adaptive.decisions {
+		res.Decisions[k] = v
+	}
+	return res
+}
+
+// State of the adaptive mode, guarded by the lock in eventLoopInternal.
+type adaptiveState struct {
+	metrics   ClusterMetrics
+	decisions map[string]TaskDecision
+	updated   time.Time
+
+	// For computing the insert rate.
+	inserts int
+}
+
+// adapt returns the schedule 's' of a task, adjusted by its decision. A
+// paused task gets a zero (disabled) schedule. Cron schedules can't be
+// scaled, so only pausing applies to them.
+func (st *adaptiveState) adapt(task string, s TaskSchedule) TaskSchedule {
+	d, ok := st.decisions[task]
+	if !ok {
+		return s
+	}
+	if d.Paused {
+		return TaskSchedule{}
+	}
+	if s.Every > 0 {
+		s.Every = time.Duration(float64(s.Every) / d.Factor)
+		s.Jitter = time.Duration(float64(s.Jitter) / d.Factor)
+	}
+	return s
+}
+
+// adaptTuning scales the amounts of datapoints which are moved by the
+// distribution tasks with their decisions.
+func (st *adaptiveState) adaptTuning(t *EventLoopTuning) {
+	scale := func(task string, n *int) {
+		if d, ok := st.decisions[task]; ok && *n > 0 {
+			*n = int(math.Max(1, math.Round(float64(*n)*d.Factor)))
+		}
+	}
+	scale("distri fast", &t.DistributeDataPointsFastN)
+	scale("distri accurate", &t.DistributeDataPointsAccurateN)
+	scale("distri internal", &t.DistributeDataPointsInternalN)
+}
+
+// coefVar returns the coefficient of variation (stddev / mean) of 'vals',
+// or 0 if the mean is 0.
+func coefVar(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+	mean := 0.
+	for _, v := range vals {
+		mean += v
+	}
+	mean /= float64(len(vals))
+	if mean == 0 {
+		return 0
+	}
+	variance := 0.
+	for _, v := range vals {
+		variance += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(variance/float64(len(vals))) / mean
+}
+
+// clusterMetrics computes metrics from Meta data of all nodes. 'inserts' is
+// the total amount of inserts to the local node at the previous call, and
+// 'elapsed' is the time since then (zero for the first call). Also returns
+// the amount of nodes which have any data, and the current total inserts.
+func clusterMetrics(local Addr, metas map[Addr]rpc.MetaResp,
+	inserts int, elapsed time.Duration) (m ClusterMetrics, active int, total int) {
+
+	// Skew, nodes without a namespace count as having 0 dps in it.
+	namespaces := make(map[string]bool)
+	for _, meta := range metas {
+		hasData := false
+		for ns, n := range meta.DPs {
+			namespaces[ns] = true
+			hasData = hasData || n > 0
+		}
+		if hasData {
+			active++
+		}
+	}
+	for ns := range namespaces {
+		lens := make([]float64, 0, len(metas))
+		for _, meta := range metas {
+			lens = append(lens, float64(meta.DPs[ns]))
+		}
+		m.Skew = math.Max(m.Skew, coefVar(lens))
+	}
+
+	localMeta := metas[local]
+	for ns, variance := range localMeta.CentroidSizeVar {
+		if c := localMeta.Centroids[ns]; c > 0 && localMeta.DPs[ns] > 0 {
+			mean := float64(localMeta.DPs[ns]) / float64(c)
+			m.CentroidSizeCV = math.Max(m.CentroidSizeCV, math.Sqrt(variance)/mean)
+		}
+	}
+	for _, n := range localMeta.Inserts {
+		total += n
+	}
+	if elapsed > 0 && total >= inserts {
+		m.InsertRate = float64(total-inserts) / elapsed.Seconds()
+	}
+	for _, d := range localMeta.QueryLatency {
+		if d > m.QueryLatency {
+			m.QueryLatency = d
+		}
+	}
+	return m, active, total
+}
+
+// pressure returns metric/threshold, or 0 if the threshold is disabled.
+func pressure(metric, threshold float64) float64 {
+	if threshold <= 0 {
+		return 0
+	}
+	return metric / threshold
+}
+
+// decide returns a decision for each adapted task, given metrics and the
+// previous decisions. A task with pressure >= 1 (a metric at its threshold)
+// speeds up immediately, proportionally to the pressure. Otherwise it backs
+// off by halving its factor each time while the pressure is low (< 0.5), or
+// settles at 1 (the schedule as is).
+func (cfg *AdaptiveConfig) decide(m ClusterMetrics, activeNodes int,
+	prev map[string]TaskDecision) map[string]TaskDecision {
+
+	insertP := pressure(m.InsertRate, cfg.InsertRateThreshold)
+	skewP := pressure(m.Skew, cfg.SkewThreshold)
+	sizeP := pressure(m.CentroidSizeCV, cfg.SizeCVThreshold)
+	latencyP := pressure(float64(m.QueryLatency), float64(cfg.LatencyThreshold))
+
+	type driver struct {
+		p      float64
+		signal string
+		reason string
+	}
+	// Picks the driver with the highest pressure.
+	max := func(drivers ...driver) driver {
+		res := drivers[0]
+		for _, d := range drivers[1:] {
+			if d.p > res.p {
+				res = d
+			}
+		}
+		return res
+	}
+	insert := driver{insertP, "insert_rate", fmt.Sprintf("insert rate %.1f/s", m.InsertRate)}
+	skew := driver{skewP, "skew", fmt.Sprintf("skew %.2f", m.Skew)}
+	size := driver{sizeP, "size_cv", fmt.Sprintf("centroid size cv %.2f", m.CentroidSizeCV)}
+	latency := driver{latencyP, "latency", fmt.Sprintf("query latency %v", m.QueryLatency)}
+
+	drivers := map[string]driver{
+		"load balancing":  max(skew, insert),
+		"distri fast":     max(skew, insert),
+		"distri accurate": max(skew, insert),
+		"distri internal": insert,
+		"split":           max(size, latency, insert),
+		"merge":           max(size, insert),
+	}
+
+	res := make(map[string]TaskDecision, len(drivers))
+	for task, d := range drivers {
+		// Nothing to balance between nodes if at most one has data.
+		if activeNodes < 2 && (task == "load balancing" || task == "distri fast" ||
+			task == "distri accurate") {
+			res[task] = TaskDecision{Factor: 1, Paused: true, Reason: "at most one node has data"}
+			continue
+		}
+
+		factor := 1.
+		if p, ok := prev[task]; ok && !p.Paused {
+			factor = p.Factor
+		}
+		signal := ""
+		switch {
+		case d.p >= 1:
+			factor = math.Min(d.p, cfg.MaxSpeedup)
+			signal = d.signal
+		case d.p < 0.5:
+			factor = math.Max(factor/2, 1/cfg.MaxBackoff)
+		default:
+			factor = 1
+		}
+		reason := d.reason
+		if d.p < 0.5 {
+			reason = "stable, " + reason
+		}
+		res[task] = TaskDecision{Factor: factor, Reason: reason, signal: signal}
+	}
+	return res
+}
+
+// observeDecisions sets the metrics of the adaptive mode (see metrics.go)
+// after 'decisions' are made.
+func observeDecisions(decisions map[string]TaskDecision) {
+	for task, d := range decisions {
+		factor := d.Factor
+		if d.Paused {
+			factor = 0
+		}
+		adaptiveFactor.Set(factor, task)
+		if d.signal != "" {
+			adaptiveTriggers.Inc(task, d.signal)
+		}
+	}
+}
+
+// Event-loop task for the adaptive mode (see AdaptiveConfig): pulls metrics
+// from the network, makes decisions and applies them.
+func eltAdaptive(ctx context.Context, cfg *EventLoopConfig, t *EventLoopTuning) {
+	metas := make(map[Addr]rpc.MetaResp, len(cfg.RemoteAddrs))
+	for _, addr := range cfg.RemoteAddrs {
+		if ctx.Err() != nil {
+			return
+		}
+		var err error
+		meta := rpc.KMeansClient(addr.ToStr(), "", &err).Meta()
+		if err == nil {
+			metas[addr] = meta
+		}
+	}
+	if _, ok := metas[cfg.LocalAddr]; !ok {
+		return
+	}
+
+	now := cfg.clock().Now()
+	cfg.internal.Lock()
+	st := cfg.internal.adaptive
+	var elapsed time.Duration
+	if !st.updated.IsZero() {
+		elapsed = now.Sub(st.updated)
+	}
+	metrics, active, inserts := clusterMetrics(cfg.LocalAddr, metas, st.inserts, elapsed)
+	decisions := cfg.Adaptive.decide(metrics, active, st.decisions)
+	observeDecisions(decisions)
+
+	var changes []string
+	for task, d := range decisions {
+		if prev, ok := st.decisions[task]; !ok || prev.Factor != d.Factor || prev.Paused != d.Paused {
+			changes = append(changes, task+" "+d.String())
+		}
+	}
+	st.metrics, st.decisions, st.updated, st.inserts = metrics, decisions, now, inserts
+	if len(changes) != 0 {
+		// Tasks waiting for their next run pick up the change.
+		cfg.internal.notify()
+	}
+	cfg.internal.Unlock()
+
+	if len(changes) != 0 {
+		sort.Strings(changes)
+		cfg.L.LogTask(adaptiveTask, "adapted", logging.F("changes", strings.Join(changes, ", ")))
+	}
+}
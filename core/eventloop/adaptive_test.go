@@ -0,0 +1,179 @@
+package eventloop
+
+import (
+	"bufio"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"trypo/pkg/kmeans/rpc"
+	"trypo/pkg/metrics"
+)
+
+func TestCoefVar(t *testing.T) {
+	tests := []struct {
+		vals []float64
+		want float64
+	}{
+		{nil, 0},
+		{[]float64{0, 0}, 0},
+		{[]float64{5, 5, 5}, 0},
+		{[]float64{0, 10}, 1},
+		{[]float64{2, 4, 4, 4, 5, 5, 7, 9}, 0.4},
+	}
+	for _, test := range tests {
+		if got := coefVar(test.vals); math.Abs(got-test.want) > 1e-9 {
+			t.Fatalf("coefVar(%v): want %v, got %v", test.vals, test.want, got)
+		}
+	}
+}
+
+func TestClusterMetrics(t *testing.T) {
+	a := Addr{IP: "localhost", Port: "1"}
+	b := Addr{IP: "localhost", Port: "2"}
+	c := Addr{IP: "localhost", Port: "3"}
+	metas := map[Addr]rpc.MetaResp{
+		a: {
+			Centroids:       map[string]int{"x": 2},
+			DPs:             map[string]int{"x": 10},
+			CentroidSizeVar: map[string]float64{"x": 25},
+			Inserts:         map[string]int{"x": 30, "y": 20},
+			QueryLatency:    map[string]time.Duration{"x": time.Millisecond, "y": time.Second},
+		},
+		// Namespace missing, counts as 0 dps.
+		b: {},
+		c: {DPs: map[string]int{"x": 0}},
+	}
+
+	m, active, total := clusterMetrics(a, metas, 40, time.Second*2)
+	if active != 1 || total != 50 {
+		t.Fatalf("want 1 active node and 50 inserts, got %v and %v", active, total)
+	}
+	// Lens [10, 0, 0]: mean 10/3, stddev sqrt(200/9).
+	if want := math.Sqrt(200./9) / (10. / 3); math.Abs(m.Skew-want) > 1e-9 {
+		t.Fatalf("want skew %v, got %v", want, m.Skew)
+	}
+	// Mean size 5, stddev 5.
+	if m.CentroidSizeCV != 1 {
+		t.Fatalf("want centroid size cv 1, got %v", m.CentroidSizeCV)
+	}
+	if m.InsertRate != 5 {
+		t.Fatalf("want insert rate 5, got %v", m.InsertRate)
+	}
+	if m.QueryLatency != time.Second {
+		t.Fatalf("want query latency 1s, got %v", m.QueryLatency)
+	}
+
+	// First call, no rate.
+	if m, _, _ := clusterMetrics(a, metas, 0, 0); m.InsertRate != 0 {
+		t.Fatalf("want no insert rate on first call, got %v", m.InsertRate)
+	}
+}
+
+func TestAdaptiveDecide(t *testing.T) {
+	cfg := AdaptiveConfig{
+		MaxSpeedup:          4,
+		MaxBackoff:          4,
+		SkewThreshold:       0.5,
+		SizeCVThreshold:     1,
+		InsertRateThreshold: 100,
+	}
+
+	// Bulk load: everything speeds up, capped by MaxSpeedup.
+	triggers := `trypo_eventloop_adaptive_triggers_total{task="load balancing",signal="skew"}`
+	before := metricValue(t, triggers)
+	d := cfg.decide(ClusterMetrics{InsertRate: 300, Skew: 5}, 3, nil)
+	if d["distri internal"].Factor != 3 || d["load balancing"].Factor != 4 {
+		t.Fatalf("unexpected decisions after bulk load: %v", d)
+	}
+	observeDecisions(d)
+	if got := metricValue(t, `trypo_eventloop_adaptive_factor{task="load balancing"}`); got != 4 {
+		t.Fatalf("unexpected factor metric: %v", got)
+	}
+	if got := metricValue(t, triggers); got != before+1 {
+		t.Fatalf("unexpected triggers metric: %v, was %v", got, before)
+	}
+
+	// Stable: backs off gradually, limited by MaxBackoff.
+	for _, want := range []float64{1.5, 0.75, 0.375, 0.25, 0.25} {
+		d = cfg.decide(ClusterMetrics{}, 3, d)
+		if got := d["merge"]; got.Factor != want || got.Paused {
+			t.Fatalf("want backoff factor %v, got %v", want, got)
+		}
+	}
+
+	// Neither high nor low: back to the schedule as is.
+	d = cfg.decide(ClusterMetrics{CentroidSizeCV: 0.7}, 3, d)
+	if d["split"].Factor != 1 || d["distri fast"].Factor != 0.25 {
+		t.Fatalf("unexpected decisions: %v", d)
+	}
+
+	// Nothing to balance with a single node.
+	d = cfg.decide(ClusterMetrics{Skew: 5}, 1, d)
+	if !d["load balancing"].Paused || d["split"].Paused {
+		t.Fatalf("unexpected decisions with one node: %v", d)
+	}
+	observeDecisions(d)
+	if got := metricValue(t, `trypo_eventloop_adaptive_factor{task="merge"}`); got != 0.5 {
+		t.Fatalf("unexpected factor metric: %v", got)
+	}
+	if got := metricValue(t, `trypo_eventloop_adaptive_factor{task="load balancing"}`); got != 0 {
+		t.Fatalf("paused task should have factor 0, got %v", got)
+	}
+	if got := metricValue(t, triggers); got != before+1 {
+		t.Fatalf("paused task was counted as triggered: %v, was %v", got, before)
+	}
+}
+
+// metricValue returns the value of 'series' (name and labels) in the default
+// metrics registry, 0 if it isn't there.
+func metricValue(t *testing.T, series string) float64 {
+	var b strings.Builder
+	if err := metrics.Default.WriteText(&b); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	sc := bufio.NewScanner(strings.NewReader(b.String()))
+	for sc.Scan() {
+		if v := strings.TrimPrefix(sc.Text(), series+" "); v != sc.Text() {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatalf("unexpected value of %v: %v", series, v)
+			}
+			return f
+		}
+	}
+	return 0
+}
+
+func TestAdaptiveState(t *testing.T) {
+	st := adaptiveState{decisions: map[string]TaskDecision{
+		"merge":           {Factor: 2},
+		"split":           {Factor: 1, Paused: true},
+		"distri fast":     {Factor: 0.5},
+		"distri internal": {Factor: 2},
+	}}
+
+	s := TaskSchedule{Every: time.Minute, Jitter: time.Second * 10, MaxConcurrency: 1}
+	if got := st.adapt("merge", s); got.Every != time.Second*30 || got.Jitter != time.Second*5 ||
+		got.MaxConcurrency != 1 {
+		t.Fatalf("unexpected adapted schedule: %+v", got)
+	}
+	if got := st.adapt("split", s); got != (TaskSchedule{}) {
+		t.Fatalf("paused task should have a disabled schedule, got %+v", got)
+	}
+	if got := st.adapt("meta", s); got != s {
+		t.Fatalf("task without decision shouldn't change, got %+v", got)
+	}
+
+	tuning := EventLoopTuning{
+		DistributeDataPointsFastN:     1,
+		DistributeDataPointsAccurateN: 50,
+		DistributeDataPointsInternalN: 200,
+	}
+	st.adaptTuning(&tuning)
+	if tuning.DistributeDataPointsFastN != 1 || tuning.DistributeDataPointsAccurateN != 50 ||
+		tuning.DistributeDataPointsInternalN != 400 {
+		t.Fatalf("unexpected adapted tuning: %+v", tuning)
+	}
+}
@@ -0,0 +1,251 @@
+package eventloop
+
+import (
+	"context"
+	"math"
+	"sort"
+	"trypo/pkg/kmeans/rpc"
+	"trypo/pkg/logging"
+)
+
+// nodeLoad is the load of a node, for one namespace, as used by planBalance.
+type nodeLoad struct {
+	// Datapoints and bytes in the namespace.
+	dps, bytes int
+	// Bytes in all namespaces, and the high-water mark for them (0 means
+	// no limit), see rpc.KMeansServer.MemHighWater.
+	totalBytes, highWater int
+	// See rpc.KMeansServer.Capacity.
+	capacity float64
+}
+
+// nodeLoads returns the load of each node in 'metas' for 'namespace'. Nodes
+// without the namespace have zero load, since they can take data too.
+func nodeLoads(metas map[Addr]rpc.MetaResp, namespace string) map[Addr]nodeLoad {
+	res := make(map[Addr]nodeLoad, len(metas))
+	for addr, meta := range metas {
+		load := nodeLoad{
+			dps:       meta.DPs[namespace],
+			bytes:     meta.Bytes[namespace],
+			highWater: meta.MemHighWater,
+			capacity:  meta.Capacity,
+		}
+		for _, b := range meta.Bytes {
+			load.totalBytes += b
+		}
+		if load.capacity <= 0 {
+			load.capacity = 1
+		}
+		res[addr] = load
+	}
+	return res
+}
+
+// planBalance returns how many datapoints (the 'transferLimit' arg for
+// StealCentroids) the node 'local' should take from each other node in
+// 'loads', such that each node ends up with a share of the bytes that is
+// proportional to its capacity.
+//
+// Only nodes that are below their share by more than 'margin' (a fraction
+// of the share) take data, and only from nodes above their share. The
+// surplus of each node is split between all nodes that are below their
+// share, such that nodes which balance at the same time don't take more
+// than the surplus. Nothing is taken that would put 'local' beyond its
+// memory high-water mark.
+func planBalance(local Addr, loads map[Addr]nodeLoad, margin float64) map[Addr]int {
+	l, ok := loads[local]
+	if !ok {
+		return nil
+	}
+	var totalBytes, totalCapacity float64
+	for _, load := range loads {
+		totalBytes += float64(load.bytes)
+		totalCapacity += load.capacity
+	}
+	if totalBytes == 0 {
+		return nil
+	}
+	share := func(load nodeLoad) float64 {
+		return totalBytes * load.capacity / totalCapacity
+	}
+
+	deficit := share(l) - float64(l.bytes)
+	if deficit <= share(l)*margin {
+		return nil
+	}
+	if l.highWater > 0 {
+		deficit = math.Min(deficit, float64(l.highWater-l.totalBytes))
+		if deficit <= 0 {
+			return nil
+		}
+	}
+
+	// Surplus and deficit of all nodes are equal, since shares add up to
+	// the total.
+	totalSurplus := 0.0
+	for _, load := range loads {
+		totalSurplus += math.Max(0, float64(load.bytes)-share(load))
+	}
+
+	res := make(map[Addr]int)
+	for addr, load := range loads {
+		surplus := float64(load.bytes) - share(load)
+		if addr.Comp(local) || surplus <= 0 || load.dps == 0 {
+			continue
+		}
+		wantBytes := surplus * deficit / totalSurplus
+		if n := int(math.Round(wantBytes / load.bytesPerDP())); n > 0 {
+			res[addr] = n
+		}
+	}
+	return res
+}
+
+// planPush is the counterpart of planBalance for when 'local' is above its
+// memory high-water mark, which pulling can't fix (data is only taken by
+// nodes below their share). Returns how many datapoints 'local' should push
+// (the 'transferLimit' arg for PushCentroids) to each other node, such that
+// it ends up below the mark. The datapoints are split between the other
+// nodes with room below their own mark, proportional to their capacity.
+func planPush(local Addr, loads map[Addr]nodeLoad) map[Addr]int {
+	l, ok := loads[local]
+	if !ok || l.highWater <= 0 || l.totalBytes <= l.highWater || l.dps == 0 {
+		return nil
+	}
+	overflow := math.Min(float64(l.totalBytes-l.highWater), float64(l.bytes))
+
+	room := make(map[Addr]float64)
+	totalCapacity := 0.0
+	for addr, load := range loads {
+		switch {
+		case addr.Comp(local):
+			continue
+		case load.highWater <= 0:
+			room[addr] = math.Inf(1)
+		case load.totalBytes < load.highWater:
+			room[addr] = float64(load.highWater - load.totalBytes)
+		default:
+			continue
+		}
+		totalCapacity += load.capacity
+	}
+
+	res := make(map[Addr]int)
+	for addr, r := range room {
+		bytes := math.Min(overflow*loads[addr].capacity/totalCapacity, r)
+		if n := int(math.Ceil(bytes / l.bytesPerDP())); n > 0 {
+			res[addr] = n
+		}
+	}
+	return res
+}
+
+// bytesPerDP returns the mean bytes of the datapoints in the namespace.
+func (l nodeLoad) bytesPerDP() float64 {
+	if l.dps == 0 {
+		return 1
+	}
+	return float64(l.bytes) / float64(l.dps)
+}
+
+// sortedAddrs returns the keys of 'm' in order, such that nodes are handled in
+// the same order on each run (see Simulation).
+func sortedAddrs(m map[Addr]int) []Addr {
+	res := make([]Addr, 0, len(m))
+	for addr := range m {
+		res = append(res, addr)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ToStr() < res[j].ToStr() })
+	return res
+}
+
+// fetchMetas fetches Meta from all 'addrs' (concurrently), nodes that can't
+// be reached are left out.
+func fetchMetas(addrs []Addr) map[Addr]rpc.MetaResp {
+	type nodeMeta struct {
+		addr Addr
+		meta rpc.MetaResp
+		err  error
+	}
+
+	// Fetch.
+	ch := make(chan nodeMeta, len(addrs))
+	for _, addr := range addrs {
+		go func(addr Addr) {
+			var err error
+			meta := rpc.KMeansClient(addr.ToStr(), "", &err).Meta()
+			ch <- nodeMeta{addr, meta, err}
+		}(addr)
+	}
+
+	// Collect.
+	res := make(map[Addr]rpc.MetaResp, len(addrs))
+	for i := 0; i < len(addrs); i++ {
+		r := <-ch
+		if r.err == nil {
+			res[r.addr] = r.meta
+		}
+	}
+	return res
+}
+
+// Event-loop task for load balancing. It transfers Centroids from remote nodes
+// to the local node when the local node has less than its share of the data in
+// a namespace (see planBalance), and from the local node to remote nodes when
+// it's above its memory high-water mark (see planPush).
+func eltLoadBalancing(ctx context.Context, cfg *EventLoopConfig, t *EventLoopTuning) {
+	metas := fetchMetas(cfg.RemoteAddrs)
+	local := cfg.LocalAddr // Abbreviation.
+	if _, ok := metas[local]; !ok {
+		return
+	}
+
+	seen := make(map[string]bool)
+	var namespaces []string
+	for _, meta := range metas {
+		for ns := range meta.DPs {
+			if !seen[ns] {
+				seen[ns] = true
+				namespaces = append(namespaces, ns)
+			}
+		}
+	}
+	sort.Strings(namespaces)
+
+	for _, ns := range namespaces {
+		if ctx.Err() != nil {
+			return
+		}
+		client := rpc.KMeansClient(local.ToStr(), ns, nil)
+		loads := nodeLoads(metas, ns)
+		moved := false
+		push := planPush(local, loads)
+		for _, other := range sortedAddrs(push) {
+			limit := push[other]
+			n, _ := client.PushCentroids(other.ToStr(), limit)
+			moved = moved || n > 0
+
+			cfg.L.LogTask("load balancing", "pushed centroids",
+				logging.Namespace(ns), logging.Peer(other.ToStr()),
+				logging.F("want", limit), logging.F("got", n))
+		}
+		steal := planBalance(local, loads, t.LoadBalancingMargin)
+		for _, other := range sortedAddrs(steal) {
+			limit := steal[other]
+			n, _ := client.StealCentroids(other.ToStr(), limit)
+			moved = moved || n > 0
+
+			cfg.L.LogTask("load balancing", "stole centroids",
+				logging.Namespace(ns), logging.Peer(other.ToStr()),
+				logging.F("want", limit), logging.F("got", n))
+		}
+
+		// Later namespaces count against the high-water mark too.
+		if moved {
+			var err error
+			if meta := rpc.KMeansClient(local.ToStr(), "", &err).Meta(); err == nil {
+				metas[local] = meta
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package eventloop
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+	"trypo/core/testutils"
+	"trypo/pkg/kmeans/common"
+	"trypo/pkg/kmeans/rpc"
+)
+
+func TestNodeLoads(t *testing.T) {
+	a := Addr{IP: "localhost", Port: "1"}
+	b := Addr{IP: "localhost", Port: "2"}
+	metas := map[Addr]rpc.MetaResp{
+		a: {
+			DPs:          map[string]int{"x": 4, "y": 1},
+			Bytes:        map[string]int{"x": 64, "y": 8},
+			Capacity:     2,
+			MemHighWater: 100,
+		},
+		b: {},
+	}
+	loads := nodeLoads(metas, "x")
+	want := map[Addr]nodeLoad{
+		a: {dps: 4, bytes: 64, totalBytes: 72, highWater: 100, capacity: 2},
+		b: {capacity: 1},
+	}
+	if !reflect.DeepEqual(loads, want) {
+		t.Fatalf("unexpected loads: %+v", loads)
+	}
+}
+
+func TestPlanBalance(t *testing.T) {
+	a := Addr{IP: "localhost", Port: "1"}
+	b := Addr{IP: "localhost", Port: "2"}
+	c := Addr{IP: "localhost", Port: "3"}
+	// 'n' dps of 10 bytes each.
+	load := func(n int, capacity float64) nodeLoad {
+		return nodeLoad{dps: n, bytes: n * 10, totalBytes: n * 10, capacity: capacity}
+	}
+
+	tests := []struct {
+		name   string
+		loads  map[Addr]nodeLoad
+		margin float64
+		want   map[Addr]int
+	}{
+		{
+			name:  "even",
+			loads: map[Addr]nodeLoad{a: load(10, 1), b: load(10, 1)},
+			want:  nil,
+		},
+		{
+			name:  "empty",
+			loads: map[Addr]nodeLoad{a: {capacity: 1}, b: {capacity: 1}},
+			want:  nil,
+		},
+		{
+			name:  "one full node",
+			loads: map[Addr]nodeLoad{a: {capacity: 1}, b: load(20, 1)},
+			want:  map[Addr]int{b: 10},
+		},
+		{
+			// Local isn't below its share by more than the margin.
+			name:   "within margin",
+			loads:  map[Addr]nodeLoad{a: load(8, 1), b: load(12, 1)},
+			margin: 0.25,
+			want:   nil,
+		},
+		{
+			// Share of 'a' is 20 out of 30.
+			name:  "capacity",
+			loads: map[Addr]nodeLoad{a: load(10, 2), b: load(20, 1)},
+			want:  map[Addr]int{b: 10},
+		},
+		{
+			// Above its share, since its capacity is lower.
+			name:  "low capacity",
+			loads: map[Addr]nodeLoad{a: load(10, 1), b: load(20, 3)},
+			want:  nil,
+		},
+		{
+			// 'c' is at its share, so only 'b' gives.
+			name:  "one source",
+			loads: map[Addr]nodeLoad{a: {capacity: 1}, b: load(40, 1), c: load(20, 1)},
+			want:  map[Addr]int{b: 20},
+		},
+		{
+			// Surplus of 10 from each of 'b' and 'c'.
+			name:  "two sources",
+			loads: map[Addr]nodeLoad{a: {capacity: 1}, b: load(30, 1), c: load(30, 1)},
+			want:  map[Addr]int{b: 10, c: 10},
+		},
+		{
+			// Room for 5 dps (50 bytes) of the wanted 10.
+			name: "high-water",
+			loads: map[Addr]nodeLoad{
+				a: {totalBytes: 50, highWater: 100, capacity: 1},
+				b: load(20, 1),
+			},
+			want: map[Addr]int{b: 5},
+		},
+		{
+			name: "beyond high-water",
+			loads: map[Addr]nodeLoad{
+				a: {totalBytes: 120, highWater: 100, capacity: 1},
+				b: load(20, 1),
+			},
+			want: nil,
+		},
+	}
+	for _, test := range tests {
+		got := planBalance(a, test.loads, test.margin)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%v: want %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestPlanPush(t *testing.T) {
+	a := Addr{IP: "localhost", Port: "1"}
+	b := Addr{IP: "localhost", Port: "2"}
+	c := Addr{IP: "localhost", Port: "3"}
+	d := Addr{IP: "localhost", Port: "4"}
+	// 20 dps of 10 bytes each, 60 bytes over the mark.
+	over := nodeLoad{dps: 20, bytes: 200, totalBytes: 260, highWater: 200, capacity: 1}
+
+	tests := []struct {
+		name  string
+		loads map[Addr]nodeLoad
+		want  map[Addr]int
+	}{
+		{
+			name:  "below high-water",
+			loads: map[Addr]nodeLoad{a: {dps: 20, bytes: 200, totalBytes: 200, highWater: 200}, b: {capacity: 1}},
+			want:  nil,
+		},
+		{
+			name:  "no high-water",
+			loads: map[Addr]nodeLoad{a: {dps: 20, bytes: 200, totalBytes: 260}, b: {capacity: 1}},
+			want:  nil,
+		},
+		{
+			// Split by capacity, 'd' is full.
+			name: "over high-water",
+			loads: map[Addr]nodeLoad{
+				a: over,
+				b: {capacity: 1},
+				c: {capacity: 2},
+				d: {totalBytes: 100, highWater: 100, capacity: 1},
+			},
+			want: map[Addr]int{b: 2, c: 4},
+		},
+		{
+			// Rounded up, since 'a' must end up below the mark.
+			name: "limited room",
+			loads: map[Addr]nodeLoad{
+				a: over,
+				b: {totalBytes: 85, highWater: 100, capacity: 1},
+			},
+			want: map[Addr]int{b: 2},
+		},
+		{
+			// At most the bytes in the namespace.
+			name: "other namespaces",
+			loads: map[Addr]nodeLoad{
+				a: {dps: 2, bytes: 20, totalBytes: 260, highWater: 200, capacity: 1},
+				b: {capacity: 1},
+			},
+			want: map[Addr]int{b: 2},
+		},
+	}
+	for _, test := range tests {
+		got := planPush(a, test.loads)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%v: want %v, got %v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestLoadBalancingFaults(t *testing.T) {
+	addrs := []Addr{
+		{IP: "localhost", Port: "3090"},
+		{IP: "localhost", Port: "3091"},
+		{IP: "localhost", Port: "3092"},
+	}
+	namespace := "test"
+	network := testutils.NewTNetwork(addrs)
+	defer network.Stop()
+	lease := time.Millisecond * 50
+	for _, node := range network.Nodes {
+		node.KMeansServer.MigrationLease = lease
+	}
+
+	n := 60
+	client := rpc.KMeansClient(addrs[0].ToStr(), namespace, nil)
+	for i := 0; i < n; i++ {
+		dp := common.DataPoint{Vec: []float64{1, float64(i % 7)}, Payload: []byte(fmt.Sprint(i))}
+		if !client.AddDataPoint(dp) {
+			t.Fatalf("couldn't add dp %v", i)
+		}
+	}
+
+	// Half of the transfers from the source fail after the datapoints are
+	// reserved, and one of the nodes that take data is slow.
+	network.Seed(1)
+	network.SetFault(addrs[0], "KMeansServer.CopyCentroid", testutils.Fault{DropRate: 0.5})
+	network.SetFault(addrs[2], "", testutils.Fault{Delay: time.Millisecond * 5})
+	for i := 0; i < 3; i++ {
+		for _, local := range addrs[1:] {
+			cfg := EventLoopConfig{
+				LocalAddr:   local,
+				RemoteAddrs: addrs,
+				L:           &structuredLogger{localAddr: local},
+			}
+			eltLoadBalancing(context.Background(), &cfg, &EventLoopTuning{})
+		}
+	}
+
+	time.Sleep(lease * 3)
+	found := make(map[string]bool)
+	for _, dp := range network.DataPoints(namespace) {
+		found[string(dp.Payload)] = true
+	}
+	if len(found) != n {
+		t.Fatalf("dps were lost: %v of %v left", len(found), n)
+	}
+	if lenDP := network.UnwrapCM(addrs[0], namespace).LenDP(); lenDP == n {
+		t.Fatal("nothing was balanced")
+	}
+}
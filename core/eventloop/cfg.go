@@ -1,86 +1,164 @@
 package eventloop
 
-import "time"
-
-// Each task in the event loop will be skippable such that not everything has
-// to run in each loop iteration. This is useful when some tasks are recource
-// and/or time intensive (more than others) and should run infrequently.
-// Example:
-//	int=1 : run on each loop.
-//	int=2 : run every second loop.
-//	int=3 : run every third loop.
-//	etc...
-// Values over 1000 will never be ran.
-type EventLoopTaskSkipConfig struct {
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"time"
+	"trypo/pkg/clock"
+)
+
+// TaskSchedule specifies when a task in the event loop runs. Each task has
+// its own schedule, which is independent of the other tasks, such that a slow
+// task doesn't delay the others. Either 'Every' or 'Cron' should be set; a
+// zero schedule (neither set) disables the task. Example:
+//
+//	TaskSchedule{Every: time.Minute, Jitter: time.Second * 10}
+//	TaskSchedule{Cron: "0 3 * * *", Timeout: time.Hour}
+type TaskSchedule struct {
+	// Every is the interval between runs, measured from the start of
+	// one run to the start of the next.
+	Every time.Duration `json:"every"`
+	// Cron is an alternative to Every, with the usual five fields, e.g
+	// "*/15 * * * *" for every 15 minutes. See parseCron in ./cron.go
+	// for the supported syntax. Times are local.
+	Cron string `json:"cron"`
+	// Jitter is the max of a random delay which is added to each run,
+	// such that nodes in the network don't do the same work in lockstep.
+	Jitter time.Duration `json:"jitter"`
+	// MaxConcurrency is how many runs of the task can be in progress at
+	// once. A run that is due while this is reached is skipped. Values
+	// below 1 are treated as 1 (i.e runs never overlap).
+	MaxConcurrency int `json:"max_concurrency"`
+	// Timeout for each run, zero means no timeout. Note that a timeout
+	// (like a stop) can't abort a call to another node, it only prevents
+	// further calls (e.g for the remaining namespaces).
+	Timeout time.Duration `json:"timeout"`
+}
+
+// Validate returns an error if any value in the schedule is invalid.
+func (s TaskSchedule) Validate() error {
+	switch {
+	case s.Every < 0:
+		return fmt.Errorf("every must be >= 0, got %v", s.Every)
+	case s.Every != 0 && s.Cron != "":
+		return errors.New("only one of every and cron can be set")
+	case s.Jitter < 0:
+		return fmt.Errorf("jitter must be >= 0, got %v", s.Jitter)
+	case s.Timeout < 0:
+		return fmt.Errorf("timeout must be >= 0, got %v", s.Timeout)
+	}
+	if s.Cron != "" {
+		if _, err := parseCron(s.Cron); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalJSON writes durations as strings (e.g "5s") instead of nanoseconds.
+func (s TaskSchedule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(taskScheduleJSON{
+		Every:          s.Every.String(),
+		Cron:           s.Cron,
+		Jitter:         s.Jitter.String(),
+		MaxConcurrency: s.MaxConcurrency,
+		Timeout:        s.Timeout.String(),
+	})
+}
+
+// UnmarshalJSON reads the form written by MarshalJSON. Values that are left
+// out are unchanged, such that a partial schedule can be given.
+func (s *TaskSchedule) UnmarshalJSON(b []byte) error {
+	v := taskScheduleJSON{
+		Every:          s.Every.String(),
+		Cron:           s.Cron,
+		Jitter:         s.Jitter.String(),
+		MaxConcurrency: s.MaxConcurrency,
+		Timeout:        s.Timeout.String(),
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	res := TaskSchedule{Cron: v.Cron, MaxConcurrency: v.MaxConcurrency}
+	for _, d := range []struct {
+		dst *time.Duration
+		s   string
+	}{{&res.Every, v.Every}, {&res.Jitter, v.Jitter}, {&res.Timeout, v.Timeout}} {
+		var err error
+		if *d.dst, err = time.ParseDuration(d.s); err != nil {
+			return err
+		}
+	}
+	*s = res
+	return nil
+}
+
+type taskScheduleJSON struct {
+	Every          string `json:"every"`
+	Cron           string `json:"cron"`
+	Jitter         string `json:"jitter"`
+	MaxConcurrency int    `json:"max_concurrency"`
+	Timeout        string `json:"timeout"`
+}
+
+// EventLoopSchedules contains a schedule for each task in the event loop,
+// see TaskSchedule.
+type EventLoopSchedules struct {
 	// Expire triggers datapoint expiration in the whole network.
 	// Not necessary to always do this, as moving dataponts will
 	// often auto-expire them, though this isn't garanteed.
-	Expire int
+	Expire TaskSchedule `json:"expire"`
 	// MemTrim triggers memory reduction in the whole network.
 	// In practice, this means that slices containing datapoints
 	// and centroids have their capacity reduced. Not necessary
 	// to always do this, since slices might be re-populated with
 	// new data, thout that is not garuanteed.
-	MemTrim int
+	MemTrim TaskSchedule `json:"mem_trim"`
 	// DistributeDataPointsFast triggers the hasty movement of
 	// datapoints within the network. It is a way of attracting
 	// dps to some best-fit node, but with an accuracy/speed
 	// tradeoff (also see DistributeDataPointsFast field). It
 	// moved dps on a node granularity. The actual amount to
 	// distribute is set in EventLoopConfig.
-	DistributeDataPointsFast int
+	DistributeDataPointsFast TaskSchedule `json:"distribute_dps_fast"`
 	// DistributeDataPointsAccurate triggers movement of datapoints
 	// within the network with highest possible accuracy, though at
 	// the cost of speed. It is an alternative to DistributeDataPointsFast
 	// and works on a Centroid granularity (contained by nodes), as opposed
 	// to just nodes. The actual amount to distribute is set in EventLoopConfig.
-	DistributeDataPointsAccurate int
+	DistributeDataPointsAccurate TaskSchedule `json:"distribute_dps_accurate"`
 	// DistributeDataPointsInternal triggers movement of datapoints
 	// within each node in the network, as opposed to between nodes.
 	// It can be thought of as data integrity on a node-level. The
 	// actual amount to distribute is set in EventLoopConfig.
-	DistributeDataPointsInternal int
+	DistributeDataPointsInternal TaskSchedule `json:"distribute_dps_internal"`
 	// SplitCentroids triggers procedures in the network that splits
 	// centroids if they are too big. The threshold values are specified
 	// in EventLoopConfig.
-	SplitCentroids int
+	SplitCentroids TaskSchedule `json:"split_centroids"`
 	// MergeCentroids triggers procedures in the network that merges
 	// centroids if they are too small. The threshold values are
 	// specified in EventLoopConfig.
-	MergeCentroids int
+	MergeCentroids TaskSchedule `json:"merge_centroids"`
 	// LoadBalancing triggers load-balancing in the network.
-	LoadBalancing int
+	LoadBalancing TaskSchedule `json:"load_balancing"`
 	// Meta triggers polling of metadata for the logger ('L' field in
 	// EventLoopConfig, data is passed to the LogMeta method).
-	Meta int
+	Meta TaskSchedule `json:"meta"`
 }
 
-// Clams vals in EventLoopTaskSkipConfig (particularly useful for
-// ensuring no zeros (zero div err when using modulus))
-func (cfg *EventLoopTaskSkipConfig) clamp(min, max int) {
-	items := []*int{
-		&cfg.Expire,
-		&cfg.MemTrim,
-		&cfg.DistributeDataPointsFast,
-		&cfg.DistributeDataPointsAccurate,
-		&cfg.DistributeDataPointsInternal,
-		&cfg.SplitCentroids,
-		&cfg.MergeCentroids,
-		&cfg.LoadBalancing,
-	}
-	for _, v := range items {
-		if *v < min {
-			*v = min
-		}
-		if *v > max {
-			*v = max
+// Validate returns an error describing the first invalid schedule, or nil.
+func (s *EventLoopSchedules) Validate() error {
+	v := reflect.ValueOf(*s)
+	for i := 0; i < v.NumField(); i++ {
+		if err := v.Field(i).Interface().(TaskSchedule).Validate(); err != nil {
+			return fmt.Errorf("%v: %v", v.Type().Field(i).Name, err)
 		}
 	}
-}
-
-type eventLoopInternal struct {
-	stopped bool
-	iter    int
+	return nil
 }
 
 // EventLoopConfig is a config type for the event loop in this pkg.
@@ -89,14 +167,9 @@ type EventLoopConfig struct {
 	// All addresses in the network, should include LocalAddr.
 	RemoteAddrs []Addr
 
-	// Timeout for each loop interation.
-	TimeoutLoop time.Duration
-	// Timeout for each task in the event loop.
-	TimeoutStep time.Duration
-
-	// Each task in the event loop will be skippable. See doc for
-	// EventLoopTaskSkipConfig for more details.
-	TaskSkip EventLoopTaskSkipConfig
+	// Each task in the event loop runs on its own schedule. See doc
+	// for TaskSchedule for more details.
+	Schedules EventLoopSchedules
 
 	// Specifies how many datapoints each node in the network should
 	// distribute in haste (for data integrity in the network). This
@@ -132,6 +205,26 @@ type EventLoopConfig struct {
 	// in which centroids will be merged.
 	MergeCentroidsMax int
 
+	// Load balancing gives each node a share of the data (bytes) in each
+	// namespace that is proportional to its capacity (see Capacity in
+	// rpc.KMeansServer). A node only takes data from others if it's below
+	// its share by more than this fraction of it, such that data isn't
+	// moved back and forth over small differences. Must be in [0, 1).
+	LoadBalancingMargin float64
+
+	// Adaptive mode, where some tasks run more or less often than their
+	// schedule says, depending on metrics pulled from the network. See
+	// doc for AdaptiveConfig for more details.
+	Adaptive AdaptiveConfig
+
+	// Custom tasks which run next to the built-in ones, see doc for Task
+	// and EventLoopConfig.Register.
+	Tasks []Task
+	// Names of built-in tasks which shouldn't run at all (see
+	// BuiltinTasks). Unlike a zero schedule, this can't be undone with
+	// Retune.
+	DisabledTasks []string
+
 	// The logger interface in this pkg has two methods, on of them
 	// (named 'LogMeta') receves a MetaData type as arg, which has
 	// some metadata for nodes. This metadata is pulled from the
@@ -142,27 +235,52 @@ type EventLoopConfig struct {
 	// defined in this config type). Also see docs for Logger interface
 	// and MetaData type.
 	LogLocalOnly bool
+	// Dashboard makes the default logger (see field 'L') redraw a table
+	// with metadata for all nodes in the terminal on each task event,
+	// instead of writing structured events. Only compatible with unix-based
+	// systems, since it clears the terminal with the 'clear' command.
+	Dashboard bool
 	// Logger for the event loop. See docs for Logger interface. If nil,
-	// then this field is set as a default logger in this pkg, it'll simply
-	// log events in the terminal. At the moment of writing, the default
-	// logger is only compatible with unix-based systems.
+	// then this field is set as a default logger in this pkg, which writes
+	// events to logging.Default() (pkg/logging), or draws the dashboard if
+	// Dashboard=true.
 	L Logger
 
-	// Added by event loop.
-	internal eventLoopInternal
+	// Clock for the schedules of tasks, nil means the process-wide clock
+	// (see pkg/clock). Set by Simulation for running in virtual time.
+	Clock clock.Clock
+	// Random source for the jitter of schedules, nil means the global
+	// source in math/rand. Set (with a seed) by Simulation, such that runs
+	// are reproducible.
+	Rand *rand.Rand
+
+	// Added by event loop, see ./tune.go.
+	internal *eventLoopInternal
 }
 
 func (cfg *EventLoopConfig) validate() {
 	if cfg == nil {
 		panic("nil eventloop cfg")
 	}
-	if cfg.L == nil {
-		cfg.L = &defaultLogger{
+	if cfg.L == nil && cfg.Dashboard {
+		cfg.L = &dashboardLogger{
 			localOnly:   cfg.LogLocalOnly,
 			localAddr:   cfg.LocalAddr,
 			globalAddrs: cfg.RemoteAddrs,
 		}
 	}
+	if cfg.L == nil {
+		cfg.L = &structuredLogger{localAddr: cfg.LocalAddr}
+	}
 
-	cfg.TaskSkip.clamp(1, 1000)
+	if err := cfg.Schedules.Validate(); err != nil {
+		panic("invalid eventloop schedule: " + err.Error())
+	}
+	cfg.Adaptive.validate()
+	if err := validateTasks(cfg.Tasks); err != nil {
+		panic("invalid eventloop task: " + err.Error())
+	}
+	if err := validateDisabled(cfg.DisabledTasks); err != nil {
+		panic("invalid eventloop disabled tasks: " + err.Error())
+	}
 }
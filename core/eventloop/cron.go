@@ -0,0 +1,135 @@
+package eventloop
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronExpr is a parsed cron expression with the usual five fields (minute,
+// hour, day of month, month, day of week). Each field is a set of allowed
+// values, stored as a bitmask.
+type cronExpr struct {
+	minute, hour, dom, month, dow uint64
+	// True if the field was '*', needed for the day-of-month/day-of-week
+	// rule (see match).
+	domAny, dowAny bool
+}
+
+// Bounds for each field in a cron expression, in order.
+var cronBounds = [5][2]int{
+	{0, 59}, // Minute.
+	{0, 23}, // Hour.
+	{1, 31}, // Day of month.
+	{1, 12}, // Month.
+	{0, 6},  // Day of week (0 is sunday).
+}
+
+// parseCron parses a cron expression such as "*/15 * * * *" (every 15 min)
+// or "0 3 * * 1-5" (03:00 on weekdays). Each field can be '*', a value, a
+// range 'a-b', a step '*/n' or 'a-b/n', or a comma-separated list of those.
+// Names (e.g 'mon') and other extensions are not supported.
+func parseCron(s string) (*cronExpr, error) {
+	parts := strings.Fields(s)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("cron %q: want 5 fields, got %v", s, len(parts))
+	}
+	var masks [5]uint64
+	for i, part := range parts {
+		mask, err := parseCronField(part, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: field %v: %v", s, i+1, err)
+		}
+		masks[i] = mask
+	}
+	return &cronExpr{
+		minute: masks[0], hour: masks[1], dom: masks[2], month: masks[3], dow: masks[4],
+		domAny: parts[2] == "*", dowAny: parts[4] == "*",
+	}, nil
+}
+
+func parseCronField(s string, min, max int) (uint64, error) {
+	var mask uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, step := item, 1
+		if i := strings.IndexByte(item, '/'); i >= 0 {
+			rng = item[:i]
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		switch i := strings.IndexByte(rng, '-'); {
+		case rng == "*":
+		case i >= 0:
+			a, errA := strconv.Atoi(rng[:i])
+			b, errB := strconv.Atoi(rng[i+1:])
+			if errA != nil || errB != nil {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+			lo, hi = a, b
+		default:
+			a, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", rng)
+			}
+			lo, hi = a, a
+			// 'a/n' means 'a-max/n'.
+			if step != 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range [%v, %v]", item, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return mask, nil
+}
+
+func cronHas(mask uint64, v int) bool { return mask&(1<<uint(v)) != 0 }
+
+// matchDay follows the traditional cron rule: if both day of month and day
+// of week are restricted, then a day matching either is fine.
+func (c *cronExpr) matchDay(t time.Time) bool {
+	dom := cronHas(c.dom, t.Day())
+	dow := cronHas(c.dow, int(t.Weekday()))
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time (with minute precision) after 't' which
+// matches the expression. Returns false if there is no such time within
+// five years (e.g "0 0 31 2 *").
+func (c *cronExpr) next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case !cronHas(c.month, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !cronHas(c.hour, t.Hour()):
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			// Can happen around daylight saving time changes.
+			if !next.After(t) {
+				next = t.Add(time.Hour)
+			}
+			t = next
+		case !cronHas(c.minute, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
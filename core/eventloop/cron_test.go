@@ -0,0 +1,65 @@
+package eventloop
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	bad := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 7",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	}
+	for _, s := range bad {
+		if _, err := parseCron(s); err == nil {
+			t.Fatalf("expected err for %q", s)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A sunday.
+	now := time.Date(2021, 8, 1, 12, 30, 10, 0, time.UTC)
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2021, month, day, hour, min, 0, 0, time.UTC)
+	}
+	table := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", at(8, 1, 12, 31)},
+		{"*/15 * * * *", at(8, 1, 12, 45)},
+		{"0,30 * * * *", at(8, 1, 13, 0)},
+		{"0 3 * * *", at(8, 2, 3, 0)},
+		{"0 3 * * 1-5", at(8, 2, 3, 0)},
+		{"0 3 * * 6", at(8, 7, 3, 0)},
+		{"15 10 15 * *", at(8, 15, 10, 15)},
+		{"0 0 1 1 *", time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// Either day of month or day of week.
+		{"0 0 10 * 3", at(8, 4, 0, 0)},
+		{"0 9-17/4 * * *", at(8, 1, 13, 0)},
+	}
+	for _, item := range table {
+		expr, err := parseCron(item.expr)
+		if err != nil {
+			t.Fatalf("unexpected err for %q: %v", item.expr, err)
+		}
+		got, ok := expr.next(now)
+		if !ok || !got.Equal(item.want) {
+			t.Fatalf("unexpected next for %q. want %v, got %v", item.expr, item.want, got)
+		}
+	}
+
+	expr, _ := parseCron("0 0 31 2 *")
+	if _, ok := expr.next(now); ok {
+		t.Fatalf("expected no next for a date that doesn't exist")
+	}
+}
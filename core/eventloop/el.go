@@ -1,58 +1,240 @@
 package eventloop
 
 import (
+	"context"
+	"sync"
 	"time"
 	"trypo/pkg/arbiter"
+	"trypo/pkg/clock"
 )
 
 type Addr = arbiter.Addr
 
-// Intended to be used for each event loop task in the event loop.
-func elStep(cfg *EventLoopConfig, task func(*EventLoopConfig)) {
-	// For quickly aborting all steps in eventloop.
-	if cfg.internal.stopped {
-		return
+// Runtime state of an event loop. The mutex guards the tuning in
+// EventLoopConfig, 'changed' and 'adaptive', which are accessed by all tasks
+// and by other goroutines (see EventLoopConfig.Retune).
+type eventLoopInternal struct {
+	sync.Mutex
+	// Closed (and replaced) by notify, such that tasks waiting for their
+	// next run can pick up a changed schedule.
+	changed chan struct{}
+	// Tracks running tasks, see ./sched.go.
+	sched *scheduler
+	// Decisions of the adaptive mode, see ./adaptive.go.
+	adaptive *adaptiveState
+}
+
+// notify wakes all tasks which are waiting for their next run, should be
+// called (with the lock held) when schedules might have changed.
+func (in *eventLoopInternal) notify() {
+	close(in.changed)
+	in.changed = make(chan struct{})
+}
+
+// Signature of all event loop tasks. 't' is a snapshot of the tuning, taken
+// when the task was started; tasks should use it instead of the tuning fields
+// in 'cfg', which can change concurrently (see EventLoopConfig.Retune).
+type taskFunc func(ctx context.Context, cfg *EventLoopConfig, t *EventLoopTuning)
+
+// elTask is a task in the event loop.
+type elTask struct {
+	name string
+	// Picks the schedule for this task.
+	schedule func(*EventLoopSchedules) TaskSchedule
+	run      taskFunc
+}
+
+// All built-in event loop tasks (see ./eltask.go). They are independent, so
+// the order doesn't matter. See ./task.go for custom tasks.
+var elTasks = []elTask{
+	{"meta", func(s *EventLoopSchedules) TaskSchedule { return s.Meta }, eltMeta},
+	{"expire", func(s *EventLoopSchedules) TaskSchedule { return s.Expire }, eltExpire},
+	{"memtrim", func(s *EventLoopSchedules) TaskSchedule { return s.MemTrim }, eltMemTrim},
+	{"merge", func(s *EventLoopSchedules) TaskSchedule { return s.MergeCentroids }, eltMergeCentroids},
+	{"split", func(s *EventLoopSchedules) TaskSchedule { return s.SplitCentroids }, eltSplitCentroids},
+	{"distri internal", func(s *EventLoopSchedules) TaskSchedule { return s.DistributeDataPointsInternal },
+		eltDistributeDataPointsInternal},
+	{"distri fast", func(s *EventLoopSchedules) TaskSchedule { return s.DistributeDataPointsFast },
+		eltDistributeDataPointsFast},
+	{"distri accurate", func(s *EventLoopSchedules) TaskSchedule { return s.DistributeDataPointsAccurate },
+		eltDistributeDataPointsAccurate},
+	{"load balancing", func(s *EventLoopSchedules) TaskSchedule { return s.LoadBalancing }, eltLoadBalancing},
+}
+
+// start prepares cfg for running an event loop.
+func (cfg *EventLoopConfig) start() {
+	cfg.validate()
+	cfg.internal = &eventLoopInternal{
+		changed:  make(chan struct{}),
+		sched:    newScheduler(),
+		adaptive: &adaptiveState{},
 	}
-	time.Sleep(cfg.TimeoutStep)
+}
 
-	// Neat in case timeout is long.
-	if cfg.internal.stopped {
-		return
+// current returns the schedule of 'task' (adjusted by the adaptive mode),
+// and a chan which is closed when it might have changed.
+func (cfg *EventLoopConfig) current(task elTask) (TaskSchedule, <-chan struct{}) {
+	cfg.internal.Lock()
+	defer cfg.internal.Unlock()
+	s := cfg.internal.adaptive.adapt(task.name, task.schedule(&cfg.Schedules))
+	return s, cfg.internal.changed
+}
+
+// clock returns cfg.Clock, or the process-wide clock if it isn't set.
+func (cfg *EventLoopConfig) clock() clock.Clock {
+	if cfg.Clock != nil {
+		return cfg.Clock
 	}
-	task(cfg)
+	return clock.Default()
 }
 
-func EventLoop(cfg *EventLoopConfig) func() {
-	cfg.validate()
+// next returns the next run of schedule 's' (see TaskSchedule.next), with the
+// clock and random source of cfg.
+func (cfg *EventLoopConfig) next(s TaskSchedule) (time.Time, bool) {
+	cfg.internal.Lock()
+	defer cfg.internal.Unlock()
+	return s.next(cfg.clock().Now(), cfg.Rand)
+}
 
-	go func() {
-		// Note: tasks are _not_ arbitrarily ordered.
-		for cfg.internal.stopped == false {
-			time.Sleep(cfg.TimeoutLoop)
+// schedule runs 'task' according to its schedule until ctx is done. Runs are
+// started in the background (see scheduler.spawn), so a slow run doesn't
+// delay the next one, that is instead limited by TaskSchedule.MaxConcurrency.
+func (cfg *EventLoopConfig) schedule(ctx context.Context, task elTask) {
+	var sched TaskSchedule
+	var due time.Time
+	var ok bool
+	first := true
+	for {
+		s, changed := cfg.current(task)
+		// The next run is only re-calculated if this schedule has
+		// changed, such that retuning other things doesn't delay it.
+		if first || s != sched {
+			sched, first = s, false
+			due, ok = cfg.next(sched)
+		}
 
-			elStep(cfg, eltMeta)
+		// Nil chan (disabled schedule) blocks forever.
+		var timeout <-chan time.Time
+		c := cfg.clock()
+		timer := c.NewTimer(due.Sub(c.Now()))
+		if ok {
+			timeout = timer.C()
+		}
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-changed:
+			timer.Stop()
+			continue
+		case <-timeout:
+		}
 
-			elStep(cfg, eltExpire)
-			elStep(cfg, eltMemTrim)
+		cfg.spawn(ctx, task, sched)
+		due, ok = cfg.next(sched)
+	}
+}
 
-			elStep(cfg, eltMergeCentroids)
-			elStep(cfg, eltSplitCentroids)
+// spawn starts one run of 'task' in the background, unless too many runs of
+// it are already in progress.
+func (cfg *EventLoopConfig) spawn(ctx context.Context, task elTask, s TaskSchedule) {
+	t := cfg.runTuning()
 
-			elStep(cfg, eltDistributeDataPointsInternal)
-			elStep(cfg, eltDistributeDataPointsFast)
-			elStep(cfg, eltDistributeDataPointsAccurate)
+	ok := cfg.internal.sched.spawn(ctx, task.name, s.MaxConcurrency, func(ctx context.Context) {
+		cfg.runTask(ctx, task, s, &t)
+	})
+	if !ok && ctx.Err() == nil {
+		taskSkipped.Inc(task.name)
+		cfg.L.LogTask(task.name, "skipped (still running)")
+	}
+}
 
-			elStep(cfg, eltLoadBalancing)
+// runTask runs 'task' once (in this goroutine), within the timeout of 's'.
+// Both the timeout and the measured duration follow the clock of cfg.
+func (cfg *EventLoopConfig) runTask(ctx context.Context, task elTask, s TaskSchedule, t *EventLoopTuning) {
+	c := cfg.clock()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = withTimeout(ctx, c, s.Timeout)
+		defer cancel()
+	}
+	start := c.Now()
+	task.run(ctx, cfg, t)
+	taskDuration.Observe(c.Now().Sub(start).Seconds(), task.name)
+}
 
-			// Tick & wraparound.
-			cfg.internal.iter++
-			if cfg.internal.iter > 1000 {
-				cfg.internal.iter = 0
-			}
+// withTimeout is like context.WithTimeout, except that the timeout is a timer
+// of 'c' (so it's cancelled in virtual time with a clock.Virtual).
+func withTimeout(ctx context.Context, c clock.Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	timer := c.NewTimer(d)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C():
+			cancel()
+		case <-ctx.Done():
 		}
 	}()
+	return ctx, cancel
+}
+
+// runTuning returns the tuning for a run of a task: a snapshot of the tuning
+// in cfg, adjusted by the adaptive mode.
+func (cfg *EventLoopConfig) runTuning() EventLoopTuning {
+	cfg.internal.Lock()
+	defer cfg.internal.Unlock()
+	t := cfg.tuning()
+	cfg.internal.adaptive.adaptTuning(&t)
+	return t
+}
+
+// run is the event loop itself, see Run.
+func (cfg *EventLoopConfig) run(ctx context.Context) {
+	// Wait for all task runs, such that nothing is running when this
+	// returns.
+	defer cfg.internal.sched.wait()
+
+	var wg sync.WaitGroup
+	for _, task := range cfg.tasks() {
+		wg.Add(1)
+		go func(task elTask) {
+			defer wg.Done()
+			cfg.schedule(ctx, task)
+		}(task)
+	}
+	wg.Wait()
+}
+
+// Run runs the event loop until ctx is done, and then waits for all running
+// tasks to finish before returning. Each task runs on its own schedule (see
+// TaskSchedule), independently of the other tasks. Note that work which is
+// done by remote nodes (triggered with RPC calls) can't be cancelled, so a
+// stop might have to wait for those calls to return.
+//
+// The fields of 'cfg' should not be written to while the event loop is
+// running; use cfg.Retune for changing parameters at runtime. Since Retune
+// depends on state set up by this func, see also EventLoop.
+func Run(ctx context.Context, cfg *EventLoopConfig) {
+	cfg.start()
+	cfg.run(ctx)
+}
+
+// EventLoop starts the event loop (see Run) in a new goroutine, and returns a
+// func for stopping it. The stop func blocks until all running tasks are
+// done, and can be called more than once.
+func EventLoop(cfg *EventLoopConfig) func() {
+	cfg.start()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cfg.run(ctx)
+	}()
 
 	return func() {
-		cfg.internal.stopped = true
+		cancel()
+		<-done
 	}
 }
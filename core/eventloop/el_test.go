@@ -17,6 +17,7 @@ import (
 	"trypo/core/testutils"
 	"trypo/pkg/kmeans/common"
 	"trypo/pkg/kmeans/rpc"
+	"trypo/pkg/logging"
 	"trypo/pkg/mathutils"
 	"trypo/pkg/searchutils"
 )
@@ -254,10 +255,10 @@ func (l *tLogger) LogMeta(m MetaData) {
 	l.monitor.metaData[l.addr] = m
 }
 
-func (l *tLogger) LogTask(s string) {
+func (l *tLogger) LogTask(task, msg string, fields ...logging.Field) {
 	l.monitor.Lock()
 	defer l.monitor.Unlock()
-	l.monitor.taskData[l.addr] = s
+	l.monitor.taskData[l.addr] = task + ": " + msg
 }
 
 /*
@@ -269,23 +270,27 @@ CFG stuff.
 func cfg(addr Addr, addrs []Addr, m *tMonitor) *EventLoopConfig {
 
 	rand.Seed(time.Now().UnixNano())
+	// Every 1-4s, with some jitter.
+	every := func() TaskSchedule {
+		return TaskSchedule{
+			Every:  time.Second * time.Duration(rand.Intn(3)+1),
+			Jitter: time.Second,
+		}
+	}
 	return &EventLoopConfig{
 		LocalAddr:   addr,
 		RemoteAddrs: addrs,
 
-		TimeoutLoop: time.Second * 1,
-		TimeoutStep: time.Millisecond * time.Duration(rand.Intn(1000)+100),
-
-		TaskSkip: EventLoopTaskSkipConfig{
-			Expire:                       rand.Intn(3) + 1,
-			MemTrim:                      rand.Intn(3) + 1,
-			DistributeDataPointsFast:     rand.Intn(3) + 1,
-			DistributeDataPointsAccurate: rand.Intn(3) + 1,
-			DistributeDataPointsInternal: rand.Intn(3) + 1,
-			SplitCentroids:               rand.Intn(3) + 1,
-			MergeCentroids:               rand.Intn(3) + 1,
-			LoadBalancing:                rand.Intn(3) + 1,
-			Meta:                         1,
+		Schedules: EventLoopSchedules{
+			Expire:                       every(),
+			MemTrim:                      every(),
+			DistributeDataPointsFast:     every(),
+			DistributeDataPointsAccurate: every(),
+			DistributeDataPointsInternal: every(),
+			SplitCentroids:               every(),
+			MergeCentroids:               every(),
+			LoadBalancing:                every(),
+			Meta:                         TaskSchedule{Every: time.Second},
 		},
 
 		DistributeDataPointsFastN:     100,
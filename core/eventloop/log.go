@@ -2,17 +2,21 @@ package eventloop
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"trypo/pkg/logging"
 )
 
 // Logger is a logger for the event-loop used in this pkg. It is primarily used
-// in EventLoopConfig. See method-specific docs for more details.
+// in EventLoopConfig. See method-specific docs for more details. Tasks run
+// concurrently, so implementations must be safe for concurrent use.
 type Logger interface {
-	// LogTask is called rapidly for each event-loop task, with a string
-	// containing the task name and some additional info such as namespaces.
-	LogTask(string)
+	// LogTask is called rapidly for events in event-loop tasks, with the
+	// task name, a short description of the event and fields with details
+	// such as the namespace (see pkg/logging for common fields).
+	LogTask(task, msg string, fields ...logging.Field)
 	// LogMeta is intended to be used for system monitoring, with data pulled
 	// from either the local node, or all nodes in the network, depending on
 	// the LogLocalOnly field in EventLoopConfig. System data is stored in,
@@ -43,62 +47,101 @@ type MetaData struct {
 	Items map[Addr]MetaDataItem
 }
 
-type defaultLogger struct {
+// structuredLogger is the default Logger, it writes to logging.Default().
+type structuredLogger struct {
+	localAddr Addr
+}
+
+func (l *structuredLogger) LogTask(task, msg string, fields ...logging.Field) {
+	all := make([]logging.Field, 0, len(fields)+2)
+	all = append(all, logging.Node(l.localAddr.ToStr()), logging.Task(task))
+	logging.Default().Info(msg, append(all, fields...)...)
+}
+
+// LogMeta logs one event (with debug level) per node and namespace.
+func (l *structuredLogger) LogMeta(m MetaData) {
+	log := logging.Default()
+	if !log.Enabled(logging.LevelDebug) {
+		return
+	}
+	for addr, item := range m.Items {
+		for ns, n := range item.LenDP {
+			log.Debug("meta", logging.Node(addr.ToStr()), logging.Namespace(ns),
+				logging.F("dps", n), logging.F("centroids", item.LenCentroids[ns]))
+		}
+	}
+}
+
+// dashboardLogger redraws a table with metadata for nodes in the terminal
+// for each task event, see EventLoopConfig.Dashboard.
+type dashboardLogger struct {
+	sync.Mutex
 	localOnly   bool
 	localAddr   Addr
 	globalAddrs []Addr
 	metaData    MetaData
 }
 
-func (l *defaultLogger) LogMeta(m MetaData) { l.metaData = m }
+func (l *dashboardLogger) LogMeta(m MetaData) {
+	l.Lock()
+	defer l.Unlock()
+	l.metaData = m
+}
 
-func (l *defaultLogger) LogTask(s string) {
+func (l *dashboardLogger) LogTask(task, msg string, fields ...logging.Field) {
+	l.Lock()
+	defer l.Unlock()
 	if len(l.metaData.Items) == 0 {
-		log.Printf("[%v] task: %v", l.localAddr.ToStr(), s)
+		// Nothing to draw yet.
+		(&structuredLogger{localAddr: l.localAddr}).LogTask(task, msg, fields...)
 		return
 	}
 
+	// Task description, e.g "merge: merging centroids namespace=a".
+	desc := []string{fmt.Sprintf("%v: %v", task, msg)}
+	for _, f := range fields {
+		desc = append(desc, fmt.Sprintf("%v=%v", f.Key, f.Value))
+	}
+
 	// @ Only unix-based.
 	fmt.Println()
 	cmd := exec.Command("clear")
 	cmd.Stdout = os.Stdout
 	cmd.Run()
 
-	if len(l.metaData.Items) > 0 {
-		// Iter like this instead of l.metaData.Items because the order
-		// will get weird/inconsistent (since it's a map).
-		for _, addr := range l.globalAddrs {
-			// localOnly=true will only pull metadata from the local node. So
-			// if that's true, then it would be a bit ugly and unnecessary to
-			// print data for other nodes.
-			if l.localOnly && !addr.Comp(l.localAddr) {
-				continue
-			}
-
-			// Collect total amount of dps in the node (for all namespaces).
-			dpLen := 0
-			for _, l := range l.metaData.Items[addr].LenDP {
-				dpLen += l
-			}
-
-			// Collect total amount of centroids in the node (for all namespaces).
-			centroidLen := 0
-			for _, l := range l.metaData.Items[addr].LenCentroids {
-				centroidLen += l
-			}
-
-			nsLen := len(l.metaData.Items[addr].LenDP)
-
-			// Node data.
-			line := fmt.Sprintf("[%v] namespaces: %3d | centroids: %6d | dps: %6d |",
-				addr.ToStr(), nsLen, centroidLen, dpLen)
-
-			// Add current process description to node data this node is local.
-			if addr.Comp(l.localAddr) {
-				line += fmt.Sprintf(" task: %v", s)
-			}
-
-			log.Println(line)
+	// Iter like this instead of l.metaData.Items because the order
+	// will get weird/inconsistent (since it's a map).
+	for _, addr := range l.globalAddrs {
+		// localOnly=true will only pull metadata from the local node. So
+		// if that's true, then it would be a bit ugly and unnecessary to
+		// print data for other nodes.
+		if l.localOnly && !addr.Comp(l.localAddr) {
+			continue
+		}
+
+		// Collect total amount of dps in the node (for all namespaces).
+		dpLen := 0
+		for _, l := range l.metaData.Items[addr].LenDP {
+			dpLen += l
+		}
+
+		// Collect total amount of centroids in the node (for all namespaces).
+		centroidLen := 0
+		for _, l := range l.metaData.Items[addr].LenCentroids {
+			centroidLen += l
 		}
+
+		nsLen := len(l.metaData.Items[addr].LenDP)
+
+		// Node data.
+		line := fmt.Sprintf("[%v] namespaces: %3d | centroids: %6d | dps: %6d |",
+			addr.ToStr(), nsLen, centroidLen, dpLen)
+
+		// Add current process description to node data this node is local.
+		if addr.Comp(l.localAddr) {
+			line += " task: " + strings.Join(desc, " ")
+		}
+
+		fmt.Println(line)
 	}
 }
@@ -0,0 +1,39 @@
+package eventloop
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"trypo/pkg/logging"
+)
+
+func TestDefaultLogger(t *testing.T) {
+	prev := logging.Default()
+	defer logging.SetDefault(prev)
+	var b bytes.Buffer
+	logging.SetDefault(logging.New(&b, logging.LevelDebug, logging.FormatLogfmt))
+
+	addr := Addr{IP: "localhost", Port: "1"}
+	cfg := &EventLoopConfig{LocalAddr: addr, RemoteAddrs: []Addr{addr}}
+	cfg.validate()
+	if _, ok := cfg.L.(*structuredLogger); !ok {
+		t.Fatalf("unexpected default logger: %T", cfg.L)
+	}
+
+	cfg.L.LogTask("merge", "merging centroids", logging.Namespace("a"))
+	cfg.L.LogMeta(MetaData{Items: map[Addr]MetaDataItem{
+		addr: {LenDP: map[string]int{"a": 3}, LenCentroids: map[string]int{"a": 1}},
+	}})
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 ||
+		!strings.Contains(lines[0], `level=info msg="merging centroids" node=localhost:1 task=merge namespace=a`) ||
+		!strings.Contains(lines[1], `level=debug msg=meta node=localhost:1 namespace=a dps=3 centroids=1`) {
+		t.Fatalf("unexpected output:\n%v", b.String())
+	}
+
+	cfg = &EventLoopConfig{LocalAddr: addr, RemoteAddrs: []Addr{addr}, Dashboard: true}
+	cfg.validate()
+	if _, ok := cfg.L.(*dashboardLogger); !ok {
+		t.Fatalf("dashboard wasn't used: %T", cfg.L)
+	}
+}
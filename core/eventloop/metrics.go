@@ -0,0 +1,19 @@
+package eventloop
+
+import "trypo/pkg/metrics"
+
+// Metrics for event loop tasks, labelled by task name.
+var (
+	taskDuration = metrics.Default.Histogram("trypo_eventloop_task_duration_seconds",
+		"Duration of event loop task runs.",
+		[]float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300}, "task")
+	taskSkipped = metrics.Default.Counter("trypo_eventloop_task_skipped_total",
+		"Event loop task runs skipped because of the concurrency limit.", "task")
+
+	// See AdaptiveConfig.
+	adaptiveFactor = metrics.Default.Gauge("trypo_eventloop_adaptive_factor",
+		"Current speed-up (>1) or back-off (<1) factor of tasks in the adaptive mode, 0 if paused.",
+		"task")
+	adaptiveTriggers = metrics.Default.Counter("trypo_eventloop_adaptive_triggers_total",
+		"Adaptive decisions where a signal at its threshold sped up a task.", "task", "signal")
+)
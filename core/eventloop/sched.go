@@ -0,0 +1,95 @@
+package eventloop
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// scheduler runs event loop work, keyed by name, and keeps track of what is
+// running. Each key has a limit of how many runs can be in progress at once;
+// work that would exceed it is skipped instead of being started, such that
+// slow work (e.g a merge in a large namespace) doesn't pile up.
+type scheduler struct {
+	mu      sync.Mutex
+	running map[string]int
+	wg      sync.WaitGroup
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{running: make(map[string]int)}
+}
+
+// claim marks one more run of 'key' as running, returns false if 'max' runs
+// (at least one) already are.
+func (s *scheduler) claim(key string, max int) bool {
+	if max < 1 {
+		max = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[key] >= max {
+		return false
+	}
+	s.running[key]++
+	s.wg.Add(1)
+	return true
+}
+
+func (s *scheduler) release(key string) {
+	s.mu.Lock()
+	s.running[key]--
+	if s.running[key] == 0 {
+		delete(s.running, key)
+	}
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// spawn calls f in a new goroutine (without waiting), unless 'max' runs with
+// the same key are running or ctx is done, in which case false is returned.
+func (s *scheduler) spawn(ctx context.Context, key string, max int, f func(context.Context)) bool {
+	if ctx.Err() != nil || !s.claim(key, max) {
+		return false
+	}
+	go func() {
+		defer s.release(key)
+		f(ctx)
+	}()
+	return true
+}
+
+// wait blocks until all work is done.
+func (s *scheduler) wait() { s.wg.Wait() }
+
+// next returns the time of the next run after 'now' (including jitter, drawn
+// from 'rnd', or the global source in math/rand if nil), or false if the
+// schedule is disabled (or a cron expression never matches). Assumes that the
+// schedule is valid.
+func (s TaskSchedule) next(now time.Time, rnd *rand.Rand) (time.Time, bool) {
+	var t time.Time
+	switch {
+	case s.Every > 0:
+		t = now.Add(s.Every)
+	case s.Cron != "":
+		expr, err := parseCron(s.Cron)
+		if err != nil {
+			return t, false
+		}
+		var ok bool
+		if t, ok = expr.next(now); !ok {
+			return t, false
+		}
+	default:
+		return t, false
+	}
+	if s.Jitter > 0 {
+		if rnd != nil {
+			t = t.Add(time.Duration(rnd.Int63n(int64(s.Jitter))))
+		} else {
+			t = t.Add(time.Duration(rand.Int63n(int64(s.Jitter))))
+		}
+	}
+	return t, true
+}
@@ -0,0 +1,140 @@
+package eventloop
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerMaxConcurrency(t *testing.T) {
+	s := newScheduler()
+	ctx := context.Background()
+
+	block := make(chan struct{})
+	f := func(context.Context) { <-block }
+	for i := 0; i < 2; i++ {
+		if !s.spawn(ctx, "a", 2, f) {
+			t.Fatalf("spawn %v was skipped", i)
+		}
+	}
+	// Same key while at max.
+	if s.spawn(ctx, "a", 2, f) {
+		t.Fatalf("spawn above max wasn't skipped")
+	}
+	// Other keys are fine, max below 1 is treated as 1.
+	if !s.spawn(ctx, "b", 0, f) {
+		t.Fatalf("spawn with another key was skipped")
+	}
+	if s.spawn(ctx, "b", 0, f) {
+		t.Fatalf("spawn above max (1) wasn't skipped")
+	}
+
+	close(block)
+	s.wait()
+	if !s.spawn(ctx, "a", 1, func(context.Context) {}) {
+		t.Fatalf("spawn was skipped after the key was released")
+	}
+	s.wait()
+}
+
+func TestSchedulerCancelled(t *testing.T) {
+	s := newScheduler()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if s.spawn(ctx, "a", 1, func(context.Context) {}) {
+		t.Fatalf("spawn wasn't skipped with a done ctx")
+	}
+}
+
+// Intended to be ran with -race.
+func TestSchedulerWait(t *testing.T) {
+	s := newScheduler()
+	ctx := context.Background()
+
+	var n int32
+	for _, key := range []string{"a", "b", "c"} {
+		s.spawn(ctx, key, 1, func(context.Context) {
+			time.Sleep(time.Millisecond * 10)
+			atomic.AddInt32(&n, 1)
+		})
+	}
+	s.wait()
+	if atomic.LoadInt32(&n) != 3 {
+		t.Fatalf("wait returned before all work was done, n=%v", n)
+	}
+}
+
+func TestTaskScheduleNext(t *testing.T) {
+	now := time.Date(2021, 8, 1, 12, 30, 10, 0, time.UTC)
+
+	if _, ok := (TaskSchedule{}).next(now, nil); ok {
+		t.Fatalf("zero schedule isn't disabled")
+	}
+	if next, _ := (TaskSchedule{Every: time.Minute}).next(now, nil); !next.Equal(now.Add(time.Minute)) {
+		t.Fatalf("unexpected next for interval: %v", next)
+	}
+	next, _ := (TaskSchedule{Cron: "*/15 * * * *"}).next(now, nil)
+	if want := time.Date(2021, 8, 1, 12, 45, 0, 0, time.UTC); !next.Equal(want) {
+		t.Fatalf("unexpected next for cron. want %v, got %v", want, next)
+	}
+
+	s := TaskSchedule{Every: time.Minute, Jitter: time.Second}
+	for i := 0; i < 100; i++ {
+		next, _ := s.next(now, nil)
+		if d := next.Sub(now); d < time.Minute || d >= time.Minute+time.Second {
+			t.Fatalf("jitter out of range: %v", d)
+		}
+	}
+
+	// Same seed, same jitter.
+	a, b := rand.New(rand.NewSource(1)), rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		nextA, _ := s.next(now, a)
+		nextB, _ := s.next(now, b)
+		if !nextA.Equal(nextB) {
+			t.Fatalf("jitter with the same seed differs: %v, %v", nextA, nextB)
+		}
+	}
+}
+
+// A slow task shouldn't delay others (each task has its own schedule).
+func TestIndependentSchedules(t *testing.T) {
+	l := &recLogger{}
+	cfg := tuneCfg(l)
+	cfg.Schedules.Meta = TaskSchedule{Every: time.Millisecond}
+
+	block := make(chan struct{})
+	cfg.start()
+	ctx, cancel := context.WithCancel(context.Background())
+	var metaRuns int32
+	slow := elTask{"slow", func(s *EventLoopSchedules) TaskSchedule { return s.LoadBalancing },
+		func(context.Context, *EventLoopConfig, *EventLoopTuning) { <-block }}
+	fast := elTask{"fast", func(s *EventLoopSchedules) TaskSchedule { return s.Meta },
+		func(context.Context, *EventLoopConfig, *EventLoopTuning) { atomic.AddInt32(&metaRuns, 1) }}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		go cfg.schedule(ctx, slow)
+		cfg.schedule(ctx, fast)
+	}()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt32(&metaRuns) < 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("fast task was delayed by slow task")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if l.find("slow: skipped (still running)") == "" {
+		t.Fatalf("overlapping run of slow task wasn't skipped")
+	}
+
+	close(block)
+	cancel()
+	<-done
+	cfg.internal.sched.wait()
+}
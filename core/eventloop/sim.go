@@ -0,0 +1,123 @@
+package eventloop
+
+import (
+	"context"
+	"math/rand"
+	"time"
+	"trypo/pkg/clock"
+)
+
+// Simulation runs the event loops of many nodes in virtual time (see
+// pkg/clock), such that the behaviour of a network over hours (e.g how fast
+// load balancing converges) can be tested in seconds, and reproduced.
+//
+// Tasks don't run in the background like with Run, but one at a time, in the
+// order of their due times (ties are broken by the order of the configs and
+// then of the tasks), and the clock is moved to the due time of each run
+// before it starts. Virtual time doesn't pass while a task runs. The jitter
+// of each node is drawn from a random source seeded by the simulation, so a
+// simulation with the same seed and nodes makes the same runs each time.
+//
+// The process-wide clock is set to the virtual clock until Close is called,
+// such that the expiry of datapoints (see common.DataPoint.Expired) follows
+// it too. So only one simulation should exist at a time, and it shouldn't run
+// next to code that depends on the real time.
+type Simulation struct {
+	// Clock is the virtual clock of all nodes.
+	Clock *clock.Virtual
+	nodes []*simNode
+}
+
+// simNode is the state of one event loop in a Simulation.
+type simNode struct {
+	cfg   *EventLoopConfig
+	tasks []simTask
+}
+
+type simTask struct {
+	task elTask
+	// Current schedule, and the next run (if ok).
+	sched TaskSchedule
+	due   time.Time
+	ok    bool
+}
+
+// NewSimulation creates a simulation of the event loops in 'cfgs', starting
+// at 'start'. The Clock and Rand fields of each config are set (the random
+// source of the config at index i is seeded with seed+i), which means that
+// the configs shouldn't be used for anything else. Panics for invalid configs,
+// like Run.
+func NewSimulation(start time.Time, seed int64, cfgs ...*EventLoopConfig) *Simulation {
+	sim := &Simulation{Clock: clock.NewVirtual(start)}
+	clock.SetDefault(sim.Clock)
+
+	for i, cfg := range cfgs {
+		cfg.Clock = sim.Clock
+		cfg.Rand = rand.New(rand.NewSource(seed + int64(i)))
+		cfg.start()
+
+		node := &simNode{cfg: cfg}
+		for _, task := range cfg.tasks() {
+			st := simTask{task: task}
+			st.sched, _ = cfg.current(task)
+			st.due, st.ok = cfg.next(st.sched)
+			node.tasks = append(node.tasks, st)
+		}
+		sim.nodes = append(sim.nodes, node)
+	}
+	return sim
+}
+
+// Run runs all tasks that are due within 'd' (of virtual time) and returns how
+// many runs there were. The clock is at the end of 'd' when this returns.
+func (sim *Simulation) Run(d time.Duration) int {
+	end := sim.Clock.Now().Add(d)
+	runs := 0
+	for sim.step(end) {
+		runs++
+	}
+	sim.Clock.Set(end)
+	return runs
+}
+
+// step runs the task that is due first (not after 'end'), returns false if
+// there is none.
+func (sim *Simulation) step(end time.Time) bool {
+	var next *simTask
+	var node *simNode
+	for _, n := range sim.nodes {
+		for i := range n.tasks {
+			st := &n.tasks[i]
+			if st.ok && !st.due.After(end) && (next == nil || st.due.Before(next.due)) {
+				next, node = st, n
+			}
+		}
+	}
+	if next == nil {
+		return false
+	}
+
+	sim.Clock.Set(next.due)
+	t := node.cfg.runTuning()
+	node.cfg.runTask(context.Background(), next.task, next.sched, &t)
+	next.due, next.ok = node.cfg.next(next.sched)
+
+	// Pick up schedules that have changed (with Retune or by the adaptive
+	// mode), like EventLoopConfig.schedule.
+	for _, n := range sim.nodes {
+		for i := range n.tasks {
+			st := &n.tasks[i]
+			if s, _ := n.cfg.current(st.task); s != st.sched {
+				st.sched = s
+				st.due, st.ok = n.cfg.next(s)
+			}
+		}
+	}
+	return true
+}
+
+// Close ends the simulation, the process-wide clock is set back to the real
+// clock.
+func (sim *Simulation) Close() {
+	clock.SetDefault(nil)
+}
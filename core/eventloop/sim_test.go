@@ -0,0 +1,177 @@
+package eventloop
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	"trypo/core/testutils"
+	"trypo/pkg/clock"
+	"trypo/pkg/kmeans/common"
+	"trypo/pkg/kmeans/rpc"
+)
+
+var simStart = time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+
+// simRuns simulates an hour of two nodes with only a custom task (with
+// jitter), and returns the node and (virtual) time of each run.
+func simRuns(t *testing.T, seed int64) []string {
+	var mu sync.Mutex
+	var runs []string
+	var cfgs []*EventLoopConfig
+	for i := 0; i < 2; i++ {
+		addr := Addr{IP: "localhost", Port: fmt.Sprint(i + 1)}
+		cfgs = append(cfgs, &EventLoopConfig{
+			LocalAddr:     addr,
+			RemoteAddrs:   []Addr{addr},
+			DisabledTasks: BuiltinTasks(),
+			Tasks: []Task{{
+				Name:     "record",
+				Schedule: TaskSchedule{Every: time.Minute, Jitter: time.Second * 10},
+				Run: func(ctx context.Context, env *TaskEnv) {
+					mu.Lock()
+					defer mu.Unlock()
+					runs = append(runs, fmt.Sprint(env.LocalAddr().Port, " ", clock.Now().Sub(simStart)))
+				},
+			}},
+			L: &recLogger{},
+		})
+	}
+
+	sim := NewSimulation(simStart, seed, cfgs...)
+	defer sim.Close()
+	if n := sim.Run(time.Hour); n != len(runs) {
+		t.Fatalf("run count %v doesn't match the recorded %v", n, len(runs))
+	}
+	if now := sim.Clock.Now(); !now.Equal(simStart.Add(time.Hour)) {
+		t.Fatalf("unexpected time after the simulation: %v", now)
+	}
+	return runs
+}
+
+func TestSimulationSchedule(t *testing.T) {
+	runs := simRuns(t, 1)
+	// Between 51 and 60 runs per node, depending on the jitter.
+	if len(runs) < 102 || len(runs) > 120 {
+		t.Fatalf("unexpected amount of runs: %v", len(runs))
+	}
+	if again := simRuns(t, 1); !reflect.DeepEqual(runs, again) {
+		t.Fatal("runs with the same seed differ")
+	}
+	if other := simRuns(t, 2); reflect.DeepEqual(runs, other) {
+		t.Fatal("runs with different seeds are equal")
+	}
+	if clock.Default() != clock.Real {
+		t.Fatal("real clock wasn't restored")
+	}
+}
+
+// simBalance adds 'n' datapoints (which expire after 3 hours) to the first
+// node of 'network', simulates an hour of load balancing and returns the
+// amount of datapoints in each node.
+func simBalance(t *testing.T, network testutils.TNetwork, addrs []Addr, n int, seed int64) []int {
+	namespace := "test"
+	var cfgs []*EventLoopConfig
+	for _, addr := range addrs {
+		cfgs = append(cfgs, &EventLoopConfig{
+			LocalAddr:   addr,
+			RemoteAddrs: addrs,
+			Schedules: EventLoopSchedules{
+				LoadBalancing: TaskSchedule{Every: time.Minute * 5, Jitter: time.Minute},
+				Expire:        TaskSchedule{Every: time.Minute * 10},
+			},
+			L: &recLogger{},
+		})
+	}
+	sim := NewSimulation(simStart, seed, cfgs...)
+	defer sim.Close()
+
+	client := rpc.KMeansClient(addrs[0].ToStr(), namespace, nil)
+	for i := 0; i < n; i++ {
+		dp := common.DataPoint{
+			Vec:           []float64{1, float64(i % 7)},
+			Payload:       []byte(fmt.Sprint(i)),
+			Expires:       simStart.Add(time.Hour * 3),
+			ExpireEnabled: true,
+		}
+		if !client.AddDataPoint(dp) {
+			t.Fatalf("couldn't add dp %v", i)
+		}
+	}
+
+	sim.Run(time.Hour)
+	var res []int
+	total := 0
+	for _, addr := range addrs {
+		lenDP := 0
+		if cm := network.UnwrapCM(addr, namespace); cm != nil {
+			lenDP = cm.LenDP()
+		}
+		res = append(res, lenDP)
+		total += lenDP
+	}
+	if total != n {
+		t.Fatalf("dps were lost or duplicated: %v of %v", total, n)
+	}
+
+	// Expired by the expire task, in virtual time.
+	sim.Run(time.Hour * 3)
+	if dps := network.DataPoints(namespace); len(dps) != 0 {
+		t.Fatalf("%v dps didn't expire", len(dps))
+	}
+	return res
+}
+
+func TestSimulationBalance(t *testing.T) {
+	addrs := []Addr{
+		{IP: "localhost", Port: "3093"},
+		{IP: "localhost", Port: "3094"},
+		{IP: "localhost", Port: "3095"},
+	}
+	network := testutils.NewTNetwork(addrs)
+	defer network.Stop()
+
+	n := 90
+	lens := simBalance(t, network, addrs, n, 1)
+	// Each node should be near its share (a third).
+	for _, lenDP := range lens {
+		if lenDP < n/6 {
+			t.Fatalf("not balanced after an hour: %v", lens)
+		}
+	}
+
+	network.Reset()
+	if again := simBalance(t, network, addrs, n, 1); !reflect.DeepEqual(lens, again) {
+		t.Fatalf("simulations with the same seed differ: %v, %v", lens, again)
+	}
+}
+
+// The timeout of a run follows the clock of the config, not the real time.
+func TestRunTaskTimeout(t *testing.T) {
+	v := clock.NewVirtual(simStart)
+	cfg := EventLoopConfig{Clock: v}
+	started, done := make(chan bool), make(chan bool)
+	task := elTask{name: "wait", run: func(ctx context.Context, _ *EventLoopConfig, _ *EventLoopTuning) {
+		close(started)
+		<-ctx.Done()
+	}}
+	go func() {
+		cfg.runTask(context.Background(), task, TaskSchedule{Timeout: time.Minute}, &EventLoopTuning{})
+		close(done)
+	}()
+
+	<-started
+	select {
+	case <-done:
+		t.Fatal("run timed out without virtual time passing")
+	case <-time.After(time.Millisecond * 20):
+	}
+	v.Advance(time.Minute)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run didn't time out in virtual time")
+	}
+}
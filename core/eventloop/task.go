@@ -0,0 +1,172 @@
+package eventloop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"trypo/pkg/logging"
+)
+
+// Task is a custom event loop task, which runs on its own schedule next to
+// the built-in ones (see EventLoopConfig.Register). Examples are re-embedding
+// of stale datapoints, exporting snapshots or custom compaction.
+type Task struct {
+	// Name is used in logs and for the concurrency limit of the schedule,
+	// must be unique and not the name of a built-in task (see BuiltinTasks).
+	Name string
+	// Schedule of the task, see TaskSchedule. Unlike schedules of built-in
+	// tasks, this is not part of the tuning, so it can't be changed with
+	// EventLoopConfig.Retune.
+	Schedule TaskSchedule
+	// Run is called for each run of the task. It should return when ctx is
+	// done (e.g because of a stop or TaskSchedule.Timeout).
+	Run func(ctx context.Context, env *TaskEnv)
+}
+
+// TaskEnv is the environment of one run of a custom task, with the same
+// helpers as the built-in tasks use.
+type TaskEnv struct {
+	// Tuning is a snapshot of the tuning, taken when the run started.
+	Tuning EventLoopTuning
+
+	name string
+	ctx  context.Context
+	cfg  *EventLoopConfig
+}
+
+// LocalAddr returns EventLoopConfig.LocalAddr.
+func (env *TaskEnv) LocalAddr() Addr { return env.cfg.LocalAddr }
+
+// RemoteAddrs returns EventLoopConfig.RemoteAddrs (which includes LocalAddr).
+func (env *TaskEnv) RemoteAddrs() []Addr { return env.cfg.RemoteAddrs }
+
+// Log logs 'msg' and 'fields' with the task logger (see Logger.LogTask),
+// using the name of the task.
+func (env *TaskEnv) Log(msg string, fields ...logging.Field) {
+	env.cfg.L.LogTask(env.name, msg, fields...)
+}
+
+// WithLocalAddrNamespaces calls 'f' with the local addr and each namespace in
+// the local node. Stops early if the run is cancelled.
+func (env *TaskEnv) WithLocalAddrNamespaces(f func(addr Addr, namespace string)) {
+	withLocalAddrNamespaces(env.ctx, env.cfg, f)
+}
+
+// WithNamespaceTable calls 'f' with all addresses in the network, grouped by
+// the namespaces they have (keys are namespaces). 'f' isn't called if the
+// run is cancelled while the table is being made.
+func (env *TaskEnv) WithNamespaceTable(f func(table map[string][]Addr)) {
+	withNamespaceTable(env.ctx, env.cfg, func(t addrNamespaceTable) {
+		if env.ctx.Err() != nil {
+			return
+		}
+		table := make(map[string][]Addr, len(t.items))
+		for _, ns := range t.namespaces() {
+			table[ns] = t.addrsWithNamespace(ns)
+		}
+		f(table)
+	})
+}
+
+// Name of the adaptive task, which is added when AdaptiveConfig.Enabled.
+const adaptiveTask = "adaptive"
+
+// BuiltinTasks returns the names of all built-in tasks, i.e the names which
+// can be used in EventLoopConfig.DisabledTasks.
+func BuiltinTasks() []string {
+	res := make([]string, 0, len(elTasks))
+	for _, task := range elTasks {
+		res = append(res, task.name)
+	}
+	return res
+}
+
+func isBuiltinTask(name string) bool {
+	for _, task := range elTasks {
+		if task.name == name {
+			return true
+		}
+	}
+	return name == adaptiveTask
+}
+
+// Register adds custom tasks to the event loop, see Task. Returns an error
+// (and adds nothing) if a task is invalid, or if the event loop has already
+// been started; tasks have to be registered before that.
+func (cfg *EventLoopConfig) Register(tasks ...Task) error {
+	if cfg.internal != nil {
+		return errors.New("can't register tasks after the event loop has started")
+	}
+	all := append(cfg.Tasks[:len(cfg.Tasks):len(cfg.Tasks)], tasks...)
+	if err := validateTasks(all); err != nil {
+		return err
+	}
+	cfg.Tasks = all
+	return nil
+}
+
+// validateTasks returns an error describing the first invalid task, or nil.
+func validateTasks(tasks []Task) error {
+	names := make(map[string]bool, len(tasks))
+	for _, task := range tasks {
+		switch {
+		case task.Name == "":
+			return errors.New("task without a name")
+		case isBuiltinTask(task.Name):
+			return fmt.Errorf("task %q: name of a built-in task", task.Name)
+		case names[task.Name]:
+			return fmt.Errorf("task %q: registered more than once", task.Name)
+		case task.Run == nil:
+			return fmt.Errorf("task %q: nil Run func", task.Name)
+		}
+		if err := task.Schedule.Validate(); err != nil {
+			return fmt.Errorf("task %q: %v", task.Name, err)
+		}
+		names[task.Name] = true
+	}
+	return nil
+}
+
+// validateDisabled returns an error if 'names' contains anything other than
+// built-in task names.
+func validateDisabled(names []string) error {
+	for _, name := range names {
+		if name == adaptiveTask || !isBuiltinTask(name) {
+			return fmt.Errorf("unknown built-in task %q (want one of %v)", name, BuiltinTasks())
+		}
+	}
+	return nil
+}
+
+// tasks returns all tasks that should run: enabled built-in tasks, the
+// adaptive task (if enabled) and custom tasks.
+func (cfg *EventLoopConfig) tasks() []elTask {
+	disabled := make(map[string]bool, len(cfg.DisabledTasks))
+	for _, name := range cfg.DisabledTasks {
+		disabled[name] = true
+	}
+
+	var res []elTask
+	for _, task := range elTasks {
+		if !disabled[task.name] {
+			res = append(res, task)
+		}
+	}
+	if cfg.Adaptive.Enabled {
+		every := TaskSchedule{Every: cfg.Adaptive.Every}
+		res = append(res, elTask{
+			adaptiveTask, func(*EventLoopSchedules) TaskSchedule { return every }, eltAdaptive,
+		})
+	}
+	for _, task := range cfg.Tasks {
+		task := task
+		res = append(res, elTask{
+			task.Name,
+			func(*EventLoopSchedules) TaskSchedule { return task.Schedule },
+			func(ctx context.Context, cfg *EventLoopConfig, t *EventLoopTuning) {
+				task.Run(ctx, &TaskEnv{Tuning: *t, name: task.Name, ctx: ctx, cfg: cfg})
+			},
+		})
+	}
+	return res
+}
@@ -0,0 +1,104 @@
+package eventloop
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRegister(t *testing.T) {
+	run := func(context.Context, *TaskEnv) {}
+	every := TaskSchedule{Every: time.Second}
+
+	bad := [][]Task{
+		{{Name: "", Schedule: every, Run: run}},
+		{{Name: "meta", Schedule: every, Run: run}},
+		{{Name: "adaptive", Schedule: every, Run: run}},
+		{{Name: "a", Schedule: every}},
+		{{Name: "a", Schedule: TaskSchedule{Cron: "nope"}, Run: run}},
+		{{Name: "a", Schedule: every, Run: run}, {Name: "a", Schedule: every, Run: run}},
+	}
+	for i, tasks := range bad {
+		cfg := EventLoopConfig{}
+		if err := cfg.Register(tasks...); err == nil {
+			t.Fatalf("bad tasks %v: expected an error", i)
+		}
+		if len(cfg.Tasks) != 0 {
+			t.Fatalf("bad tasks %v: tasks were registered despite error", i)
+		}
+	}
+
+	cfg := tuneCfg(&recLogger{})
+	if err := cfg.Register(Task{Name: "a", Schedule: every, Run: run}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// Duplicate across calls.
+	if err := cfg.Register(Task{Name: "a", Schedule: every, Run: run}); err == nil {
+		t.Fatalf("expected an error for duplicate name")
+	}
+
+	cfg.start()
+	if err := cfg.Register(Task{Name: "b", Schedule: every, Run: run}); err == nil {
+		t.Fatalf("expected an error after start")
+	}
+}
+
+func TestTasks(t *testing.T) {
+	cfg := tuneCfg(&recLogger{})
+	cfg.DisabledTasks = []string{"merge", "split"}
+	cfg.Adaptive = AdaptiveConfig{Enabled: true, Every: time.Second}
+	cfg.Tasks = []Task{{Name: "custom", Run: func(context.Context, *TaskEnv) {}}}
+
+	names := make(map[string]bool)
+	for _, task := range cfg.tasks() {
+		names[task.name] = true
+	}
+	if len(names) != len(elTasks)-2+2 || names["merge"] || names["split"] ||
+		!names["adaptive"] || !names["custom"] || !names["meta"] {
+		t.Fatalf("unexpected tasks: %v", names)
+	}
+
+	cfg.DisabledTasks = []string{"nope"}
+	if err := validateDisabled(cfg.DisabledTasks); err == nil {
+		t.Fatalf("expected an error for unknown task")
+	}
+}
+
+func TestCustomTask(t *testing.T) {
+	l := &recLogger{}
+	cfg := tuneCfg(l)
+	cfg.Schedules = EventLoopSchedules{}
+	cfg.MergeCentroidsMax = 42
+
+	envs := make(chan *TaskEnv, 1)
+	err := cfg.Register(Task{
+		Name:     "custom",
+		Schedule: TaskSchedule{Every: time.Millisecond, MaxConcurrency: 1},
+		Run: func(ctx context.Context, env *TaskEnv) {
+			env.Log("ran")
+			select {
+			case envs <- env:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	stop := EventLoop(cfg)
+	defer stop()
+	select {
+	case env := <-envs:
+		if env.Tuning.MergeCentroidsMax != 42 || env.LocalAddr() != cfg.LocalAddr ||
+			len(env.RemoteAddrs()) != 1 {
+			t.Fatalf("unexpected env: %+v", env)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("custom task didn't run")
+	}
+	stop()
+	if l.find("custom: ran") == "" {
+		t.Fatalf("custom task log wasn't prefixed with its name")
+	}
+}
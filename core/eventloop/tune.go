@@ -0,0 +1,147 @@
+package eventloop
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"trypo/pkg/logging"
+)
+
+// EventLoopTuning contains the parameters of EventLoopConfig which can be
+// changed while the event loop is running (see EventLoopConfig.Retune). See
+// docs of the corresponding fields in EventLoopConfig.
+type EventLoopTuning struct {
+	Schedules EventLoopSchedules `json:"schedules"`
+
+	DistributeDataPointsFastN     int `json:"distribute_dps_fast_n"`
+	DistributeDataPointsAccurateN int `json:"distribute_dps_accurate_n"`
+	DistributeDataPointsInternalN int `json:"distribute_dps_internal_n"`
+
+	SplitCentroidsMin int `json:"split_centroids_min"`
+	SplitCentroidsMax int `json:"split_centroids_max"`
+	MergeCentroidsMin int `json:"merge_centroids_min"`
+	MergeCentroidsMax int `json:"merge_centroids_max"`
+
+	LoadBalancingMargin float64 `json:"load_balancing_margin"`
+}
+
+// check returns an error describing all invalid values, or nil.
+func (t *EventLoopTuning) check() error {
+	var errs []string
+	if err := t.Schedules.Validate(); err != nil {
+		errs = append(errs, "Schedules."+err.Error())
+	}
+	if t.DistributeDataPointsFastN < 0 || t.DistributeDataPointsAccurateN < 0 ||
+		t.DistributeDataPointsInternalN < 0 {
+		errs = append(errs, "DistributeDataPointsXN must be >= 0")
+	}
+	if t.SplitCentroidsMin > t.SplitCentroidsMax {
+		errs = append(errs, "SplitCentroidsMin must be <= SplitCentroidsMax")
+	}
+	if t.MergeCentroidsMin > t.MergeCentroidsMax {
+		errs = append(errs, "MergeCentroidsMin must be <= MergeCentroidsMax")
+	}
+	if t.LoadBalancingMargin < 0 || t.LoadBalancingMargin >= 1 {
+		errs = append(errs, "LoadBalancingMargin must be in [0, 1)")
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// diff returns a description of each value that differs between 't' and
+// 'other', e.g "Schedules.Expire.Every: 20s -> 5s".
+func (t *EventLoopTuning) diff(other *EventLoopTuning) []string {
+	var res []string
+	var walk func(prefix string, a, b reflect.Value)
+	walk = func(prefix string, a, b reflect.Value) {
+		for i := 0; i < a.NumField(); i++ {
+			name := prefix + a.Type().Field(i).Name
+			if a.Field(i).Kind() == reflect.Struct {
+				walk(name+".", a.Field(i), b.Field(i))
+				continue
+			}
+			if a.Field(i).Interface() != b.Field(i).Interface() {
+				res = append(res, fmt.Sprintf("%v: %v -> %v", name, a.Field(i), b.Field(i)))
+			}
+		}
+	}
+	walk("", reflect.ValueOf(*t), reflect.ValueOf(*other))
+	return res
+}
+
+// Tuning returns the current tuning parameters of the event loop. Safe to
+// call while the event loop is running.
+func (cfg *EventLoopConfig) Tuning() EventLoopTuning {
+	if cfg.internal != nil {
+		cfg.internal.Lock()
+		defer cfg.internal.Unlock()
+	}
+	return cfg.tuning()
+}
+
+func (cfg *EventLoopConfig) tuning() EventLoopTuning {
+	return EventLoopTuning{
+		Schedules:                     cfg.Schedules,
+		DistributeDataPointsFastN:     cfg.DistributeDataPointsFastN,
+		DistributeDataPointsAccurateN: cfg.DistributeDataPointsAccurateN,
+		DistributeDataPointsInternalN: cfg.DistributeDataPointsInternalN,
+		SplitCentroidsMin:             cfg.SplitCentroidsMin,
+		SplitCentroidsMax:             cfg.SplitCentroidsMax,
+		MergeCentroidsMin:             cfg.MergeCentroidsMin,
+		MergeCentroidsMax:             cfg.MergeCentroidsMax,
+		LoadBalancingMargin:           cfg.LoadBalancingMargin,
+	}
+}
+
+func (cfg *EventLoopConfig) setTuning(t EventLoopTuning) {
+	cfg.Schedules = t.Schedules
+	cfg.DistributeDataPointsFastN = t.DistributeDataPointsFastN
+	cfg.DistributeDataPointsAccurateN = t.DistributeDataPointsAccurateN
+	cfg.DistributeDataPointsInternalN = t.DistributeDataPointsInternalN
+	cfg.SplitCentroidsMin = t.SplitCentroidsMin
+	cfg.SplitCentroidsMax = t.SplitCentroidsMax
+	cfg.MergeCentroidsMin = t.MergeCentroidsMin
+	cfg.MergeCentroidsMax = t.MergeCentroidsMax
+	cfg.LoadBalancingMargin = t.LoadBalancingMargin
+}
+
+// Retune changes the tuning parameters of the event loop. If the event loop
+// is running, then the change is applied immediately, and is logged with the
+// LogTask method of the logger ('L' field). Task runs which are in progress
+// keep the tuning they were started with, and tasks waiting for their next
+// run are rescheduled if their schedule has changed. Note that the adaptive
+// mode (see AdaptiveConfig) works on top of the tuning, so it isn't changed
+// by that mode.
+//
+// Returns a description of each changed value (relative to the current
+// values), or an error if 't' is invalid (nothing is changed then). Safe to
+// call while the event loop is running, as opposed to writing the fields of
+// EventLoopConfig directly.
+func (cfg *EventLoopConfig) Retune(t EventLoopTuning) ([]string, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	if cfg.internal == nil {
+		// Not running.
+		current := cfg.tuning()
+		cfg.setTuning(t)
+		return current.diff(&t), nil
+	}
+
+	cfg.internal.Lock()
+	current := cfg.tuning()
+	changes := current.diff(&t)
+	cfg.setTuning(t)
+	cfg.internal.notify()
+	cfg.internal.Unlock()
+
+	// Logged outside the lock, the logger can be slow (e.g the dashboard
+	// clears the terminal).
+	if len(changes) != 0 {
+		cfg.L.LogTask("retune", "retuned", logging.F("changes", strings.Join(changes, ", ")))
+	}
+	return changes, nil
+}
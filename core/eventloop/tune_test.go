@@ -0,0 +1,165 @@
+package eventloop
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"trypo/pkg/logging"
+)
+
+/*
+--------------------------------------------------------------------------------
+Section for utils.
+--------------------------------------------------------------------------------
+*/
+
+// Logger which records all task events, as "task: msg key=val ...".
+type recLogger struct {
+	sync.Mutex
+	tasks []string
+}
+
+func (l *recLogger) LogMeta(MetaData) {}
+
+func (l *recLogger) LogTask(task, msg string, fields ...logging.Field) {
+	l.Lock()
+	defer l.Unlock()
+	s := task + ": " + msg
+	for _, f := range fields {
+		s += fmt.Sprintf(" %v=%v", f.Key, f.Value)
+	}
+	l.tasks = append(l.tasks, s)
+}
+
+// find returns the first task containing 's', or "".
+func (l *recLogger) find(s string) string {
+	l.Lock()
+	defer l.Unlock()
+	for _, task := range l.tasks {
+		if strings.Contains(task, s) {
+			return task
+		}
+	}
+	return ""
+}
+
+// Config for an event loop without any reachable nodes, so tasks are no-ops.
+func tuneCfg(l Logger) *EventLoopConfig {
+	every := TaskSchedule{Every: time.Millisecond}
+	addr := Addr{IP: "localhost", Port: "1"}
+	return &EventLoopConfig{
+		LocalAddr:   addr,
+		RemoteAddrs: []Addr{addr},
+		Schedules: EventLoopSchedules{
+			Expire: every, MemTrim: every, DistributeDataPointsFast: every,
+			DistributeDataPointsAccurate: every, DistributeDataPointsInternal: every,
+			SplitCentroids: every, MergeCentroids: every, LoadBalancing: every, Meta: every,
+		},
+		SplitCentroidsMin: 1000,
+		SplitCentroidsMax: 1000000,
+		MergeCentroidsMin: -1,
+		MergeCentroidsMax: 100,
+		L:                 l,
+	}
+}
+
+/*
+--------------------------------------------------------------------------------
+Section for tests.
+--------------------------------------------------------------------------------
+*/
+
+func TestRetuneInvalid(t *testing.T) {
+	cfg := tuneCfg(&recLogger{})
+	want := cfg.Tuning()
+
+	bad := []func(*EventLoopTuning){
+		func(t *EventLoopTuning) { t.Schedules.Meta.Every = -1 },
+		func(t *EventLoopTuning) { t.Schedules.Expire.Cron = "* * * *" },
+		func(t *EventLoopTuning) { t.Schedules.Expire.Cron = "* * * * *" },
+		func(t *EventLoopTuning) { t.Schedules.SplitCentroids.Jitter = -1 },
+		func(t *EventLoopTuning) { t.DistributeDataPointsFastN = -1 },
+		func(t *EventLoopTuning) { t.SplitCentroidsMin = t.SplitCentroidsMax + 1 },
+		func(t *EventLoopTuning) { t.MergeCentroidsMin = t.MergeCentroidsMax + 1 },
+	}
+	for i, f := range bad {
+		tuning := cfg.Tuning()
+		f(&tuning)
+		if _, err := cfg.Retune(tuning); err == nil {
+			t.Fatalf("expected err for case %v", i)
+		}
+		if cfg.Tuning() != want {
+			t.Fatalf("tuning changed despite err for case %v", i)
+		}
+	}
+}
+
+func TestRetuneStopped(t *testing.T) {
+	cfg := tuneCfg(&recLogger{})
+	tuning := cfg.Tuning()
+	tuning.Schedules.Expire.Every = time.Second
+	tuning.MergeCentroidsMax = 50
+
+	changes, err := cfg.Retune(tuning)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	want := []string{"Schedules.Expire.Every: 1ms -> 1s", "MergeCentroidsMax: 100 -> 50"}
+	if strings.Join(changes, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	// Not running, so applied immediately.
+	if cfg.Schedules.Expire.Every != time.Second || cfg.MergeCentroidsMax != 50 {
+		t.Fatalf("not applied: %+v", cfg.Tuning())
+	}
+}
+
+// Intended to be ran with -race.
+func TestRetuneRunning(t *testing.T) {
+	l := &recLogger{}
+	cfg := tuneCfg(l)
+	stop := EventLoop(cfg)
+	defer stop()
+
+	tuning := cfg.Tuning()
+	for i := 2; i < 10; i++ {
+		tuning.Schedules.LoadBalancing.Every = time.Millisecond * time.Duration(i)
+		tuning.DistributeDataPointsInternalN = i * 10
+		if _, err := cfg.Retune(tuning); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		time.Sleep(time.Microsecond * 100)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for cfg.Tuning() != tuning {
+		if time.Now().After(deadline) {
+			t.Fatalf("tuning never applied: %+v", cfg.Tuning())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if l.find("retune: retuned changes=") == "" {
+		t.Fatalf("changes were not logged")
+	}
+}
+
+func TestStop(t *testing.T) {
+	cfg := tuneCfg(&recLogger{})
+	cfg.Schedules.Meta = TaskSchedule{Every: time.Hour}
+	stop := EventLoop(cfg)
+
+	// Shouldn't wait for the timeout.
+	done := make(chan struct{})
+	go func() {
+		stop()
+		stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("stop didn't return")
+	}
+}
@@ -12,9 +12,9 @@ import (
 )
 
 var addrs = []Addr{
-	{"localhost", "3000"},
-	{"localhost", "3001"},
-	{"localhost", "3002"},
+	{IP: "localhost", Port: "3010"},
+	{IP: "localhost", Port: "3011"},
+	{IP: "localhost", Port: "3012"},
 }
 var namespace = "test"
 var network = testutils.NewTNetwork(addrs)
@@ -233,6 +233,34 @@ func TestBestFitNodesAccurate(t *testing.T) {
 	}
 }
 
+func TestBestFitNodesFaults(t *testing.T) {
+	network.Reset()
+	defer network.Reset()
+
+	for i, addr := range addrs {
+		client := rpc.KMeansClient(addr.ToStr(), namespace, nil)
+		if !client.AddDataPoint(dp(vec(1, float64(i+1)), 0)) {
+			t.Fatalf("unexpected 'not ok' for %v", addr.ToStr())
+		}
+	}
+
+	// The best fit is unreachable, and the second best is slow.
+	network.Partition(addrs[2])
+	network.SetFault(addrs[1], "", testutils.Fault{Delay: time.Millisecond * 20})
+
+	for _, f := range []func(BestFitNodesArgs) []Addr{BestFitNodesFast, BestFitNodesAccurate} {
+		rAddrs := f(BestFitNodesArgs{
+			AddrOpts:      addrs,
+			Namespace:     namespace,
+			Vec:           vec(1, 3),
+			KNNSearchFunc: searchutils.KNNCos,
+		})
+		if len(rAddrs) != 2 || !rAddrs[0].Comp(addrs[1]) || !rAddrs[1].Comp(addrs[0]) {
+			t.Fatalf("unexpected addrs: %v", rAddrs)
+		}
+	}
+}
+
 func TestCleanup(t *testing.T) {
 	defer network.Stop()
 }
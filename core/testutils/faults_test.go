@@ -0,0 +1,230 @@
+package testutils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"trypo/pkg/kmeans/common"
+	"trypo/pkg/kmeans/rpc"
+)
+
+/*
+Tests where nodes fail in the middle of operations that move datapoints
+between them, checking that no datapoint is lost. Each test uses its own
+network, since nodes are stopped.
+*/
+
+var faultAddrs = []Addr{
+	{IP: "localhost", Port: "3033"},
+	{IP: "localhost", Port: "3034"},
+	{IP: "localhost", Port: "3035"},
+}
+
+// Lease for reservations (see rpc.KMeansServer.MigrationLease).
+const faultLease = time.Millisecond * 50
+
+// newFaultNetwork starts a network where 'n' dps (with unique payloads) are
+// added to the first node.
+func newFaultNetwork(t *testing.T, n int) *TNetwork {
+	network := NewTNetwork(faultAddrs)
+	for _, node := range network.Nodes {
+		node.KMeansServer.MigrationLease = faultLease
+	}
+	var err error
+	client := rpc.KMeansClient(faultAddrs[0].ToStr(), namespace, &err)
+	for i := 0; i < n; i++ {
+		dp := common.DataPoint{Vec: vec(1, float64(i%7)), Payload: []byte(fmt.Sprint(i))}
+		if !client.AddDataPoint(dp) || err != nil {
+			t.Fatalf("couldn't add dp: %v", err)
+		}
+	}
+	return &network
+}
+
+// checkNoLoss fails 't' unless all 'n' dps added by newFaultNetwork are in the
+// network. Waits for reservations to run out first, such that dps which are
+// being put back are counted.
+func checkNoLoss(t *testing.T, network *TNetwork, n int) {
+	time.Sleep(faultLease * 3)
+	found := make(map[string]bool)
+	for _, dp := range network.DataPoints(namespace) {
+		found[string(dp.Payload)] = true
+	}
+	for i := 0; i < n; i++ {
+		if !found[fmt.Sprint(i)] {
+			t.Fatalf("dp %v was lost, found %v of %v", i, len(found), n)
+		}
+	}
+}
+
+// stopAfter stops the node at 'addr' after 'd', in a new goroutine.
+func stopAfter(network *TNetwork, addr Addr, d time.Duration) {
+	go func() {
+		time.Sleep(d)
+		network.Nodes[addr].StopFunc()
+	}()
+}
+
+func TestDistributeFaults(t *testing.T) {
+	n := 50
+	network := newFaultNetwork(t, n)
+	defer network.Stop()
+
+	// One receiver rejects dps after a while, the other goes down.
+	network.Nodes[faultAddrs[1]].KMeansServer.Quotas = rpc.Quotas{"*": {MaxDPs: 5}}
+	stopAfter(network, faultAddrs[2], time.Millisecond*5)
+
+	client := rpc.KMeansClient(faultAddrs[0].ToStr(), namespace, nil)
+	others := []string{faultAddrs[1].ToStr(), faultAddrs[2].ToStr()}
+	client.DistributeDataPointsAccurate(others, n/2)
+	client.DistributeDataPointsFast(others, n/2)
+
+	checkNoLoss(t, network, n)
+}
+
+func TestKNNDrainFaults(t *testing.T) {
+	n := 20
+	network := newFaultNetwork(t, n)
+	defer network.Stop()
+	node := network.Nodes[faultAddrs[0]].KMeansServer
+
+	// The response is lost, so the dps are never acknowledged.
+	var r rpc.ReserveKNNResp
+	args := rpc.KNNLookupArgs{NameSpace: namespace, Vec: vec(1, 3), K: 5}
+	if err := node.ReserveKNN(args, &r); err != nil || len(r.DPs) != 5 {
+		t.Fatalf("unexpected drain: %v, %v", r.DPs, err)
+	}
+	checkNoLoss(t, network, n)
+
+	// The node goes down while draining.
+	stopAfter(network, faultAddrs[0], time.Millisecond)
+	got := 0
+	for i := 0; i < 20; i++ {
+		dps := rpc.KMeansClient(faultAddrs[0].ToStr(), namespace, nil).KNNLookup(vec(1, 3), 1, true)
+		got += len(dps)
+	}
+	// Drained dps are gone (received by the caller) so only the rest is checked.
+	time.Sleep(faultLease * 3)
+	if left := len(network.DataPoints(namespace)); left+got < n {
+		t.Fatalf("dps were lost: %v drained, %v left of %v", got, left, n)
+	}
+}
+
+func TestStealFaults(t *testing.T) {
+	n := 100
+	network := newFaultNetwork(t, n)
+	defer network.Stop()
+
+	// The source goes down while Centroids are stolen from it.
+	stopAfter(network, faultAddrs[0], time.Millisecond*2)
+	for _, addr := range faultAddrs[1:] {
+		client := rpc.KMeansClient(addr.ToStr(), namespace, nil)
+		client.StealCentroids(faultAddrs[0].ToStr(), n)
+	}
+
+	checkNoLoss(t, network, n)
+}
+
+func TestFaultDelay(t *testing.T) {
+	network := newFaultNetwork(t, 1)
+	defer network.Stop()
+	addr := faultAddrs[0]
+	delay := time.Millisecond * 50
+	network.SetFault(addr, "KMeansServer.Vec", Fault{Delay: delay})
+
+	var err error
+	client := rpc.KMeansClient(addr.ToStr(), namespace, &err)
+	start := time.Now()
+	if client.Vec(); err != nil || time.Since(start) < delay {
+		t.Fatalf("call wasn't delayed: %v, %v", time.Since(start), err)
+	}
+	// Other methods aren't affected.
+	start = time.Now()
+	if client.LenDP(); err != nil || time.Since(start) >= delay {
+		t.Fatalf("unexpected delay: %v, %v", time.Since(start), err)
+	}
+}
+
+func TestFaultDrop(t *testing.T) {
+	network := newFaultNetwork(t, 0)
+	defer network.Stop()
+	addr := faultAddrs[0]
+	network.SetFault(addr, "", Fault{DropRate: 1})
+
+	// Handled by the node, but the response doesn't arrive.
+	var err error
+	client := rpc.KMeansClient(addr.ToStr(), namespace, &err)
+	if client.AddDataPoint(common.DataPoint{Vec: vec(1, 1)}) || err == nil {
+		t.Fatal("response wasn't dropped")
+	}
+	if n := len(network.DataPoints(namespace)); n != 1 {
+		t.Fatalf("call wasn't handled: %v dps", n)
+	}
+
+	network.ClearFaults()
+	if client.LenDP(); err != nil {
+		t.Fatalf("unexpected err after clearing faults: %v", err)
+	}
+}
+
+func TestFaultSeed(t *testing.T) {
+	network := newFaultNetwork(t, 1)
+	defer network.Stop()
+	addr := faultAddrs[0]
+	network.SetFault(addr, "", Fault{DropRate: 0.5})
+
+	// Which calls fail only depends on the seed.
+	outcomes := func() string {
+		res := ""
+		for i := 0; i < 20; i++ {
+			var err error
+			rpc.KMeansClient(addr.ToStr(), namespace, &err).LenDP()
+			res += fmt.Sprint(err == nil)
+		}
+		return res
+	}
+	network.Seed(42)
+	first := outcomes()
+	network.Seed(42)
+	if second := outcomes(); first != second {
+		t.Fatalf("different outcomes for the same seed:\n%v\n%v", first, second)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	network := newFaultNetwork(t, 1)
+	defer network.Stop()
+	addr := faultAddrs[0]
+
+	var err error
+	client := rpc.KMeansClient(addr.ToStr(), namespace, &err)
+	network.Partition(addr)
+	if client.LenDP(); err == nil {
+		t.Fatal("reached a partitioned node")
+	}
+	network.Heal()
+	err = nil
+	if n := client.LenDP(); err != nil || n != 1 {
+		t.Fatalf("unexpected result after healing: %v, %v", n, err)
+	}
+}
+
+func TestCrashRestart(t *testing.T) {
+	network := newFaultNetwork(t, 1)
+	defer network.Stop()
+	addr := faultAddrs[0]
+
+	var err error
+	client := rpc.KMeansClient(addr.ToStr(), namespace, &err)
+	network.Crash(addr)
+	if client.Namespaces(); err == nil {
+		t.Fatal("reached a crashed node")
+	}
+	if err := network.Restart(addr); err != nil {
+		t.Fatal(err)
+	}
+	err = nil
+	if namespaces := client.Namespaces(); err != nil || len(namespaces) != 0 {
+		t.Fatalf("unexpected namespaces after restart: %v, %v", namespaces, err)
+	}
+}
@@ -1,19 +1,21 @@
 /*
 Test utils for the core pkg. Contains stuff such as a test network
 with nodes consisting of KMeansServer (pkg/kmeans/rpc/) as well as
-ArbiterServer (pkg/arbiter).
+ArbiterServer (pkg/arbiter). Faults (latency, dropped connections,
+partitions, crashes) can be injected into the network, see Fault.
 */
 package testutils
 
 import (
 	"fmt"
 	"net"
-	"net/rpc"
 	"time"
 	"trypo/pkg/arbiter"
 	"trypo/pkg/kmeans/centroid"
 	"trypo/pkg/kmeans/centroidmanager"
+	"trypo/pkg/kmeans/common"
 	kmrpc "trypo/pkg/kmeans/rpc"
+	"trypo/pkg/rpcutils"
 	"trypo/pkg/searchutils"
 )
 
@@ -71,42 +73,38 @@ type Node struct {
 	KMeansServer  *KMeansServer
 	ArbiterServer *ArbiterServer
 	StopFunc      func()
+	// Listens on Addr and forwards to the servers, nil for nodes that are
+	// not in a TNetwork (then the servers listen on Addr).
+	proxy *proxy
 }
 
 // StartListen makes a Node active.
-func (n Node) StartListen() error {
-	handler := rpc.NewServer()
-	handler.Register(n.KMeansServer)
-	handler.Register(n.ArbiterServer)
-
-	ln, err := net.Listen("tcp", n.Addr.ToStr())
+func (n *Node) StartListen() error {
+	addr := n.Addr.ToStr()
+	if n.proxy != nil {
+		addr = "localhost:0"
+	}
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
-
-	var conn net.Conn
-	var stopped bool
-	n.StopFunc = func() {
+	stop, err := rpcutils.Serve(ln, n.KMeansServer, n.ArbiterServer)
+	if err != nil {
 		ln.Close()
-		if conn != nil {
-			conn.Close()
-		}
-		stopped = true
+		return err
 	}
-
-	go func() {
-		for {
-			if stopped {
-				break
-			}
-			cxn, err := ln.Accept()
-			conn = cxn
-			if err != nil {
-				break
-			}
-			go handler.ServeConn(cxn)
+	untrack := kmrpc.TrackMetrics(n.KMeansServer)
+	if n.proxy != nil {
+		n.proxy.setBackend(ln.Addr().String())
+	}
+	n.StopFunc = func() {
+		if n.proxy != nil {
+			n.proxy.setBackend("")
+			n.proxy.dropConns()
 		}
-	}()
+		untrack()
+		stop()
+	}
 	return nil
 }
 
@@ -116,11 +114,17 @@ type TNetwork struct {
 	Nodes map[Addr]*Node
 }
 
-// NewTNetwork creates a new test network.
+// NewTNetwork creates a new test network. Each node is behind a proxy that
+// injects faults (none at first), with random choices (see Fault.DropRate)
+// seeded with 1, see Seed.
 func NewTNetwork(addrs []Addr) TNetwork {
 	nodes := make(map[Addr]*Node)
 
-	for _, addr := range addrs {
+	for i, addr := range addrs {
+		p, err := newProxy(addr.ToStr(), int64(i+1))
+		if err != nil {
+			panic(fmt.Sprintf("couldn't start server on addr %v", addr))
+		}
 		node := Node{
 			Addr:         addr,
 			KMeansServer: NewKMeansServer(addr.ToStr()),
@@ -130,6 +134,7 @@ func NewTNetwork(addrs []Addr) TNetwork {
 				SessionDuration: time.Second * 3,
 				ArbiterDuration: time.Second * 5,
 			}),
+			proxy: p,
 		}
 
 		startErr := node.StartListen()
@@ -149,11 +154,16 @@ func (tn *TNetwork) Stop() {
 		if n.StopFunc != nil {
 			n.StopFunc()
 		}
+		if n.proxy != nil {
+			n.proxy.stop()
+		}
 	}
 }
 
-// Reset resets data in a test network (doesn't kill servers).
+// Reset resets data in a test network (doesn't kill servers), and removes
+// faults (see ClearFaults).
 func (tn *TNetwork) Reset() {
+	tn.ClearFaults()
 	for _, node := range *&tn.Nodes {
 		node.KMeansServer.Table.Reset()
 
@@ -177,3 +187,80 @@ func (tn *TNetwork) UnwrapCM(addr Addr, namespace string) *CentroidManager {
 	})
 	return r
 }
+
+// DataPoints returns all datapoints in a namespace, in all nodes of the test
+// network (including nodes that are stopped).
+func (tn *TNetwork) DataPoints(namespace string) []common.DataPoint {
+	var res []common.DataPoint
+	for _, node := range tn.Nodes {
+		node.KMeansServer.Table.Access(namespace, func(cm *CentroidManager) {
+			for _, c := range cm.Centroids {
+				res = append(res, c.ExportDataPoints()...)
+			}
+		})
+	}
+	return res
+}
+
+// SetFault sets the fault for calls of 'method' (e.g "KMeansServer.Vec") to
+// the node at 'addr', or for all methods that have no fault of their own if
+// 'method' is empty. The zero Fault removes it. Applies to open connections
+// as well.
+func (tn *TNetwork) SetFault(addr Addr, method string, f Fault) {
+	tn.Nodes[addr].proxy.setFault(method, f)
+}
+
+// ClearFaults removes all faults and partitions (see Heal) in the network.
+func (tn *TNetwork) ClearFaults() {
+	for _, n := range tn.Nodes {
+		n.proxy.clearFaults()
+	}
+	tn.Heal()
+}
+
+// Seed sets the seed for the random choices of faults (see Fault.DropRate),
+// such that a scenario can be repeated. Each node gets its own source (seeded
+// with 'seed' plus the index of the node in tn.Addrs), so the choices for a
+// node only depend on the calls to it.
+func (tn *TNetwork) Seed(seed int64) {
+	for i, addr := range tn.Addrs {
+		tn.Nodes[addr].proxy.seed(seed + int64(i))
+	}
+}
+
+// Partition cuts the nodes at 'addrs' off from the network until Heal is
+// called: open connections to them are dropped, and new ones are refused.
+// Note, all nodes share this process, so connections can't be told apart by
+// the node that makes them, and a node that is cut off can still call others.
+func (tn *TNetwork) Partition(addrs ...Addr) {
+	for _, addr := range addrs {
+		tn.Nodes[addr].proxy.setIsolated(true)
+	}
+}
+
+// Heal reverts Partition for all nodes.
+func (tn *TNetwork) Heal() {
+	for _, n := range tn.Nodes {
+		n.proxy.setIsolated(false)
+	}
+}
+
+// DropConns closes all open connections to the node at 'addr'.
+func (tn *TNetwork) DropConns(addr Addr) {
+	tn.Nodes[addr].proxy.dropConns()
+}
+
+// Crash stops the node at 'addr' and drops its data (as if the process
+// died), see Restart.
+func (tn *TNetwork) Crash(addr Addr) {
+	node := tn.Nodes[addr]
+	if node.StopFunc != nil {
+		node.StopFunc()
+	}
+	node.KMeansServer.Table.Reset()
+}
+
+// Restart starts a node that was stopped (with Node.StopFunc or Crash).
+func (tn *TNetwork) Restart(addr Addr) error {
+	return tn.Nodes[addr].StartListen()
+}
@@ -10,9 +10,9 @@ import (
 )
 
 var addrs = []Addr{
-	{"localhost", "3000"},
-	{"localhost", "3001"},
-	{"localhost", "3002"},
+	{"localhost", "3030"},
+	{"localhost", "3031"},
+	{"localhost", "3032"},
 }
 var namespace = "test"
 var network = NewTNetwork(addrs)
@@ -36,7 +36,7 @@ func TestStart(t *testing.T) {
 
 	tries := 1000
 	errs := make(arbiter.ArbErrs)
-	ok := arbiter.ArbiterClients(addrs, errs, nil).TryForceNewArbiter(tries)
+	ok := arbiter.TryForceNewArbiter(addrs, errs, nil, tries)
 
 	if _, err := errs.CheckAll(); err != nil {
 		t.Fatalf("TryForce err: %v", err)
@@ -0,0 +1,268 @@
+package testutils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"time"
+	"trypo/pkg/rpcutils"
+)
+
+// Fault is what happens to calls to a node in TNetwork, see TNetwork.SetFault.
+type Fault struct {
+	// Added before each response is sent back to the caller.
+	Delay time.Duration
+	// Probability (0 to 1) that the connection is closed instead of sending a
+	// response back, i.e the caller gets an error although the node handled
+	// the call.
+	DropRate float64
+}
+
+// proxy is in front of the servers of a Node (on the address of the node), and
+// forwards connections to them while applying faults. Responses are decoded
+// (net/rpc with gob) such that faults can be set per method, so TLS and the
+// secret handshake (see pkg/rpcutils) disable that; connections are then
+// forwarded as they are, with only the Delay of the "" method (per read).
+type proxy struct {
+	ln   net.Listener
+	done chan struct{}
+
+	mu sync.Mutex
+	// Address of the servers, empty while they are down.
+	backend string
+	// Connections are refused while isolated, see TNetwork.Partition.
+	isolated bool
+	// Keys are methods (e.g "KMeansServer.Vec"), "" is for all methods.
+	faults map[string]Fault
+	rand   *rand.Rand
+	// Open connections, from callers and to the backend.
+	conns map[net.Conn]bool
+}
+
+// newProxy starts a proxy on 'addr'.
+func newProxy(addr string, seed int64) (*proxy, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p := proxy{
+		ln:     ln,
+		done:   make(chan struct{}),
+		faults: make(map[string]Fault),
+		rand:   rand.New(rand.NewSource(seed)),
+		conns:  make(map[net.Conn]bool),
+	}
+	go p.accept()
+	return &p, nil
+}
+
+func (p *proxy) accept() {
+	defer close(p.done)
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.serve(conn)
+	}
+}
+
+// stop closes the listener and all connections.
+func (p *proxy) stop() {
+	p.ln.Close()
+	<-p.done
+	p.dropConns()
+}
+
+// track adds 'conns' to p.conns, or closes them and returns false if the node
+// isn't reachable.
+func (p *proxy) track(conns ...net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.isolated || p.backend == "" {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return false
+	}
+	for _, conn := range conns {
+		p.conns[conn] = true
+	}
+	return true
+}
+
+func (p *proxy) untrack(conns ...net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+		delete(p.conns, conn)
+	}
+}
+
+// dropConns closes all open connections.
+func (p *proxy) dropConns() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conn := range p.conns {
+		conn.Close()
+		delete(p.conns, conn)
+	}
+}
+
+func (p *proxy) setBackend(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.backend = addr
+}
+
+func (p *proxy) setIsolated(isolated bool) {
+	p.mu.Lock()
+	p.isolated = isolated
+	p.mu.Unlock()
+	if isolated {
+		p.dropConns()
+	}
+}
+
+func (p *proxy) setFault(method string, f Fault) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f == (Fault{}) {
+		delete(p.faults, method)
+		return
+	}
+	p.faults[method] = f
+}
+
+func (p *proxy) clearFaults() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.faults = make(map[string]Fault)
+}
+
+func (p *proxy) seed(seed int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rand = rand.New(rand.NewSource(seed))
+}
+
+// fault returns the fault for 'method' (that of "" if it has none), and
+// whether the response should be dropped.
+func (p *proxy) fault(method string) (Fault, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, ok := p.faults[method]
+	if !ok {
+		f = p.faults[""]
+	}
+	return f, f.DropRate > 0 && p.rand.Float64() < f.DropRate
+}
+
+// serve forwards 'conn' to the backend.
+func (p *proxy) serve(conn net.Conn) {
+	p.mu.Lock()
+	backend := p.backend
+	p.mu.Unlock()
+	if !p.track(conn) {
+		return
+	}
+	remote, err := net.Dial("tcp", backend)
+	if err != nil {
+		p.untrack(conn)
+		return
+	}
+	if !p.track(remote) {
+		p.untrack(conn)
+		return
+	}
+	defer p.untrack(conn, remote)
+
+	go func() {
+		io.Copy(remote, conn)
+		// Either side closing ends both directions.
+		p.untrack(conn, remote)
+	}()
+	if rpcutils.Plain() {
+		p.forwardResponses(conn, remote)
+	} else {
+		p.forwardRaw(conn, remote)
+	}
+}
+
+// forwardRaw copies from 'remote' to 'conn', with the delay of the "" method
+// before each write.
+func (p *proxy) forwardRaw(conn, remote net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := remote.Read(buf)
+		if n > 0 {
+			if f, _ := p.fault(""); f.Delay > 0 {
+				time.Sleep(f.Delay)
+			}
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// recorder keeps the bytes that are read through it, such that a message can
+// be forwarded after it's decoded. It's an io.ByteReader, so gob doesn't read
+// beyond the end of a message.
+type recorder struct {
+	r   *bufio.Reader
+	buf bytes.Buffer
+}
+
+func (r *recorder) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.buf.Write(b[:n])
+	return n, err
+}
+
+func (r *recorder) ReadByte() (byte, error) {
+	c, err := r.r.ReadByte()
+	if err == nil {
+		r.buf.WriteByte(c)
+	}
+	return c, err
+}
+
+// forwardResponses copies net/rpc responses from 'remote' to 'conn', applying
+// the fault for the method of each.
+func (p *proxy) forwardResponses(conn, remote net.Conn) {
+	rec := recorder{r: bufio.NewReader(remote)}
+	dec := gob.NewDecoder(&rec)
+	for {
+		var resp rpc.Response
+		if err := dec.Decode(&resp); err != nil {
+			return
+		}
+		// Body, which is discarded (decoded into the zero Value).
+		if err := dec.DecodeValue(reflect.Value{}); err != nil {
+			return
+		}
+
+		f, drop := p.fault(resp.ServiceMethod)
+		if f.Delay > 0 {
+			time.Sleep(f.Delay)
+		}
+		if drop {
+			return
+		}
+		if _, err := conn.Write(rec.buf.Bytes()); err != nil {
+			return
+		}
+		rec.buf.Reset()
+	}
+}
@@ -2,4 +2,4 @@ module trypo
 
 go 1.16
 
-require github.com/crunchypi/go-narb v0.0.0-20210728113441-c451128919c7 // indirect
+require github.com/crunchypi/go-narb v0.0.0-20210728113441-c451128919c7
@@ -74,3 +74,41 @@ func (s *ArbStats) UniformStatus(sc StatusCode) bool {
 func NewArbiterServer(cfg NewSessionMemberConfig) *ArbiterServer {
 	return rpc.NewArbiterServer(NewSessionMember(cfg))
 }
+
+// TryForceNewArbiter is like ArbiterClients(addrs, errs, stats).TryForceNewArbiter,
+// except that a vote round which fails with a mix of StatusFailedVoteCollection
+// and StatusFailedVoteConsensus is retried instead of aborted. That mix is
+// expected: once a node has failed on consensus, it answers vote requests of
+// the same round with StatusFailedVoteConsensus, which fails the collection of
+// nodes that are asked later. Network errors still abort. Nil maps are allowed.
+func TryForceNewArbiter(addrs []Addr, errs ArbErrs, stats ArbStats, retries int) bool {
+	if errs == nil {
+		errs = make(ArbErrs)
+	}
+	if stats == nil {
+		stats = make(ArbStats)
+	}
+	clients := ArbiterClients(addrs, errs, stats)
+
+	available := clients.Ping()
+	id := common.NewRandID(20)
+	if !clients.InitSession(id, available) {
+		return false
+	}
+	for i := 0; i < retries; i++ {
+		if clients.CollectVotes(id, available) {
+			return true
+		}
+		if _, err := errs.CheckAll(); err != nil {
+			return false
+		}
+		for _, status := range stats {
+			if status != common.StatusFailedVoteConsensus &&
+				status != common.StatusFailedVoteCollection {
+				return false
+			}
+		}
+		clients.InitSession(id, available)
+	}
+	return false
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/crunchypi/go-narb/apsa/common"
 	"github.com/crunchypi/go-narb/apsa/rpc"
+	"trypo/pkg/rpcutils"
 )
 
 type network struct {
@@ -26,7 +27,7 @@ func newNetwork(addrs []common.Addr) *network {
 			ArbiterDuration: time.Second * 5,
 		})
 		// Func to call for stopping the server.
-		stopServerFunc, err := rpc.StartListen(server, addr)
+		stopServerFunc, err := rpcutils.Listen(addr.ToStr(), server)
 		if err != nil {
 			// ...
 		}
@@ -45,9 +46,9 @@ func (n *network) cleanup() {
 
 func TestClientsTryForceNewArbiter(t *testing.T) {
 	addrs := []common.Addr{
-		{"localhost", "3000"},
-		{"localhost", "3001"},
-		{"localhost", "3002"},
+		{"localhost", "3060"},
+		{"localhost", "3061"},
+		{"localhost", "3062"},
 	}
 
 	// Start servers.
@@ -57,14 +58,14 @@ func TestClientsTryForceNewArbiter(t *testing.T) {
 	errors := make(ArbErrs)
 	statuses := make(ArbStats)
 	retries := 1000
-	ok := rpc.ArbiterClients(addrs, errors, statuses).TryForceNewArbiter(retries)
+	ok := TryForceNewArbiter(addrs, errors, statuses, retries)
 
 	if addr, err := errors.CheckAll(); err != nil {
 		t.Fatalf("(tryforce) %v: %v", addr.ToStr(), err)
 	}
 
 	if !ok {
-		t.Fatalf("failed consensus after %v tries", retries)
+		t.Fatalf("failed consensus after %v tries: %v", retries, statuses)
 	}
 
 	_, ok = rpc.ArbiterClients(addrs, errors, statuses).Arbiter()
@@ -0,0 +1,183 @@
+/*
+This pkg contains clocks for code that depends on time, such that it can run
+in virtual time (e.g the simulations in core/eventloop, where hours pass in
+seconds). Code that can't be given a clock (such as common.DataPoint.Expired)
+uses the process-wide clock, see SetDefault.
+*/
+package clock
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the time and makes timers.
+type Clock interface {
+	Now() time.Time
+	// NewTimer is like time.NewTimer.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is like time.Timer, but with a method for the chan.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Real is the wall clock (package time).
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+// Process-wide clock, see SetDefault. Held in an atomic.Value (as a
+// defaultClock, since the type of stored values can't change) rather than
+// behind a lock, as it's read for every datapoint in expiry sweeps.
+var def atomic.Value
+
+type defaultClock struct{ c Clock }
+
+// SetDefault sets the process-wide clock, nil means Real (the default).
+func SetDefault(c Clock) {
+	def.Store(defaultClock{c})
+}
+
+// Default returns the process-wide clock, see SetDefault.
+func Default() Clock {
+	if d, _ := def.Load().(defaultClock); d.c != nil {
+		return d.c
+	}
+	return Real
+}
+
+// Now returns the time of the process-wide clock, see SetDefault.
+func Now() time.Time { return Default().Now() }
+
+// AfterFunc is like time.AfterFunc, but on clock 'c': 'f' is called in its own
+// goroutine once the timer fires. The returned func stops it, and returns
+// false if the timer has already fired (then 'f' is called regardless) or was
+// stopped before.
+func AfterFunc(c Clock, d time.Duration, f func()) (stop func() bool) {
+	t := c.NewTimer(d)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-t.C():
+			f()
+		case <-done:
+		}
+	}()
+	return func() bool {
+		if !t.Stop() {
+			return false
+		}
+		close(done)
+		return true
+	}
+}
+
+// Virtual is a clock where time only passes when it is moved (with Set or
+// Advance). Timers fire when the time is moved to or past their deadline.
+// Safe for concurrent use.
+type Virtual struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*virtualTimer
+}
+
+// NewVirtual creates a Virtual clock, starting at 'start'.
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+// Now returns the current (virtual) time.
+func (v *Virtual) Now() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.now
+}
+
+// NewTimer makes a timer that fires when the time is moved 'd' ahead, or at
+// once if 'd' isn't positive.
+func (v *Virtual) NewTimer(d time.Duration) Timer {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	t := &virtualTimer{v: v, deadline: v.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- v.now
+		return t
+	}
+	v.timers = append(v.timers, t)
+	return t
+}
+
+// Set moves the time to 't' and fires the timers that are due, in the order
+// of their deadlines. The time never moves backwards.
+func (v *Virtual) Set(t time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if t.Before(v.now) {
+		return
+	}
+	v.now = t
+
+	sort.SliceStable(v.timers, func(i, j int) bool {
+		return v.timers[i].deadline.Before(v.timers[j].deadline)
+	})
+	i := 0
+	for ; i < len(v.timers) && !v.timers[i].deadline.After(t); i++ {
+		v.timers[i].c <- v.timers[i].deadline
+	}
+	v.timers = v.timers[i:]
+}
+
+// Advance moves the time 'd' ahead, see Set.
+func (v *Virtual) Advance(d time.Duration) {
+	v.Set(v.Now().Add(d))
+}
+
+// Next returns the deadline of the earliest timer that hasn't fired, false if
+// there is none.
+func (v *Virtual) Next() (time.Time, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var next time.Time
+	for _, t := range v.timers {
+		if next.IsZero() || t.deadline.Before(next) {
+			next = t.deadline
+		}
+	}
+	return next, !next.IsZero()
+}
+
+type virtualTimer struct {
+	v        *Virtual
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (t *virtualTimer) C() <-chan time.Time { return t.c }
+
+// Stop prevents the timer from firing, false if it already has (or was
+// stopped).
+func (t *virtualTimer) Stop() bool {
+	t.v.mu.Lock()
+	defer t.v.mu.Unlock()
+	for i, other := range t.v.timers {
+		if other == t {
+			t.v.timers = append(t.v.timers[:i], t.v.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
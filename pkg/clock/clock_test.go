@@ -0,0 +1,88 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVirtual(t *testing.T) {
+	start := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	v := NewVirtual(start)
+
+	late := v.NewTimer(time.Hour)
+	early := v.NewTimer(time.Minute)
+	stopped := v.NewTimer(time.Second)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("unexpected result of Stop")
+	}
+	if next, ok := v.Next(); !ok || !next.Equal(start.Add(time.Minute)) {
+		t.Fatalf("unexpected next deadline: %v", next)
+	}
+
+	v.Advance(time.Minute * 30)
+	if !v.Now().Equal(start.Add(time.Minute * 30)) {
+		t.Fatalf("unexpected time: %v", v.Now())
+	}
+	select {
+	case at := <-early.C():
+		if !at.Equal(start.Add(time.Minute)) {
+			t.Fatalf("timer fired with the wrong time: %v", at)
+		}
+	default:
+		t.Fatal("due timer didn't fire")
+	}
+	select {
+	case <-late.C():
+		t.Fatal("timer fired early")
+	case <-stopped.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+
+	// Time doesn't move backwards.
+	v.Set(start)
+	if !v.Now().Equal(start.Add(time.Minute * 30)) {
+		t.Fatalf("time moved backwards: %v", v.Now())
+	}
+	if early.Stop() {
+		t.Fatal("stopped a timer that had fired")
+	}
+}
+
+func TestDefault(t *testing.T) {
+	defer SetDefault(nil)
+	start := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	SetDefault(NewVirtual(start))
+	if !Now().Equal(start) {
+		t.Fatalf("unexpected time of the default clock: %v", Now())
+	}
+	SetDefault(nil)
+	if Default() != Real {
+		t.Fatal("nil didn't restore the real clock")
+	}
+}
+
+func TestAfterFunc(t *testing.T) {
+	v := NewVirtual(time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC))
+	called := make(chan bool, 2)
+	AfterFunc(v, time.Minute, func() { called <- true })
+	stop := AfterFunc(v, time.Minute, func() { called <- false })
+	if !stop() || stop() {
+		t.Fatal("unexpected result of stop")
+	}
+
+	v.Advance(time.Minute)
+	select {
+	case ok := <-called:
+		if !ok {
+			t.Fatal("stopped func was called")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("func wasn't called")
+	}
+	select {
+	case <-called:
+		t.Fatal("unexpected call")
+	case <-time.After(time.Millisecond * 20):
+	}
+}
@@ -5,9 +5,13 @@ The centroid impl here follows the common.Centroid interface.
 package centroid
 
 import (
+	"reflect"
 	"sort"
+	"time"
+	"trypo/pkg/clock"
 	"trypo/pkg/kmeans/common"
 	"trypo/pkg/mathutils"
+	"trypo/pkg/searchutils"
 )
 
 // Iface hint
@@ -23,8 +27,32 @@ type Centroid struct {
 	DataPoints    []common.DataPoint
 	knnSearchFunc knnSearchFunc
 	kfnSearchFunc knnSearchFunc
+
+	// Set if vectors are stored quantized (see NewCentroidArgs.Quantization).
+	// In that case, the Vec field of each dp in DataPoints is nil, while
+	// qvecs holds the quantized vectors (same index as DataPoints).
+	quantizer *mathutils.Quantizer
+	qvecs     []mathutils.QVec
+	// Set if knnSearchFunc is known to match a distance kernel, such that
+	// quantized vectors are searched without decoding them (see knnSearch).
+	qKernel *quantKernel
+
+	// Secondary (graph) index used for lookups in large Centroids, see
+	// NewCentroidArgs.Index and ./index.go. Nil until it is needed.
+	index    *nswIndex
+	indexCfg IndexConfig
+
+	// Running sum of stored vectors, c.vec is derived from it. Nil or out of
+	// sync (count differs from len(DataPoints)) means it has to be recomputed,
+	// see c.syncSum.
+	sum *mathutils.VecSum
 }
 
+// DriftTolerance is the estimated relative error of the internal vector of
+// a Centroid (see mathutils.VecSum.Drift) at which it is recomputed from all
+// contained datapoints, as opposed to being adjusted incrementally.
+var DriftTolerance = 1e-9
+
 // NewCentroidArgs is used as an argument to NewCentroid.
 type NewCentroidArgs struct {
 	InitVec []float64
@@ -53,6 +81,18 @@ type NewCentroidArgs struct {
 	// KFNSearchFunc is the same as KNNSearchFunc but should find k furthest
 	// neighs as opposed to nearest.
 	KFNSearchFunc knnSearchFunc
+	// Quantization specifies whether or not vectors of contained datapoints
+	// should be stored in a quantized form (int8 or float16 with a scale and
+	// offset, see pkg/mathutils/quantize.go), which reduces memory at the cost
+	// of precision. The zero value keeps vectors as float64. Lookups with
+	// searchutils.KNNCos or KNNEuc compare quantized vectors directly (see
+	// the distance kernels of mathutils.Quantizer), other search funcs are
+	// given decoded vectors.
+	Quantization mathutils.QuantConfig
+	// Index configures a secondary graph index which makes KNNLookup cheap
+	// for large Centroids (as opposed to a linear scan), at the cost of
+	// approximate results. The zero value disables it. See IndexConfig.
+	Index IndexConfig
 }
 
 // NewCentroid creates a new centroid with the specified args.
@@ -66,24 +106,105 @@ func NewCentroid(args NewCentroidArgs) (Centroid, bool) {
 		DataPoints:    make([]common.DataPoint, 0, args.InitCap),
 		knnSearchFunc: args.KNNSearchFunc,
 		kfnSearchFunc: args.KFNSearchFunc,
+		quantizer:     mathutils.NewQuantizer(args.Quantization, len(args.InitVec)),
+		indexCfg:      args.Index.withDefaults(),
 	}
 	for i, v := range args.InitVec {
 		c.vec[i] = v
 	}
+	if c.quantizer != nil {
+		c.qvecs = make([]mathutils.QVec, 0, args.InitCap)
+		c.qKernel = quantKernelOf(args.KNNSearchFunc)
+	}
 	return c, true
 }
 
 // Vec returns the vector of a centroid.
 func (c *Centroid) Vec() []float64 { return c.vec }
 
-// addDataPoint adjusts the internal vector while adding new dps.
+// vecAt returns the vector of the datapoint at index i, decoded if the
+// vectors are quantized.
+func (c *Centroid) vecAt(i int) []float64 {
+	if c.quantizer == nil {
+		return c.DataPoints[i].Vec
+	}
+	return c.quantizer.Decode(c.qvecs[i])
+}
+
+// dataPointAt returns a copy of the datapoint at index i, with a decoded
+// vector if vectors are quantized. Used whenever dps leave a Centroid.
+func (c *Centroid) dataPointAt(i int) common.DataPoint {
+	dp := c.DataPoints[i]
+	dp.Vec = c.vecAt(i)
+	return dp
+}
+
+// syncSum makes sure that c.sum is in sync with c.DataPoints, recomputing it
+// from scratch if not (DataPoints can be replaced from outside of this pkg)
+// or if its error estimate is above DriftTolerance. c.vec is updated in case
+// of recomputation, unless there are no datapoints.
+func (c *Centroid) syncSum() {
+	if c.sum != nil && c.sum.Len() == len(c.DataPoints) && c.sum.Drift() <= DriftTolerance {
+		return
+	}
+	c.recomputeSum()
+}
+
+// recomputeSum recomputes c.sum and c.vec from all datapoints.
+func (c *Centroid) recomputeSum() {
+	c.sum = mathutils.NewVecSum(len(c.vec))
+	gen := c.dataPointVecGenerator()
+	for vec, cont := gen(); cont; vec, cont = gen() {
+		c.sum.Add(vec)
+	}
+	if vec, ok := c.sum.Mean(); ok {
+		c.vec = vec
+	}
+}
+
+// requantize widens the range of c.quantizer to cover vec and re-encodes all
+// stored vectors. The range grows geometrically (see Quantizer.Widen), so this
+// is amortised O(1) per added dp and re-encoding decoded vectors doesn't add up
+// to more than one quantization step. The sum (and internal vector) is then
+// recomputed, since the stored vectors will have changed slightly.
+func (c *Centroid) requantize(vec []float64) {
+	vecs := make([][]float64, len(c.qvecs))
+	for i := range c.qvecs {
+		vecs[i] = c.vecAt(i)
+	}
+	c.quantizer.Widen(vec)
+	for i := range c.qvecs {
+		c.qvecs[i] = c.quantizer.Encode(vecs[i])
+	}
+	if len(c.qvecs) > 0 {
+		c.recomputeSum()
+	}
+}
+
+// addDataPoint adjusts the internal vector while adding new dps. If vectors
+// are quantized, then the internal vector is adjusted with the stored (i.e
+// quantized) vector, such that removals done later will mirror additions.
 func (c *Centroid) addDataPoint(dp common.DataPoint) {
+	vec := dp.Vec
+	if c.quantizer != nil {
+		if !c.quantizer.Covers(vec) {
+			c.requantize(vec)
+		}
+		qv := c.quantizer.Encode(vec)
+		vec = c.quantizer.Decode(qv)
+		c.qvecs = append(c.qvecs, qv)
+		dp.Vec = nil
+	}
+
 	// Auto-adjust internal vec.
-	c.vec = mathutils.VecMulScalar(c.vec, float64(len(c.DataPoints)))
-	c.vec, _ = mathutils.VecAdd(c.vec, dp.Vec)
-	c.vec = mathutils.VecDivScalar(c.vec, float64(len(c.DataPoints))+1)
+	c.syncSum()
+	c.sum.Add(vec)
+	c.vec, _ = c.sum.Mean()
 
 	c.DataPoints = append(c.DataPoints, dp)
+	if c.index != nil && len(c.index.edges) == len(c.DataPoints)-1 {
+		c.index.insert(c, len(c.DataPoints)-1)
+	}
 }
 
 // AddDataPoint adds a DataPoint the relevant centroid. Returns false if the vector
@@ -97,50 +218,158 @@ func (c *Centroid) AddDataPoint(dp common.DataPoint) bool {
 }
 
 // rmDataPoint adjusts the internal vector while removing new dps at an
-// index pointing to c.DataPoints. The removal process itself is done with
-// unsafe reslicing (without bounds checking).
+// index pointing to c.DataPoints. The removal is a swap-remove, i.e the last
+// dp is moved into 'index', which is O(1) but changes order. Removing many
+// indexes is safe if it is done in descending order. No bounds checking.
 func (c *Centroid) rmDataPoint(index int) {
-	// Auto-adjust internal vec.
-	if len(c.DataPoints) > 1 { // guard 0 div error.
-		dp := c.DataPoints[index]
-		c.vec = mathutils.VecMulScalar(c.vec, float64(len(c.DataPoints)))
-		c.vec, _ = mathutils.VecSub(c.vec, dp.Vec)
-		c.vec = mathutils.VecDivScalar(c.vec, float64(len(c.DataPoints)-1))
-	}
-	// _Should_ be re-sliced with O(1) going by Go documentation/code.
-	c.DataPoints = append(c.DataPoints[:index], c.DataPoints[index+1:]...)
+	// Graph index is maintained if it is in sync, dropped otherwise.
+	if c.index != nil && len(c.index.edges) == len(c.DataPoints) {
+		c.index.remove(c, index)
+	} else {
+		c.index = nil
+	}
+	// Auto-adjust internal vec. It is kept as is when the last dp is
+	// removed, as the mean of nothing is undefined.
+	c.syncSum()
+	c.sum.Sub(c.vecAt(index))
+	if vec, ok := c.sum.Mean(); ok {
+		c.vec = vec
+	}
+	last := len(c.DataPoints) - 1
+	c.DataPoints[index] = c.DataPoints[last]
+	c.DataPoints[last] = common.DataPoint{} // Don't keep refs alive.
+	c.DataPoints = c.DataPoints[:last]
+	if c.quantizer != nil {
+		c.qvecs[index] = c.qvecs[last]
+		c.qvecs[last] = mathutils.QVec{}
+		c.qvecs = c.qvecs[:last]
+	}
 }
 
 // dataPointVecGenerator creates a generator which iterates through all internal
-// data points and returns their vec. Auto-removes expired payloads.
+// data points and returns their vec, such that the n-th vec belongs to
+// c.DataPoints[n]. It does not modify c.DataPoints; do c.Expire() first if
+// expired datapoints should be excluded. Quantized vectors are decoded into
+// a buffer which is re-used between calls, so the returned vectors are only
+// valid until the next call.
 func (c *Centroid) dataPointVecGenerator() func() ([]float64, bool) {
 	i := 0
+	var buf []float64
 	return func() ([]float64, bool) {
-		// Check bounds and skip expired datapoints.
-		for i < len(c.DataPoints) && c.DataPoints[i].Expired() {
-			c.rmDataPoint(i)
-		}
 		if i >= len(c.DataPoints) {
 			return nil, false
 		}
 		i++
+		if c.quantizer != nil {
+			buf = c.quantizer.DecodeInto(c.qvecs[i-1], buf)
+			return buf, true
+		}
 		return c.DataPoints[i-1].Vec, true
 	}
 }
 
+// quantKernel is a distance kernel of mathutils.Quantizer that matches a
+// known search func, see quantKernels.
+type quantKernel struct {
+	dist func(q *mathutils.Quantizer, vec []float64, qv mathutils.QVec) (float64, error)
+	// True if a lower score is nearer (distance, as opposed to similarity).
+	ascending bool
+}
+
+// Search funcs (by func pointer) that have a matching distance kernel. Others
+// (such as custom search funcs) are given decoded vectors.
+var quantKernels = map[uintptr]quantKernel{
+	funcPtr(searchutils.KNNCos): {(*mathutils.Quantizer).CosineSimilarity, false},
+	funcPtr(searchutils.KNNEuc): {(*mathutils.Quantizer).EuclideanDistance, true},
+}
+
+func funcPtr(f knnSearchFunc) uintptr { return reflect.ValueOf(f).Pointer() }
+
+// quantKernelOf returns the kernel that matches 'f', nil if there is none.
+func quantKernelOf(f knnSearchFunc) *quantKernel {
+	if k, ok := quantKernels[funcPtr(f)]; ok {
+		return &k
+	}
+	return nil
+}
+
+// knnSearch finds (max) k nearest neighs of vec among the datapoints at 'ids'
+// (all if nil), and returns indexes into 'ids' (or c.DataPoints), nearest
+// first. Uses c.knnSearchFunc, or c.qKernel directly on quantized vectors.
+func (c *Centroid) knnSearch(vec []float64, ids []int, k int) []int {
+	if c.qKernel == nil {
+		if ids == nil {
+			return c.knnSearchFunc(vec, c.dataPointVecGenerator(), k)
+		}
+		return c.knnSearchFunc(vec, c.idsVecGenerator(ids), k)
+	}
+	n := len(c.qvecs)
+	if ids != nil {
+		n = len(ids)
+	}
+	better := func(a, b float64) bool {
+		if c.qKernel.ascending {
+			return a < b
+		}
+		return a > b
+	}
+	// Best first, like searchutils.KNNBrute.
+	res := make([]int, 0, k)
+	scores := make([]float64, 0, k)
+	for i := 0; i < n && k > 0; i++ {
+		qv := c.qvecs[i]
+		if ids != nil {
+			qv = c.qvecs[ids[i]]
+		}
+		score, err := c.qKernel.dist(c.quantizer, vec, qv)
+		if err != nil || (len(res) == k && !better(score, scores[k-1])) {
+			continue
+		}
+		pos := sort.Search(len(res), func(j int) bool { return better(score, scores[j]) })
+		if len(res) < k {
+			res, scores = append(res, 0), append(scores, 0)
+		}
+		copy(res[pos+1:], res[pos:])
+		copy(scores[pos+1:], scores[pos:])
+		res[pos], scores[pos] = i, score
+	}
+	return res
+}
+
 // DrainUnordered drains n internal datapoints in a manner that has no particylar.
 // significance, specifically by how they are stored internally -- in no order.
+// Expired datapoints that are encountered are dropped.
 func (c *Centroid) DrainUnordered(n int) []common.DataPoint {
 	res := make([]common.DataPoint, 0, n)
-	for len(c.DataPoints) != 0 && len(res) < n {
-		if !c.DataPoints[0].Expired() {
-			res = append(res, c.DataPoints[0])
+	// Datapoints are taken from the front, then the consumed prefix is
+	// removed backwards (see c.rmDataPoint).
+	consumed := 0
+	now := clock.Now()
+	for consumed < len(c.DataPoints) && len(res) < n {
+		if !c.DataPoints[consumed].ExpiredAt(now) {
+			res = append(res, c.dataPointAt(consumed))
 		}
-		c.rmDataPoint(0)
+		consumed++
 	}
+	c.bulk(consumed, func() {
+		for i := consumed - 1; i > -1; i-- {
+			c.rmDataPoint(i)
+		}
+	})
 	return res
 }
 
+// bulk runs f, which removes (about) n datapoints. If n is large compared to
+// the amount of datapoints, then the graph index is rebuilt after f instead
+// of being maintained for each removal (see withoutIndex in ./index.go).
+func (c *Centroid) bulk(n int, f func()) {
+	if c.index != nil && n*10 > len(c.DataPoints) {
+		c.withoutIndex(f)
+		return
+	}
+	f()
+}
+
 // DrainOrdered drains n internal DataPoints that are furthest away from the
 // internal vector of a centroid. Furthest away can mean different things,
 // depending on the 'KFNSearchFunc' field used in the 'NewCentroidArgs' struct
@@ -149,48 +378,110 @@ func (c *Centroid) DrainUnordered(n int) []common.DataPoint {
 // similarity to this Centroid.
 func (c *Centroid) DrainOrdered(n int) []common.DataPoint {
 	res := make([]common.DataPoint, 0, n)
-	// Furthest neigh.
-	indexes := c.kfnSearchFunc(c.vec, c.dataPointVecGenerator(), n)
+	// Furthest neigh, relative to the vec before expired dps are removed.
+	vec := c.vec
+	c.Expire()
+	indexes := c.kfnSearchFunc(vec, c.dataPointVecGenerator(), n)
 	for _, index := range indexes {
-		res = append(res, c.DataPoints[index])
-	}
-	// Sorting because this method will remove datapoints at these indexes, and
-	// having things out of order can cause a rugpull (c.DataPoints index shift).
-	sort.Ints(indexes)
-	for i := len(indexes) - 1; i > -1; i-- { // Backwards for removal safety.
-		c.rmDataPoint(indexes[i])
+		res = append(res, c.dataPointAt(index))
 	}
+	c.rmDataPoints(indexes)
 	return res
 }
 
 // Expire looks through internal datapoints and removes the ones that have
-// expired. This needs a follow-up with Centroid.MemTrim() to completely
-// free up the space and reduce the internal cap.
+// expired, in a single linear pass. This needs a follow-up with
+// Centroid.MemTrim() to completely free up the space and reduce the
+// internal cap.
 func (c *Centroid) Expire() {
-	i := 0
-	for i < len(c.DataPoints) {
-		if c.DataPoints[i].Expired() {
-			c.rmDataPoint(i)
-			continue
+	// Expiry is cheap to check compared to removal, so counting first is fine.
+	now := clock.Now()
+	n := 0
+	for i := range c.DataPoints {
+		if c.DataPoints[i].ExpiredAt(now) {
+			n++
 		}
-		i++
 	}
+	if n == 0 {
+		return
+	}
+	c.bulk(n, func() {
+		i := 0
+		for i < len(c.DataPoints) {
+			// Swap-remove moves an unchecked dp into i, so no i++.
+			if c.DataPoints[i].ExpiredAt(now) {
+				c.rmDataPoint(i)
+				continue
+			}
+			i++
+		}
+	})
 }
 
 // LenDP returns the number of DataPoints stored internally.
 func (c *Centroid) LenDP() int { return len(c.DataPoints) }
 
-// MemTrim creates a new internal DataPoint slice where capacity equals len.
+// LenBytes returns the (approximate) amount of bytes used for storing vectors
+// and payloads of internal DataPoints. Quantized vectors are counted as stored.
+func (c *Centroid) LenBytes() int {
+	res := 0
+	for i := range c.DataPoints {
+		res += len(c.DataPoints[i].Vec)*8 + len(c.DataPoints[i].Payload)
+	}
+	for i := range c.qvecs {
+		res += c.qvecs[i].Bytes()
+	}
+	return res
+}
+
+// Quantized returns true if the vectors of internal DataPoints are quantized.
+func (c *Centroid) Quantized() bool { return c.quantizer != nil }
+
+// ExportDataPoints returns a copy of all internal DataPoints, with decoded
+// vectors if they are quantized. Meant for sending a Centroid elsewhere
+// (through RPC, for instance), since quantization state is unexported.
+func (c *Centroid) ExportDataPoints() []common.DataPoint {
+	res := make([]common.DataPoint, len(c.DataPoints))
+	for i := range c.DataPoints {
+		res[i] = c.dataPointAt(i)
+	}
+	return res
+}
+
+// MemTrim creates a new internal DataPoint slice where capacity equals len,
+// and rebuilds the graph index (if enabled).
+//
+// If vectors are quantized, then the quantization range is re-fitted to the
+// remaining DataPoints as well, since it only grows otherwise.
 func (c *Centroid) MemTrim() {
-	dps := make([]common.DataPoint, 0)
-	// Using DrainUnordered because it removes expired dps with c.rmDataPoint,
-	// which adjusts c.vec as well. Also, not using len(c.DataPoints) as arg
-	// to c.DrainUnordered(...) because that would create a slice of that cap,
-	// which would make this method (MemTrim) pointless, as it reduces cap.
-	for len(c.DataPoints) > 0 {
-		dps = append(dps, c.DrainUnordered(1)...)
-	}
-	c.DataPoints = dps
+	// Rebuilt at the end.
+	c.index = nil
+	defer c.RebuildIndex()
+
+	// Expire adjusts c.vec as well.
+	c.Expire()
+	if c.quantizer == nil {
+		dps := make([]common.DataPoint, len(c.DataPoints))
+		copy(dps, c.DataPoints)
+		c.DataPoints = dps
+		return
+	}
+
+	// Vectors in dps are decoded, so they're used to re-fit.
+	dps := c.ExportDataPoints()
+	i := 0
+	c.quantizer.Fit(func() ([]float64, bool) {
+		if i >= len(dps) {
+			return nil, false
+		}
+		i++
+		return dps[i-1].Vec, true
+	})
+	c.qvecs = make([]mathutils.QVec, 0, len(dps))
+	c.DataPoints = make([]common.DataPoint, 0, len(dps))
+	for _, dp := range dps {
+		c.addDataPoint(dp)
+	}
 }
 
 // MoveVector moves the internal centroid vector to be the mean of all
@@ -199,11 +490,9 @@ func (c *Centroid) MemTrim() {
 // it is still available in case those methods are somehow bypassed in
 // the future.
 func (c *Centroid) MoveVector() bool {
-	vec, ok := mathutils.VecMean(c.dataPointVecGenerator())
-	if ok {
-		c.vec = vec
-	}
-	return ok
+	c.Expire()
+	c.recomputeSum()
+	return c.sum.Len() != 0
 }
 
 // DistributeDataPoints removes n internal DataPoints using the DrainOrdered
@@ -237,27 +526,76 @@ func (c *Centroid) DistributeDataPoints(n int, receivers []common.DataPointRecei
 	}
 }
 
+// knnIndexes returns the indexes (into c.DataPoints) of max 'k' DataPoints
+// that are nearest 'vec', none of which have expired. With a linear search,
+// all expired DataPoints are removed first. With the graph index, only the
+// expired ones that are found are removed, and the search is repeated until
+// none are found, such that expired DataPoints don't take the place of live
+// ones in the result. The indexes are valid until the next removal.
+func (c *Centroid) knnIndexes(vec []float64, k int) []int {
+	for {
+		if !c.ensureIndex() {
+			c.Expire()
+			return c.knnSearch(vec, nil, k)
+		}
+		indexes := c.index.search(c, vec, k)
+		var expired []int
+		now := clock.Now()
+		for _, i := range indexes {
+			if c.DataPoints[i].ExpiredAt(now) {
+				expired = append(expired, i)
+			}
+		}
+		if len(expired) == 0 {
+			return indexes
+		}
+		c.rmDataPoints(expired)
+	}
+}
+
+// rmDataPoints removes DataPoints at 'indexes' (in any order), see
+// c.rmDataPoint.
+func (c *Centroid) rmDataPoints(indexes []int) {
+	// Sorting because removing out of order can cause a rugpull
+	// (c.rmDataPoint moves the last dp into the removed index).
+	sorted := append([]int(nil), indexes...)
+	sort.Ints(sorted)
+	for i := len(sorted) - 1; i > -1; i-- { // Backwards for removal safety.
+		c.rmDataPoint(sorted[i])
+	}
+}
+
 // KNNLookup uses the supplied 'vec' to lookup 'n' best-fit DataPoints and
 // returns them; 'drain'=true will remove them from self as well. Best fit will
 // depend on the 'KFNSearchFunc' field used in the 'NewCentroidArgs' struct when
 // crating a new Centroid with 'NewCentroid'. If that field is for instance
 // net-means/searchutils.KNNCos, then best fit equals best cosine similarity.
+// Expired DataPoints are never returned, see c.knnIndexes.
 func (c *Centroid) KNNLookup(vec []float64, k int, drain bool) []common.DataPoint {
-	res := make([]common.DataPoint, 0, k)
-
-	indexes := c.knnSearchFunc(vec, c.dataPointVecGenerator(), k)
+	indexes := c.knnIndexes(vec, k)
+	res := make([]common.DataPoint, 0, len(indexes))
 	for _, i := range indexes {
-		res = append(res, c.DataPoints[i])
+		res = append(res, c.dataPointAt(i))
 	}
-
-	// Secondary loop because ints in indexes might not be ordered.
 	if drain {
-		// Sorting because this method will remove datapoints at these indexes, and
-		// having things out of order can cause a rugpull (c.DataPoints index shift).
-		sort.Ints(indexes)
-		for i := len(indexes) - 1; i > -1; i-- {
-			c.rmDataPoint(indexes[i])
+		c.rmDataPoints(indexes)
+	}
+	return res
+}
+
+// Touch finds DataPoints like KNNLookup (without drain), and pushes the expiry
+// of those that expire (ExpireEnabled=true) forward to 'expires'. Expiry is
+// never moved back, and DataPoints that don't expire are left as they are.
+// Returns the found DataPoints, with their new expiry.
+func (c *Centroid) Touch(vec []float64, k int, expires time.Time) []common.DataPoint {
+	indexes := c.knnIndexes(vec, k)
+	res := make([]common.DataPoint, 0, len(indexes))
+	for _, i := range indexes {
+		dp := &c.DataPoints[i]
+		if dp.ExpireEnabled && dp.Expires.Before(expires) {
+			dp.Expires = expires
 		}
+		res = append(res, c.dataPointAt(i))
 	}
 	return res
 }
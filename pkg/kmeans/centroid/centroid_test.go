@@ -1,8 +1,12 @@
 package centroid
 
 import (
+	"fmt"
+	"math"
+	"math/rand"
 	"testing"
 	"time"
+	"trypo/pkg/clock"
 	"trypo/pkg/kmeans/common"
 	"trypo/pkg/mathutils"
 	"trypo/pkg/searchutils"
@@ -111,19 +115,22 @@ func TestRmDataPoint(t *testing.T) {
 		t.Fatalf("did not adjust internal vec correctly (no. 1): %v", c.Vec())
 	}
 
-	c.rmDataPoint(0) // dp1.
+	c.rmDataPoint(0) // dp1, dp3 is moved into its place.
 	if !vecEq(c.Vec(), vec(5, 5)) {
 		t.Fatalf("did not adjust internal vec correctly (no. 2): %v", c.Vec())
 	}
+	if !vecEq(c.DataPoints[0].Vec, vec(6, 6)) {
+		t.Fatalf("did not swap-remove: %v", c.DataPoints)
+	}
 
-	c.rmDataPoint(0) // dp2, note index shifted
-	if !vecEq(c.Vec(), vec(6, 6)) {
+	c.rmDataPoint(0) // dp3, dp2 is moved into its place.
+	if !vecEq(c.Vec(), vec(4, 4)) {
 		t.Fatalf("did not adjust internal vec correctly (no. 3): %v", c.Vec())
 	}
 
-	c.rmDataPoint(0) // dp3, note index shifted
-	if !vecEq(c.Vec(), vec(6, 6)) {
-		t.Fatalf("did not adjust internal vec correctly (no. 3): %v", c.Vec())
+	c.rmDataPoint(0) // dp2.
+	if !vecEq(c.Vec(), vec(4, 4)) {
+		t.Fatalf("did not adjust internal vec correctly (no. 4): %v", c.Vec())
 	}
 	if len(c.DataPoints) != 0 {
 		t.Errorf("didn't remove all dps: %v", len(c.DataPoints))
@@ -134,24 +141,22 @@ func TestDataPointVecGenerator(t *testing.T) {
 	c := newCentroid(vec(1, 1))
 	c.DataPoints = []common.DataPoint{
 		dp(vec(1, 2), 0),
-		dp(vec(1, 3), 1), // Expire so gen returns 1 thing.
+		dp(vec(1, 3), 1), // Expired, but should still be generated.
 	}
 
 	sleep()
 	gen := c.dataPointVecGenerator()
-	v, _ := gen()
-	if !vecEq(v, vec(1, 2)) {
-		t.Fatalf("generator produced incorrect res: %v", v)
+	for i, want := range [][]float64{vec(1, 2), vec(1, 3)} {
+		v, cont := gen()
+		if !cont || !vecEq(v, want) {
+			t.Fatalf("generator produced incorrect res (no. %v): %v", i, v)
+		}
 	}
-	_, cont := gen()
-	if cont {
-		t.Fatalf("second generator call signals continue")
+	if _, cont := gen(); cont {
+		t.Fatalf("third generator call signals continue")
 	}
-	if len(c.DataPoints) != 1 {
-		t.Fatalf("generator didn't expire one datapoint")
-	}
-	if !vecEq(c.DataPoints[0].Vec, vec(1, 2)) {
-		t.Fatalf("generator expired incorrect datapoint")
+	if len(c.DataPoints) != 2 {
+		t.Fatalf("generator modified datapoints")
 	}
 }
 
@@ -299,3 +304,617 @@ func TestKNNLookup(t *testing.T) {
 		t.Fatal("centroid didn't drain")
 	}
 }
+
+/*
+--------------------------------------------------------------------------------
+Quantization section.
+--------------------------------------------------------------------------------
+*/
+
+// Helper for configuring a centroid with quantized vectors.
+func newCentroidQuantized(vec []float64, cfg mathutils.QuantConfig) Centroid {
+	c, ok := NewCentroid(NewCentroidArgs{
+		InitVec:       vec,
+		InitCap:       0,
+		KNNSearchFunc: searchutils.KNNCos,
+		KFNSearchFunc: searchutils.KFNCos,
+		Quantization:  cfg,
+	})
+
+	if !ok {
+		panic("failed test configuration")
+	}
+	return c
+}
+
+// All quantization configs, used in loops.
+var quantConfigs = []mathutils.QuantConfig{
+	{Kind: mathutils.QuantInt8, Scope: mathutils.QuantPerDimension},
+	{Kind: mathutils.QuantInt8, Scope: mathutils.QuantPerCentroid},
+	{Kind: mathutils.QuantFloat16, Scope: mathutils.QuantPerDimension},
+	{Kind: mathutils.QuantFloat16, Scope: mathutils.QuantPerCentroid},
+}
+
+// vecNear checks that all elements in v1 & v2 are within tolerance.
+func vecNear(v1, v2 []float64, tolerance float64) bool {
+	if len(v1) != len(v2) {
+		return false
+	}
+	for i := range v1 {
+		if math.Abs(v1[i]-v2[i]) > tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQuantizedAddDataPoint(t *testing.T) {
+	for _, cfg := range quantConfigs {
+		c := newCentroidQuantized(vec(0, 0), cfg)
+		c.AddDataPoint(dp(vec(1, 2), 0))
+		c.AddDataPoint(dp(vec(3, 6), 0))
+		c.AddDataPoint(dp(vec(2, 4), 0))
+
+		if len(c.qvecs) != 3 || c.DataPoints[0].Vec != nil {
+			t.Fatalf("%v: vectors are not stored quantized", cfg)
+		}
+		if !vecNear(c.Vec(), vec(2, 4), 0.05) {
+			t.Fatalf("%v: incorrect internal vec: %v", cfg, c.Vec())
+		}
+
+		// Mean maintenance should mirror additions exactly, so
+		// removing all but one dp leaves exactly that (stored) vec.
+		c.rmDataPoint(0)
+		c.rmDataPoint(0)
+		if !vecEq(c.Vec(), c.vecAt(0)) {
+			t.Fatalf("%v: drift after removal: %v", cfg, c.Vec())
+		}
+	}
+}
+
+func TestQuantizedKNNLookup(t *testing.T) {
+	for _, cfg := range quantConfigs {
+		c := newCentroidQuantized(vec(0, 0, 0), cfg)
+		c.AddDataPoint(dp(vec(1, 2, 3), 0)) // dp1.
+		c.AddDataPoint(dp(vec(1, 3, 4), 0)) // dp2.
+		c.AddDataPoint(dp(vec(9, 1, 1), 0)) // dp3.
+
+		// vec(1,1,1) is closest to dp1.
+		dps := c.KNNLookup(vec(1, 1, 1), 1, true)
+		if len(dps) != 1 {
+			t.Fatalf("%v: incorrect result length/amount", cfg)
+		}
+		if !vecNear(dps[0].Vec, vec(1, 2, 3), 0.05) { // dp1.
+			t.Fatalf("%v: incorrect result value: %v", cfg, dps[0].Vec)
+		}
+		if c.LenDP() != 2 || len(c.qvecs) != 2 {
+			t.Fatalf("%v: centroid didn't drain", cfg)
+		}
+	}
+}
+
+// Kernels on quantized vectors give the same result as a search over decoded
+// vectors, and are within quantization error of a search over the originals.
+func TestQuantizedKernels(t *testing.T) {
+	funcs := map[string]struct {
+		knn  knnSearchFunc
+		dist func(v1, v2 []float64) (float64, error)
+	}{
+		"cos": {searchutils.KNNCos, mathutils.CosineSimilarity},
+		"euc": {searchutils.KNNEuc, mathutils.EuclideanDistance},
+	}
+	dps := dpsRand(1, 300, 8)
+	targets := dpsRand(2, 20, 8)
+	orig := newCentroidFilled(dps)
+	for name, f := range funcs {
+		for _, cfg := range quantConfigs {
+			c, _ := NewCentroid(NewCentroidArgs{
+				InitVec:       make([]float64, 8),
+				KNNSearchFunc: f.knn,
+				KFNSearchFunc: searchutils.KFNCos,
+				Quantization:  cfg,
+			})
+			for _, dp := range dps {
+				c.AddDataPoint(dp)
+			}
+			if c.qKernel == nil {
+				t.Fatalf("%v %v: no kernel", name, cfg)
+			}
+			tol := 0.03
+			if cfg.Kind == mathutils.QuantFloat16 {
+				tol = 0.003
+			}
+			for _, target := range targets {
+				got := c.knnSearch(target.Vec, nil, 5)
+				want := f.knn(target.Vec, c.dataPointVecGenerator(), 5)
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Fatalf("%v %v: kernel %v, decoded %v", name, cfg, got, want)
+				}
+				// Subsets, as with the graph index.
+				ids := []int{7, 3, 250, 42, 99, 1}
+				got = c.knnSearch(target.Vec, ids, 3)
+				if want := f.knn(target.Vec, c.idsVecGenerator(ids), 3); fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Fatalf("%v %v: kernel %v, decoded %v (ids)", name, cfg, got, want)
+				}
+				got = c.knnSearch(target.Vec, nil, 5)
+				exact := f.knn(target.Vec, orig.dataPointVecGenerator(), 5)
+				for i := range got {
+					d1, _ := f.dist(target.Vec, dps[got[i]].Vec)
+					d2, _ := f.dist(target.Vec, dps[exact[i]].Vec)
+					if math.Abs(d1-d2) > tol {
+						t.Fatalf("%v %v: %v-th neigh off by %v", name, cfg, i, d1-d2)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestQuantizedMemTrim(t *testing.T) {
+	c := newCentroidQuantized(vec(0, 0), quantConfigs[0])
+	c.AddDataPoint(dp(vec(-100, 100), 0)) // Widens range a lot.
+	c.AddDataPoint(dp(vec(1, 2), 0))
+	c.AddDataPoint(dp(vec(2, 1), 0))
+
+	// Range is now re-fitted to the two remaining dps only,
+	// so new dps within that range are stored precisely.
+	c.rmDataPoint(0)
+	c.MemTrim()
+	if c.LenDP() != 2 {
+		t.Fatalf("unexpected dp count after memtrim: %v", c.LenDP())
+	}
+	c.AddDataPoint(dp(vec(1.5, 1.5), 0))
+	if v := c.ExportDataPoints()[2].Vec; !vecNear(v, vec(1.5, 1.5), 0.01) {
+		t.Fatalf("imprecise vec after re-fit: %v", v)
+	}
+}
+
+// Values that creep outwards widen the range many times, which must neither
+// add up re-encoding errors nor drop (expired) dps as a side effect.
+func TestQuantizedWiden(t *testing.T) {
+	defer clock.SetDefault(nil)
+	start := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	v := clock.NewVirtual(start)
+	clock.SetDefault(v)
+
+	const n = 1000
+	orig := func(i int) []float64 { return vec(float64(i), -float64(i)/3) }
+	for _, cfg := range quantConfigs {
+		c := newCentroidQuantized(vec(0, 0), cfg)
+		for i := 1; i <= n; i++ {
+			dp := dp(orig(i), 0)
+			if i == 1 {
+				dp.Expires, dp.ExpireEnabled = v.Now().Add(time.Minute), true
+			}
+			c.AddDataPoint(dp)
+			if i == 1 {
+				v.Advance(time.Hour)
+			}
+		}
+		if c.LenDP() != n {
+			t.Fatalf("%v: dps were dropped while widening: %v", cfg, c.LenDP())
+		}
+
+		// Within two steps of a range fitted exactly to the values.
+		width := float64(n - 1)
+		if cfg.Scope == mathutils.QuantPerCentroid {
+			width = float64(n) + float64(n)/3
+		}
+		tolerance := width / 127
+		if cfg.Kind == mathutils.QuantFloat16 {
+			tolerance = width / 1024
+		}
+		for i, dp := range c.ExportDataPoints() {
+			if !vecNear(dp.Vec, orig(i+1), tolerance) {
+				t.Fatalf("%v: imprecise vec %v: %v", cfg, i, dp.Vec)
+			}
+		}
+	}
+}
+
+// Compares recall and memory of quantized centroids against float64. Recall is
+// the share of true nearest neighs (exact float64 search) that are returned.
+func BenchmarkKNNLookupQuantized(b *testing.B) {
+	const dim, n, k, queries = 64, 5000, 10, 50
+	rng := rand.New(rand.NewSource(1))
+	randVec := func() []float64 {
+		v := make([]float64, dim)
+		for i := range v {
+			v[i] = rng.Float64()*2 - 1
+		}
+		return v
+	}
+	// Payloads identify dps, such that results are matched exactly.
+	dps := make([]common.DataPoint, n)
+	for i := range dps {
+		dps[i] = common.DataPoint{Vec: randVec(), Payload: []byte(fmt.Sprint(i))}
+	}
+	qvecs := make([][]float64, queries)
+	for i := range qvecs {
+		qvecs[i] = randVec()
+	}
+
+	// Ground truth with exact float64 search.
+	exact := newCentroid(vec(make([]float64, dim)...))
+	for _, dp := range dps {
+		exact.AddDataPoint(dp)
+	}
+	truth := make([]map[string]bool, queries)
+	for i, q := range qvecs {
+		truth[i] = make(map[string]bool, k)
+		for _, dp := range exact.KNNLookup(q, k, false) {
+			truth[i][string(dp.Payload)] = true
+		}
+	}
+
+	cfgs := append([]mathutils.QuantConfig{{}}, quantConfigs...)
+	names := []string{"float64", "int8dim", "int8centroid", "f16dim", "f16centroid"}
+	minRecall := []float64{1, 0.8, 0.8, 0.95, 0.95}
+	for i, cfg := range cfgs {
+		c := newCentroidQuantized(make([]float64, dim), cfg)
+		for _, dp := range dps {
+			c.AddDataPoint(dp)
+		}
+		b.Run(names[i], func(b *testing.B) {
+			hits := 0
+			for j := 0; j < b.N; j++ {
+				q := j % queries
+				for _, dp := range c.KNNLookup(qvecs[q], k, false) {
+					if truth[q][string(dp.Payload)] {
+						hits++
+					}
+				}
+			}
+			recall := float64(hits) / float64(b.N*k)
+			if recall < minRecall[i] {
+				b.Fatalf("recall %.3f is below %.2f", recall, minRecall[i])
+			}
+			b.ReportMetric(recall, "recall")
+			b.ReportMetric(float64(c.LenBytes())/float64(n), "B/dp")
+		})
+	}
+}
+
+/*
+--------------------------------------------------------------------------------
+Graph index section.
+--------------------------------------------------------------------------------
+*/
+
+// Helper for configuring a centroid with a graph index.
+func newCentroidIndexed(vec []float64, cfg IndexConfig) Centroid {
+	c, ok := NewCentroid(NewCentroidArgs{
+		InitVec:       vec,
+		InitCap:       0,
+		KNNSearchFunc: searchutils.KNNCos,
+		KFNSearchFunc: searchutils.KFNCos,
+		Index:         cfg,
+	})
+
+	if !ok {
+		panic("failed test configuration")
+	}
+	return c
+}
+
+// Helper for creating n random dps of a dimension (seeded).
+func dpsRand(seed int64, n, dim int) []common.DataPoint {
+	rng := rand.New(rand.NewSource(seed))
+	dps := make([]common.DataPoint, n)
+	for i := range dps {
+		v := make([]float64, dim)
+		for j := range v {
+			v[j] = rng.Float64()*2 - 1
+		}
+		dps[i] = common.DataPoint{Vec: v}
+	}
+	return dps
+}
+
+// Checks that the graph is symmetric and that all ids are in range.
+func checkIndex(t *testing.T, c *Centroid) {
+	if c.index == nil {
+		t.Fatalf("index not built")
+	}
+	if len(c.index.edges) != len(c.DataPoints) {
+		t.Fatalf("index out of sync: %v vs %v", len(c.index.edges), len(c.DataPoints))
+	}
+	for i, edges := range c.index.edges {
+		for _, j := range edges {
+			if j < 0 || j >= len(c.index.edges) || j == i {
+				t.Fatalf("node %v has invalid edge %v", i, j)
+			}
+			found := false
+			for _, k := range c.index.edges[j] {
+				found = found || k == i
+			}
+			if !found {
+				t.Fatalf("edge %v->%v is not symmetric", i, j)
+			}
+		}
+	}
+}
+
+func TestIndexedKNNLookup(t *testing.T) {
+	c := newCentroidIndexed(vec(make([]float64, 8)...), IndexConfig{Threshold: 50})
+	exact := newCentroid(vec(make([]float64, 8)...))
+	for _, dp := range dpsRand(1, 500, 8) {
+		c.AddDataPoint(dp)
+		exact.AddDataPoint(dp)
+	}
+
+	hits := 0
+	queries := dpsRand(2, 20, 8)
+	for _, q := range queries {
+		want := dps2Vecs(exact.KNNLookup(q.Vec, 5, false))
+		for _, dp := range c.KNNLookup(q.Vec, 5, false) {
+			if vecIn(dp.Vec, want) {
+				hits++
+			}
+		}
+	}
+	checkIndex(t, &c)
+	if recall := float64(hits) / float64(len(queries)*5); recall < 0.9 {
+		t.Fatalf("low recall with index: %v", recall)
+	}
+}
+
+func TestIndexedMaintenance(t *testing.T) {
+	c := newCentroidIndexed(vec(make([]float64, 4)...), IndexConfig{Threshold: 20})
+	for _, dp := range dpsRand(3, 200, 4) {
+		c.AddDataPoint(dp)
+	}
+
+	// Drain through the index (incremental removals).
+	for _, q := range dpsRand(4, 30, 4) {
+		if len(c.KNNLookup(q.Vec, 2, true)) != 2 {
+			t.Fatalf("indexed drain returned too few dps")
+		}
+	}
+	if c.LenDP() != 140 {
+		t.Fatalf("unexpected dp count after drain: %v", c.LenDP())
+	}
+	checkIndex(t, &c)
+
+	// Incremental additions after removals.
+	for _, dp := range dpsRand(5, 10, 4) {
+		c.AddDataPoint(dp)
+	}
+	checkIndex(t, &c)
+
+	// Bulk removal rebuilds.
+	c.DrainUnordered(100)
+	checkIndex(t, &c)
+
+	// Below threshold, index is dropped.
+	c.DrainUnordered(40)
+	c.MemTrim()
+	if c.index != nil {
+		t.Fatalf("index not dropped below threshold")
+	}
+}
+
+// Expired dps found with the index are replaced by live ones.
+func TestIndexedKNNLookupExpired(t *testing.T) {
+	defer clock.SetDefault(nil)
+	start := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	v := clock.NewVirtual(start)
+	clock.SetDefault(v)
+
+	c := newCentroidIndexed(vec(make([]float64, 4)...), IndexConfig{Threshold: 20})
+	for i, dp := range dpsRand(6, 200, 4) {
+		// Most dps expire.
+		if i%4 != 0 {
+			dp.Expires = start.Add(time.Minute)
+			dp.ExpireEnabled = true
+		}
+		c.AddDataPoint(dp)
+	}
+	v.Advance(time.Hour)
+
+	for _, q := range dpsRand(7, 10, 4) {
+		res := c.KNNLookup(q.Vec, 5, false)
+		if len(res) != 5 {
+			t.Fatalf("want 5 dps, got %v", len(res))
+		}
+		for _, dp := range res {
+			if dp.Expired() {
+				t.Fatalf("expired dp was returned")
+			}
+		}
+	}
+	checkIndex(t, &c)
+}
+
+func TestTouch(t *testing.T) {
+	defer clock.SetDefault(nil)
+	start := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	v := clock.NewVirtual(start)
+	clock.SetDefault(v)
+
+	c := newCentroid(vec(1, 1))
+	expiring := func(v []float64) common.DataPoint {
+		return common.DataPoint{Vec: v, Expires: start.Add(time.Minute), ExpireEnabled: true}
+	}
+	c.AddDataPoint(expiring(vec(1, 0)))
+	c.AddDataPoint(expiring(vec(0, 1)))
+	c.AddDataPoint(dp(vec(1, 0.1), 0)) // Doesn't expire.
+
+	touched := c.Touch(vec(1, 0), 2, start.Add(time.Hour))
+	if len(touched) != 2 {
+		t.Fatalf("want 2 touched dps, got %v", len(touched))
+	}
+	for _, dp := range c.DataPoints {
+		switch {
+		case vecEq(dp.Vec, vec(1, 0)) && !dp.Expires.Equal(start.Add(time.Hour)):
+			t.Fatalf("expiry wasn't pushed forward: %v", dp.Expires)
+		case vecEq(dp.Vec, vec(1, 0.1)) && dp.ExpireEnabled:
+			t.Fatalf("dp without expiry was given one")
+		}
+	}
+
+	// Never moved back.
+	c.Touch(vec(1, 0), 1, start.Add(time.Second))
+	v.Advance(time.Minute * 30)
+	c.Expire()
+	if c.LenDP() != 2 {
+		t.Fatalf("want 2 dps left, got %v", c.LenDP())
+	}
+}
+
+// Compares indexed lookups with linear lookups for a large centroid.
+func BenchmarkKNNLookupIndexed(b *testing.B) {
+	const dim, n, k = 32, 10000, 10
+	dps := dpsRand(1, n, dim)
+	queries := dpsRand(2, 100, dim)
+
+	for _, threshold := range []int{0, 1000} {
+		c := newCentroidIndexed(make([]float64, dim), IndexConfig{Threshold: threshold})
+		for _, dp := range dps {
+			c.AddDataPoint(dp)
+		}
+		c.RebuildIndex()
+		b.Run(fmt.Sprintf("threshold=%v", threshold), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c.KNNLookup(queries[i%len(queries)].Vec, k, false)
+			}
+		})
+	}
+}
+
+/*
+--------------------------------------------------------------------------------
+Section for storage (removal) benchmarks.
+--------------------------------------------------------------------------------
+*/
+
+// newCentroidFilled creates a Centroid with the given datapoints added.
+func newCentroidFilled(dps []common.DataPoint) *Centroid {
+	c := newCentroid(make([]float64, len(dps[0].Vec)))
+	for _, dp := range dps {
+		c.AddDataPoint(dp)
+	}
+	return &c
+}
+
+func BenchmarkDrainUnordered(b *testing.B) {
+	dps := dpsRand(1, 20000, 32)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c := newCentroidFilled(dps)
+		b.StartTimer()
+		for c.LenDP() != 0 {
+			c.DrainUnordered(100)
+		}
+	}
+}
+
+func BenchmarkDrainOrdered(b *testing.B) {
+	dps := dpsRand(1, 5000, 32)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c := newCentroidFilled(dps)
+		b.StartTimer()
+		c.DrainOrdered(2500)
+	}
+}
+
+func BenchmarkExpire(b *testing.B) {
+	dps := dpsRand(1, 20000, 32)
+	// Every other dp expires.
+	expires := time.Now().Add(-time.Second)
+	for i := range dps {
+		if i%2 == 0 {
+			dps[i].Expires = expires
+			dps[i].ExpireEnabled = true
+		}
+	}
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c := newCentroid(make([]float64, 32))
+		c.DataPoints = append([]common.DataPoint(nil), dps...)
+		c.MoveVector()
+		c.DataPoints = append([]common.DataPoint(nil), dps...)
+		b.StartTimer()
+		c.Expire()
+	}
+}
+
+func BenchmarkKNNLookupDrain(b *testing.B) {
+	dps := dpsRand(1, 20000, 32)
+	queries := dpsRand(2, 100, 32)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c := newCentroidFilled(dps)
+		b.StartTimer()
+		for _, q := range queries {
+			c.KNNLookup(q.Vec, 10, true)
+		}
+	}
+}
+
+/*
+--------------------------------------------------------------------------------
+Section for mean maintenance (property tests).
+--------------------------------------------------------------------------------
+*/
+
+// vecClose checks that v1 and v2 are equal within tol, relative to the
+// largest absolute element of v2 (or 1 if smaller).
+func vecClose(v1, v2 []float64, tol float64) bool {
+	if len(v1) != len(v2) {
+		return false
+	}
+	mag := 1.
+	for _, v := range v2 {
+		mag = math.Max(mag, math.Abs(v))
+	}
+	for i := range v1 {
+		if math.Abs(v1[i]-v2[i]) > tol*mag {
+			return false
+		}
+	}
+	return true
+}
+
+func TestVecMeanProperty(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	c := newCentroid(vec(0, 0, 0))
+	for op := 0; op < 50000; op++ {
+		if c.LenDP() == 0 || rng.Float64() < 0.55 {
+			// Mixed magnitudes make naive mean updates drift quickly.
+			v := make([]float64, 3)
+			for i := range v {
+				v[i] = (rng.Float64()*2 - 1) * math.Pow(10, float64(rng.Intn(10)-3))
+			}
+			c.AddDataPoint(dp(v, 0))
+		} else {
+			c.rmDataPoint(rng.Intn(c.LenDP()))
+		}
+		if op%1000 != 0 || c.LenDP() == 0 {
+			continue
+		}
+		want, _ := mathutils.VecMean(c.dataPointVecGenerator())
+		if !vecClose(c.Vec(), want, 1e-9) {
+			t.Fatalf("op %v: internal vec drifted: have %v, want %v", op, c.Vec(), want)
+		}
+	}
+}
+
+func TestVecMeanDriftRecompute(t *testing.T) {
+	c := newCentroid(vec(0, 0))
+	c.AddDataPoint(dp(vec(1, 2), 0))
+	// Adding and removing a huge vec over and over builds up error estimate,
+	// which should trigger recomputation from the datapoints.
+	for i := 0; i < 10000; i++ {
+		c.AddDataPoint(dp(vec(1e15, -1e15), 0))
+		c.rmDataPoint(1)
+	}
+	c.syncSum()
+	if d := c.sum.Drift(); d > DriftTolerance {
+		t.Fatalf("drift above tolerance after sync: %v", d)
+	}
+	if !vecEq(c.Vec(), vec(1, 2)) {
+		t.Fatalf("internal vec incorrect: %v", c.Vec())
+	}
+}
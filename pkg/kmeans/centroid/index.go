@@ -0,0 +1,267 @@
+/*
+This file contains an optional secondary index for Centroid, a navigable small
+world (NSW) graph over the contained datapoints. It is used by KNNLookup when
+a Centroid grows large (see IndexConfig), as the default lookup is a linear
+scan over all datapoints.
+
+The graph only uses the search of the Centroid for comparing vectors (it never
+computes distances by itself, see Centroid.knnSearch), so it works with
+whatever similarity the Centroid is set up with. Searching is a beam search: keep the 'ef' best
+nodes found so far, expand their neighbours, pick the 'ef' best again, and
+stop when no new nodes make it into the beam.
+*/
+package centroid
+
+// IndexConfig is used to configure the secondary (graph) index of a Centroid.
+// The zero value disables the index.
+type IndexConfig struct {
+	// Threshold is the amount of datapoints a Centroid must have before
+	// lookups use the index (it is built on demand when this is reached,
+	// and maintained incrementally after that). Zero disables the index.
+	Threshold int
+	// M is the amount of neighbours each new node is linked to (nodes
+	// can have up to 2*M). Defaults to 8 if <= 0.
+	M int
+	// EF is the size of the beam used while searching, a higher value
+	// means better recall but slower lookups. Defaults to 32 if <= 0.
+	EF int
+}
+
+// withDefaults returns a copy with default values where unset.
+func (cfg IndexConfig) withDefaults() IndexConfig {
+	if cfg.M <= 0 {
+		cfg.M = 8
+	}
+	if cfg.EF <= 0 {
+		cfg.EF = 32
+	}
+	return cfg
+}
+
+// nswIndex is a graph where node i represents Centroid.DataPoints[i]. Edges
+// are kept symmetric (if a links to b then b links to a).
+type nswIndex struct {
+	cfg   IndexConfig
+	edges [][]int
+}
+
+// idsVecGenerator creates a generator over the vectors of the datapoints
+// with the given ids (indexes into c.DataPoints). Expired datapoints are not
+// skipped here, since that would shift ids; see Centroid.knnIndexes.
+func (c *Centroid) idsVecGenerator(ids []int) vecGenerator {
+	i := 0
+	var buf []float64
+	return func() ([]float64, bool) {
+		if i >= len(ids) {
+			return nil, false
+		}
+		i++
+		if c.quantizer != nil {
+			buf = c.quantizer.DecodeInto(c.qvecs[ids[i-1]], buf)
+			return buf, true
+		}
+		return c.DataPoints[ids[i-1]].Vec, true
+	}
+}
+
+// bestIDs picks (max) k ids from 'ids' that are nearest vec.
+func (c *Centroid) bestIDs(vec []float64, ids []int, k int) []int {
+	res := make([]int, 0, k)
+	for _, i := range c.knnSearch(vec, ids, k) {
+		res = append(res, ids[i])
+	}
+	return res
+}
+
+// search does a beam search in the graph and returns (max) k ids nearest vec.
+func (idx *nswIndex) search(c *Centroid, vec []float64, k int) []int {
+	if len(idx.edges) == 0 {
+		return nil
+	}
+	ef := idx.cfg.EF
+	if ef < k {
+		ef = k
+	}
+
+	// A few spread out entry points, helps if the graph is fragmented.
+	n := len(idx.edges)
+	beam := []int{0}
+	for _, i := range []int{n / 2, n - 1} {
+		if i != 0 && (len(beam) == 1 || beam[1] != i) {
+			beam = append(beam, i)
+		}
+	}
+
+	seen := make(map[int]bool, ef*4)
+	expanded := make(map[int]bool, ef)
+	for _, i := range beam {
+		seen[i] = true
+	}
+	for {
+		candidates := append(make([]int, 0, len(beam)*2*idx.cfg.M), beam...)
+		for _, i := range beam {
+			if expanded[i] {
+				continue
+			}
+			expanded[i] = true
+			for _, j := range idx.edges[i] {
+				if !seen[j] {
+					seen[j] = true
+					candidates = append(candidates, j)
+				}
+			}
+		}
+		// Nothing new was found, so the beam is stable.
+		if len(candidates) == len(beam) {
+			break
+		}
+		beam = c.bestIDs(vec, candidates, ef)
+	}
+	return c.bestIDs(vec, beam, k)
+}
+
+// link adds a symmetric edge between a and b (no duplicates).
+func (idx *nswIndex) link(a, b int) {
+	if a == b {
+		return
+	}
+	for _, j := range idx.edges[a] {
+		if j == b {
+			return
+		}
+	}
+	idx.edges[a] = append(idx.edges[a], b)
+	idx.edges[b] = append(idx.edges[b], a)
+}
+
+// unlink removes the (symmetric) edge between a and b.
+func (idx *nswIndex) unlink(a, b int) {
+	idx.edges[a] = removeInt(idx.edges[a], b)
+	idx.edges[b] = removeInt(idx.edges[b], a)
+}
+
+// prune keeps the 2*M nearest neighbours of node i, if it has more.
+func (idx *nswIndex) prune(c *Centroid, i int) {
+	max := idx.cfg.M * 2
+	if len(idx.edges[i]) <= max {
+		return
+	}
+	keep := make(map[int]bool, max)
+	for _, j := range c.bestIDs(c.vecAt(i), idx.edges[i], max) {
+		keep[j] = true
+	}
+	// Copy since unlink modifies idx.edges[i].
+	for _, j := range append([]int(nil), idx.edges[i]...) {
+		if !keep[j] {
+			idx.unlink(i, j)
+		}
+	}
+}
+
+// insert adds node i (i.e c.DataPoints[i]) to the graph. The node must be
+// the last one, i.e i == len(idx.edges).
+func (idx *nswIndex) insert(c *Centroid, i int) {
+	vec := c.vecAt(i)
+	neighs := idx.search(c, vec, idx.cfg.M)
+	idx.edges = append(idx.edges, make([]int, 0, idx.cfg.M))
+	for _, j := range neighs {
+		idx.link(i, j)
+		idx.prune(c, j)
+	}
+}
+
+// remove deletes node i from the graph, where the last node takes its id
+// (mirrors swap-removal from c.DataPoints, see Centroid.rmDataPoint). Only
+// the neighbours of the two nodes are touched. Neighbours of the removed
+// node are re-connected to each other, such that the graph doesn't fragment.
+func (idx *nswIndex) remove(c *Centroid, i int) {
+	neighs := append([]int(nil), idx.edges[i]...)
+	for _, j := range neighs {
+		idx.unlink(i, j)
+	}
+	// Each former neighbour is linked to the nearest other former neighbour.
+	for _, j := range neighs {
+		others := removeInt(append([]int(nil), neighs...), j)
+		for _, o := range c.bestIDs(c.vecAt(j), others, 1) {
+			idx.link(j, o)
+			idx.prune(c, j)
+			idx.prune(c, o)
+		}
+	}
+
+	// Move the last node into id i.
+	last := len(idx.edges) - 1
+	if i != last {
+		idx.edges[i] = idx.edges[last]
+		for _, j := range idx.edges[i] {
+			for k, x := range idx.edges[j] {
+				if x == last {
+					idx.edges[j][k] = i
+				}
+			}
+		}
+	}
+	idx.edges = idx.edges[:last]
+}
+
+// removeInt removes the first occurrence of v in s (order is not kept).
+func removeInt(s []int, v int) []int {
+	for k, x := range s {
+		if x == v {
+			s[k] = s[len(s)-1]
+			return s[:len(s)-1]
+		}
+	}
+	return s
+}
+
+// indexEnabled returns true if lookups should use the graph index.
+func (c *Centroid) indexEnabled() bool {
+	return c.indexCfg.Threshold > 0 && len(c.DataPoints) >= c.indexCfg.Threshold
+}
+
+// RebuildIndex (re)builds the graph index from scratch if the Centroid is
+// large enough to use it (see IndexConfig.Threshold), or drops it otherwise.
+// The index is maintained incrementally while adding and removing datapoints,
+// so this is only necessary after larger changes (such as a split or merge
+// in a CentroidManager) which tend to leave a less navigable graph.
+func (c *Centroid) RebuildIndex() {
+	c.index = nil
+	if !c.indexEnabled() {
+		return
+	}
+	idx := &nswIndex{
+		cfg:   c.indexCfg,
+		edges: make([][]int, 0, len(c.DataPoints)),
+	}
+	for i := range c.DataPoints {
+		idx.insert(c, i)
+	}
+	c.index = idx
+}
+
+// ensureIndex makes sure that the index is usable (if enabled) before a
+// lookup. DataPoints can be replaced from outside of this pkg, in which
+// case the index is out of sync and has to be rebuilt.
+func (c *Centroid) ensureIndex() bool {
+	if !c.indexEnabled() {
+		c.index = nil
+		return false
+	}
+	if c.index == nil || len(c.index.edges) != len(c.DataPoints) {
+		c.RebuildIndex()
+	}
+	return true
+}
+
+// withoutIndex runs f (some bulk change to c.DataPoints) without maintaining
+// the index incrementally, then rebuilds it if it existed before. Rebuilding
+// once is cheaper than a lot of incremental removals.
+func (c *Centroid) withoutIndex(f func()) {
+	hadIndex := c.index != nil
+	c.index = nil
+	f()
+	if hadIndex {
+		c.RebuildIndex()
+	}
+}
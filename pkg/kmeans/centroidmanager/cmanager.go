@@ -8,6 +8,7 @@ package centroidmanager
 
 import (
 	"sort"
+	"time"
 	"trypo/pkg/kmeans/centroid"
 	"trypo/pkg/kmeans/common"
 	"trypo/pkg/mathutils"
@@ -19,6 +20,9 @@ var _ common.DataPointReceiver = new(CentroidManager)
 // Abbreviation.
 type dpReceivers = []common.DataPointReceiver
 
+// Initial amount of nearest Centroids searched for in MergeCentroids.
+const mergeSearchK = 8
+
 // Named parameter funcs. See NewCentroidManagerArgs.KNNSearchFunc.
 type vecGenerator = func() ([]float64, bool)
 type knnSearchFunc = func(targetVec []float64, vecs vecGenerator, k int) []int
@@ -47,6 +51,20 @@ type CentroidManager struct {
 	knnSearchFunc knnSearchFunc
 	// See NewCentroidManagerArgs.KFNSearchFunc.
 	kfnSearchFunc knnSearchFunc
+	// See NewCentroidManagerArgs.Quantization.
+	quantization mathutils.QuantConfig
+	// See NewCentroidManagerArgs.Index.
+	index centroid.IndexConfig
+	// See NewCentroidManagerArgs.Router.
+	routerCfg RouterConfig
+	// Coarse routing structure over Centroids, nil if not used (see
+	// router.go). Built lazily.
+	router *router
+	// Cached indexes into Centroids, see CentroidManager.indexOf.
+	positions map[*centroid.Centroid]int
+	// Running sum of Centroid vecs, cm.vec is derived from it. Recomputed
+	// when out of sync with Centroids, see CentroidManager.syncSum.
+	sum *mathutils.VecSum
 }
 
 type NewCentroidManagerArgs struct {
@@ -79,6 +97,18 @@ type NewCentroidManagerArgs struct {
 	// KFNSearchFunc is the same as KNNSearchFunc but should find k furthest
 	// neighs as opposed to nearest.
 	KFNSearchFunc knnSearchFunc
+	// Quantization is passed on to all internal Centroids and specifies if
+	// (and how) they should store vectors in a quantized form. See the
+	// field with the same name in pkg/kmeans/centroid.NewCentroidArgs.
+	Quantization mathutils.QuantConfig
+	// Index is passed on to all internal Centroids and configures a graph
+	// index used for lookups in large Centroids. See the field with the
+	// same name in pkg/kmeans/centroid.NewCentroidArgs.
+	Index centroid.IndexConfig
+	// Router configures a routing structure over the internal Centroids,
+	// used to find the nearest ones without comparing against all of them.
+	// See RouterConfig for more info; the zero value disables it.
+	Router RouterConfig
 }
 
 // NewCentroid creates a new centroid manager with the specified args.
@@ -94,6 +124,9 @@ func NewCentroidManager(args NewCentroidManagerArgs) (CentroidManager, bool) {
 		initCap:             args.InitCap,
 		knnSearchFunc:       args.KNNSearchFunc,
 		kfnSearchFunc:       args.KFNSearchFunc,
+		quantization:        args.Quantization,
+		index:               args.Index,
+		routerCfg:           args.Router,
 	}
 	for i, v := range args.InitVec {
 		cm.vec[i] = v
@@ -109,6 +142,8 @@ func (cm *CentroidManager) newCentroid(vec []float64) *centroid.Centroid {
 		InitCap:       cm.initCap,
 		KNNSearchFunc: cm.knnSearchFunc,
 		KFNSearchFunc: cm.kfnSearchFunc,
+		Quantization:  cm.quantization,
+		Index:         cm.index,
 	}
 	centroid, ok := centroid.NewCentroid(args)
 	if !ok {
@@ -184,6 +219,9 @@ func (cm *CentroidManager) splitCentroid(atIndex, trimN int) (*centroid.Centroid
 	for i := 0; i < len(dps); i++ {
 		newCentroid.AddDataPoint(dps[i])
 	}
+	// Graph indexes (if enabled) are navigable but not great after this.
+	oldCentroid.RebuildIndex()
+	newCentroid.RebuildIndex()
 	return newCentroid, true
 }
 
@@ -205,19 +243,84 @@ func (cm *CentroidManager) splitCentroid(atIndex, trimN int) (*centroid.Centroid
 //	... do something to centroidToChange that changes it's vec.
 //	prepUpdate(centroidToChange.Vec())
 //
-// Note, this does not support deleting centroids.
+// Note, this does not support adding or deleting centroids in between (see
+// cm.addCentroid and cm.removeCentroid); cm.vec is recomputed if it happens.
 func (cm *CentroidManager) prepVecUpdate(v1 []float64) func([]float64) {
 	oldVec := make([]float64, (len(v1)))
 	copy(oldVec, v1)
+	cm.syncSum()
 	return func(v2 []float64) {
-		cmLen := float64(len(cm.Centroids))
-		cm.vec = mathutils.VecMulScalar(cm.vec, cmLen)
-		cm.vec, _ = mathutils.VecSub(cm.vec, oldVec)
-		cm.vec, _ = mathutils.VecAdd(cm.vec, v2)
-		cm.vec = mathutils.VecDivScalar(cm.vec, cmLen)
+		if cm.sum.Len() != len(cm.Centroids) {
+			cm.recomputeVec()
+			return
+		}
+		cm.sum.Sub(oldVec)
+		cm.sum.Add(v2)
+		if vec, ok := cm.sum.Mean(); ok {
+			cm.vec = vec
+		}
+	}
+}
+
+// prepCentroidUpdate is prepVecUpdate for a Centroid in cm.Centroids, whose
+// vec is about to change. The returned func finalizes the update of cm.vec,
+// and of the group vec of the Centroid if routing is used (see router.go).
+func (cm *CentroidManager) prepCentroidUpdate(c *centroid.Centroid) func() {
+	updateVec := cm.prepVecUpdate(c.Vec())
+	return func() {
+		updateVec(c.Vec())
+		cm.routeMoved(c)
+	}
+}
+
+// syncSum makes sure that cm.sum is in sync with cm.Centroids (which can be
+// replaced from outside of this pkg), recomputing it from scratch if not, or
+// if its error estimate is above centroid.DriftTolerance.
+func (cm *CentroidManager) syncSum() {
+	if cm.sum != nil && cm.sum.Len() == len(cm.Centroids) &&
+		cm.sum.Drift() <= centroid.DriftTolerance {
+		return
+	}
+	cm.recomputeVec()
+}
+
+// recomputeVec recomputes cm.sum and cm.vec from all internal Centroid vecs.
+// cm.vec is kept as is if there are no Centroids.
+func (cm *CentroidManager) recomputeVec() {
+	cm.sum = mathutils.NewVecSum(len(cm.vec))
+	for _, c := range cm.Centroids {
+		cm.sum.Add(c.Vec())
+	}
+	if vec, ok := cm.sum.Mean(); ok {
+		cm.vec = vec
+	}
+}
+
+// addCentroid appends a Centroid to cm.Centroids, and adjusts cm.vec and the
+// router accordingly.
+func (cm *CentroidManager) addCentroid(c *centroid.Centroid) {
+	cm.syncSum()
+	cm.Centroids = append(cm.Centroids, c)
+	cm.routeAdd(c)
+	cm.sum.Add(c.Vec())
+	if vec, ok := cm.sum.Mean(); ok {
+		cm.vec = vec
 	}
 }
 
+// removeCentroid removes the Centroid at index i in cm.Centroids, and adjusts
+// cm.vec and the router accordingly. cm.vec is kept as is if the last
+// Centroid is removed. No bounds checking.
+func (cm *CentroidManager) removeCentroid(i int) {
+	cm.syncSum()
+	cm.sum.Sub(cm.Centroids[i].Vec())
+	if vec, ok := cm.sum.Mean(); ok {
+		cm.vec = vec
+	}
+	cm.routeRemove(cm.Centroids[i])
+	cm.Centroids = append(cm.Centroids[:i], cm.Centroids[i+1:]...)
+}
+
 // Vec exposes the internal vector of a CentroidManager.
 func (km *CentroidManager) Vec() []float64 { return km.vec }
 
@@ -240,32 +343,33 @@ func (cm *CentroidManager) AddDataPoint(dp common.DataPoint) bool {
 	if len(cm.Centroids) == 0 {
 		c := cm.newCentroid(dp.Vec)
 		c.AddDataPoint(dp)
-		cm.Centroids = append(cm.Centroids, c)
-		cm.vec = c.Vec()
+		cm.addCentroid(c)
 		return true
 	}
 
 	// Try find nearest centroid.
-	indexes := cm.knnSearchFunc(dp.Vec, cm.centroidVecGenerator(), 1)
+	indexes := cm.nearestCentroidIndexes(dp.Vec, 1)
 	if len(indexes) == 0 {
 		return false
 	}
 
 	// Try add to nearest centroid.
-	centroid := cm.Centroids[indexes[0]]          // Abbreviation.
-	updateVec := cm.prepVecUpdate(centroid.Vec()) // Track old vec.
+	centroid := cm.Centroids[indexes[0]]         // Abbreviation.
+	updateVec := cm.prepCentroidUpdate(centroid) // Track old vec.
 	if !centroid.AddDataPoint(dp) {
 		return false
 	}
 
 	// Adjust cm.vec.
-	updateVec(centroid.Vec())
+	updateVec()
 
 	// Potential centroid split.
 	if centroid.LenDP() >= cm.centroidDPThreshold {
+		updateVec = cm.prepCentroidUpdate(centroid)
 		newCentroid, splitOK := cm.splitCentroid(indexes[0], cm.centroidDPThreshold/2)
+		updateVec()
 		if splitOK {
-			cm.Centroids = append(cm.Centroids, newCentroid)
+			cm.addCentroid(newCentroid)
 		}
 	}
 	return true
@@ -281,10 +385,10 @@ func (cm *CentroidManager) DrainUnordered(n int) []common.DataPoint {
 	for centroidIndex, portion := range cm.centroidDataPointPortions(n) {
 		centroid := cm.Centroids[centroidIndex]
 		// Prep for internal vec update.
-		updateVec := cm.prepVecUpdate(centroid.Vec())
+		updateVec := cm.prepCentroidUpdate(centroid)
 		res = append(res, centroid.DrainUnordered(portion)...)
 		// Finalize internal vec update.
-		updateVec(centroid.Vec())
+		updateVec()
 
 	}
 	return res
@@ -304,10 +408,10 @@ func (cm *CentroidManager) DrainOrdered(n int) []common.DataPoint {
 	for centroidIndex, portion := range cm.centroidDataPointPortions(n) {
 		centroid := cm.Centroids[centroidIndex]
 		// Prep for internal vec update.
-		updateVec := cm.prepVecUpdate(centroid.Vec())
+		updateVec := cm.prepCentroidUpdate(centroid)
 		res = append(res, centroid.DrainOrdered(portion)...)
 		// Finalize internal vec update.
-		updateVec(centroid.Vec())
+		updateVec()
 	}
 	return res
 }
@@ -318,10 +422,10 @@ func (cm *CentroidManager) DrainOrdered(n int) []common.DataPoint {
 func (cm *CentroidManager) Expire() {
 	for _, centroid := range cm.Centroids {
 		// Prep for internal vec update.
-		updateVec := cm.prepVecUpdate(centroid.Vec())
+		updateVec := cm.prepCentroidUpdate(centroid)
 		centroid.Expire()
 		// Finalize internal vec update.
-		updateVec(centroid.Vec())
+		updateVec()
 	}
 }
 
@@ -336,6 +440,22 @@ func (cm *CentroidManager) LenDP() int {
 	return res
 }
 
+// LenBytes returns the (approximate) amount of bytes used for storing vectors
+// and payloads of datapoints in all internal centroids, see Centroid.LenBytes.
+func (cm *CentroidManager) LenBytes() int {
+	res := 0
+	for _, centroid := range cm.Centroids {
+		res += centroid.LenBytes()
+	}
+	return res
+}
+
+// DPBytes returns the amount of bytes that 'dp' adds to LenBytes when it is
+// added to this instance, i.e with its vector quantized if vectors are.
+func (cm *CentroidManager) DPBytes(dp common.DataPoint) int {
+	return cm.quantization.VecBytes(len(dp.Vec)) + len(dp.Payload)
+}
+
 // MemTrim will call the method with the same name on each internal centroid,
 // which will remove expired datapoints. In this process, all centroids that
 // have no datapoints left will be removed from this CentroidManager instance
@@ -344,25 +464,15 @@ func (cm *CentroidManager) LenDP() int {
 func (cm *CentroidManager) MemTrim() {
 	centroids := make([]*centroid.Centroid, 0, len(cm.Centroids))
 	for _, centroid := range cm.Centroids {
-		// Prep for internal vec update.
-		updateVec := cm.prepVecUpdate(centroid.Vec())
 		centroid.MemTrim()
-		// Finalize internal vec update.
-		updateVec(centroid.Vec())
 		if centroid.LenDP() != 0 {
 			centroids = append(centroids, centroid)
 		}
-
-		// Will not be included in new centroids slice, so effectively deleted.
-		// In this case, the internal vec must be updated a bit differently
-		// than what cm.prepVecUpdate does. Note bounds check.
-		if centroid.LenDP() == 1 && len(cm.Centroids) > 1 {
-			cm.vec = mathutils.VecMulScalar(cm.vec, float64(len(cm.Centroids)))
-			cm.vec, _ = mathutils.VecSub(cm.vec, centroid.Vec())
-			cm.vec = mathutils.VecDivScalar(cm.vec, float64(len(cm.Centroids)-1))
-		}
 	}
 	cm.Centroids = centroids
+	// All Centroids are touched anyway, so recomputing is cheap here.
+	cm.recomputeVec()
+	cm.rebuildRouter()
 }
 
 // MoveVector sets the internal vector to the average of all internal Centroids.
@@ -374,11 +484,13 @@ func (cm *CentroidManager) MoveVector() bool {
 		centroid.MoveVector()
 	}
 
-	vec, ok := mathutils.VecMean(cm.centroidVecGenerator())
-	if ok {
-		cm.vec = vec
+	// Centroid vecs have moved, so group vecs have to as well.
+	if cm.router != nil {
+		cm.router.refresh()
 	}
-	return ok
+
+	cm.recomputeVec()
+	return len(cm.Centroids) != 0
 }
 
 // DistributeDataPoints will drain max 'n' DataPoints from internal Centroids
@@ -424,15 +536,14 @@ func (cm *CentroidManager) DistributeDataPointsInternal(n int) {
 func (cm *CentroidManager) KNNLookup(vec []float64, k int, drain bool) []common.DataPoint {
 	res := make([]common.DataPoint, 0, k)
 
-	gen := cm.centroidVecGenerator() // Brevity.
-	for _, centroidIndex := range cm.knnSearchFunc(vec, gen, k) {
+	for _, centroidIndex := range cm.nearestCentroidIndexes(vec, k) {
 		if len(res) >= k {
 			break
 		}
 
 		centroid := cm.Centroids[centroidIndex]
 		// Prep for internal vec update.
-		updateVec := cm.prepVecUpdate(centroid.Vec())
+		updateVec := cm.prepCentroidUpdate(centroid)
 		for _, dp := range centroid.KNNLookup(vec, k-len(res), drain) {
 			switch {
 			// Keep adding to res until requirement is met.
@@ -451,7 +562,25 @@ func (cm *CentroidManager) KNNLookup(vec []float64, k int, drain bool) []common.
 			}
 		}
 		// Finalize internal vec update.
-		updateVec(centroid.Vec())
+		updateVec()
+	}
+	return res
+}
+
+// Touch finds datapoints like KNNLookup (without drain), and pushes the expiry
+// of those that expire forward to 'expires' (never back), see Centroid.Touch.
+// Returns the found datapoints, with their new expiry. Note, will update
+// internal CentroidManager vector (expired datapoints may be removed).
+func (cm *CentroidManager) Touch(vec []float64, k int, expires time.Time) []common.DataPoint {
+	res := make([]common.DataPoint, 0, k)
+	for _, centroidIndex := range cm.nearestCentroidIndexes(vec, k) {
+		if len(res) >= k {
+			break
+		}
+		centroid := cm.Centroids[centroidIndex]
+		updateVec := cm.prepCentroidUpdate(centroid)
+		res = append(res, centroid.Touch(vec, k-len(res), expires)...)
+		updateVec()
 	}
 	return res
 }
@@ -468,7 +597,7 @@ func (cm *CentroidManager) KNNLookup(vec []float64, k int, drain bool) []common.
 func (cm *CentroidManager) NearestCentroids(vec []float64, n int, drain bool) (
 	[]*centroid.Centroid, bool,
 ) {
-	indexes := cm.knnSearchFunc(vec, cm.centroidVecGenerator(), n)
+	indexes := cm.nearestCentroidIndexes(vec, n)
 	if len(indexes) == 0 {
 		return nil, false
 	}
@@ -479,20 +608,69 @@ func (cm *CentroidManager) NearestCentroids(vec []float64, n int, drain bool) (
 	if drain {
 		sort.Ints(indexes)
 		for i := len(indexes) - 1; i > -1; i-- {
-			j := indexes[i] // Abbreviation for actual centroid index.
-			// Auto-adjust internal vec.
-			if len(cm.Centroids) > 0 {
-				cm.vec = mathutils.VecMulScalar(cm.vec, float64(len(cm.Centroids)))
-				cm.vec, _ = mathutils.VecSub(cm.vec, cm.Centroids[j].Vec())
-				cm.vec = mathutils.VecDivScalar(cm.vec, float64(len(cm.Centroids)-1))
-			}
-			// Delete.
-			cm.Centroids = append(cm.Centroids[:j], cm.Centroids[j+1:]...)
+			// Delete, auto-adjusts internal vec.
+			cm.removeCentroid(indexes[i])
 		}
 	}
 	return centroids, true
 }
 
+// DrainNearestCentroid removes the Centroid nearest 'vec' (see NearestCentroids)
+// and returns it. If that Centroid has more than 'maxDPs' DataPoints, then it is
+// split instead; the 'maxDPs' DataPoints nearest 'vec' are removed from it and
+// returned in a new Centroid, while the rest stay. Returns false if there are
+// no Centroids or maxDPs <= 0. Note, will update internal CentroidManager vector.
+func (cm *CentroidManager) DrainNearestCentroid(vec []float64, maxDPs int) (
+	*centroid.Centroid, bool,
+) {
+	indexes := cm.nearestCentroidIndexes(vec, 1)
+	if len(indexes) == 0 || maxDPs <= 0 {
+		return nil, false
+	}
+	c := cm.Centroids[indexes[0]]
+	if c.LenDP() <= maxDPs {
+		cm.removeCentroid(indexes[0])
+		return c, true
+	}
+
+	updateVec := cm.prepCentroidUpdate(c)
+	dps := c.KNNLookup(vec, maxDPs, true)
+	updateVec()
+	c.RebuildIndex()
+	if len(dps) == 0 {
+		return nil, false
+	}
+	part := cm.newCentroid(dps[0].Vec)
+	for _, dp := range dps {
+		part.AddDataPoint(dp)
+	}
+	part.RebuildIndex()
+	return part, true
+}
+
+// AdoptCentroids adds Centroids that were created elsewhere (received from a
+// remote node, for instance) to this CentroidManager. Each Centroid is
+// re-created with the properties of this instance (search funcs, quantization,
+// etc) such that it behaves like any other internal Centroid. Empty Centroids
+// are ignored. Note, will update internal CentroidManager vector (with the
+// vecs of the adopted Centroids only, other Centroids aren't moved).
+func (cm *CentroidManager) AdoptCentroids(centroids []*centroid.Centroid) {
+	for _, other := range centroids {
+		if other == nil || other.LenDP() == 0 {
+			continue
+		}
+		dps := other.ExportDataPoints()
+		c := cm.newCentroid(dps[0].Vec)
+		for _, dp := range dps {
+			c.AddDataPoint(dp)
+		}
+		if c.LenDP() != 0 {
+			c.RebuildIndex()
+			cm.addCentroid(c)
+		}
+	}
+}
+
 // SplitCentroids iterates through all internal Centroids and passes them to
 // the evaluation func 'splits' -- if it returns true, then that centroid will
 // be split in half. Example:
@@ -506,12 +684,16 @@ func (cm *CentroidManager) SplitCentroids(split func(*centroid.Centroid) bool) {
 			continue
 		}
 
+		updateVec := cm.prepCentroidUpdate(centroid)
 		newCentroid, splitOK := cm.splitCentroid(i, centroid.LenDP()/2)
+		updateVec()
 		if splitOK {
 			newCentroids = append(newCentroids, newCentroid)
 		}
 	}
-	cm.Centroids = append(cm.Centroids, newCentroids...)
+	for _, c := range newCentroids {
+		cm.addCentroid(c)
+	}
 }
 
 // MergeCentroids iterates through all internal Centroids and passes them to
@@ -537,49 +719,58 @@ func (cm *CentroidManager) MergeCentroids(merge func(*centroid.Centroid) bool) {
 		if !merge(candidate) || delMarks[i] {
 			continue
 		}
-		// Abbreviations:
-		vec := candidate.Vec()
-		gen := cm.centroidVecGenerator()
-		k := len(cm.Centroids)
+		// Copy, since candidate vec changes while merging.
+		vec := make([]float64, len(candidate.Vec()))
+		copy(vec, candidate.Vec())
 
 		// Prep for internal vec update for 'candidate' centroid.
 		updateVecCandidate := cm.prepVecUpdate(vec)
 
-		// Merge nearest centroids into 'candidate' until merge()=true.
-		for _, centroidIndex := range cm.knnSearchFunc(vec, gen, k) {
-			// Guard identity or double merge.
-			if centroidIndex == i || delMarks[centroidIndex] {
-				continue
+		// Merge nearest centroids into 'candidate' until merge()=false. The
+		// amount of nearest centroids searched for is doubled each round, as
+		// opposed to sorting all of them up front (most merges are satisfied
+		// by a few neighbours).
+		visited := make(map[int]bool)
+		for k, satisfied := mergeSearchK, false; !satisfied; k *= 2 {
+			indexes := cm.nearestCentroidIndexes(vec, k)
+			for _, centroidIndex := range indexes {
+				// Guard identity, double merge or already seen.
+				if centroidIndex == i || delMarks[centroidIndex] || visited[centroidIndex] {
+					continue
+				}
+				visited[centroidIndex] = true
+				// Merge other _completely_ into candidate.
+				delMarks[centroidIndex] = true
+				other := cm.Centroids[centroidIndex]
+				// Other's vec changes while draining, which must be tracked
+				// for it to be removed properly from cm.vec later.
+				updateVecOther := cm.prepCentroidUpdate(other)
+				for _, dp := range other.DrainUnordered(other.LenDP()) {
+					candidate.AddDataPoint(dp)
+				}
+				updateVecOther()
+				if !merge(candidate) { // Check if satisfied.
+					satisfied = true
+					break
+				}
 			}
-			// Merge other _completely_ into candidate.
-			delMarks[centroidIndex] = true
-			other := cm.Centroids[centroidIndex]
-			for _, dp := range other.DrainUnordered(other.LenDP()) {
-				candidate.AddDataPoint(dp)
-			}
-			if !merge(candidate) { // Check if satisfied.
+			// All centroids have been considered.
+			if len(indexes) < k || k >= len(cm.Centroids) {
 				break
 			}
 		}
+		candidate.RebuildIndex()
 		// Finalize internal vec update for 'candidate' centroid.
 		updateVecCandidate(candidate.Vec())
+		cm.routeMoved(candidate)
 	}
 	// Filter out centroids marked for deletion from cm.Centroids.
 	// Note, the reason for backwards looping is to prevent index
 	// shifting issues.
 	for i := len(cm.Centroids) - 1; i > -1; i-- {
 		if delMarks[i] {
-			// This should always be true, due to how this func works at the
-			// time of writing, but doing a bounds check juuust in case:
-			if len(cm.Centroids) > 0 {
-				// Need this, it changes the internal vector appropriately
-				// when deleting a centroid:
-				cm.vec = mathutils.VecMulScalar(cm.vec, float64(len(cm.Centroids)))
-				cm.vec, _ = mathutils.VecSub(cm.vec, cm.Centroids[i].Vec())
-				cm.vec = mathutils.VecDivScalar(cm.vec, float64(len(cm.Centroids)-1))
-			}
-			// Delete.
-			cm.Centroids = append(cm.Centroids[:i], cm.Centroids[i+1:]...)
+			// Delete, auto-adjusts internal vec.
+			cm.removeCentroid(i)
 		}
 	}
 }
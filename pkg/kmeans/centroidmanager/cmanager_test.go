@@ -2,6 +2,9 @@ package centroidmanager
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
 	"testing"
 	"time"
 	"trypo/pkg/kmeans/centroid"
@@ -632,6 +635,36 @@ func TestKNNLookupNoDrain(t *testing.T) {
 	}
 }
 
+func TestTouch(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	c1 := newCentroid(vec(1, 1))
+	c1.AddDataPoint(dp(vec(1, 2), 10))
+	c1.AddDataPoint(dp(vec(1, 3), 10))
+	c2 := newCentroid(vec(1, 5))
+	c2.AddDataPoint(dp(vec(1, 6), 10))
+
+	cm := newCentroidManager(vec(0, 0))
+	cm.Centroids = []*centroid.Centroid{c1, c2}
+	cm.MoveVector()
+
+	// Nearest dps are in different centroids.
+	touched := cm.Touch(vec(1, 5.7), 2, expires)
+	if len(touched) != 2 || cm.LenDP() != 3 {
+		t.Fatalf("unexpected touch: %v touched, %v left", len(touched), cm.LenDP())
+	}
+	n := 0
+	for _, c := range cm.Centroids {
+		for _, dp := range c.DataPoints {
+			if dp.Expires.Equal(expires) {
+				n++
+			}
+		}
+	}
+	if n != 2 {
+		t.Fatalf("want 2 dps with new expiry, got %v", n)
+	}
+}
+
 func TestNearestCentroid(t *testing.T) {
 	c1 := newCentroid(vec(1, 2))
 	c2 := newCentroid(vec(1, 3))
@@ -656,6 +689,69 @@ func TestNearestCentroid(t *testing.T) {
 	}
 }
 
+func TestDrainNearestCentroid(t *testing.T) {
+	c1 := newCentroid(vec(1, 0))
+	c1.AddDataPoint(dp(vec(1, 0), 0))
+	c2 := newCentroid(vec(0, 1))
+	for _, v := range [][]float64{vec(0, 1), vec(1, 1), vec(0.1, 1)} {
+		c2.AddDataPoint(dp(v, 0))
+	}
+	cm := newCentroidManager(vec(0, 0))
+	cm.Centroids = []*centroid.Centroid{c1, c2}
+	cm.MoveVector()
+
+	// Split, the nearest dps are taken.
+	c, ok := cm.DrainNearestCentroid(vec(0, 1), 2)
+	if !ok || c.LenDP() != 2 || c == c2 {
+		t.Fatalf("unexpected split: %v, %v", ok, c)
+	}
+	for _, v := range dps2Vecs(c.DataPoints) {
+		if vecEq(v, vec(1, 1)) {
+			t.Fatalf("the farthest dp was taken")
+		}
+	}
+	if len(cm.Centroids) != 2 || c2.LenDP() != 1 || !vecEq(c2.Vec(), vec(1, 1)) {
+		t.Fatalf("unexpected remainder: %v centroids, %v dps", len(cm.Centroids), c2.LenDP())
+	}
+	if !vecEq(cm.Vec(), vec(1, 0.5)) {
+		t.Fatalf("internal vec wasn't updated: %v", cm.Vec())
+	}
+
+	// Whole.
+	c, ok = cm.DrainNearestCentroid(vec(1, 0), 2)
+	if !ok || c != c1 || len(cm.Centroids) != 1 {
+		t.Fatalf("whole centroid wasn't drained")
+	}
+
+	if _, ok := cm.DrainNearestCentroid(vec(1, 0), 0); ok {
+		t.Fatalf("drained with maxDPs = 0")
+	}
+}
+
+func TestAdoptCentroids(t *testing.T) {
+	c1 := newCentroid(vec(1, 0))
+	c1.AddDataPoint(dp(vec(1, 0), 1))
+	cm := newCentroidManager(vec(0, 0))
+	cm.Centroids = []*centroid.Centroid{c1}
+	cm.MoveVector()
+	time.Sleep(_SLEEPUNIT * 2)
+
+	c2 := newCentroid(vec(0, 1))
+	c2.AddDataPoint(dp(vec(0, 1), 0))
+	c2.AddDataPoint(dp(vec(0, 3), 0))
+	cm.AdoptCentroids([]*centroid.Centroid{c2, newCentroid(vec(1, 1)), nil})
+	if len(cm.Centroids) != 2 || !vecEq(cm.Centroids[1].Vec(), vec(0, 2)) {
+		t.Fatalf("unexpected centroids after adopt: %v", len(cm.Centroids))
+	}
+	if !vecEq(cm.Vec(), vec(0.5, 1)) {
+		t.Fatalf("internal vec wasn't updated: %v", cm.Vec())
+	}
+	// Other centroids are left as is (expiry is for Expire).
+	if c1.LenDP() != 1 {
+		t.Fatalf("adopt touched other centroids")
+	}
+}
+
 func TestSplit(t *testing.T) {
 	dps := []common.DataPoint{
 		dp(vec(1), 0),
@@ -724,3 +820,236 @@ func TestMergeCentroids(t *testing.T) {
 		t.Fatalf("auto-adjusted cm vec is incorrect. want %v, have %v", cm.vec, vecBkp)
 	}
 }
+
+/*
+--------------------------------------------------------------------------------
+Section for routing (router.go).
+--------------------------------------------------------------------------------
+*/
+
+// newCentroidManagerRouted sets up a CentroidManager with routing enabled and
+// n (single dp) centroids with random (seeded) vecs of dimension 'dim'.
+func newCentroidManagerRouted(seed int64, n, dim int) CentroidManager {
+	cm, ok := NewCentroidManager(NewCentroidManagerArgs{
+		InitVec:       make([]float64, dim),
+		KNNSearchFunc: _knnSearchFunc,
+		KFNSearchFunc: _kfnSearchFunc,
+		Router:        RouterConfig{Threshold: 100, GroupSize: 16, Probe: 4},
+	})
+	if !ok {
+		panic("couldn't setup CentroidManager for test")
+	}
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < n; i++ {
+		v := make([]float64, dim)
+		for j := range v {
+			v[j] = r.Float64()*2 - 1
+		}
+		c := newCentroid(v)
+		c.AddDataPoint(dp(vec(v...), 0))
+		cm.Centroids = append(cm.Centroids, c)
+	}
+	cm.MoveVector()
+	return cm
+}
+
+// checkRouter verifies that the router covers exactly cm.Centroids.
+func checkRouter(t *testing.T, cm *CentroidManager) {
+	if cm.router == nil {
+		t.Fatalf("router not set up")
+	}
+	if len(cm.router.of) != len(cm.Centroids) {
+		t.Fatalf("router has %v centroids, want %v", len(cm.router.of), len(cm.Centroids))
+	}
+	members := 0
+	for _, g := range cm.router.groups {
+		if len(g.members) == 0 {
+			t.Fatalf("router has an empty group")
+		}
+		if len(g.members) > cm.router.cfg.GroupSize*2 {
+			t.Fatalf("router group too large: %v", len(g.members))
+		}
+		members += len(g.members)
+	}
+	if members != len(cm.Centroids) {
+		t.Fatalf("router groups have %v members, want %v", members, len(cm.Centroids))
+	}
+	// Group vecs follow member vecs.
+	for _, g := range cm.router.groups {
+		i := 0
+		mean, _ := mathutils.VecMean(func() ([]float64, bool) {
+			if i >= len(g.members) {
+				return nil, false
+			}
+			i++
+			return g.members[i-1].Vec(), true
+		})
+		for j := range mean {
+			if math.Abs(mean[j]-g.vec[j]) > 1e-9 {
+				t.Fatalf("group vec %v isn't the mean of its members %v", g.vec, mean)
+			}
+		}
+	}
+	for _, c := range cm.Centroids {
+		if _, ok := cm.router.of[c]; !ok {
+			t.Fatalf("centroid missing in router")
+		}
+	}
+}
+
+func TestRouterNearestCentroids(t *testing.T) {
+	cm := newCentroidManagerRouted(1, 1000, 8)
+	r := rand.New(rand.NewSource(2))
+
+	hits, tries := 0, 200
+	for i := 0; i < tries; i++ {
+		v := make([]float64, 8)
+		for j := range v {
+			v[j] = r.Float64()*2 - 1
+		}
+		want := cm.knnSearchFunc(v, cm.centroidVecGenerator(), 1)
+		have := cm.nearestCentroidIndexes(v, 1)
+		if len(have) != 1 {
+			t.Fatalf("got %v indexes, want 1", len(have))
+		}
+		if have[0] == want[0] {
+			hits++
+		}
+	}
+	checkRouter(t, &cm)
+	// Approximate search, so some misses are fine.
+	if recall := float64(hits) / float64(tries); recall < 0.8 {
+		t.Fatalf("routed search recall too low: %v", recall)
+	}
+
+	// Asking for more than a few groups hold should still give k results.
+	if l := len(cm.nearestCentroidIndexes(vec(1, 1, 1, 1, 1, 1, 1, 1), 300)); l != 300 {
+		t.Fatalf("got %v indexes, want 300", l)
+	}
+}
+
+func TestRouterMaintenance(t *testing.T) {
+	cm := newCentroidManagerRouted(3, 300, 4)
+	cm.nearestCentroidIndexes(vec(1, 1, 1, 1), 1) // Builds router.
+	checkRouter(t, &cm)
+
+	// Drain (as with StealCentroid).
+	centroids, ok := cm.NearestCentroids(vec(1, 0, 0, 0), 20, true)
+	if !ok || len(centroids) != 20 {
+		t.Fatalf("couldn't drain centroids")
+	}
+	checkRouter(t, &cm)
+	for _, c := range centroids {
+		if _, ok := cm.router.of[c]; ok {
+			t.Fatalf("drained centroid still in router")
+		}
+	}
+
+	// Adopt (as with StealCentroid, receiving end).
+	cm.AdoptCentroids(centroids)
+	checkRouter(t, &cm)
+
+	// Split.
+	for _, c := range cm.Centroids[:50] {
+		c.AddDataPoint(dp(vec(c.Vec()...), 0))
+	}
+	cm.SplitCentroids(func(c *centroid.Centroid) bool { return c.LenDP() > 1 })
+	if len(cm.Centroids) != 350 {
+		t.Fatalf("unexpected centroid count after split: %v", len(cm.Centroids))
+	}
+	checkRouter(t, &cm)
+
+	// Merge.
+	cm.MergeCentroids(func(c *centroid.Centroid) bool { return c.LenDP() < 3 })
+	checkRouter(t, &cm)
+	if cm.LenDP() != 350 {
+		t.Fatalf("lost datapoints while merging: %v", cm.LenDP())
+	}
+
+	// Direct modification of cm.Centroids, router should notice.
+	cm.Centroids = cm.Centroids[:len(cm.Centroids)-1]
+	cm.nearestCentroidIndexes(vec(1, 1, 1, 1), 1)
+	if cm.router != nil {
+		checkRouter(t, &cm)
+	}
+}
+
+// Adding and removing dps moves centroids, and with them their groups.
+func TestRouterMovedCentroids(t *testing.T) {
+	cm := newCentroidManagerRouted(3, 300, 4)
+	cm.nearestCentroidIndexes(vec(1, 1, 1, 1), 1) // Builds router.
+
+	r := rand.New(rand.NewSource(6))
+	for i := 0; i < 100; i++ {
+		if !cm.AddDataPoint(dp(vec(r.Float64()*4, r.Float64()*4, -1, -1), 0)) {
+			t.Fatalf("couldn't add dp %v", i)
+		}
+	}
+	checkRouter(t, &cm)
+	cm.DrainOrdered(50)
+	checkRouter(t, &cm)
+}
+
+func BenchmarkNearestCentroids(b *testing.B) {
+	for _, routed := range []bool{false, true} {
+		cm := newCentroidManagerRouted(4, 10000, 16)
+		if !routed {
+			cm.routerCfg = RouterConfig{}
+		}
+		v := cm.Centroids[0].Vec()
+		b.Run(fmt.Sprintf("routed=%v", routed), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				cm.NearestCentroids(v, 1, false)
+			}
+		})
+	}
+}
+
+/*
+--------------------------------------------------------------------------------
+Section for mean maintenance (property tests).
+--------------------------------------------------------------------------------
+*/
+
+func TestVecMeanProperty(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randVec := func() []float64 {
+		v := make([]float64, 3)
+		for i := range v {
+			v[i] = (rng.Float64()*2 - 1) * math.Pow(10, float64(rng.Intn(8)-2))
+		}
+		return v
+	}
+	cm := newCentroidManager(vec(0, 0, 0))
+	for op := 0; op < 5000; op++ {
+		switch x := rng.Float64(); {
+		case x < 0.7 || cm.LenDP() == 0:
+			cm.AddDataPoint(dp(randVec(), 0))
+		case x < 0.8:
+			cm.DrainUnordered(3)
+		case x < 0.85:
+			cm.DrainOrdered(3)
+		case x < 0.9:
+			cm.KNNLookup(randVec(), 2, true)
+		case x < 0.95:
+			cm.NearestCentroids(randVec(), 1, true)
+		case x < 0.97:
+			cm.MergeCentroids(func(c *centroid.Centroid) bool { return c.LenDP() < 3 })
+		default:
+			cm.MemTrim()
+		}
+		if len(cm.Centroids) == 0 {
+			continue
+		}
+		want, _ := mathutils.VecMean(cm.centroidVecGenerator())
+		mag := 1.
+		for _, v := range want {
+			mag = math.Max(mag, math.Abs(v))
+		}
+		for i := range want {
+			if math.Abs(cm.vec[i]-want[i]) > 1e-9*mag {
+				t.Fatalf("op %v: cm vec drifted: have %v, want %v", op, cm.vec, want)
+			}
+		}
+	}
+}
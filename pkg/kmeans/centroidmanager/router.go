@@ -0,0 +1,368 @@
+/*
+This file contains a coarse routing structure for CentroidManager, used for
+finding the nearest internal Centroids without comparing a vector against all
+of them. Centroids are grouped under 'super-centroids' (routeGroup), where the
+vector of a group is the mean of its member Centroid vectors. A search first
+finds the nearest groups and then the nearest Centroids within those groups,
+so it is roughly O(groups + groupSize) as opposed to O(centroids).
+
+The router is kept consistent as Centroids are added (splits, adoption from
+remote nodes), moved (dps added or removed) and removed (merges, draining),
+and is rebuilt from scratch when it is found to be out of sync with
+CentroidManager.Centroids (which is exported and can be modified from outside
+of this pkg).
+*/
+package centroidmanager
+
+import (
+	"trypo/pkg/kmeans/centroid"
+	"trypo/pkg/mathutils"
+)
+
+// RouterConfig configures coarse routing for a CentroidManager. The zero
+// value disables routing, i.e all Centroids are searched linearly.
+type RouterConfig struct {
+	// Threshold is the amount of Centroids a CentroidManager must have
+	// before routing is used. Zero disables routing.
+	Threshold int
+	// GroupSize is the target amount of Centroids per group (groups are
+	// split when they grow past twice this). Defaults to 64 if <= 0.
+	GroupSize int
+	// Probe is the amount of nearest groups searched through for each
+	// lookup. A higher value means better accuracy but slower lookups.
+	// Defaults to 4 if <= 0.
+	Probe int
+}
+
+// withDefaults returns a copy with default values where unset.
+func (cfg RouterConfig) withDefaults() RouterConfig {
+	if cfg.GroupSize <= 0 {
+		cfg.GroupSize = 64
+	}
+	if cfg.Probe <= 0 {
+		cfg.Probe = 4
+	}
+	return cfg
+}
+
+// routeGroup is a 'super-centroid', a group of Centroids.
+type routeGroup struct {
+	vec     []float64
+	members []*centroid.Centroid
+}
+
+// refresh sets the group vector to the mean of member vectors.
+func (g *routeGroup) refresh() {
+	i := 0
+	vec, ok := mathutils.VecMean(func() ([]float64, bool) {
+		if i >= len(g.members) {
+			return nil, false
+		}
+		i++
+		return g.members[i-1].Vec(), true
+	})
+	if ok {
+		g.vec = vec
+	}
+}
+
+type router struct {
+	cfg    RouterConfig
+	groups []*routeGroup
+	// Which group a Centroid belongs to.
+	of map[*centroid.Centroid]*routeGroup
+}
+
+// groupVecGenerator returns a generator over the vecs of all groups.
+func (r *router) groupVecGenerator() vecGenerator {
+	i := 0
+	return func() ([]float64, bool) {
+		if i >= len(r.groups) {
+			return nil, false
+		}
+		i++
+		return r.groups[i-1].vec, true
+	}
+}
+
+// centroidsVecGenerator returns a generator over the vecs of 'centroids'.
+func centroidsVecGenerator(centroids []*centroid.Centroid) vecGenerator {
+	i := 0
+	return func() ([]float64, bool) {
+		if i >= len(centroids) {
+			return nil, false
+		}
+		i++
+		return centroids[i-1].Vec(), true
+	}
+}
+
+// add puts a Centroid into the nearest group, which is split if it grows
+// too large.
+func (r *router) add(cm *CentroidManager, c *centroid.Centroid) {
+	if _, ok := r.of[c]; ok {
+		return
+	}
+	if len(r.groups) == 0 {
+		r.groups = append(r.groups, &routeGroup{})
+	}
+	g := r.groups[0]
+	indexes := cm.knnSearchFunc(c.Vec(), r.groupVecGenerator(), 1)
+	if len(indexes) != 0 {
+		g = r.groups[indexes[0]]
+	}
+	g.members = append(g.members, c)
+	g.refresh()
+	r.of[c] = g
+
+	if len(g.members) > r.cfg.GroupSize*2 {
+		r.split(cm, g)
+	}
+}
+
+// remove takes a Centroid out of its group, empty groups are removed.
+func (r *router) remove(c *centroid.Centroid) {
+	g, ok := r.of[c]
+	if !ok {
+		return
+	}
+	delete(r.of, c)
+	for i, other := range g.members {
+		if other == c {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	if len(g.members) != 0 {
+		g.refresh()
+		return
+	}
+	for i, other := range r.groups {
+		if other == g {
+			r.groups = append(r.groups[:i], r.groups[i+1:]...)
+			break
+		}
+	}
+}
+
+// split divides a group in two. The member furthest away from the group
+// vec is used as one seed, the member furthest away from that seed as the
+// other, then all members are assigned to the nearest seed.
+func (r *router) split(cm *CentroidManager, g *routeGroup) {
+	members := g.members
+	far := cm.kfnSearchFunc(g.vec, centroidsVecGenerator(members), 1)
+	if len(far) == 0 {
+		return
+	}
+	seedA := members[far[0]].Vec()
+	far = cm.kfnSearchFunc(seedA, centroidsVecGenerator(members), 1)
+	if len(far) == 0 {
+		return
+	}
+	seedB := members[far[0]].Vec()
+	seeds := [][]float64{seedA, seedB}
+
+	a, b := &routeGroup{}, &routeGroup{}
+	for _, c := range members {
+		i := 0
+		gen := func() ([]float64, bool) {
+			if i >= len(seeds) {
+				return nil, false
+			}
+			i++
+			return seeds[i-1], true
+		}
+		indexes := cm.knnSearchFunc(c.Vec(), gen, 1)
+		if len(indexes) != 0 && indexes[0] == 1 {
+			b.members = append(b.members, c)
+		} else {
+			a.members = append(a.members, c)
+		}
+	}
+	// Degenerate case (all vecs equal, for instance); halve instead.
+	if len(a.members) == 0 || len(b.members) == 0 {
+		half := len(members) / 2
+		a.members = append([]*centroid.Centroid(nil), members[:half]...)
+		b.members = append([]*centroid.Centroid(nil), members[half:]...)
+	}
+
+	for i, other := range r.groups {
+		if other == g {
+			r.groups = append(r.groups[:i], r.groups[i+1:]...)
+			break
+		}
+	}
+	for _, ng := range []*routeGroup{a, b} {
+		ng.refresh()
+		for _, c := range ng.members {
+			r.of[c] = ng
+		}
+		r.groups = append(r.groups, ng)
+	}
+}
+
+// refresh sets the vec of all groups to the mean of their members, used
+// when Centroid vecs have moved.
+func (r *router) refresh() {
+	for _, g := range r.groups {
+		g.refresh()
+	}
+}
+
+// nearest returns (max) k Centroids nearest vec, by probing the nearest
+// groups. More groups are probed if the first ones don't have k Centroids.
+func (r *router) nearest(cm *CentroidManager, vec []float64, k int) []*centroid.Centroid {
+	probe := r.cfg.Probe
+	for {
+		if probe > len(r.groups) {
+			probe = len(r.groups)
+		}
+		candidates := make([]*centroid.Centroid, 0, probe*r.cfg.GroupSize)
+		for _, i := range cm.knnSearchFunc(vec, r.groupVecGenerator(), probe) {
+			candidates = append(candidates, r.groups[i].members...)
+		}
+		if len(candidates) >= k || probe == len(r.groups) {
+			res := make([]*centroid.Centroid, 0, k)
+			for _, i := range cm.knnSearchFunc(vec, centroidsVecGenerator(candidates), k) {
+				res = append(res, candidates[i])
+			}
+			return res
+		}
+		probe *= 2
+	}
+}
+
+// rebuild creates a new router for all of cm.Centroids. Seeds are picked
+// evenly from cm.Centroids (one per group), and each Centroid is assigned
+// to the nearest seed.
+func (r *router) rebuild(cm *CentroidManager) {
+	r.of = make(map[*centroid.Centroid]*routeGroup, len(cm.Centroids))
+	r.groups = nil
+	if len(cm.Centroids) == 0 {
+		return
+	}
+
+	n := (len(cm.Centroids) + r.cfg.GroupSize - 1) / r.cfg.GroupSize
+	step := len(cm.Centroids) / n
+	seeds := make([]*centroid.Centroid, n)
+	for i := range seeds {
+		seeds[i] = cm.Centroids[i*step]
+		r.groups = append(r.groups, &routeGroup{vec: seeds[i].Vec()})
+	}
+	for _, c := range cm.Centroids {
+		g := r.groups[0]
+		if indexes := cm.knnSearchFunc(c.Vec(), r.groupVecGenerator(), 1); len(indexes) != 0 {
+			g = r.groups[indexes[0]]
+		}
+		g.members = append(g.members, c)
+		r.of[c] = g
+	}
+
+	// Drop empty groups and set vecs to member means.
+	groups := r.groups[:0]
+	for _, g := range r.groups {
+		if len(g.members) != 0 {
+			g.refresh()
+			groups = append(groups, g)
+		}
+	}
+	r.groups = groups
+}
+
+/*
+--------------------------------------------------------------------------------
+CentroidManager helpers for routing, these work with or without routing.
+--------------------------------------------------------------------------------
+*/
+
+// routing returns true if the router should be used, and makes sure that it
+// is in sync with cm.Centroids if so.
+func (cm *CentroidManager) routing() bool {
+	if cm.routerCfg.Threshold <= 0 || len(cm.Centroids) < cm.routerCfg.Threshold {
+		cm.router = nil
+		return false
+	}
+	if cm.router == nil || len(cm.router.of) != len(cm.Centroids) {
+		cm.rebuildRouter()
+	}
+	return true
+}
+
+// rebuildRouter (re)builds the router from scratch, if routing is enabled.
+func (cm *CentroidManager) rebuildRouter() {
+	cm.router = nil
+	cm.positions = nil
+	if cm.routerCfg.Threshold <= 0 || len(cm.Centroids) < cm.routerCfg.Threshold {
+		return
+	}
+	cm.router = &router{cfg: cm.routerCfg.withDefaults()}
+	cm.router.rebuild(cm)
+}
+
+// routeAdd registers a Centroid that was appended to cm.Centroids.
+func (cm *CentroidManager) routeAdd(c *centroid.Centroid) {
+	if cm.router != nil {
+		cm.router.add(cm, c)
+	}
+}
+
+// routeRemove unregisters a Centroid that is removed from cm.Centroids.
+func (cm *CentroidManager) routeRemove(c *centroid.Centroid) {
+	if cm.router != nil {
+		cm.router.remove(c)
+	}
+	cm.positions = nil
+}
+
+// routeMoved updates the group vec of a Centroid after its vec has changed
+// (dps added or removed), such that routing doesn't drift between calls to
+// MoveVector.
+func (cm *CentroidManager) routeMoved(c *centroid.Centroid) {
+	if cm.router == nil {
+		return
+	}
+	if g, ok := cm.router.of[c]; ok {
+		g.refresh()
+	}
+}
+
+// indexOf returns the index of c in cm.Centroids, or -1. Positions are
+// cached and re-computed when found to be stale.
+func (cm *CentroidManager) indexOf(c *centroid.Centroid) int {
+	if i, ok := cm.positions[c]; ok && i < len(cm.Centroids) && cm.Centroids[i] == c {
+		return i
+	}
+	cm.positions = make(map[*centroid.Centroid]int, len(cm.Centroids))
+	for i, other := range cm.Centroids {
+		cm.positions[other] = i
+	}
+	if i, ok := cm.positions[c]; ok {
+		return i
+	}
+	return -1
+}
+
+// nearestCentroidIndexes returns (max) k indexes into cm.Centroids, for the
+// Centroids nearest vec. Uses the router if enabled, a linear search with
+// cm.knnSearchFunc otherwise. The router returning unknown Centroids means
+// that it is out of sync, in which case it is rebuilt and asked again.
+func (cm *CentroidManager) nearestCentroidIndexes(vec []float64, k int) []int {
+	if !cm.routing() {
+		return cm.knnSearchFunc(vec, cm.centroidVecGenerator(), k)
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		res := make([]int, 0, k)
+		for _, c := range cm.router.nearest(cm, vec, k) {
+			i := cm.indexOf(c)
+			if i == -1 {
+				break
+			}
+			res = append(res, i)
+		}
+		if len(res) == k || len(res) == len(cm.Centroids) {
+			return res
+		}
+		cm.rebuildRouter()
+	}
+	return cm.knnSearchFunc(vec, cm.centroidVecGenerator(), k)
+}
@@ -1,6 +1,9 @@
 package common
 
-import "time"
+import (
+	"time"
+	"trypo/pkg/clock"
+)
 
 // DataPoint is a common data carrier in this pkg.
 type DataPoint struct {
@@ -11,9 +14,15 @@ type DataPoint struct {
 }
 
 // Expired returns true if dp.ExpireEnabled=true and dp.Expires
-// is a time before now.
+// is a time before now (of the process-wide clock, see pkg/clock).
 func (dp *DataPoint) Expired() bool {
-	return dp.ExpireEnabled && time.Now().After(dp.Expires)
+	return dp.ExpiredAt(clock.Now())
+}
+
+// ExpiredAt is like Expired, but relative to 'now', for sweeps over many
+// datapoints (which read the clock once).
+func (dp *DataPoint) ExpiredAt(now time.Time) bool {
+	return dp.ExpireEnabled && now.After(dp.Expires)
 }
 
 // DataPointReceiver receives DataPoints.
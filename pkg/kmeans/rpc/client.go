@@ -9,27 +9,62 @@ package rpc
 
 import (
 	"net/rpc"
+	"time"
 	"trypo/pkg/kmeans/centroid"
+	"trypo/pkg/rpcutils"
 )
 
-// client tries to connect to a remote client with c.remoteAddr, give
-// it to the task func, then clean the client up. It is meant to reduce
-// some rpc boilerplate.
-func (c *kmeansClient) client(taskF func(*rpc.Client)) {
-	client, err := rpc.Dial("tcp", c.remoteAddr)
-	if err != nil {
-		*c.err = err
-		return
+// caller is what task funcs (see kmeansClient.client) use for calling the
+// remote server, it has the same Call method as rpc.Client.
+type caller interface {
+	Call(serviceMethod string, args interface{}, reply interface{}) error
+}
+
+// lazyCaller is a caller which connects on the first call, such that errors
+// while connecting are reported per method. All calls are recorded in
+// metrics, see ./metrics.go.
+type lazyCaller struct {
+	addr string
+	rc   *rpc.Client
+}
+
+func (l *lazyCaller) Call(serviceMethod string, args interface{}, reply interface{}) error {
+	start := time.Now()
+	err := l.call(serviceMethod, args, reply)
+	observeCall(serviceMethod, l.addr, time.Since(start), err)
+	return err
+}
+
+func (l *lazyCaller) call(serviceMethod string, args interface{}, reply interface{}) error {
+	if l.rc == nil {
+		rc, err := rpcutils.Dial(l.addr)
+		if err != nil {
+			return err
+		}
+		l.rc = rc
 	}
-	defer client.Close()
-	taskF(client)
+	return l.rc.Call(serviceMethod, args, reply)
+}
+
+func (l *lazyCaller) close() {
+	if l.rc != nil {
+		l.rc.Close()
+	}
+}
+
+// client gives a caller for c.remoteAddr to the task func, then cleans the
+// connection up. It is meant to reduce some rpc boilerplate.
+func (c *kmeansClient) client(taskF func(caller)) {
+	l := lazyCaller{addr: c.remoteAddr}
+	defer l.close()
+	taskF(&l)
 }
 
 // Namespaces fetches all namespaces stored in remote server.
 func (c *kmeansClient) Namespaces() []string {
 	var resp []string
 
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		*c.err = rc.Call("KMeansServer.Namespaces", 0, &resp)
 	})
 
@@ -42,7 +77,7 @@ func (c *kmeansClient) Namespaces() []string {
 func (c *kmeansClient) Vec() []float64 {
 	var resp []float64
 
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		*c.err = rc.Call("KMeansServer.Vec", c.namespace, &resp)
 	})
 
@@ -57,7 +92,7 @@ func (c *kmeansClient) Vec() []float64 {
 func (c *kmeansClient) AddDataPoint(dp DataPoint) bool {
 	var resp bool
 
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		args := AddDataPointArgs{NameSpace: c.namespace, DP: dp}
 		*c.err = rc.Call("KMeansServer.AddDataPoint", args, &resp)
 	})
@@ -71,7 +106,7 @@ func (c *kmeansClient) AddDataPoint(dp DataPoint) bool {
 func (c *kmeansClient) DrainUnordered(n int) []DataPoint {
 	var resp []DataPoint
 
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		args := DrainArgs{NameSpace: c.namespace, N: n}
 		*c.err = rc.Call("KMeansServer.DrainUnordered", args, &resp)
 	})
@@ -85,7 +120,7 @@ func (c *kmeansClient) DrainUnordered(n int) []DataPoint {
 func (c *kmeansClient) DrainOrdered(n int) []DataPoint {
 	var resp []DataPoint
 
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		args := DrainArgs{NameSpace: c.namespace, N: n}
 		*c.err = rc.Call("KMeansServer.DrainOrdered", args, &resp)
 	})
@@ -97,7 +132,7 @@ func (c *kmeansClient) DrainOrdered(n int) []DataPoint {
 // (T of pkg/kmeans/centroidmanager, se that method name for more documentation),
 // using the addr and namespace specified while setting up this client.
 func (c *kmeansClient) Expire() {
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		*c.err = rc.Call("KMeansServer.Expire", c.namespace, nil)
 	})
 }
@@ -108,7 +143,7 @@ func (c *kmeansClient) Expire() {
 func (c *kmeansClient) LenDP() int {
 	var resp int
 
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		*c.err = rc.Call("KMeansServer.LenDP", c.namespace, &resp)
 	})
 
@@ -119,7 +154,7 @@ func (c *kmeansClient) LenDP() int {
 // (T of pkg/kmeans/centroidmanager, se that method name for more documentation),
 // using the addr and namespace specified while setting up this client.
 func (c *kmeansClient) MemTrim() {
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		*c.err = rc.Call("KMeansServer.MemTrim", c.namespace, nil)
 	})
 }
@@ -130,7 +165,7 @@ func (c *kmeansClient) MemTrim() {
 func (c *kmeansClient) MoveVector() bool {
 	var resp bool
 
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		*c.err = rc.Call("KMeansServer.MoveVector", c.namespace, &resp)
 	})
 
@@ -145,7 +180,7 @@ func (c *kmeansClient) MoveVector() bool {
 // is derived from CentroidManager.Vec() on _other_ nodes). Note, all of this
 // is done within the same namespace that was used while setting up this client.
 func (c *kmeansClient) DistributeDataPointsFast(addrs []string, n int) {
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		args := DistribDPArgs{NameSpace: c.namespace, N: n, AddrOptions: addrs}
 		*c.err = rc.Call("KMeansServer.DistributeDataPointsFast", args, nil)
 	})
@@ -159,7 +194,7 @@ func (c *kmeansClient) DistributeDataPointsFast(addrs []string, n int) {
 // This is _a_lot_ slower due to many network calls, but has the benefit of
 // placing distribute dps precisely.
 func (c *kmeansClient) DistributeDataPointsAccurate(addrs []string, n int) {
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		args := DistribDPArgs{NameSpace: c.namespace, N: n, AddrOptions: addrs}
 		*c.err = rc.Call("KMeansServer.DistributeDataPointsAccurate", args, nil)
 	})
@@ -169,7 +204,7 @@ func (c *kmeansClient) DistributeDataPointsAccurate(addrs []string, n int) {
 // (T of pkg/kmeans/centroidmanager, se that method name for more documentation),
 // using the addr and namespace specified while setting up this client.
 func (c *kmeansClient) DistributeDataPointsInternal(n int) {
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		// Line length < 80 ish.
 		s := "KMeansServer.DistributeDataPointsInternal"
 		args := DistribDPIArgs{NameSpace: c.namespace, N: n}
@@ -180,12 +215,43 @@ func (c *kmeansClient) DistributeDataPointsInternal(n int) {
 // Calls the method with the same name on a remote instance of T CentroidManager
 // (T of pkg/kmeans/centroidmanager, se that method name for more documentation),
 // using the addr and namespace specified while setting up this client.
+//
+// With drain=true, the datapoints are drained with KMeansServer.ReserveKNN and
+// acknowledged once they are received, so they are put back in the remote node
+// if the response is lost. If the acknowledgement is lost, they are put back as
+// well, i.e the datapoints are then both returned and kept.
 func (c *kmeansClient) KNNLookup(vec []float64, k int, drain bool) []DataPoint {
 	resp := make([]DataPoint, 0, k)
 
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		args := KNNLookupArgs{NameSpace: c.namespace, Vec: vec, K: k, Drain: drain}
-		*c.err = rc.Call("KMeansServer.KNNLookup", args, &resp)
+		if !drain {
+			*c.err = rc.Call("KMeansServer.KNNLookup", args, &resp)
+			return
+		}
+		var r ReserveKNNResp
+		if *c.err = rc.Call("KMeansServer.ReserveKNN", args, &r); *c.err != nil {
+			return
+		}
+		resp = r.DPs
+		if r.ID != 0 {
+			// Not an error for this call, see above.
+			rc.Call("KMeansServer.DeleteCentroid", MigrationArgs{ID: r.ID}, nil)
+		}
+	})
+
+	return resp
+}
+
+// Calls KMeansServer.Touch on the remote node, using the addr and namespace
+// specified while setting up this client. Returns the amount of datapoints that
+// were found (and touched, if they expire).
+func (c *kmeansClient) Touch(vec []float64, k int, ttl time.Duration) int {
+	var resp int
+
+	c.client(func(rc caller) {
+		args := TouchArgs{NameSpace: c.namespace, Vec: vec, K: k, TTL: ttl}
+		*c.err = rc.Call("KMeansServer.Touch", args, &resp)
 	})
 
 	return resp
@@ -199,14 +265,20 @@ func (c *kmeansClient) KNNLookup(vec []float64, k int, drain bool) []DataPoint {
 // This is done using the CentroidFactory field of this kmeansClient instance,
 // so that has to be configured (a default exists, configured with cosine
 // similarity/distance funcs, used in methods such as DrainUnordered).
-// Additionally, empty centroids are filtered out.
+// Additionally, empty centroids are filtered out. With drain=true, each Centroid
+// is moved with ReserveCentroid, CopyCentroid and DeleteCentroid (see
+// ./migrate.go), so it isn't lost if a response is.
 func (c *kmeansClient) NearestCentroids(vec []float64, n int, drain bool) (
 	[]*centroid.Centroid, bool,
 ) {
 	var resp []*Centroid
 
-	c.client(func(rc *rpc.Client) {
-		args := NearestCentroidArgs{NameSpace: c.namespace, Vec: vec, N: n, Drain: drain}
+	c.client(func(rc caller) {
+		if drain {
+			resp, *c.err = drainNearestCentroids(rc, c.namespace, vec, n)
+			return
+		}
+		args := NearestCentroidArgs{NameSpace: c.namespace, Vec: vec, N: n}
 		*c.err = rc.Call("KMeansServer.NearestCentroids", args, &resp)
 	})
 
@@ -237,6 +309,34 @@ func (c *kmeansClient) NearestCentroids(vec []float64, n int, drain bool) (
 	return resp, true
 }
 
+// drainNearestCentroids moves max 'n' Centroids nearest 'vec' from the node of
+// 'rc', one at a time, for kmeansClient.NearestCentroids. A Centroid that can't
+// be copied is released (put back), and ends the loop.
+func drainNearestCentroids(rc caller, namespace string, vec []float64, n int) ([]*Centroid, error) {
+	res := make([]*Centroid, 0, n)
+	for len(res) < n {
+		var reserved ReserveCentroidResp
+		args := ReserveCentroidArgs{NameSpace: namespace, Vec: vec}
+		if err := rc.Call("KMeansServer.ReserveCentroid", args, &reserved); err != nil {
+			return res, err
+		}
+		if reserved.LenDP == 0 {
+			break
+		}
+
+		var dps []DataPoint
+		mig := MigrationArgs{ID: reserved.ID}
+		if err := rc.Call("KMeansServer.CopyCentroid", mig, &dps); err != nil {
+			rc.Call("KMeansServer.ReleaseCentroid", mig, nil)
+			return res, err
+		}
+		res = append(res, &Centroid{DataPoints: dps})
+		// If this fails, the Centroid is put back when the lease runs out.
+		rc.Call("KMeansServer.DeleteCentroid", mig, nil)
+	}
+	return res, nil
+}
+
 // Connects to a remmote node using the addr and namespace specified while
 // setting up this client, and finds a Centroid that is nearest 'vec' before
 // returning the vector of that Centroid. 'nearest' will depend on how the
@@ -244,7 +344,7 @@ func (c *kmeansClient) NearestCentroids(vec []float64, n int, drain bool) (
 func (c *kmeansClient) NearestCentroidVec(vec []float64) []float64 {
 	var resp []float64
 
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		args := NearestCentroidVecArgs{NameSpace: c.namespace, Vec: vec}
 		*c.err = rc.Call("KMeansServer.NearestCentroidVec", args, &resp)
 	})
@@ -261,7 +361,7 @@ func (c *kmeansClient) NearestCentroidVec(vec []float64) []float64 {
 // Instead, a range can be specified here such that remote Centroids are split
 // if their contained amt of DPs falls within the range (min&max are _exclusive_).
 func (c *kmeansClient) SplitCentroids(dpRangeMin, dpRangeMax int) {
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		args := SplitCentroidsArgs{
 			NameSpace:  c.namespace,
 			DPRangeMin: dpRangeMin,
@@ -280,7 +380,7 @@ func (c *kmeansClient) SplitCentroids(dpRangeMin, dpRangeMax int) {
 // Instead, a range can be specified here such that remote Centroids are merged
 // if their contained amt of DPs falls within the range (min&max are _exclusive_).
 func (c *kmeansClient) MergeCentroids(dpRangeMin, dpRangeMax int) {
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		args := SplitCentroidsArgs{
 			NameSpace:  c.namespace,
 			DPRangeMin: dpRangeMin,
@@ -292,13 +392,14 @@ func (c *kmeansClient) MergeCentroids(dpRangeMin, dpRangeMax int) {
 
 // StealCentroids will 'steal' one or more Centroid from a remote node, intended for
 // load balancing. If A=(the node contacted with this method) and B=(the node which
-// A steals from, with addr 'fromAddr'), then A will keep 'stealing' _whole_
-// Centroids from B until the total amount of transferred datapoints exceeds
-// 'transferLimit' (this value might therefore be greatly overshot), using
-// KMeansClient(...).NearestCentroid(vec), where vec is the vector of CentroidManager
-// in A with the supplied namespace. The response is a bool and an int, where the
-// former represents total amount of datapoints transferred, while the latter
-// indicates whether or not there was a network/namespace issue between A & B.
+// A steals from, with addr 'fromAddr'), then A will keep 'stealing' the Centroids
+// in B that are nearest the vector of the CentroidManager in A (with the supplied
+// namespace) until 'transferLimit' datapoints are transferred. Centroids are split
+// when needed, such that the limit isn't exceeded, and are moved in a way that
+// doesn't lose data on network errors (see ./migrate.go). The response is a bool
+// and an int, where the former represents total amount of datapoints transferred,
+// while the latter indicates whether or not there was a network/namespace issue
+// between A & B.
 // The configuration of the int and bool have these implied meanings:
 //	- int = 0 & bool = false : remote node err (namespace or network issue).
 //	- int > 0 & bool = false : Some Centroids transferred before network err.
@@ -309,7 +410,7 @@ func (c *kmeansClient) MergeCentroids(dpRangeMin, dpRangeMax int) {
 func (c *kmeansClient) StealCentroids(fromAddr string, transferLimit int) (int, bool) {
 	var n int
 	var ok bool
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		args := StealCentroidArgs{
 			FromAddr:        fromAddr,
 			NameSpace:       c.namespace,
@@ -323,11 +424,89 @@ func (c *kmeansClient) StealCentroids(fromAddr string, transferLimit int) (int,
 	return n, ok
 }
 
+// PushCentroids is the counterpart of StealCentroids, where the node contacted
+// with this method (A) moves Centroids to the node at 'toAddr' (B), intended for
+// load balancing from nodes that are overloaded. It is done by asking B to steal
+// from A, so the limits and return values are the same as for StealCentroids.
+func (c *kmeansClient) PushCentroids(toAddr string, transferLimit int) (int, bool) {
+	var n int
+	var ok bool
+	c.client(func(rc caller) {
+		args := PushCentroidsArgs{
+			ToAddr:          toAddr,
+			NameSpace:       c.namespace,
+			TransferDPLimit: transferLimit,
+		}
+		resp := StealCentroidsResp{}
+		*c.err = rc.Call("KMeansServer.PushCentroids", args, &resp)
+		n = resp.TransferredN
+		ok = resp.OK
+	})
+	return n, ok
+}
+
+// ReserveCentroid reserves the Centroid nearest 'vec' (or a part of it, within
+// 'maxDPs' and 'maxBytes') for a transfer, see KMeansServer.ReserveCentroid.
+// Returns the ID of the reservation and the amount of datapoints in it.
+func (c *kmeansClient) ReserveCentroid(vec []float64, maxDPs, maxBytes int) (uint64, int) {
+	var resp ReserveCentroidResp
+	c.client(func(rc caller) {
+		args := ReserveCentroidArgs{NameSpace: c.namespace, Vec: vec, MaxDPs: maxDPs, MaxBytes: maxBytes}
+		*c.err = rc.Call("KMeansServer.ReserveCentroid", args, &resp)
+	})
+	return resp.ID, resp.LenDP
+}
+
+// CopyCentroid fetches the datapoints of a reserved Centroid, see
+// ReserveCentroid.
+func (c *kmeansClient) CopyCentroid(id uint64) []DataPoint {
+	var resp []DataPoint
+	c.client(func(rc caller) {
+		*c.err = rc.Call("KMeansServer.CopyCentroid", MigrationArgs{ID: id}, &resp)
+	})
+	return resp
+}
+
+// DeleteCentroid drops a reserved Centroid, see ReserveCentroid.
+func (c *kmeansClient) DeleteCentroid(id uint64) {
+	c.client(func(rc caller) {
+		*c.err = rc.Call("KMeansServer.DeleteCentroid", MigrationArgs{ID: id}, nil)
+	})
+}
+
+// ReleaseCentroid puts a reserved Centroid back, see ReserveCentroid.
+func (c *kmeansClient) ReleaseCentroid(id uint64) {
+	c.client(func(rc caller) {
+		*c.err = rc.Call("KMeansServer.ReleaseCentroid", MigrationArgs{ID: id}, nil)
+	})
+}
+
 // Meta fetches metadata from the node.
 func (c *kmeansClient) Meta() MetaResp {
 	r := MetaResp{}
-	c.client(func(rc *rpc.Client) {
+	c.client(func(rc caller) {
 		*c.err = rc.Call("KMeansServer.Meta", 0, &r)
 	})
 	return r
 }
+
+// Export fetches a snapshot (see SaveSnapshot) of the data in the node, for
+// the namespace of this client, or all namespaces if it's empty.
+func (c *kmeansClient) Export() []byte {
+	var r []byte
+	c.client(func(rc caller) {
+		*c.err = rc.Call("KMeansServer.Export", c.namespace, &r)
+	})
+	return r
+}
+
+// Import sends a snapshot (see SaveSnapshot) to the node, where its data is
+// added. Returns the amount of datapoints that were added. The namespace of
+// this client isn't used (the snapshot has its own namespaces).
+func (c *kmeansClient) Import(snapshot []byte) int {
+	var r int
+	c.client(func(rc caller) {
+		*c.err = rc.Call("KMeansServer.Import", snapshot, &r)
+	})
+	return r
+}
@@ -0,0 +1,108 @@
+package rpc
+
+import (
+	"net/rpc"
+	"sync"
+	"time"
+	"trypo/pkg/logging"
+	"trypo/pkg/metrics"
+)
+
+// Metrics for calls made by kmeansClient, labelled by method (e.g
+// "KMeansServer.Vec") and peer (remote address). See lazyCaller.
+var (
+	rpcCalls = metrics.Default.Counter("trypo_rpc_calls_total",
+		"RPC calls made to other nodes.", "method", "peer")
+	rpcErrors = metrics.Default.Counter("trypo_rpc_errors_total",
+		"RPC calls to other nodes that failed (including connection errors).", "method", "peer")
+	rpcLatency = metrics.Default.Histogram("trypo_rpc_call_duration_seconds",
+		"Duration of RPC calls to other nodes.", metrics.DefBuckets, "method", "peer")
+)
+
+// Datapoints moved from a node to others, labelled by namespace and op, which
+// is one of the dpsMoved* consts.
+var dpsMoved = metrics.Default.Counter("trypo_datapoints_moved_total",
+	"Datapoints moved between nodes.", "namespace", "op")
+
+const (
+	dpsMovedFast     = "distribute_fast"
+	dpsMovedAccurate = "distribute_accurate"
+	dpsMovedSteal    = "steal"
+)
+
+// Metrics for the data in tracked servers (see TrackMetrics), labelled by node
+// (address of the server) and namespace. Set when scraped.
+var (
+	nodeDPs = metrics.Default.Gauge("trypo_datapoints",
+		"Datapoints in a node.", "node", "namespace")
+	nodeCentroids = metrics.Default.Gauge("trypo_centroids",
+		"Centroids in a node.", "node", "namespace")
+	nodeCentroidSize = metrics.Default.Histogram("trypo_centroid_size",
+		"Amount of datapoints in each centroid of a node.",
+		[]float64{0, 10, 100, 1000, 10000, 100000, 1000000}, "node", "namespace")
+)
+
+func observeCall(method, peer string, d time.Duration, err error) {
+	rpcCalls.Inc(method, peer)
+	rpcLatency.Observe(d.Seconds(), method, peer)
+	if err != nil {
+		rpcErrors.Inc(method, peer)
+		// Errors returned by the remote server (e.g a missing namespace)
+		// are part of normal operation, connection errors are not.
+		level := logging.LevelWarn
+		if _, ok := err.(rpc.ServerError); ok {
+			level = logging.LevelDebug
+		}
+		logging.Default().Log(level, "rpc call failed", logging.F("method", method),
+			logging.Peer(peer), logging.Duration(d), logging.Err(err))
+	}
+}
+
+// Servers that node metrics are collected for, see TrackMetrics.
+var listening = struct {
+	sync.Mutex
+	servers map[*KMeansServer]bool
+}{servers: make(map[*KMeansServer]bool)}
+
+func init() {
+	metrics.Default.OnScrape(collectNodeMetrics)
+}
+
+// TrackMetrics makes metrics (datapoint and centroid counts, centroid sizes)
+// be collected for the data in 's', until the returned func is called. This
+// is done by StartListen, so it's only needed for servers which are started
+// in other ways.
+func TrackMetrics(s *KMeansServer) (untrack func()) {
+	listening.Lock()
+	defer listening.Unlock()
+	listening.servers[s] = true
+	return func() {
+		listening.Lock()
+		defer listening.Unlock()
+		delete(listening.servers, s)
+	}
+}
+
+func collectNodeMetrics() {
+	listening.Lock()
+	servers := make([]*KMeansServer, 0, len(listening.servers))
+	for s := range listening.servers {
+		servers = append(servers, s)
+	}
+	listening.Unlock()
+
+	nodeDPs.Reset()
+	nodeCentroids.Reset()
+	nodeCentroidSize.Reset()
+	for _, s := range servers {
+		for _, ns := range s.Table.Namespaces() {
+			s.Table.Access(ns, func(cm *CentroidManager) {
+				nodeDPs.Set(float64(cm.LenDP()), s.addr, ns)
+				nodeCentroids.Set(float64(len(cm.Centroids)), s.addr, ns)
+				for _, c := range cm.Centroids {
+					nodeCentroidSize.Observe(float64(c.LenDP()), s.addr, ns)
+				}
+			})
+		}
+	}
+}
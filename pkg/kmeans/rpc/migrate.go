@@ -0,0 +1,338 @@
+package rpc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"trypo/pkg/clock"
+)
+
+/*
+Centroids are moved between nodes in four steps, such that a network error at
+any point doesn't lose data:
+	1. ReserveCentroid: the source node removes the Centroid nearest a vector
+	   (split, if it's bigger than what the destination can take) and holds
+	   it as a reservation.
+	2. CopyCentroid: the destination fetches the datapoints.
+	3. The destination adds the datapoints to its own data (commit).
+	4. DeleteCentroid: the source drops the reservation.
+If the destination can't finish, it calls ReleaseCentroid, which puts the
+Centroid back in the source. Reservations that are neither deleted nor
+released in time (see KMeansServer.MigrationLease) are put back as well, so
+if step 4 doesn't reach the source, then the datapoints end up in both nodes
+rather than in neither.
+
+Other operations that remove datapoints and send them elsewhere use the same
+reservations: ReserveKNN (KNNLookup with drain, acknowledged with
+DeleteCentroid), and the DistributeDataPoints* methods (which hold drained
+datapoints until each is added to another node). Reservations are included in
+snapshots (see SaveSnapshot).
+*/
+
+// Used when KMeansServer.MigrationLease isn't set.
+const defaultMigrationLease = time.Second * 30
+
+// migration is a set of datapoints that are reserved for a transfer to another
+// node. They are put back as one Centroid if 'whole', else one at a time.
+type migration struct {
+	namespace string
+	dps       []DataPoint
+	whole     bool
+	stop      func() bool // Stops the lease, see clock.AfterFunc.
+}
+
+// migrations are the reservations in a node. The zero value is ready to use.
+type migrations struct {
+	sync.Mutex
+	next  uint64
+	items map[uint64]*migration
+}
+
+// add reserves 'mig'. If 'lease' is above zero, then 'expire' is called with
+// the ID of the reservation when it runs out (on the process-wide clock, see
+// pkg/clock).
+func (m *migrations) add(mig *migration, lease time.Duration, expire func(uint64)) uint64 {
+	m.Lock()
+	defer m.Unlock()
+	if m.items == nil {
+		m.items = make(map[uint64]*migration)
+	}
+	m.next++
+	id := m.next
+	if lease > 0 {
+		mig.stop = clock.AfterFunc(clock.Default(), lease, func() { expire(id) })
+	}
+	m.items[id] = mig
+	return id
+}
+
+// get returns the datapoints reserved with 'id'.
+func (m *migrations) get(id uint64) ([]DataPoint, bool) {
+	m.Lock()
+	defer m.Unlock()
+	mig, ok := m.items[id]
+	if !ok {
+		return nil, false
+	}
+	return mig.dps, true
+}
+
+// ack drops the first 'n' datapoints of the reservation with 'id', once they
+// have been handled.
+func (m *migrations) ack(id uint64, n int) {
+	m.Lock()
+	defer m.Unlock()
+	if mig, ok := m.items[id]; ok {
+		if n > len(mig.dps) {
+			n = len(mig.dps)
+		}
+		mig.dps = mig.dps[n:]
+	}
+}
+
+// take removes and returns the reservation with 'id'.
+func (m *migrations) take(id uint64) (*migration, bool) {
+	m.Lock()
+	defer m.Unlock()
+	mig, ok := m.items[id]
+	if ok {
+		if mig.stop != nil {
+			mig.stop()
+		}
+		delete(m.items, id)
+	}
+	return mig, ok
+}
+
+// reserved returns the datapoints of all reservations for 'namespace'.
+func (m *migrations) reserved(namespace string) [][]DataPoint {
+	m.Lock()
+	defer m.Unlock()
+	var res [][]DataPoint
+	for _, mig := range m.items {
+		if mig.namespace == namespace && len(mig.dps) != 0 {
+			res = append(res, append([]DataPoint(nil), mig.dps...))
+		}
+	}
+	return res
+}
+
+// reserve holds 'dps' (removed from 'namespace') as a reservation, which is
+// put back when s.MigrationLease runs out (if 'lease'). See migration for
+// 'whole'.
+func (s *KMeansServer) reserve(namespace string, dps []DataPoint, whole, lease bool) uint64 {
+	mig := &migration{namespace: namespace, dps: dps, whole: whole}
+	d := time.Duration(0)
+	if lease {
+		if d = s.MigrationLease; d <= 0 {
+			d = defaultMigrationLease
+		}
+	}
+	return s.migrations.add(mig, d, func(id uint64) {
+		s.ReleaseCentroid(MigrationArgs{ID: id}, nil)
+	})
+}
+
+// putBack adds 'dps' to 'namespace', after they were removed for a transfer
+// that didn't happen. They are added as one Centroid if 'whole', else one at
+// a time (such that each ends up in its nearest Centroid). The namespace is
+// created if it was removed in the meantime.
+func (s *KMeansServer) putBack(namespace string, dps []DataPoint, whole bool) {
+	if len(dps) == 0 {
+		return
+	}
+	add := func(cm *CentroidManager) {
+		if whole {
+			cm.AdoptCentroids([]*Centroid{{DataPoints: dps}})
+			return
+		}
+		for _, dp := range dps {
+			cm.AddDataPoint(dp)
+		}
+	}
+	if !s.Table.Access(namespace, add) {
+		cm := s.CentroidManagerFactoryFunc(dps[0].Vec)
+		add(cm)
+		s.Table.AddSlot(namespace, &CManagerSlot{cManager: cm})
+	}
+}
+
+// MigrationErr is returned for IDs of reservations that don't exist (anymore),
+// see ReserveCentroid.
+type MigrationErr struct{ ID uint64 }
+
+func (e MigrationErr) Error() string {
+	return fmt.Sprintf("no reserved centroid with id %v", e.ID)
+}
+
+type ReserveCentroidArgs struct {
+	NameSpace string
+	Vec       []float64
+	// Limits for the reserved Centroid, zero or less means no limit.
+	MaxDPs   int
+	MaxBytes int
+}
+
+type ReserveCentroidResp struct {
+	ID    uint64
+	LenDP int
+}
+
+// ReserveCentroid removes the Centroid nearest args.Vec from the namespace and
+// holds it for a transfer (see the top of this file). If the Centroid has more
+// datapoints than args.MaxDPs, or more bytes than args.MaxBytes (counted as in
+// KMeansServer.Quotas), then it is split and only the part nearest args.Vec is
+// reserved. The response has LenDP=0 if there is nothing to reserve. Returns a
+// NamespaceErr if the namespace doesn't exist.
+func (s *KMeansServer) ReserveCentroid(args ReserveCentroidArgs, r *ReserveCentroidResp) error {
+	var reserved *Centroid
+	err := s.handleNamespaceErr(args.NameSpace, func(cm *CentroidManager) {
+		nearest, ok := cm.NearestCentroids(args.Vec, 1, false)
+		if !ok || nearest[0].LenDP() == 0 {
+			return
+		}
+		n := nearest[0].LenDP()
+		if args.MaxDPs > 0 && args.MaxDPs < n {
+			n = args.MaxDPs
+		}
+		if perDP := maxDPBytes(cm, nearest[0]); args.MaxBytes > 0 && args.MaxBytes/perDP < n {
+			n = args.MaxBytes / perDP
+		}
+		if c, ok := cm.DrainNearestCentroid(args.Vec, n); ok {
+			reserved = c
+		}
+	})
+	if err != nil || reserved == nil {
+		return err
+	}
+	r.ID = s.reserve(args.NameSpace, reserved.ExportDataPoints(), true, true)
+	r.LenDP = reserved.LenDP()
+	return nil
+}
+
+// maxDPBytes returns the bytes of the largest datapoint in 'c' (like
+// CentroidManager.DPBytes of 'cm'), such that datapoints of 'c' times this is
+// an upper bound for their bytes.
+func maxDPBytes(cm *CentroidManager, c *Centroid) int {
+	payload := 0
+	for i := range c.DataPoints {
+		if n := len(c.DataPoints[i].Payload); n > payload {
+			payload = n
+		}
+	}
+	if res := cm.DPBytes(DataPoint{Vec: c.Vec()}) + payload; res > 0 {
+		return res
+	}
+	return 1
+}
+
+type MigrationArgs struct {
+	ID uint64
+}
+
+// CopyCentroid returns the datapoints of a reserved Centroid (see
+// ReserveCentroid). Returns a MigrationErr if there is no reservation with
+// args.ID.
+func (s *KMeansServer) CopyCentroid(args MigrationArgs, r *[]DataPoint) error {
+	dps, ok := s.migrations.get(args.ID)
+	if !ok {
+		return MigrationErr{args.ID}
+	}
+	*r = dps
+	return nil
+}
+
+// DeleteCentroid drops a reserved Centroid (see ReserveCentroid), once it has
+// been copied to another node. Also used to acknowledge the datapoints sent by
+// ReserveKNN. Returns a MigrationErr if there is no reservation with args.ID.
+func (s *KMeansServer) DeleteCentroid(args MigrationArgs, _ *int) error {
+	if _, ok := s.migrations.take(args.ID); !ok {
+		return MigrationErr{args.ID}
+	}
+	return nil
+}
+
+// ReleaseCentroid puts a reserved Centroid (see ReserveCentroid) back, as if
+// it was never reserved. Returns a MigrationErr if there is no reservation
+// with args.ID.
+func (s *KMeansServer) ReleaseCentroid(args MigrationArgs, _ *int) error {
+	mig, ok := s.migrations.take(args.ID)
+	if !ok {
+		return MigrationErr{args.ID}
+	}
+	s.putBack(mig.namespace, mig.dps, mig.whole)
+	return nil
+}
+
+type ReserveKNNResp struct {
+	ID  uint64
+	DPs []DataPoint
+}
+
+// ReserveKNN is like KNNLookup with drain (args.Drain is ignored), except that
+// the drained datapoints are held as a reservation (see the top of this file)
+// until the caller has received them and acknowledges that with DeleteCentroid.
+// Otherwise they are put back when the lease runs out. The response has ID=0
+// if nothing was drained. Returns a NamespaceErr if the namespace doesn't
+// exist.
+func (s *KMeansServer) ReserveKNN(args KNNLookupArgs, r *ReserveKNNResp) error {
+	err := s.handleNamespaceErr(args.NameSpace, func(cm *CentroidManager) {
+		start := time.Now()
+		r.DPs = cm.KNNLookup(args.Vec, args.K, true)
+		s.stats.addQuery(args.NameSpace, time.Since(start))
+	})
+	if err != nil || len(r.DPs) == 0 {
+		return err
+	}
+	r.ID = s.reserve(args.NameSpace, r.DPs, false, true)
+	return nil
+}
+
+// stageDrain drains (with DrainOrdered) max 'n' datapoints from 'namespace'
+// and holds them as a reservation without a lease, for the DistributeDataPoints*
+// methods. Each datapoint must be acknowledged (see migrations.ack) once it has
+// been added elsewhere or put back, and the reservation taken at the end.
+// Returns a NamespaceErr if the namespace doesn't exist.
+func (s *KMeansServer) stageDrain(namespace string, n int) (uint64, []DataPoint, error) {
+	var dps []DataPoint
+	err := s.handleNamespaceErr(namespace, func(cm *CentroidManager) {
+		dps = cm.DrainOrdered(n)
+	})
+	if err != nil || len(dps) == 0 {
+		return 0, nil, err
+	}
+	return s.reserve(namespace, dps, false, false), dps, nil
+}
+
+// pullCentroid moves a Centroid (or part of it, within 'maxDPs' and 'maxBytes')
+// from the node of 'from' to the namespace in 's', nearest 'vec', see the top
+// of this file. The namespace must exist in 's'. Returns the amount of moved
+// datapoints and their bytes (like CentroidManager.DPBytes), zero if there
+// was nothing to move or the transfer failed (then the error is in 'from').
+func (s *KMeansServer) pullCentroid(from *kmeansClient, vec []float64, maxDPs, maxBytes int) (int, int) {
+	ns := from.namespace
+	id, n := from.ReserveCentroid(vec, maxDPs, maxBytes)
+	if n == 0 {
+		return 0, 0
+	}
+	dps := from.CopyCentroid(id)
+	if len(dps) != n {
+		from.ReleaseCentroid(id)
+		return 0, 0
+	}
+
+	bytes := 0
+	s.Table.Access(ns, func(cm *CentroidManager) {
+		for _, dp := range dps {
+			bytes += cm.DPBytes(dp)
+		}
+		// Re-created with the properties of cm (search funcs, etc).
+		cm.AdoptCentroids([]*Centroid{{DataPoints: dps}})
+	})
+	s.usage.add(ns, len(dps), bytes)
+
+	// If this fails, the reservation expires and the datapoints are put back
+	// in the source, i.e duplicated rather than lost.
+	from.DeleteCentroid(id)
+	return len(dps), bytes
+}
@@ -0,0 +1,156 @@
+package rpc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"trypo/pkg/metrics"
+)
+
+// Quota limits the resources used by a namespace. Zero fields mean no limit.
+// MaxDPs and MaxBytes are enforced in each node (see KMeansServer.Quotas),
+// while WriteRate and QueryRate are enforced by each API server (core/api).
+type Quota struct {
+	// Datapoints in a node.
+	MaxDPs int `json:"max_dps"`
+	// Bytes used for vectors and payloads in a node, see Centroid.LenBytes.
+	MaxBytes int `json:"max_bytes"`
+	// Datapoints added per second.
+	WriteRate float64 `json:"write_rate"`
+	// Queries per second.
+	QueryRate float64 `json:"query_rate"`
+}
+
+// Quotas by namespace, where "*" is the quota for all namespaces that don't
+// have their own.
+type Quotas map[string]Quota
+
+// For returns the quota for 'namespace'.
+func (q Quotas) For(namespace string) Quota {
+	if quota, ok := q[namespace]; ok {
+		return quota
+	}
+	return q["*"]
+}
+
+// Prefix of QuotaErr messages, see IsQuotaErr.
+const quotaErrPrefix = "quota exceeded"
+
+// QuotaErr is returned by KMeansServer.AddDataPoint when a datapoint would
+// make its namespace exceed the Quota in the node. Limit is "dps" or
+// "bytes", Used is the usage before the datapoint.
+type QuotaErr struct {
+	Namespace string
+	Limit     string
+	Used, Max int
+}
+
+func (e QuotaErr) Error() string {
+	return fmt.Sprintf("%v for namespace '%v': %v %v/%v",
+		quotaErrPrefix, e.Namespace, e.Limit, e.Used, e.Max)
+}
+
+// IsQuotaErr returns true if 'err' is a QuotaErr, also after it has been sent
+// over RPC (where it becomes an rpc.ServerError).
+func IsQuotaErr(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), quotaErrPrefix)
+}
+
+// Rejections because of quotas, labelled by namespace and limit ("dps" or
+// "bytes" for nodes, "write_rate" or "query_rate" for API servers).
+var QuotaRejections = metrics.Default.Counter("trypo_quota_rejections_total",
+	"Requests and datapoints rejected because of namespace quotas.", "namespace", "limit")
+
+// How often the usage of a namespace is recounted, see quotaUsage.
+const quotaRecount = time.Second
+
+// quotaUsage keeps track of the datapoints and bytes of namespaces in a node,
+// for checking quotas. Counting bytes means iterating over all datapoints, so
+// usage is recounted at most once per quotaRecount, and datapoints added in
+// between are counted on top. Removals are noticed on the next recount. The
+// zero value is ready to use.
+type quotaUsage struct {
+	sync.Mutex
+	usage map[string]nsUsage
+}
+
+type nsUsage struct {
+	dps, bytes int
+	at         time.Time
+}
+
+// get returns the usage of 'namespace', recounted from 'cm' if it's stale.
+// 'cm' must be locked (i.e this is called in CManagerTable.Access).
+func (u *quotaUsage) get(namespace string, cm *CentroidManager) nsUsage {
+	u.Lock()
+	defer u.Unlock()
+	if u.usage == nil {
+		u.usage = make(map[string]nsUsage)
+	}
+	usage, ok := u.usage[namespace]
+	if !ok || time.Since(usage.at) > quotaRecount {
+		usage = nsUsage{at: time.Now()}
+		if cm != nil {
+			usage.dps, usage.bytes = cm.LenDP(), cm.LenBytes()
+		}
+		u.usage[namespace] = usage
+	}
+	return usage
+}
+
+// add counts 'dps' and 'bytes' added to 'namespace'.
+func (u *quotaUsage) add(namespace string, dps, bytes int) {
+	u.Lock()
+	defer u.Unlock()
+	if usage, ok := u.usage[namespace]; ok {
+		usage.dps += dps
+		usage.bytes += bytes
+		u.usage[namespace] = usage
+	}
+}
+
+// checkQuota returns a QuotaErr if adding 'dps' datapoints with a total of
+// 'bytes' to 'namespace' would exceed its quota in 's'. 'cm' is the locked
+// CentroidManager of the namespace, nil if it doesn't exist yet.
+func (s *KMeansServer) checkQuota(namespace string, cm *CentroidManager, dps, bytes int) error {
+	quota := s.Quotas.For(namespace)
+	if quota.MaxDPs <= 0 && quota.MaxBytes <= 0 {
+		return nil
+	}
+	usage := s.usage.get(namespace, cm)
+	var err error
+	switch {
+	case quota.MaxDPs > 0 && usage.dps+dps > quota.MaxDPs:
+		err = QuotaErr{namespace, "dps", usage.dps, quota.MaxDPs}
+	case quota.MaxBytes > 0 && usage.bytes+bytes > quota.MaxBytes:
+		err = QuotaErr{namespace, "bytes", usage.bytes, quota.MaxBytes}
+	}
+	if err != nil {
+		QuotaRejections.Inc(namespace, err.(QuotaErr).Limit)
+	}
+	return err
+}
+
+// remaining returns how many datapoints and bytes can be added to 'namespace'
+// in 's' before its quota is reached, -1 means no limit. 'cm' is like for
+// checkQuota.
+func (s *KMeansServer) remaining(namespace string, cm *CentroidManager) (dps, bytes int) {
+	quota := s.Quotas.For(namespace)
+	dps, bytes = -1, -1
+	if quota.MaxDPs <= 0 && quota.MaxBytes <= 0 {
+		return dps, bytes
+	}
+	usage := s.usage.get(namespace, cm)
+	if quota.MaxDPs > 0 {
+		if dps = quota.MaxDPs - usage.dps; dps < 0 {
+			dps = 0
+		}
+	}
+	if quota.MaxBytes > 0 {
+		if bytes = quota.MaxBytes - usage.bytes; bytes < 0 {
+			bytes = 0
+		}
+	}
+	return dps, bytes
+}
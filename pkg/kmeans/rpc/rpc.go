@@ -7,12 +7,12 @@ package rpc
 
 import (
 	"fmt"
-	"net"
-	"net/rpc"
 	"sync"
+	"time"
 	"trypo/pkg/kmeans/centroid"
 	"trypo/pkg/kmeans/centroidmanager"
 	"trypo/pkg/kmeans/common"
+	"trypo/pkg/rpcutils"
 	"trypo/pkg/searchutils"
 )
 
@@ -194,6 +194,30 @@ type KMeansServer struct {
 	// The server has functionality for creating new namespaced CentroidManager
 	// and will need a way of doing that.
 	CentroidManagerFactoryFunc CentroidManagerFactoryF
+	// Activity (inserts & queries), reported by Meta.
+	stats serverStats
+	// Limits for namespaces in this node, see Quota. Only MaxDPs and MaxBytes
+	// are used here. Must not be changed while the server is listening.
+	Quotas Quotas
+	// Usage of namespaces with quotas.
+	usage quotaUsage
+	// Expiry policies for namespaces, see TTL. Like Quotas, must not be
+	// changed while listening.
+	TTLs TTLs
+	// Datapoints reserved for transfers to other nodes, see ./migrate.go.
+	migrations migrations
+	// How long reservations (see ReserveCentroid and ReserveKNN) are held
+	// before the datapoints are put back. Zero or less means 30 seconds.
+	// Like Quotas, must not be changed while listening.
+	MigrationLease time.Duration
+	// Relative weight of this node compared to others (e.g 2 for a node with
+	// twice the memory of a node with 1), which load balancing uses to give
+	// each node a proportional share of data. Zero or less means 1.
+	Capacity float64
+	// Bytes (see CentroidManager.LenBytes, for all namespaces) that this
+	// node won't go beyond by stealing Centroids (see StealCentroid). Zero
+	// means no limit. Like Quotas, must not be changed while listening.
+	MemHighWater int
 }
 
 // NewKMeansServer sets up (but doesn't start) a new KMeansServer.
@@ -211,33 +235,16 @@ func NewKMeansServer(addr string, f CentroidManagerFactoryF) *KMeansServer {
 // StartListen is a convenience func for starting one or more instances of
 // KMeansServer -- it is not a method of that type because that would make
 // Go complain (since it is an RPC server). Will return a func that can be
-// used to stop a server.
+// used to stop a server. Metrics for the data in the server are collected
+// while it's listening, see TrackMetrics.
 func StartListen(s *KMeansServer) (stop func(), err error) {
-	handler := rpc.NewServer()
-	handler.Register(s)
-
-	ln, err := net.Listen("tcp", s.addr)
+	stopListen, err := rpcutils.Listen(s.addr, s)
 	if err != nil {
 		return nil, err
 	}
-
-	var conn net.Conn
-	stop = func() {
-		ln.Close()
-		if conn != nil {
-			conn.Close()
-		}
-	}
-
-	go func() {
-		for {
-			cxn, err := ln.Accept()
-			conn = cxn
-			if err != nil {
-				break
-			}
-			go handler.ServeConn(cxn)
-		}
-	}()
-	return stop, nil
+	untrack := TrackMetrics(s)
+	return func() {
+		untrack()
+		stopListen()
+	}, nil
 }
@@ -1,13 +1,19 @@
 package rpc
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+	"trypo/pkg/clock"
 	"trypo/pkg/kmeans/centroid"
 	"trypo/pkg/kmeans/centroidmanager"
 	"trypo/pkg/kmeans/common"
 	"trypo/pkg/mathutils"
+	"trypo/pkg/metrics"
 	"trypo/pkg/searchutils"
 )
 
@@ -184,6 +190,10 @@ func (tn *tNetwork) reset() {
 		slots := make(map[string]*CManagerSlot)
 		table := CManagerTable{slots: slots}
 		node.Table = &table
+		// Usage of old namespaces (for quotas).
+		node.usage.Lock()
+		node.usage.usage = nil
+		node.usage.Unlock()
 	}
 }
 
@@ -193,8 +203,30 @@ func (tn *tNetwork) unwrap(addr, namespace string) *CentroidManager {
 	return node.Table.slots[namespace].cManager
 }
 
+// lenDP is like unwrap(..).LenDP(), but locks the slot, for namespaces where
+// datapoints are put back concurrently (e.g when a migration lease runs out).
+func (tn *tNetwork) lenDP(addr, namespace string) int {
+	n := 0
+	tn.nodes[addr].Table.Access(namespace, func(cm *CentroidManager) {
+		n = cm.LenDP()
+	})
+	return n
+}
+
+// waitLenDP waits (up to a second) until the namespace on the node at 'addr'
+// has 'want' datapoints, returns the last count.
+func (tn *tNetwork) waitLenDP(addr, namespace string, want int) int {
+	deadline := time.Now().Add(time.Second)
+	n := tn.lenDP(addr, namespace)
+	for n != want && time.Now().Before(deadline) {
+		sleep()
+		n = tn.lenDP(addr, namespace)
+	}
+	return n
+}
+
 // One address per node in a tNetwork instance (next var).
-var addrs = []addr{"localhost:3001", "localhost:3002", "localhost:3003"}
+var addrs = []addr{"localhost:3051", "localhost:3052", "localhost:3053"}
 
 // A test network for all tests, this should be cleaned in each test,
 // so use 'defer network.reset()' or something like that. It is
@@ -684,6 +716,43 @@ func TestDistributeDataPointsInternal(t *testing.T) {
 	}
 }
 
+func TestDistributeDataPointsRejected(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+	namespace := "test"
+	addr1, addr2 := addrs[0], addrs[1]
+
+	// Node 1 has 2D dps, while node 2 only takes 3D dps.
+	cm1 := newCentroidManager(vec(1, 1))
+	cm1.AddDataPoint(dp(vec(1, 3), 0))
+	cm1.AddDataPoint(dp(vec(1, 4), 0))
+	network.nodes[addr1].Table.AddSlot(namespace, &CManagerSlot{cManager: cm1})
+	cm2 := newCentroidManager(vec(1, 1, 1))
+	cm2.AddDataPoint(dp(vec(1, 1, 1), 0))
+	network.nodes[addr2].Table.AddSlot(namespace, &CManagerSlot{cManager: cm2})
+
+	var err error
+	if KMeansClient(addr2, namespace, &err).AddDataPoint(dp(vec(1, 3), 0)) || err != nil {
+		t.Fatalf("dp with unequal dimension was acknowledged: %v", err)
+	}
+
+	// The receiver rejects each dp, so all are put back in the sender.
+	s := network.nodes[addr1]
+	args := DistribDPArgs{NameSpace: namespace, AddrOptions: []string{addr2}, N: 2}
+	err = s.distributeDataPoints(args, dpsMovedFast, func(dp DataPoint) bool {
+		return KMeansClient(addr2, namespace, nil).AddDataPoint(dp)
+	})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if n := cm1.LenDP(); n != 2 {
+		t.Fatalf("rejected dps weren't put back, sender has %v", n)
+	}
+	if n := cm2.LenDP(); n != 1 {
+		t.Fatalf("unexpected dps in receiver: %v", n)
+	}
+}
+
 func TestKNNLookup(t *testing.T) {
 	// Boilerplate.
 	defer network.reset()
@@ -939,7 +1008,624 @@ func TestStealCentroids(t *testing.T) {
 	}
 }
 
+func TestMeta(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+	namespace := "meta"
+	addr := addrs[0]
+
+	// Test setup; remote node with two centroids of size 1 and 3 (via
+	// AddDataPoint, such that inserts are counted), and one query.
+	var err error
+	client := KMeansClient(addr, namespace, &err)
+	client.AddDataPoint(dp(vec(1, 1), 0))
+	cm := network.unwrap(addr, namespace)
+	c := newCentroid(vec(9, 9))
+	cm.Centroids = append(cm.Centroids, c)
+	for i := 0; i < 3; i++ {
+		c.AddDataPoint(dp(vec(9, 9), 0))
+	}
+	client.KNNLookup(vec(1, 1), 1, false)
+
+	// Validation.
+	meta := client.Meta()
+	if err != nil {
+		t.Fatalf("client err: %v", err)
+	}
+	if meta.Centroids[namespace] != 2 || meta.DPs[namespace] != 4 {
+		t.Fatalf("unexpected lens: %+v", meta)
+	}
+	// Sizes 1 & 3, so mean is 2.
+	if meta.CentroidSizeVar[namespace] != 1 {
+		t.Fatalf("unexpected centroid size variance: %v", meta.CentroidSizeVar[namespace])
+	}
+	if sizes := meta.CentroidSizes[namespace]; len(sizes) != 2 || sizes[0] != 1 || sizes[1] != 3 {
+		t.Fatalf("unexpected centroid sizes: %v", sizes)
+	}
+	if want := vecNorm(cm.Vec()); meta.VecNorm[namespace] != want || want == 0 {
+		t.Fatalf("unexpected vec norm. want %v, got %v", want, meta.VecNorm[namespace])
+	}
+	if meta.Inserts[namespace] != 1 {
+		t.Fatalf("unexpected inserts: %v", meta.Inserts[namespace])
+	}
+	if meta.QueryLatency[namespace] <= 0 {
+		t.Fatalf("query latency wasn't recorded")
+	}
+	// 4 dps with 2d vecs.
+	if meta.Bytes[namespace] != 4*16 {
+		t.Fatalf("unexpected bytes: %v", meta.Bytes[namespace])
+	}
+	if meta.Capacity != 1 || meta.MemHighWater != 0 {
+		t.Fatalf("unexpected capacity: %v, %v", meta.Capacity, meta.MemHighWater)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+	namespace := "metrics"
+	addr1, addr2 := addrs[0], addrs[1]
+
+	// Test setup; node 1 with two centroids of size 1 and 3.
+	client := KMeansClient(addr1, namespace, nil)
+	client.AddDataPoint(dp(vec(1, 1), 0))
+	cm := network.unwrap(addr1, namespace)
+	c := newCentroid(vec(9, 9))
+	cm.Centroids = append(cm.Centroids, c)
+	for i := 0; i < 3; i++ {
+		c.AddDataPoint(dp(vec(9, 9), 0))
+	}
+	// Unreachable peer.
+	KMeansClient("localhost:3059", namespace, nil).Vec()
+
+	scrape := func() string {
+		var b strings.Builder
+		if err := metrics.Default.WriteText(&b); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return b.String()
+	}
+	out := scrape()
+	want := []string{
+		fmt.Sprintf(`trypo_datapoints{node="%v",namespace="%v"} 4`, addr1, namespace),
+		fmt.Sprintf(`trypo_centroids{node="%v",namespace="%v"} 2`, addr1, namespace),
+		fmt.Sprintf(`trypo_centroid_size_bucket{node="%v",namespace="%v",le="10"} 2`, addr1, namespace),
+		fmt.Sprintf(`trypo_rpc_calls_total{method="KMeansServer.AddDataPoint",peer="%v"}`, addr1),
+		`trypo_rpc_errors_total{method="KMeansServer.Vec",peer="localhost:3059"} 1`,
+	}
+	for _, s := range want {
+		if !strings.Contains(out, s) {
+			t.Fatalf("metrics don't contain %q:\n%v", s, out)
+		}
+	}
+
+	// Steal everything from node 1 to node 2.
+	if n, ok := KMeansClient(addr2, namespace, nil).StealCentroids(addr1, 100); n != 4 || !ok {
+		t.Fatalf("unexpected steal result: %v, %v", n, ok)
+	}
+	out = scrape()
+	want = []string{
+		fmt.Sprintf(`trypo_datapoints_moved_total{namespace="%v",op="steal"} 4`, namespace),
+		fmt.Sprintf(`trypo_datapoints{node="%v",namespace="%v"} 4`, addr2, namespace),
+	}
+	for _, s := range want {
+		if !strings.Contains(out, s) {
+			t.Fatalf("metrics don't contain %q:\n%v", s, out)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+
+	c1 := newCentroid(vec(1, 1))
+	c1.DataPoints = []DataPoint{dp(vec(1, 1), 0), dp(vec(1, 2), 0)}
+	c2 := newCentroid(vec(1, 9))
+	c2.DataPoints = []DataPoint{dp(vec(1, 9), 0)}
+	cm := newCentroidManager(vec(1, 1))
+	cm.Centroids = []*Centroid{c1, c2}
+	cm.MoveVector()
+
+	s := newKMeansServer("unused")
+	s.Table.AddSlot("a", &CManagerSlot{cManager: cm})
+	s.Table.AddSlot("b", &CManagerSlot{cManager: newCentroidManager(vec(1, 1))})
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+	if err := SaveSnapshotFile(s, path); err != nil {
+		t.Fatalf("save err: %v", err)
+	}
+
+	// Into an empty server.
+	loaded := newKMeansServer("unused")
+	n, err := LoadSnapshotFile(loaded, path)
+	if err != nil {
+		t.Fatalf("load err: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("unexpected dp amount loaded. want 3, got %v", n)
+	}
+	loaded.Table.Access("a", func(other *CentroidManager) {
+		if other.LenDP() != 3 || len(other.Centroids) != 2 {
+			t.Fatalf("unexpected namespace content: %v dps, %v centroids",
+				other.LenDP(), len(other.Centroids))
+		}
+		if !vecEq(other.Vec(), cm.Vec()) {
+			t.Fatalf("unexpected vec. want %v, got %v", cm.Vec(), other.Vec())
+		}
+	})
+
+	// Missing file is not an error.
+	if n, err := LoadSnapshotFile(loaded, path+"x"); n != 0 || err != nil {
+		t.Fatalf("unexpected result for missing file: %v, %v", n, err)
+	}
+	// Garbage is.
+	if _, err := LoadSnapshot(loaded, strings.NewReader("garbage")); err == nil {
+		t.Fatalf("expected err for garbage snapshot")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+
+	for i, addr := range addrs[:2] {
+		client := KMeansClient(addr, "a", nil)
+		client.AddDataPoint(dp(vec(1, float64(i+1)), 0))
+		KMeansClient(addr, "b", nil).AddDataPoint(dp(vec(9, 1), 0))
+	}
+
+	// One namespace.
+	var err error
+	snap := KMeansClient(addrs[0], "a", &err).Export()
+	if err != nil {
+		t.Fatalf("export err: %v", err)
+	}
+	KMeansClient(addrs[0], "nope", &err).Export()
+	if err == nil {
+		t.Fatalf("expected err for missing namespace")
+	}
+
+	// All namespaces in two nodes, merged into one snapshot.
+	var merged bytes.Buffer
+	n, err := MergeSnapshots(&merged,
+		bytes.NewReader(KMeansClient(addrs[0], "", nil).Export()),
+		bytes.NewReader(KMeansClient(addrs[1], "", nil).Export()))
+	if err != nil || n != 4 {
+		t.Fatalf("unexpected merge: %v dps, err: %v", n, err)
+	}
+
+	n = KMeansClient(addrs[2], "", &err).Import(merged.Bytes())
+	if err != nil || n != 4 {
+		t.Fatalf("unexpected import: %v dps, err: %v", n, err)
+	}
+	if a, b := network.unwrap(addrs[2], "a"), network.unwrap(addrs[2], "b"); a.LenDP() != 2 || b.LenDP() != 2 {
+		t.Fatalf("unexpected imported data: %v, %v", a.LenDP(), b.LenDP())
+	}
+	n = KMeansClient(addrs[2], "", &err).Import(snap)
+	if err != nil || n != 1 || network.unwrap(addrs[2], "a").LenDP() != 3 {
+		t.Fatalf("unexpected import of single namespace: %v dps, err: %v", n, err)
+	}
+
+	KMeansClient(addrs[2], "", &err).Import([]byte("garbage"))
+	if err == nil {
+		t.Fatalf("expected err for garbage snapshot")
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+	namespace := "test"
+
+	cm := newCentroidManager(vec(1, 1))
+	for i := 0; i < 6; i++ {
+		c := newCentroid(vec(1, float64(i)))
+		c.DataPoints = []DataPoint{dp(vec(1, float64(i)), 0), dp(vec(1, float64(i)), 0)}
+		cm.Centroids = append(cm.Centroids, c)
+	}
+	cm.MoveVector()
+	network.nodes[addrs[0]].Table.AddSlot(namespace, &CManagerSlot{cManager: cm})
+
+	moved, ok := Handoff(network.nodes[addrs[0]], addrs)
+	if !ok {
+		t.Fatalf("handoff not ok")
+	}
+	if moved != 12 || cm.LenDP() != 0 {
+		t.Fatalf("unexpected handoff: moved %v, %v remaining", moved, cm.LenDP())
+	}
+	total := 0
+	for _, addr := range addrs[1:] {
+		other := network.unwrap(addr, namespace)
+		if other.LenDP() == 0 {
+			t.Fatalf("peer %v didn't get anything", addr)
+		}
+		total += other.LenDP()
+	}
+	if total != 12 {
+		t.Fatalf("unexpected dp total among peers: %v", total)
+	}
+}
+
 // NOTE: Have this at the bottom of this file for cleanup.
+func TestQuota(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+	node := network.nodes[addrs[0]]
+	node.Quotas = Quotas{"quota": {MaxDPs: 2}, "*": {MaxBytes: 20}}
+	defer func() { node.Quotas = nil }()
+
+	var err error
+	client := KMeansClient(addrs[0], "quota", &err)
+	for i := 0; i < 2; i++ {
+		if !client.AddDataPoint(dp(vec(1, 1), 0)) || err != nil {
+			t.Fatalf("dp %v was rejected: %v", i, err)
+		}
+	}
+	if client.AddDataPoint(dp(vec(1, 1), 0)) || !IsQuotaErr(err) {
+		t.Fatalf("dp over max dps wasn't rejected: %v", err)
+	}
+	if !strings.Contains(err.Error(), "namespace 'quota': dps 2/2") {
+		t.Fatalf("unclear err: %v", err)
+	}
+
+	// Default quota; each dp is 16 bytes (a 2d vec) plus payload.
+	err = nil
+	client = KMeansClient(addrs[0], "quota-default", &err)
+	if !client.AddDataPoint(dp(vec(1, 1), 0)) || err != nil {
+		t.Fatalf("first dp was rejected: %v", err)
+	}
+	big := dp(vec(1, 1), 0)
+	big.Payload = []byte("12345")
+	if client.AddDataPoint(big) || !IsQuotaErr(err) {
+		t.Fatalf("dp over max bytes wasn't rejected: %v", err)
+	}
+	if IsQuotaErr(NamespaceErr{"x"}) || IsQuotaErr(nil) {
+		t.Fatalf("unexpected quota err")
+	}
+
+	// Dps that aren't added (unequal dimension) don't count.
+	node.Quotas["quota-rejected"] = Quota{MaxDPs: 2}
+	err = nil
+	client = KMeansClient(addrs[0], "quota-rejected", &err)
+	for i, v := range [][]float64{vec(1, 1), vec(1, 1, 1), vec(1, 2)} {
+		if ok := client.AddDataPoint(dp(v, 0)); ok != (i != 1) || err != nil {
+			t.Fatalf("unexpected resp for dp %v: %v, %v", i, ok, err)
+		}
+	}
+
+	// Quantized vectors are counted as stored, 2 bytes for a 2d int8 vec.
+	factory := node.CentroidManagerFactoryFunc
+	defer func() { node.CentroidManagerFactoryFunc = factory }()
+	node.CentroidManagerFactoryFunc = func(v []float64) *CentroidManager {
+		cm, _ := centroidmanager.NewCentroidManager(centroidmanager.NewCentroidManagerArgs{
+			InitVec:             v,
+			CentroidDPThreshold: 10,
+			KNNSearchFunc:       _knnSearchFunc,
+			KFNSearchFunc:       _kfnSearchFunc,
+			Quantization:        mathutils.QuantConfig{Kind: mathutils.QuantInt8},
+		})
+		return &cm
+	}
+	node.Quotas["quota-int8"] = Quota{MaxBytes: 4}
+	err = nil
+	client = KMeansClient(addrs[0], "quota-int8", &err)
+	for i := 0; i < 2; i++ {
+		if !client.AddDataPoint(dp(vec(1, float64(i)), 0)) || err != nil {
+			t.Fatalf("quantized dp %v was rejected: %v", i, err)
+		}
+	}
+	if client.AddDataPoint(dp(vec(1, 1), 0)) || !IsQuotaErr(err) {
+		t.Fatalf("quantized dp over max bytes wasn't rejected: %v", err)
+	}
+	if n := network.unwrap(addrs[0], "quota-int8").LenBytes(); n != 4 {
+		t.Fatalf("unexpected bytes: %v", n)
+	}
+}
+
+func TestStealCentroidsQuota(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+	namespace := "steal-quota"
+	thief := network.nodes[addrs[0]]
+	thief.Quotas = Quotas{namespace: {MaxDPs: 2}}
+	defer func() { thief.Quotas = nil }()
+
+	c := newCentroid(vec(1, 1))
+	for i := 0; i < 3; i++ {
+		c.DataPoints = append(c.DataPoints, dp(vec(1, 1), 0))
+	}
+	victim := newCentroidManager(vec(1, 1))
+	victim.Centroids = []*Centroid{c}
+	network.nodes[addrs[1]].Table.AddSlot(namespace, &CManagerSlot{cManager: victim})
+
+	var err error
+	n, ok := KMeansClient(addrs[0], namespace, &err).StealCentroids(addrs[1], 10)
+	if err != nil || !ok || n != 2 {
+		t.Fatalf("unexpected transfer: n=%v ok=%v err=%v", n, ok, err)
+	}
+	// The datapoint that didn't fit was given back.
+	if got := network.unwrap(addrs[0], namespace).LenDP(); got != 2 {
+		t.Fatalf("unexpected dps in thief: %v", got)
+	}
+	if got := network.unwrap(addrs[1], namespace).LenDP(); got != 1 {
+		t.Fatalf("unexpected dps in victim: %v", got)
+	}
+
+	// Full, so nothing more is taken.
+	n, ok = KMeansClient(addrs[0], namespace, &err).StealCentroids(addrs[1], 10)
+	if n != 0 || !ok {
+		t.Fatalf("full node stole dps: n=%v ok=%v", n, ok)
+	}
+}
+
+func TestStealCentroidsHighWater(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+	namespace := "steal-mem"
+	thief := network.nodes[addrs[0]]
+	// Room for 3 dps with 2d vecs, including one in another namespace.
+	thief.MemHighWater = 4 * 16
+	defer func() { thief.MemHighWater = 0 }()
+	thief.Table.AddSlot("other", &CManagerSlot{cManager: newCentroidManager(vec(1, 1))})
+	network.unwrap(addrs[0], "other").AddDataPoint(dp(vec(1, 1), 0))
+
+	victim := newCentroidManager(vec(1, 1))
+	for i := 0; i < 2; i++ {
+		c := newCentroid(vec(1, 1))
+		for j := 0; j < 2; j++ {
+			c.DataPoints = append(c.DataPoints, dp(vec(1, 1), 0))
+		}
+		victim.Centroids = append(victim.Centroids, c)
+	}
+	network.nodes[addrs[1]].Table.AddSlot(namespace, &CManagerSlot{cManager: victim})
+
+	var err error
+	n, ok := KMeansClient(addrs[0], namespace, &err).StealCentroids(addrs[1], 10)
+	if err != nil || !ok || n != 3 {
+		t.Fatalf("unexpected transfer: n=%v ok=%v err=%v", n, ok, err)
+	}
+	if got := network.unwrap(addrs[1], namespace).LenDP(); got != 1 {
+		t.Fatalf("unexpected dps in victim: %v", got)
+	}
+	if got := thief.lenBytes(); got != thief.MemHighWater {
+		t.Fatalf("unexpected bytes in thief: %v", got)
+	}
+}
+
+func TestStealCentroidsSplit(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+	namespace := "steal-split"
+
+	c := newCentroid(vec(1, 1))
+	for i := 0; i < 5; i++ {
+		c.DataPoints = append(c.DataPoints, dp(vec(1, 1), 0))
+	}
+	victim := newCentroidManager(vec(1, 1))
+	victim.Centroids = []*Centroid{c}
+	network.nodes[addrs[1]].Table.AddSlot(namespace, &CManagerSlot{cManager: victim})
+
+	// The limit isn't overshot, the centroid is split instead.
+	var err error
+	n, ok := KMeansClient(addrs[0], namespace, &err).StealCentroids(addrs[1], 2)
+	if err != nil || !ok || n != 2 {
+		t.Fatalf("unexpected transfer: n=%v ok=%v err=%v", n, ok, err)
+	}
+	if got := network.unwrap(addrs[1], namespace).LenDP(); got != 3 {
+		t.Fatalf("unexpected dps in victim: %v", got)
+	}
+	if got := network.unwrap(addrs[0], namespace).LenDP(); got != 2 {
+		t.Fatalf("unexpected dps in thief: %v", got)
+	}
+}
+
+func TestPushCentroids(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+	namespace := "push"
+
+	var err error
+	client := KMeansClient(addrs[0], namespace, &err)
+	for i := 0; i < 3; i++ {
+		client.AddDataPoint(dp(vec(1, 1), 0))
+	}
+	n, ok := client.PushCentroids(addrs[1], 2)
+	if err != nil || !ok || n != 2 {
+		t.Fatalf("unexpected transfer: n=%v ok=%v err=%v", n, ok, err)
+	}
+	if got := network.unwrap(addrs[1], namespace).LenDP(); got != 2 {
+		t.Fatalf("unexpected dps in receiver: %v", got)
+	}
+	if got := network.unwrap(addrs[0], namespace).LenDP(); got != 1 {
+		t.Fatalf("unexpected dps in pusher: %v", got)
+	}
+}
+
+func TestMigration(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+	namespace := "migration"
+	lease := time.Millisecond * 50
+	network.nodes[addrs[0]].MigrationLease = lease
+	defer func() { network.nodes[addrs[0]].MigrationLease = 0 }()
+
+	var err error
+	client := KMeansClient(addrs[0], namespace, &err)
+	for i := 0; i < 3; i++ {
+		client.AddDataPoint(dp(vec(1, 1), 0))
+	}
+	lenDP := func() int { return network.lenDP(addrs[0], namespace) }
+
+	// Reserved dps are taken out until they're released.
+	id, n := client.ReserveCentroid(vec(1, 1), 2, 0)
+	if err != nil || n != 2 || lenDP() != 1 {
+		t.Fatalf("unexpected reservation: n=%v, left=%v, err=%v", n, lenDP(), err)
+	}
+	if dps := client.CopyCentroid(id); len(dps) != 2 {
+		t.Fatalf("unexpected copy: %v", dps)
+	}
+	client.ReleaseCentroid(id)
+	if err != nil || lenDP() != 3 {
+		t.Fatalf("release didn't put dps back: %v, %v", lenDP(), err)
+	}
+	if client.DeleteCentroid(id); err == nil {
+		t.Fatalf("deleted a released reservation")
+	}
+
+	// Bytes limit; each dp is 16 bytes.
+	err = nil
+	if _, n := client.ReserveCentroid(vec(1, 1), 0, 10); n != 0 {
+		t.Fatalf("reserved beyond the bytes limit: %v", n)
+	}
+	if _, n := client.ReserveCentroid(vec(1, 1), 0, 20); n != 1 {
+		t.Fatalf("bytes limit wasn't respected: %v", n)
+	}
+	// Not deleted, so put back when the lease runs out.
+	if n := network.waitLenDP(addrs[0], namespace, 3); n != 3 {
+		t.Fatalf("expired reservation wasn't put back: %v", n)
+	}
+
+	id, _ = client.ReserveCentroid(vec(1, 1), 1, 0)
+	client.DeleteCentroid(id)
+	if err != nil || lenDP() != 2 {
+		t.Fatalf("unexpected dps after delete: %v, %v", lenDP(), err)
+	}
+	if client.CopyCentroid(id); err == nil || !strings.Contains(err.Error(), "no reserved centroid") {
+		t.Fatalf("unexpected err for a deleted reservation: %v", err)
+	}
+
+	// Leases run out on the process-wide clock.
+	defer clock.SetDefault(nil)
+	v := clock.NewVirtual(time.Now())
+	clock.SetDefault(v)
+	err = nil
+	client.ReserveCentroid(vec(1, 1), 1, 0)
+	time.Sleep(lease * 3)
+	if err != nil || lenDP() != 1 {
+		t.Fatalf("lease ran out in real time: %v, %v", lenDP(), err)
+	}
+	v.Advance(lease)
+	if n := network.waitLenDP(addrs[0], namespace, 2); n != 2 {
+		t.Fatalf("lease didn't run out in virtual time: %v", n)
+	}
+}
+
+func TestReserveKNN(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+	namespace := "reserveknn"
+	node := network.nodes[addrs[0]]
+	lease := time.Millisecond * 50
+	node.MigrationLease = lease
+	defer func() { node.MigrationLease = 0 }()
+
+	var err error
+	client := KMeansClient(addrs[0], namespace, &err)
+	for i := 0; i < 3; i++ {
+		client.AddDataPoint(dp(vec(1, float64(i)), 0))
+	}
+	lenDP := func() int { return network.lenDP(addrs[0], namespace) }
+
+	// As if the response was lost; put back when the lease runs out.
+	var r ReserveKNNResp
+	args := KNNLookupArgs{NameSpace: namespace, Vec: vec(1, 0), K: 2}
+	if err := node.ReserveKNN(args, &r); err != nil || len(r.DPs) != 2 || lenDP() != 1 {
+		t.Fatalf("unexpected reservation: %v, left=%v, err=%v", r.DPs, lenDP(), err)
+	}
+	// Reserved dps are kept in snapshots.
+	var b bytes.Buffer
+	if err := SaveSnapshot(node, &b); err != nil {
+		t.Fatal(err)
+	}
+	if snap, _ := readSnapshot(&b); len(snap.Namespaces[namespace]) != 2 {
+		t.Fatalf("unexpected snapshot: %v", snap.Namespaces[namespace])
+	}
+	if n := network.waitLenDP(addrs[0], namespace, 3); n != 3 {
+		t.Fatalf("expired reservation wasn't put back: %v", n)
+	}
+
+	// Acknowledged by the client.
+	if dps := client.KNNLookup(vec(1, 0), 2, true); err != nil || len(dps) != 2 {
+		t.Fatalf("unexpected drain: %v, %v", dps, err)
+	}
+	time.Sleep(lease * 3)
+	if lenDP() != 1 {
+		t.Fatalf("acknowledged dps were put back: %v", lenDP())
+	}
+}
+
+func TestTTL(t *testing.T) {
+	// Boilerplate.
+	defer network.reset()
+	defer clock.SetDefault(nil)
+	start := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	v := clock.NewVirtual(start)
+	clock.SetDefault(v)
+	node := network.nodes[addrs[0]]
+	node.TTLs = TTLs{"ttl": {Default: time.Hour}, "refresh": {Default: time.Hour, RefreshOnRead: true}}
+	defer func() { node.TTLs = nil }()
+	expires := func(namespace string) []time.Time {
+		var res []time.Time
+		for _, c := range network.unwrap(addrs[0], namespace).Centroids {
+			for _, dp := range c.DataPoints {
+				res = append(res, dp.Expires)
+			}
+		}
+		return res
+	}
+
+	// Default TTL, unless the dp has its own expiry.
+	var err error
+	client := KMeansClient(addrs[0], "ttl", &err)
+	client.AddDataPoint(dp(vec(1, 0), 0))
+	own := common.DataPoint{Vec: vec(0, 1), Expires: start.Add(time.Minute * 45), ExpireEnabled: true}
+	client.AddDataPoint(own)
+	if got := expires("ttl"); len(got) != 2 || !got[0].Equal(start.Add(time.Hour)) ||
+		!got[1].Equal(own.Expires) {
+		t.Fatalf("unexpected expiry: %v", got)
+	}
+
+	// Touch pushes expiry forward, reads don't without RefreshOnRead.
+	v.Advance(time.Minute * 30)
+	client.KNNLookup(vec(1, 0), 1, false)
+	if n := client.Touch(vec(1, 0), 1, time.Hour*2); n != 1 || err != nil {
+		t.Fatalf("unexpected touch: %v, %v", n, err)
+	}
+	if got := expires("ttl"); !got[0].Equal(start.Add(time.Minute * 150)) {
+		t.Fatalf("expiry wasn't pushed forward: %v", got)
+	}
+	// Default TTL of the namespace, none for others.
+	if n := client.Touch(vec(0, 1), 1, 0); n != 1 || !expires("ttl")[1].Equal(start.Add(time.Minute*90)) {
+		t.Fatalf("unexpected touch with the default TTL: %v, %v", n, expires("ttl"))
+	}
+	KMeansClient(addrs[0], "none", nil).AddDataPoint(dp(vec(1, 0), 0))
+	if n := KMeansClient(addrs[0], "none", nil).Touch(vec(1, 0), 1, 0); n != 0 {
+		t.Fatalf("touched without a TTL: %v", n)
+	}
+
+	// Refresh on read.
+	client = KMeansClient(addrs[0], "refresh", &err)
+	client.AddDataPoint(dp(vec(1, 0), 0))
+	v.Advance(time.Minute * 30)
+	if dps := client.KNNLookup(vec(1, 0), 1, false); len(dps) != 1 ||
+		!dps[0].Expires.Equal(start.Add(time.Hour*2)) {
+		t.Fatalf("read didn't refresh: %v", dps)
+	}
+	v.Advance(time.Minute * 45)
+	client.Expire()
+	if n := client.LenDP(); n != 1 {
+		t.Fatalf("refreshed dp expired")
+	}
+
+	// JSON form.
+	var ttl TTL
+	if err := json.Unmarshal([]byte(`{"default": "24h", "refresh_on_read": true}`), &ttl); err != nil ||
+		ttl != (TTL{Default: time.Hour * 24, RefreshOnRead: true}) {
+		t.Fatalf("unexpected ttl from json: %+v, %v", ttl, err)
+	}
+}
+
 func TestCleanup(t *testing.T) {
 	network.stop()
 }
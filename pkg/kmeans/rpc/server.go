@@ -7,6 +7,11 @@ Server for RPC layer on top of pkg/kmeans/centroidmanager.
 package rpc
 
 import (
+	"bytes"
+	"math"
+	"sort"
+	"time"
+	"trypo/pkg/clock"
 	"trypo/pkg/searchutils"
 )
 
@@ -48,22 +53,44 @@ type AddDataPointArgs struct {
 
 // Forward call to the method with the same name on an instance of CentroidManager
 // (pkg kmeans/CentroidManager). Will createa a new CentroidManager instance if
-// the namespace is not currently in use.
+// the namespace is not currently in use. Responds with false if the dp wasn't
+// added (see CentroidManager.AddDataPoint), which callers that move dps rely
+// on to keep them. Returns a QuotaErr (and false) if the dp would make the
+// namespace exceed its quota (see KMeansServer.Quotas).
 func (s *KMeansServer) AddDataPoint(args AddDataPointArgs, resp *bool) error {
+	args.DP = s.withDefaultTTL(args.NameSpace, args.DP)
+	size := 0
+	var quotaErr error
 	lookupOK := s.Table.Access(args.NameSpace, func(cm *CentroidManager) {
-		*resp = cm.AddDataPoint(args.DP)
+		size = cm.DPBytes(args.DP)
+		if quotaErr = s.checkQuota(args.NameSpace, cm, 1, size); quotaErr == nil {
+			*resp = cm.AddDataPoint(args.DP)
+		}
 	})
+	if quotaErr != nil {
+		*resp = false
+		return quotaErr
+	}
 	// Namespace doesn't exist, create one + add dp there.
 	if !lookupOK {
 		centroidManager := s.CentroidManagerFactoryFunc(args.DP.Vec)
-		centroidManager.AddDataPoint(args.DP)
-		slot := CManagerSlot{cManager: centroidManager}
-		// Returns a false if a slot is the containec CentroidManager is
-		// nil, but it is assumed that it works here.
-		s.Table.AddSlot(args.NameSpace, &slot)
+		size = centroidManager.DPBytes(args.DP)
+		if err := s.checkQuota(args.NameSpace, nil, 1, size); err != nil {
+			*resp = false
+			return err
+		}
+		if *resp = centroidManager.AddDataPoint(args.DP); *resp {
+			slot := CManagerSlot{cManager: centroidManager}
+			// Returns a false if a slot is the containec CentroidManager is
+			// nil, but it is assumed that it works here.
+			s.Table.AddSlot(args.NameSpace, &slot)
+		}
 	}
-
-	*resp = true
+	if !*resp {
+		return nil
+	}
+	s.stats.addInsert(args.NameSpace)
+	s.usage.add(args.NameSpace, 1, size)
 	return nil
 }
 
@@ -146,45 +173,59 @@ func distributeDP(dp DataPoint, gen vecGenerator, addrs []string, namespace stri
 	return false
 }
 
+// distributeDataPoints drains args.N datapoints from this node (see stageDrain)
+// and gives each to 'send', which returns true if the dp was added to another
+// node. Those that weren't are put back, so no dp is lost if a remote node
+// fails. Moved dps are counted in dpsMoved with 'kind'.
+func (s *KMeansServer) distributeDataPoints(args DistribDPArgs, kind string, send func(DataPoint) bool) error {
+	// Nowhere to send dps, so nothing is drained.
+	if len(args.AddrOptions) == 0 {
+		return s.handleNamespaceErr(args.NameSpace, func(*CentroidManager) {})
+	}
+
+	id, dps, err := s.stageDrain(args.NameSpace, args.N)
+	if err != nil || len(dps) == 0 {
+		return err
+	}
+	defer s.migrations.take(id)
+
+	for _, dp := range dps {
+		if send(dp) {
+			dpsMoved.Inc(args.NameSpace, kind)
+		} else {
+			// Put back into self so the dp isn't lost.
+			s.putBack(args.NameSpace, []DataPoint{dp}, false)
+		}
+		s.migrations.ack(id, 1)
+	}
+	return nil
+}
+
 // DistributeDataPointsFast will try to distribute args.N datapoints in haste
 // (with some accuracy) from this node amongst 'best-fit' remote nodes listed
 // in args.AddrOptions (all within the same args.NameSpace). Specifically, this
 // node's CentroidManager with the given namespace will have its DrainOrdered
 // method called, then those dps will be sent to remote nodes that are most
 // similar to those dps (similarity is caluclated by remote CentroidManager.Vec()).
+// Drained dps are kept as a reservation until they are added elsewhere (see
+// ./migrate.go), and put back if that fails.
 func (s *KMeansServer) DistributeDataPointsFast(args DistribDPArgs, _ *int) error {
-	dps := make([]DataPoint, 0, args.N)
-
-	// Not wrapping the code below with this because it locks the CentroidManager.
-	nsErr := s.handleNamespaceErr(args.NameSpace, func(cm *CentroidManager) {
-		dps = append(dps, cm.DrainOrdered(args.N)...)
-	})
-
-	if nsErr != nil || len(dps) == 0 || len(args.AddrOptions) == 0 {
-		return nsErr
-	}
-
 	// Fetch remote vecs. Done outside of the dp loop (below) because these
 	// vecs are not assumed to change by a lot (they might, if those nodes
 	// have few dps, but the tradeoff is made nontheless).
-	rch := fetchVecs(args.AddrOptions, func(addr string) ([]float64, bool) {
-		var err error
-		vec := KMeansClient(addr, args.NameSpace, &err).Vec()
-		return vec, err == nil && vec != nil
-	})
-	rsl := rch.collect() // collect the chan.
-
-	addrs := rsl.intoAddrs()
-	for _, dp := range dps {
-		gen := rsl.intoVecGenerator()
-		if !distributeDP(dp, gen, addrs, args.NameSpace) {
-			// Put back into self so the dp isn't lost.
-			s.Table.Access(args.NameSpace, func(cm *CentroidManager) {
-				cm.AddDataPoint(dp)
+	var rsl *fetchVecsResSlice
+
+	return s.distributeDataPoints(args, dpsMovedFast, func(dp DataPoint) bool {
+		if rsl == nil {
+			rch := fetchVecs(args.AddrOptions, func(addr string) ([]float64, bool) {
+				var err error
+				vec := KMeansClient(addr, args.NameSpace, &err).Vec()
+				return vec, err == nil && vec != nil
 			})
+			rsl = rch.collect() // collect the chan.
 		}
-	}
-	return nil
+		return distributeDP(dp, rsl.intoVecGenerator(), rsl.intoAddrs(), args.NameSpace)
+	})
 }
 
 // DistributeDataPointsAccurate is similar to DistributeDataPointsFast but is
@@ -195,19 +236,8 @@ func (s *KMeansServer) DistributeDataPointsFast(args DistribDPArgs, _ *int) erro
 // This is _a_lot_ slower due to many network calls, but has the benefit of
 // placing distribute dps precisely.
 func (s *KMeansServer) DistributeDataPointsAccurate(args DistribDPArgs, _ *int) error {
-	dps := make([]DataPoint, 0, args.N)
-
-	// Not wrapping the code below with this because it locks the CentroidManager.
-	nsErr := s.handleNamespaceErr(args.NameSpace, func(cm *CentroidManager) {
-		dps = append(dps, cm.DrainOrdered(args.N)...)
-	})
-
-	if nsErr != nil || len(dps) == 0 || len(args.AddrOptions) == 0 {
-		return nsErr
-	}
-
-	for _, dp := range dps {
-		// Fetch remote vecs. Done inside the loop, even though the dps might
+	return s.distributeDataPoints(args, dpsMovedAccurate, func(dp DataPoint) bool {
+		// Fetch remote vecs. Done for each dp, even though the dps might
 		// not vary much with their vecs, because this method trades speed for
 		// accuracy.
 		rch := fetchVecs(args.AddrOptions, func(addr string) ([]float64, bool) {
@@ -216,17 +246,8 @@ func (s *KMeansServer) DistributeDataPointsAccurate(args DistribDPArgs, _ *int)
 			return vec, err == nil && vec != nil
 		})
 		rsl := rch.collect() // collect the chan.
-		gen := rsl.intoVecGenerator()
-
-		addrs := rsl.intoAddrs()
-		if !distributeDP(dp, gen, addrs, args.NameSpace) {
-			// Put back into self so the dp isn't lost.
-			s.Table.Access(args.NameSpace, func(cm *CentroidManager) {
-				cm.AddDataPoint(dp)
-			})
-		}
-	}
-	return nil
+		return distributeDP(dp, rsl.intoVecGenerator(), rsl.intoAddrs(), args.NameSpace)
+	})
 }
 
 type DistribDPIArgs struct {
@@ -252,10 +273,20 @@ type KNNLookupArgs struct {
 
 // Forward call to the method with the same name on an instance of CentroidManager
 // (pkg kmeans/CentroidManager). Returns a NamespaceErr if the namespace doesn't
-// lead to an instance.
+// lead to an instance. Note, drained dps are lost if the response doesn't reach
+// the caller, see ReserveKNN (used by kmeansClient.KNNLookup) for a safe drain.
+// Without drain, the found dps are touched if the TTL of the namespace has
+// RefreshOnRead (see TTL).
 func (s *KMeansServer) KNNLookup(args KNNLookupArgs, resp *[]DataPoint) error {
+	ttl := s.TTLs.For(args.NameSpace)
 	return s.handleNamespaceErr(args.NameSpace, func(cm *CentroidManager) {
-		*resp = cm.KNNLookup(args.Vec, args.K, args.Drain)
+		start := time.Now()
+		if !args.Drain && ttl.RefreshOnRead && ttl.Default > 0 {
+			*resp = cm.Touch(args.Vec, args.K, clock.Now().Add(ttl.Default))
+		} else {
+			*resp = cm.KNNLookup(args.Vec, args.K, args.Drain)
+		}
+		s.stats.addQuery(args.NameSpace, time.Since(start))
 	})
 }
 
@@ -268,10 +299,19 @@ type NearestCentroidArgs struct {
 
 // Forward call to the method with the same name on an instance of CentroidManager
 // (pkg kmeans/CentroidManager). Returns a NamespaceErr if the namespace doesn't
-// lead to an instance.
+// lead to an instance. Note, drained Centroids are lost if the response doesn't
+// reach the caller, see ReserveCentroid (used by kmeansClient.NearestCentroids)
+// for a safe drain.
 func (s *KMeansServer) NearestCentroids(args NearestCentroidArgs, r *[]*Centroid) error {
 	return s.handleNamespaceErr(args.NameSpace, func(cm *CentroidManager) {
-		*r, _ = cm.NearestCentroids(args.Vec, args.N, args.Drain)
+		centroids, _ := cm.NearestCentroids(args.Vec, args.N, args.Drain)
+		// Only DataPoints are sent (unexported fields are lost in transfer),
+		// so they are exported such that quantized vectors are decoded.
+		res := make([]*Centroid, len(centroids))
+		for i, c := range centroids {
+			res[i] = &Centroid{DataPoints: c.ExportDataPoints()}
+		}
+		*r = res
 	})
 }
 
@@ -329,7 +369,7 @@ func (s *KMeansServer) MergeCentroids(args SplitCentroidsArgs, _ *int) error {
 type StealCentroidArgs struct {
 	FromAddr  string
 	NameSpace string
-	// Will steal Centroids until the total DP amount exceeds this.
+	// Will steal Centroids until this many DPs are transferred.
 	TransferDPLimit int
 }
 
@@ -339,17 +379,19 @@ type StealCentroidsResp struct {
 }
 
 // StealCentroids will 'steal' one or more Centroid from a remote node, intended for
-// load balancing. It will keep 'stealing' _whole_ Centroids until the total amount
-// of datapoints exceeds args.TransferDPLimit (this value might therefore be greatly
-// overshot), using KMeansClient().NearestCentroids(vec), where vec is the vector
-// of CentroidManager for this node and namespace. The response 'r' will have
-// different implied meanings:
+// load balancing. It will keep 'stealing' the Centroids nearest the vector of the
+// CentroidManager for this node and namespace until args.TransferDPLimit datapoints
+// are transferred, splitting them if needed such that the limit isn't exceeded.
+// Each Centroid is moved in steps that don't lose data on network errors (see
+// ./migrate.go). The response 'r' will have different implied meanings:
 //	- TransferredN = 0 & OK = false : remote node err (namespace or network issue).
 //	- TransferredN > 0 & OK = false : Some Centroids transferred before network err.
 //	- TransferredN = 0 & OK = true : No network err but remote is empty.
 //	- TransferredN > 0 & OK = true : all ok.
 // Note, cannot return a NamespaceErr, as a new namespace will be created if node
-// A does not have that namespace.
+// A does not have that namespace. Stealing also stops at the quota of this node
+// for the namespace (see KMeansServer.Quotas) and at its memory high-water mark
+// (see KMeansServer.MemHighWater).
 func (s *KMeansServer) StealCentroid(args StealCentroidArgs, r *StealCentroidsResp) error {
 	// Not wrapping the code below with this because it locks the CentroidManager
 	// just for this one thing (getting a vec).
@@ -373,36 +415,87 @@ func (s *KMeansServer) StealCentroid(args StealCentroidArgs, r *StealCentroidsRe
 		s.Table.AddSlot(args.NameSpace, &CManagerSlot{cManager: cm})
 	}
 
-	for r.TransferredN < args.TransferDPLimit && clientErr == nil {
-		// Can be improved. One at a time for convenience + readability.
-		centroids, cOK := client.NearestCentroids(localVec, 1, true)
-
-		if !cOK || len(centroids) == 0 {
-			break
+	memLeft := -1
+	if s.MemHighWater > 0 {
+		if memLeft = s.MemHighWater - s.lenBytes(); memLeft < 0 {
+			memLeft = 0
 		}
+	}
 
+	for r.TransferredN < args.TransferDPLimit && clientErr == nil {
+		// Nothing is taken if this node is at its quota for the namespace,
+		// or at its memory high-water mark.
+		var dpsLeft, bytesLeft int
 		s.Table.Access(args.NameSpace, func(cm *CentroidManager) {
-			// @ unsafe, this is assuming cm has similar properties as centroids
-			// @ (such as KNNSearchfunc, etc).
-			cm.Centroids = append(cm.Centroids, centroids...)
-			r.TransferredN += centroids[0].LenDP()
+			dpsLeft, bytesLeft = s.remaining(args.NameSpace, cm)
 		})
-	}
+		if limitLeft := args.TransferDPLimit - r.TransferredN; dpsLeft < 0 || limitLeft < dpsLeft {
+			dpsLeft = limitLeft
+		}
+		if bytesLeft < 0 || (memLeft >= 0 && memLeft < bytesLeft) {
+			bytesLeft = memLeft
+		}
+		if dpsLeft == 0 || bytesLeft == 0 {
+			break
+		}
 
-	s.Table.Access(args.NameSpace, func(cm *CentroidManager) {
-		cm.MoveVector()
-	})
+		// One at a time for convenience + readability.
+		n, bytes := s.pullCentroid(client, localVec, dpsLeft, bytesLeft)
+		if n == 0 {
+			break
+		}
+		r.TransferredN += n
+		if memLeft >= 0 {
+			if memLeft -= bytes; memLeft < 0 {
+				memLeft = 0
+			}
+		}
+	}
 
+	dpsMoved.Add(float64(r.TransferredN), args.NameSpace, dpsMovedSteal)
 	r.OK = clientErr == nil
 	return nil
 }
 
-// MetaResp is metadata for a node. Contains two fiels, both are maps where keys
-// are namespaces. Vals for 'Centroids' is the total amount of Centroids for the
-// namespace. Likewise, DPs is the total amount of datapoints for a namespace.
+type PushCentroidsArgs struct {
+	ToAddr    string
+	NameSpace string
+	// Will push Centroids until this many DPs are transferred.
+	TransferDPLimit int
+}
+
+// PushCentroids moves Centroids from this node to the node at args.ToAddr, by
+// asking that node to steal them (see StealCentroid), so the response has the
+// same meaning. Intended for load balancing from nodes that are overloaded.
+func (s *KMeansServer) PushCentroids(args PushCentroidsArgs, r *StealCentroidsResp) error {
+	var err error
+	n, ok := KMeansClient(args.ToAddr, args.NameSpace, &err).StealCentroids(s.addr, args.TransferDPLimit)
+	r.TransferredN, r.OK = n, ok && err == nil
+	return nil
+}
+
+// MetaResp is metadata for a node. Fields which are maps have namespaces as
+// keys. Vals for 'Centroids' is the total amount of Centroids for the
+// namespace. Likewise, DPs is the total amount of datapoints for a namespace,
+// and Bytes is the memory they use (see CentroidManager.LenBytes).
+// CentroidSizeVar is the variance of the amount of datapoints in Centroids,
+// and CentroidSizes are those amounts (in increasing order). VecNorm is the
+// (euclidean) norm of the vector of the CentroidManager (see Vec). Inserts
+// is the amount of datapoints added (with AddDataPoint) since the server
+// started, and QueryLatency is a moving average of the time spent in
+// KNNLookup (it doesn't include network time). Capacity and MemHighWater are
+// the same as in KMeansServer (with Capacity defaulted to 1).
 type MetaResp struct {
-	Centroids map[string]int
-	DPs       map[string]int
+	Centroids       map[string]int
+	DPs             map[string]int
+	Bytes           map[string]int
+	CentroidSizeVar map[string]float64
+	CentroidSizes   map[string][]int
+	VecNorm         map[string]float64
+	Inserts         map[string]int
+	QueryLatency    map[string]time.Duration
+	Capacity        float64
+	MemHighWater    int
 }
 
 // Meta returns metadata for a node.
@@ -416,16 +509,118 @@ func (s *KMeansServer) Meta(_ int, resp *MetaResp) error {
 
 	centroids := make(map[string]int, len(namespaces))
 	dps := make(map[string]int, len(namespaces))
+	bytes := make(map[string]int, len(namespaces))
+	sizeVar := make(map[string]float64, len(namespaces))
+	sizes := make(map[string][]int, len(namespaces))
+	norms := make(map[string]float64, len(namespaces))
 
 	for _, ns := range namespaces {
 		s.Table.Access(ns, func(cm *CentroidManager) {
 			centroids[ns] = len(cm.Centroids)
 			dps[ns] = cm.LenDP()
+			bytes[ns] = cm.LenBytes()
+			sizeVar[ns] = centroidSizeVar(cm)
+			nsSizes := make([]int, len(cm.Centroids))
+			for i, c := range cm.Centroids {
+				nsSizes[i] = c.LenDP()
+			}
+			sort.Ints(nsSizes)
+			sizes[ns] = nsSizes
+			norms[ns] = vecNorm(cm.Vec())
 		})
 	}
 
 	(*resp).Centroids = centroids
 	(*resp).DPs = dps
+	(*resp).Bytes = bytes
+	(*resp).CentroidSizeVar = sizeVar
+	(*resp).CentroidSizes = sizes
+	(*resp).VecNorm = norms
+	(*resp).Inserts, (*resp).QueryLatency = s.stats.copy()
+	(*resp).Capacity = s.capacity()
+	(*resp).MemHighWater = s.MemHighWater
 
 	return nil
 }
+
+// capacity returns s.Capacity, or 1 if it isn't set.
+func (s *KMeansServer) capacity() float64 {
+	if s.Capacity <= 0 {
+		return 1
+	}
+	return s.Capacity
+}
+
+// lenBytes returns the bytes used by all namespaces in this node, see
+// CentroidManager.LenBytes.
+func (s *KMeansServer) lenBytes() int {
+	s.Table.Lock()
+	namespaces := make([]string, 0, len(s.Table.slots))
+	for key := range s.Table.slots {
+		namespaces = append(namespaces, key)
+	}
+	s.Table.Unlock()
+
+	n := 0
+	for _, ns := range namespaces {
+		s.Table.Access(ns, func(cm *CentroidManager) {
+			n += cm.LenBytes()
+		})
+	}
+	return n
+}
+
+// centroidSizeVar returns the (population) variance of the amount of
+// datapoints in the Centroids of cm.
+func centroidSizeVar(cm *CentroidManager) float64 {
+	if len(cm.Centroids) == 0 {
+		return 0
+	}
+	n := float64(len(cm.Centroids))
+	mean := 0.
+	for _, c := range cm.Centroids {
+		mean += float64(c.LenDP())
+	}
+	mean /= n
+
+	res := 0.
+	for _, c := range cm.Centroids {
+		res += math.Pow(float64(c.LenDP())-mean, 2)
+	}
+	return res / n
+}
+
+// vecNorm returns the euclidean norm of 'vec'.
+func vecNorm(vec []float64) float64 {
+	res := 0.
+	for _, v := range vec {
+		res += v * v
+	}
+	return math.Sqrt(res)
+}
+
+// Export sends a snapshot (see SaveSnapshot) of the data in the server, for
+// one namespace or all of them if 'namespace' is empty.
+func (s *KMeansServer) Export(namespace string, resp *[]byte) error {
+	namespaces := s.Table.Namespaces()
+	if namespace != "" {
+		if !s.Table.Access(namespace, func(*CentroidManager) {}) {
+			return NamespaceErr{namespace}
+		}
+		namespaces = []string{namespace}
+	}
+	var b bytes.Buffer
+	if err := saveSnapshot(s, &b, namespaces); err != nil {
+		return err
+	}
+	*resp = b.Bytes()
+	return nil
+}
+
+// Import adds the data in a snapshot (see LoadSnapshot) to the server, and
+// sends the amount of datapoints that were added.
+func (s *KMeansServer) Import(snapshot []byte, resp *int) error {
+	n, err := LoadSnapshot(s, bytes.NewReader(snapshot))
+	*resp = n
+	return err
+}
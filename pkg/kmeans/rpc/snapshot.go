@@ -0,0 +1,210 @@
+/*
+Persistence and handoff of the data kept by a KMeansServer, intended for
+shutting a node down (and starting it back up) without losing data. These are
+funcs and not methods of KMeansServer for the same reason as StartListen.
+*/
+package rpc
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Bumped when the snapshot format changes.
+const snapshotVersion = 1
+
+// snapshot is the persisted form of the data in a KMeansServer. Only
+// datapoints are kept (grouped by Centroid), everything else is derived.
+type snapshot struct {
+	Version int
+	// Keys are namespaces, vals are the datapoints of each Centroid.
+	Namespaces map[string][][]DataPoint
+}
+
+// SaveSnapshot writes all data (for all namespaces) in a KMeansServer to 'w'.
+// Each namespace is locked while it is copied, so the server can be used
+// concurrently, though the snapshot is then not consistent across namespaces.
+// Datapoints that are reserved for a transfer (see ReserveCentroid) are
+// included, so they might end up in both this snapshot and another node.
+func SaveSnapshot(s *KMeansServer, w io.Writer) error {
+	return saveSnapshot(s, w, s.Table.Namespaces())
+}
+
+// saveSnapshot is SaveSnapshot for some namespaces, those that don't exist
+// are skipped.
+func saveSnapshot(s *KMeansServer, w io.Writer, namespaces []string) error {
+	snap := snapshot{
+		Version:    snapshotVersion,
+		Namespaces: make(map[string][][]DataPoint),
+	}
+	for _, ns := range namespaces {
+		s.Table.Access(ns, func(cm *CentroidManager) {
+			centroids := make([][]DataPoint, 0, len(cm.Centroids))
+			for _, c := range cm.Centroids {
+				if c.LenDP() != 0 {
+					centroids = append(centroids, c.ExportDataPoints())
+				}
+			}
+			snap.Namespaces[ns] = centroids
+		})
+		// Datapoints that are being moved elsewhere are kept, in case the
+		// move doesn't finish (see ./migrate.go).
+		if reserved := s.migrations.reserved(ns); len(reserved) != 0 {
+			snap.Namespaces[ns] = append(snap.Namespaces[ns], reserved...)
+		}
+	}
+	return gob.NewEncoder(w).Encode(&snap)
+}
+
+// LoadSnapshot reads data written by SaveSnapshot from 'r' and adds it to a
+// KMeansServer. Namespaces are created (with s.CentroidManagerFactoryFunc)
+// if they don't exist, otherwise the Centroids are adopted by the existing
+// CentroidManager. Returns the amount of datapoints that were loaded.
+func LoadSnapshot(s *KMeansServer, r io.Reader) (int, error) {
+	snap, err := readSnapshot(r)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for ns, dps := range snap.Namespaces {
+		centroids := make([]*Centroid, 0, len(dps))
+		for _, cdps := range dps {
+			if len(cdps) != 0 {
+				centroids = append(centroids, &Centroid{DataPoints: cdps})
+				n += len(cdps)
+			}
+		}
+		if len(centroids) == 0 {
+			continue
+		}
+		adopt := func(cm *CentroidManager) { cm.AdoptCentroids(centroids) }
+		if !s.Table.Access(ns, adopt) {
+			cm := s.CentroidManagerFactoryFunc(centroids[0].DataPoints[0].Vec)
+			adopt(cm)
+			s.Table.AddSlot(ns, &CManagerSlot{cManager: cm})
+		}
+	}
+	return n, nil
+}
+
+// readSnapshot decodes a snapshot written by SaveSnapshot.
+func readSnapshot(r io.Reader) (snapshot, error) {
+	var snap snapshot
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return snap, err
+	}
+	if snap.Version != snapshotVersion {
+		return snap, fmt.Errorf("unsupported snapshot version %v (want %v)",
+			snap.Version, snapshotVersion)
+	}
+	return snap, nil
+}
+
+// MergeSnapshots reads snapshots (written by SaveSnapshot, e.g exported from
+// several nodes with kmeansClient.Export) from 'rs', and writes them as a
+// single snapshot to 'w'. Returns the amount of datapoints in the result.
+func MergeSnapshots(w io.Writer, rs ...io.Reader) (int, error) {
+	merged := snapshot{
+		Version:    snapshotVersion,
+		Namespaces: make(map[string][][]DataPoint),
+	}
+	n := 0
+	for _, r := range rs {
+		snap, err := readSnapshot(r)
+		if err != nil {
+			return 0, err
+		}
+		for ns, centroids := range snap.Namespaces {
+			merged.Namespaces[ns] = append(merged.Namespaces[ns], centroids...)
+			for _, dps := range centroids {
+				n += len(dps)
+			}
+		}
+	}
+	return n, gob.NewEncoder(w).Encode(&merged)
+}
+
+// SaveSnapshotFile is like SaveSnapshot but writes to a file. The file is
+// replaced atomically, so an existing snapshot is intact if this fails.
+func SaveSnapshotFile(s *KMeansServer, path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after rename.
+
+	if err := SaveSnapshot(s, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshotFile is like LoadSnapshot but reads from a file. A file that
+// doesn't exist is not an error (nothing is loaded).
+func LoadSnapshotFile(s *KMeansServer, path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return LoadSnapshot(s, f)
+}
+
+// Handoff moves all data (for all namespaces) in a KMeansServer to the nodes
+// at 'peers' (addresses of other KMeansServer instances, 's' itself is
+// skipped), intended for when 's' is about to be shut down. The peers
+// are asked to steal Centroids from 's' (see StealCentroid), in rounds where
+// each peer takes an even share of what remains, such that each Centroid
+// ends up at the peer with the most similar data. The server must still be
+// listening while this is done.
+//
+// Returns the amount of datapoints moved, and false if any peer could not be
+// reached (in which case data might remain in 's').
+func Handoff(s *KMeansServer, peers []string) (int, bool) {
+	others := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		if peer != s.addr {
+			others = append(others, peer)
+		}
+	}
+
+	lenDP := func(ns string) int {
+		n := 0
+		s.Table.Access(ns, func(cm *CentroidManager) { n = cm.LenDP() })
+		return n
+	}
+
+	moved, allOK := 0, true
+	for _, ns := range s.Table.Namespaces() {
+		for remaining := lenDP(ns); remaining > 0 && len(others) != 0; {
+			share := remaining/len(others) + 1
+			progress := false
+			for _, peer := range others {
+				n, ok := KMeansClient(peer, ns, nil).StealCentroids(s.addr, share)
+				moved += n
+				progress = progress || n > 0
+				allOK = allOK && ok
+			}
+			if !progress {
+				break
+			}
+			remaining = lenDP(ns)
+		}
+	}
+	return moved, allOK
+}
@@ -0,0 +1,58 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// Weight of the latest query in the moving average of query latency, so
+// roughly the last 1/latencyAlpha queries are represented.
+const latencyAlpha = 0.1
+
+// serverStats keeps track of activity in a KMeansServer, per namespace, which
+// is reported by KMeansServer.Meta. The zero value is ready to use.
+type serverStats struct {
+	sync.Mutex
+	// Total amount of datapoints added with AddDataPoint.
+	inserts map[string]int
+	// Exponential moving average of KNNLookup durations.
+	latency map[string]time.Duration
+}
+
+func (s *serverStats) addInsert(namespace string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.inserts == nil {
+		s.inserts = make(map[string]int)
+	}
+	s.inserts[namespace]++
+}
+
+func (s *serverStats) addQuery(namespace string, d time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	if s.latency == nil {
+		s.latency = make(map[string]time.Duration)
+	}
+	prev, ok := s.latency[namespace]
+	if !ok {
+		s.latency[namespace] = d
+		return
+	}
+	s.latency[namespace] = prev + time.Duration(latencyAlpha*float64(d-prev))
+}
+
+// copy returns copies of the stats maps.
+func (s *serverStats) copy() (inserts map[string]int, latency map[string]time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	inserts = make(map[string]int, len(s.inserts))
+	for k, v := range s.inserts {
+		inserts[k] = v
+	}
+	latency = make(map[string]time.Duration, len(s.latency))
+	for k, v := range s.latency {
+		latency[k] = v
+	}
+	return inserts, latency
+}
@@ -0,0 +1,94 @@
+package rpc
+
+import (
+	"encoding/json"
+	"time"
+	"trypo/pkg/clock"
+)
+
+// TTL is the expiry policy of a namespace. The zero value means that
+// datapoints only expire as set by clients (see common.DataPoint).
+type TTL struct {
+	// Default is the time to live of datapoints that are added without
+	// an expiry (ExpireEnabled=false), zero means that they never expire.
+	// Applies to all adds with KMeansServer.AddDataPoint, including those
+	// done when datapoints are distributed between nodes.
+	Default time.Duration
+	// RefreshOnRead makes lookups (KMeansServer.KNNLookup without drain)
+	// push the expiry of the datapoints they find forward to Default from
+	// now, as if they were touched (see KMeansServer.Touch).
+	RefreshOnRead bool
+}
+
+// TTLs by namespace, where "*" is the TTL for all namespaces that don't have
+// their own.
+type TTLs map[string]TTL
+
+// For returns the TTL for 'namespace'.
+func (t TTLs) For(namespace string) TTL {
+	if ttl, ok := t[namespace]; ok {
+		return ttl
+	}
+	return t["*"]
+}
+
+type ttlJSON struct {
+	Default       string `json:"default"`
+	RefreshOnRead bool   `json:"refresh_on_read"`
+}
+
+// MarshalJSON writes Default as a string (e.g "24h") instead of nanoseconds.
+func (t TTL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ttlJSON{Default: t.Default.String(), RefreshOnRead: t.RefreshOnRead})
+}
+
+// UnmarshalJSON reads the form written by MarshalJSON. Values that are left
+// out are unchanged.
+func (t *TTL) UnmarshalJSON(b []byte) error {
+	v := ttlJSON{Default: t.Default.String(), RefreshOnRead: t.RefreshOnRead}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(v.Default)
+	if err != nil {
+		return err
+	}
+	*t = TTL{Default: d, RefreshOnRead: v.RefreshOnRead}
+	return nil
+}
+
+// withDefaultTTL returns 'dp' with the default expiry of 'namespace' in 's',
+// unless it already has an expiry (or there is no default).
+func (s *KMeansServer) withDefaultTTL(namespace string, dp DataPoint) DataPoint {
+	if ttl := s.TTLs.For(namespace).Default; ttl > 0 && !dp.ExpireEnabled {
+		dp.Expires = clock.Now().Add(ttl)
+		dp.ExpireEnabled = true
+	}
+	return dp
+}
+
+type TouchArgs struct {
+	NameSpace string
+	Vec       []float64
+	K         int
+	// New time to live, zero or less means the default of the namespace
+	// (see TTL).
+	TTL time.Duration
+}
+
+// Touch pushes the expiry of the args.K datapoints nearest args.Vec forward to
+// args.TTL from now (see CentroidManager.Touch). Expiry is never moved back,
+// and datapoints that don't expire are left as they are. The response is the
+// amount of datapoints that were found, zero if there is no TTL to apply.
+// Returns a NamespaceErr if the namespace doesn't exist.
+func (s *KMeansServer) Touch(args TouchArgs, r *int) error {
+	ttl := args.TTL
+	if ttl <= 0 {
+		ttl = s.TTLs.For(args.NameSpace).Default
+	}
+	return s.handleNamespaceErr(args.NameSpace, func(cm *CentroidManager) {
+		if ttl > 0 {
+			*r = len(cm.Touch(args.Vec, args.K, clock.Now().Add(ttl)))
+		}
+	})
+}
@@ -0,0 +1,284 @@
+/*
+This pkg contains a small structured, leveled logger which writes one line per
+event, either in logfmt or JSON. Events carry fields, where the ones that are
+common in this system have their own constructors (Node, Namespace, Task,
+Peer, Duration and Err) such that they're named consistently. Example:
+
+	logging.Default().Info("stole centroids", logging.Namespace(ns),
+		logging.Peer(addr), logging.F("dps", n))
+
+Output (logfmt):
+
+	time=2021-08-01T12:00:00.000Z level=info msg="stole centroids" namespace=a peer=localhost:3501 dps=10
+*/
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is the severity of an event, events below the level of a Logger are
+// dropped.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if s, ok := levelNames[l]; ok {
+		return s
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (l Level) MarshalText() ([]byte, error) { return []byte(l.String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepts the names
+// "debug", "info", "warn" and "error".
+func (l *Level) UnmarshalText(b []byte) error {
+	for level, name := range levelNames {
+		if name == strings.ToLower(string(b)) {
+			*l = level
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q (want debug, info, warn or error)", b)
+}
+
+// Format is the output format of a Logger.
+type Format int
+
+const (
+	// FormatLogfmt is key=value pairs, e.g: level=info msg="some event".
+	FormatLogfmt Format = iota
+	// FormatJSON is one JSON object per line.
+	FormatJSON
+)
+
+var formatNames = map[Format]string{
+	FormatLogfmt: "logfmt",
+	FormatJSON:   "json",
+}
+
+func (f Format) String() string {
+	if s, ok := formatNames[f]; ok {
+		return s
+	}
+	return fmt.Sprintf("format(%d)", int(f))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (f Format) MarshalText() ([]byte, error) { return []byte(f.String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepts the names
+// "logfmt" and "json".
+func (f *Format) UnmarshalText(b []byte) error {
+	for format, name := range formatNames {
+		if name == strings.ToLower(string(b)) {
+			*f = format
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log format %q (want logfmt or json)", b)
+}
+
+// Field is a key-value pair attached to an event.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a Field, see also the constructors for common fields below.
+func F(key string, value interface{}) Field { return Field{key, value} }
+
+// Node is the address of the (RPC) node an event is about.
+func Node(addr string) Field { return Field{"node", addr} }
+
+// Namespace is the data namespace an event is about.
+func Namespace(namespace string) Field { return Field{"namespace", namespace} }
+
+// Task is the name of the event loop task an event is from.
+func Task(name string) Field { return Field{"task", name} }
+
+// Peer is the address of a remote node, e.g the other end of an RPC call.
+func Peer(addr string) Field { return Field{"peer", addr} }
+
+// Duration is how long something took.
+func Duration(d time.Duration) Field { return Field{"duration", d} }
+
+// Err is an error, a nil error is written as an empty value.
+func Err(err error) Field { return Field{"error", err} }
+
+// output is shared by a Logger and all loggers derived from it with With.
+type output struct {
+	sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+	now    func() time.Time
+}
+
+// Logger writes events to an io.Writer. It is safe for concurrent use.
+type Logger struct {
+	out    *output
+	fields []Field
+}
+
+// New returns a Logger which writes events with at least 'level' to 'w'.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{out: &output{w: w, level: level, format: format, now: time.Now}}
+}
+
+var std = struct {
+	sync.Mutex
+	l *Logger
+}{l: New(os.Stderr, LevelInfo, FormatLogfmt)}
+
+// Default returns the logger used by all packages in this system. It writes
+// to stderr in logfmt with LevelInfo, unless changed with SetDefault.
+func Default() *Logger {
+	std.Lock()
+	defer std.Unlock()
+	return std.l
+}
+
+// SetDefault changes the logger returned by Default.
+func SetDefault(l *Logger) {
+	std.Lock()
+	defer std.Unlock()
+	std.l = l
+}
+
+// With returns a Logger which adds 'fields' to all events (before the
+// fields given to each event).
+func (l *Logger) With(fields ...Field) *Logger {
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+	return &Logger{out: l.out, fields: all}
+}
+
+// Enabled returns true if events with 'level' are written, can be used for
+// avoiding expensive fields.
+func (l *Logger) Enabled(level Level) bool { return level >= l.out.level }
+
+func (l *Logger) Debug(msg string, fields ...Field) { l.Log(LevelDebug, msg, fields...) }
+func (l *Logger) Info(msg string, fields ...Field)  { l.Log(LevelInfo, msg, fields...) }
+func (l *Logger) Warn(msg string, fields ...Field)  { l.Log(LevelWarn, msg, fields...) }
+func (l *Logger) Error(msg string, fields ...Field) { l.Log(LevelError, msg, fields...) }
+
+// Log writes an event, if 'level' is enabled.
+func (l *Logger) Log(level Level, msg string, fields ...Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	all := make([]Field, 0, 3+len(l.fields)+len(fields))
+	all = append(all,
+		Field{"time", l.out.now().UTC().Format("2006-01-02T15:04:05.000Z07:00")},
+		Field{"level", level.String()},
+		Field{"msg", msg},
+	)
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+
+	var b bytes.Buffer
+	switch l.out.format {
+	case FormatJSON:
+		writeJSON(&b, all)
+	default:
+		writeLogfmt(&b, all)
+	}
+	b.WriteByte('\n')
+
+	l.out.Lock()
+	defer l.out.Unlock()
+	l.out.w.Write(b.Bytes())
+}
+
+// text returns the value of a field as a string.
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func writeLogfmt(b *bytes.Buffer, fields []Field) {
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		s := text(f.Value)
+		if needsQuote(s) {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(s)
+	}
+}
+
+func needsQuote(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, r := range s {
+		if unicode.IsSpace(r) || r == '=' || r == '"' || !unicode.IsPrint(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(b *bytes.Buffer, fields []Field) {
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.Key)
+		b.Write(k)
+		b.WriteByte(':')
+		var v interface{} = f.Value
+		switch f.Value.(type) {
+		// Numbers and bools as they are, everything else as text.
+		case int, int64, int32, uint, uint64, uint32, float64, float32, bool:
+		default:
+			v = text(f.Value)
+		}
+		bv, err := json.Marshal(v)
+		if err != nil {
+			bv, _ = json.Marshal(text(f.Value))
+		}
+		b.Write(bv)
+	}
+	b.WriteByte('}')
+}
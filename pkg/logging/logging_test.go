@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestLogger returns a logger with a fixed time, writing to the returned
+// buffer.
+func newTestLogger(level Level, format Format) (*Logger, *bytes.Buffer) {
+	var b bytes.Buffer
+	l := New(&b, level, format)
+	l.out.now = func() time.Time { return time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC) }
+	return l, &b
+}
+
+func TestLogfmt(t *testing.T) {
+	l, b := newTestLogger(LevelInfo, FormatLogfmt)
+	l = l.With(Node("localhost:3500"))
+
+	l.Debug("dropped")
+	l.Info("stole centroids", Namespace("a b"), Peer("localhost:3501"),
+		Duration(time.Millisecond*1500), F("dps", 10), Err(nil))
+	l.Error("failed", Err(errors.New(`bad "thing"`)))
+
+	want := `time=2021-08-01T12:00:00.000Z level=info msg="stole centroids" node=localhost:3500 ` +
+		`namespace="a b" peer=localhost:3501 duration=1.5s dps=10 error=""` + "\n" +
+		`time=2021-08-01T12:00:00.000Z level=error msg=failed node=localhost:3500 ` +
+		`error="bad \"thing\""` + "\n"
+	if b.String() != want {
+		t.Fatalf("unexpected output:\n%v\nwant:\n%v", b.String(), want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	l, b := newTestLogger(LevelDebug, FormatJSON)
+	l.Debug("event", Task("merge"), F("n", 3), F("ok", true), Duration(time.Second))
+
+	want := `{"time":"2021-08-01T12:00:00.000Z","level":"debug","msg":"event",` +
+		`"task":"merge","n":3,"ok":true,"duration":"1s"}` + "\n"
+	if b.String() != want {
+		t.Fatalf("unexpected output:\n%v\nwant:\n%v", b.String(), want)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &m); err != nil {
+		t.Fatalf("output isn't valid JSON: %v", err)
+	}
+}
+
+func TestLevelText(t *testing.T) {
+	var l Level
+	if err := l.UnmarshalText([]byte("WARN")); err != nil || l != LevelWarn {
+		t.Fatalf("unexpected level: %v (err: %v)", l, err)
+	}
+	if err := l.UnmarshalText([]byte("loud")); err == nil {
+		t.Fatalf("expected an error")
+	}
+	var f Format
+	if err := f.UnmarshalText([]byte("json")); err != nil || f != FormatJSON {
+		t.Fatalf("unexpected format: %v (err: %v)", f, err)
+	}
+	if b, _ := FormatLogfmt.MarshalText(); string(b) != "logfmt" {
+		t.Fatalf("unexpected format text: %s", b)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	prev := Default()
+	defer SetDefault(prev)
+
+	l, b := newTestLogger(LevelInfo, FormatLogfmt)
+	SetDefault(l)
+	Default().Info("x")
+	if !strings.Contains(b.String(), "msg=x") {
+		t.Fatalf("default logger wasn't changed: %q", b.String())
+	}
+}
@@ -0,0 +1,395 @@
+/*
+This file contains tools for scalar quantization of vectors, i.e storing each
+vector element as an int8 or float16 (as opposed to float64) together with a
+scale and offset. The scale and offset are either kept per dimension or as a
+single pair for all dimensions (see QuantScope). Distance kernels (below
+DecodeInto) operate directly on the quantized form, so vectors don't have to
+be decoded into new slices when compared.
+
+*/
+
+package mathutils
+
+import (
+	"errors"
+	"math"
+)
+
+// QuantKind specifies how vector elements are stored when quantized.
+type QuantKind int
+
+const (
+	// QuantNone disables quantization (plain float64).
+	QuantNone QuantKind = iota
+	// QuantInt8 stores each element as an int8 (1 byte).
+	QuantInt8
+	// QuantFloat16 stores each element as an IEEE 754 half float (2 bytes).
+	QuantFloat16
+)
+
+// QuantScope specifies the granularity of scale and offset used in quantization.
+type QuantScope int
+
+const (
+	// QuantPerDimension keeps one scale and offset per vector dimension.
+	QuantPerDimension QuantScope = iota
+	// QuantPerCentroid keeps one scale and offset for all dimensions.
+	QuantPerCentroid
+)
+
+// QuantConfig is a quantization configuration, the zero value disables it.
+type QuantConfig struct {
+	Kind  QuantKind
+	Scope QuantScope
+}
+
+// VecBytes returns the amount of bytes used for the elements of a vector with
+// 'dim' elements when it is stored with this configuration (like QVec.Bytes,
+// or 8 per element without quantization).
+func (cfg QuantConfig) VecBytes(dim int) int {
+	switch cfg.Kind {
+	case QuantInt8:
+		return dim
+	case QuantFloat16:
+		return dim * 2
+	}
+	return dim * 8
+}
+
+// QVec is a quantized vector. Only one of the fields is used, depending on
+// the QuantKind of the Quantizer that created it.
+type QVec struct {
+	I8  []int8
+	F16 []uint16
+}
+
+// Len returns the dimension of the quantized vector.
+func (qv *QVec) Len() int {
+	if qv.I8 != nil {
+		return len(qv.I8)
+	}
+	return len(qv.F16)
+}
+
+// Bytes returns the amount of bytes used for the vector elements.
+func (qv *QVec) Bytes() int { return len(qv.I8) + len(qv.F16)*2 }
+
+// Quantizer encodes float64 vectors into QVec and back. It keeps track of
+// the value range it has seen (per dimension or in total, see QuantScope)
+// and derives scale and offset from that range. Values outside the range
+// are clamped, so Covers and Widen should be used before encoding values
+// that might fall outside -- stored QVec must then be re-encoded.
+type Quantizer struct {
+	kind  QuantKind
+	scope QuantScope
+	dim   int
+
+	// Range seen so far; len=dim for QuantPerDimension, len=1 otherwise.
+	lo, hi []float64
+	// Derived from lo & hi (see setParams).
+	scale, offset []float64
+	// Whether or not any range is set (first Widen).
+	init bool
+}
+
+// NewQuantizer creates a Quantizer for vectors with 'dim' elements. Returns
+// nil if cfg.Kind is QuantNone (or unknown), which is meant to signal that
+// vectors should be kept as they are.
+func NewQuantizer(cfg QuantConfig, dim int) *Quantizer {
+	if cfg.Kind != QuantInt8 && cfg.Kind != QuantFloat16 {
+		return nil
+	}
+	n := dim
+	if cfg.Scope == QuantPerCentroid {
+		n = 1
+	}
+	return &Quantizer{
+		kind:   cfg.Kind,
+		scope:  cfg.Scope,
+		dim:    dim,
+		lo:     make([]float64, n),
+		hi:     make([]float64, n),
+		scale:  make([]float64, n),
+		offset: make([]float64, n),
+	}
+}
+
+// Config returns the configuration used to create the Quantizer.
+func (q *Quantizer) Config() QuantConfig { return QuantConfig{q.kind, q.scope} }
+
+// param index for vector element i.
+func (q *Quantizer) p(i int) int {
+	if q.scope == QuantPerCentroid {
+		return 0
+	}
+	return i
+}
+
+// setParams derives scale and offset from lo and hi. Offset is the middle
+// of the range while scale maps the range onto [-127,127] for int8 and
+// [-1,1] for float16.
+func (q *Quantizer) setParams() {
+	for j := range q.lo {
+		q.offset[j] = (q.lo[j] + q.hi[j]) / 2
+		width := q.hi[j] - q.lo[j]
+		switch {
+		// Zero width means that all values equal offset, any scale works.
+		case width == 0:
+			q.scale[j] = 1
+		case q.kind == QuantInt8:
+			q.scale[j] = width / 254
+		default:
+			q.scale[j] = width / 2
+		}
+	}
+}
+
+// Covers returns true if all elements of vec are within the current range.
+func (q *Quantizer) Covers(vec []float64) bool {
+	if !q.init || len(vec) != q.dim {
+		return false
+	}
+	for i, v := range vec {
+		if v < q.lo[q.p(i)] || v > q.hi[q.p(i)] {
+			return false
+		}
+	}
+	return true
+}
+
+// Widen expands the range such that vec is covered. A range that grows gets
+// headroom on the side(s) it grew towards, such that it at least doubles in
+// width. Stored vectors then have to be re-encoded only a logarithmic amount
+// of times when values creep outwards, and since the step size (scale)
+// doubles each time as well, the error from re-encoding already quantized
+// values adds up to at most one step of the final range. The first call sets
+// the range without padding.
+func (q *Quantizer) Widen(vec []float64) {
+	if len(vec) != q.dim {
+		return
+	}
+	lo := append([]float64(nil), q.lo...)
+	hi := append([]float64(nil), q.hi...)
+	seen := make([]bool, len(lo))
+	for i, v := range vec {
+		j := q.p(i)
+		// First vec for this param (per centroid scope has many).
+		if !q.init && !seen[j] {
+			lo[j], hi[j] = v, v
+			seen[j] = true
+			continue
+		}
+		lo[j] = math.Min(lo[j], v)
+		hi[j] = math.Max(hi[j], v)
+	}
+	for j := range lo {
+		grewLo, grewHi := lo[j] < q.lo[j], hi[j] > q.hi[j]
+		if q.init && (grewLo || grewHi) {
+			width := hi[j] - lo[j]
+			pad := math.Max((q.hi[j]-q.lo[j])*2, width*1.5) - width
+			switch {
+			case grewLo && grewHi:
+				lo[j] -= pad / 2
+				hi[j] += pad / 2
+			case grewLo:
+				lo[j] -= pad
+			default:
+				hi[j] += pad
+			}
+		}
+	}
+	q.lo, q.hi = lo, hi
+	q.init = true
+	q.setParams()
+}
+
+// Fit resets the range to exactly cover all vectors given by the generator,
+// (no padding). Returns false if the generator is empty or if any vector
+// has an unexpected length, in which case the Quantizer is left unchanged.
+func (q *Quantizer) Fit(generator func() ([]float64, bool)) bool {
+	lo := make([]float64, len(q.lo))
+	hi := make([]float64, len(q.hi))
+	first := true
+	for {
+		vec, cont := generator()
+		if !cont {
+			break
+		}
+		if len(vec) != q.dim {
+			return false
+		}
+		for i, v := range vec {
+			j := q.p(i)
+			if first || v < lo[j] {
+				lo[j] = v
+			}
+			if first || v > hi[j] {
+				hi[j] = v
+			}
+			if q.scope == QuantPerCentroid {
+				first = false
+			}
+		}
+		first = false
+	}
+	if first {
+		return false
+	}
+	q.lo, q.hi = lo, hi
+	q.init = true
+	q.setParams()
+	return true
+}
+
+// Encode quantizes a vector. Values outside the current range are clamped.
+func (q *Quantizer) Encode(vec []float64) QVec {
+	qv := QVec{}
+	switch q.kind {
+	case QuantInt8:
+		qv.I8 = make([]int8, len(vec))
+		for i, v := range vec {
+			j := q.p(i)
+			x := math.Round((v - q.offset[j]) / q.scale[j])
+			qv.I8[i] = int8(math.Max(-127, math.Min(127, x)))
+		}
+	case QuantFloat16:
+		qv.F16 = make([]uint16, len(vec))
+		for i, v := range vec {
+			j := q.p(i)
+			x := (v - q.offset[j]) / q.scale[j]
+			qv.F16[i] = float64ToHalf(math.Max(-1, math.Min(1, x)))
+		}
+	}
+	return qv
+}
+
+// at decodes element i of qv.
+func (q *Quantizer) at(qv *QVec, i int) float64 {
+	j := q.p(i)
+	if q.kind == QuantInt8 {
+		return float64(qv.I8[i])*q.scale[j] + q.offset[j]
+	}
+	return halfToFloat64(qv.F16[i])*q.scale[j] + q.offset[j]
+}
+
+// Decode converts a quantized vector back into a (new) float64 vector.
+func (q *Quantizer) Decode(qv QVec) []float64 {
+	return q.DecodeInto(qv, make([]float64, qv.Len()))
+}
+
+// DecodeInto is the same as Decode but writes into dst, which is re-sized
+// if it doesn't have the correct length. Useful for avoiding allocations
+// when decoding many vectors in sequence.
+func (q *Quantizer) DecodeInto(qv QVec, dst []float64) []float64 {
+	if len(dst) != qv.Len() {
+		dst = make([]float64, qv.Len())
+	}
+	for i := range dst {
+		dst[i] = q.at(&qv, i)
+	}
+	return dst
+}
+
+// CosineSimilarity is the quantized counterpart of CosineSimilarity in this
+// pkg, comparing a vector to a quantized vector without decoding the latter
+// into a new slice. Returns an err if the vectors are of different lengths.
+func (q *Quantizer) CosineSimilarity(vec []float64, qv QVec) (float64, error) {
+	if len(vec) != qv.Len() {
+		return 0, errors.New("similarity measurement attempt failed: vectors are of different lengths")
+	}
+	var dot, n1, n2 float64
+	for i, v := range vec {
+		x := q.at(&qv, i)
+		dot += v * x
+		n1 += v * v
+		n2 += x * x
+	}
+	if n1 == 0 && n2 == 0 {
+		return 0, nil
+	}
+	return dot / math.Sqrt(n1) / math.Sqrt(n2), nil
+}
+
+// EuclideanDistance is the quantized counterpart of EuclideanDistance in
+// this pkg, see CosineSimilarity. Returns an err if the vectors are of
+// different lengths.
+func (q *Quantizer) EuclideanDistance(vec []float64, qv QVec) (float64, error) {
+	if len(vec) != qv.Len() {
+		return 0, errors.New("distance measurement attempt failed: vectors are of different lengths")
+	}
+	var r float64
+	for i, v := range vec {
+		d := v - q.at(&qv, i)
+		r += d * d
+	}
+	return math.Sqrt(r), nil
+}
+
+// float64ToHalf converts a float into IEEE 754 half precision bits, with
+// rounding to nearest (ties away from zero).
+func float64ToHalf(f float64) uint16 {
+	b := math.Float32bits(float32(f))
+	sign := uint16(b>>16) & 0x8000
+	exp32 := int((b >> 23) & 0xff)
+	mant := b & 0x7fffff
+
+	// Inf or NaN.
+	if exp32 == 0xff {
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	}
+
+	exp := exp32 - 127 + 15
+	switch {
+	// Overflow, becomes inf.
+	case exp >= 0x1f:
+		return sign | 0x7c00
+	// Subnormal (or zero if too small).
+	case exp <= 0:
+		if exp < -10 {
+			return sign
+		}
+		mant |= 0x800000 // Implicit leading bit.
+		shift := uint(14 - exp)
+		half := uint16(mant >> shift)
+		if (mant>>(shift-1))&1 == 1 {
+			half++
+		}
+		return sign | half
+	}
+	half := sign | uint16(exp<<10) | uint16(mant>>13)
+	// Round; a carry into the exponent is still correct.
+	if mant&0x1000 != 0 {
+		half++
+	}
+	return half
+}
+
+// halfToFloat64 converts IEEE 754 half precision bits into a float. Done
+// with bit manipulation (through float32) since it is used in hot loops.
+func halfToFloat64(h uint16) float64 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch exp {
+	case 0:
+		if mant == 0 {
+			return float64(math.Float32frombits(sign))
+		}
+		// Subnormal; normalise for float32.
+		e := uint32(127 - 15 + 1)
+		for mant&0x400 == 0 {
+			mant <<= 1
+			e--
+		}
+		mant &= 0x3ff
+		return float64(math.Float32frombits(sign | e<<23 | mant<<13))
+	// Inf or NaN.
+	case 0x1f:
+		return float64(math.Float32frombits(sign | 0x7f800000 | mant<<13))
+	}
+	return float64(math.Float32frombits(sign | (exp+127-15)<<23 | mant<<13))
+}
@@ -0,0 +1,146 @@
+/*
+This file contains VecSum, a running sum of vectors with an explicit count,
+used for maintaining means incrementally (add/remove one vector at a time)
+without the error build-up of repeatedly doing mean*n+v/(n+1). Summation is
+compensated (Kahan-Babuska / Neumaier), and an error estimate is tracked such
+that owners can recompute from scratch when it grows too large (see Drift).
+*/
+
+package mathutils
+
+import "math"
+
+// machineEps is the unit roundoff of float64.
+const machineEps = 1.1102230246251565e-16
+
+// VecSum is a compensated running sum of vectors, along with the amount of
+// vectors in the sum. The zero value is not usable, see NewVecSum.
+type VecSum struct {
+	sum  []float64
+	comp []float64
+	n    int
+	// Sum of the largest absolute element of all vectors added or removed
+	// since the last Reset. Used for estimating accumulated error.
+	mass float64
+}
+
+// NewVecSum creates an empty VecSum for vectors with 'dim' elements.
+func NewVecSum(dim int) *VecSum {
+	return &VecSum{
+		sum:  make([]float64, dim),
+		comp: make([]float64, dim),
+	}
+}
+
+// VecSumOf creates a VecSum of all vectors given by the generator. Returns
+// false if any vector has a different dimension than the first one, or if
+// the generator is empty (in which case the VecSum has dimension 'dim').
+func VecSumOf(dim int, generator func() ([]float64, bool)) (*VecSum, bool) {
+	s := NewVecSum(dim)
+	first := true
+	for {
+		vec, cont := generator()
+		if !cont {
+			break
+		}
+		if first && len(vec) != dim {
+			s = NewVecSum(len(vec))
+		}
+		first = false
+		if !s.Add(vec) {
+			return s, false
+		}
+	}
+	return s, !first
+}
+
+// add does a compensated addition of sign*vec.
+func (s *VecSum) add(vec []float64, sign float64) bool {
+	if len(vec) != len(s.sum) {
+		return false
+	}
+	max := 0.
+	for i, v := range vec {
+		v *= sign
+		t := s.sum[i] + v
+		if math.Abs(s.sum[i]) >= math.Abs(v) {
+			s.comp[i] += (s.sum[i] - t) + v
+		} else {
+			s.comp[i] += (v - t) + s.sum[i]
+		}
+		s.sum[i] = t
+		max = math.Max(max, math.Abs(v))
+	}
+	s.mass += max
+	return true
+}
+
+// Add adds a vector to the sum. Returns false if the dimension is wrong.
+func (s *VecSum) Add(vec []float64) bool {
+	if !s.add(vec, 1) {
+		return false
+	}
+	s.n++
+	return true
+}
+
+// Sub removes a vector (previously added) from the sum. Returns false if the
+// dimension is wrong or if the sum is empty.
+func (s *VecSum) Sub(vec []float64) bool {
+	if s.n == 0 || !s.add(vec, -1) {
+		return false
+	}
+	s.n--
+	return true
+}
+
+// Len returns the amount of vectors in the sum.
+func (s *VecSum) Len() int { return s.n }
+
+// Dim returns the dimension of the vectors in the sum.
+func (s *VecSum) Dim() int { return len(s.sum) }
+
+// Sum returns the (compensated) sum, as a new vector.
+func (s *VecSum) Sum() []float64 {
+	res := make([]float64, len(s.sum))
+	for i := range res {
+		res[i] = s.sum[i] + s.comp[i]
+	}
+	return res
+}
+
+// Mean returns the mean of all vectors in the sum, as a new vector. Returns
+// false (and a nil vector) if the sum is empty.
+func (s *VecSum) Mean() ([]float64, bool) {
+	if s.n == 0 {
+		return nil, false
+	}
+	res := s.Sum()
+	for i := range res {
+		res[i] /= float64(s.n)
+	}
+	return res, true
+}
+
+// Drift estimates the relative error of Mean, which grows with the amount
+// (and magnitude) of additions and removals done since the last Reset, and
+// shrinks with the amount of vectors in the sum. Owners of a VecSum should
+// recompute it from scratch (Reset + Add) when this exceeds some tolerance.
+func (s *VecSum) Drift() float64 {
+	if s.n == 0 {
+		return 0
+	}
+	mag := 1.
+	for i := range s.sum {
+		mag = math.Max(mag, math.Abs(s.sum[i]+s.comp[i])/float64(s.n))
+	}
+	return 2 * machineEps * s.mass / float64(s.n) / mag
+}
+
+// Reset empties the sum.
+func (s *VecSum) Reset() {
+	for i := range s.sum {
+		s.sum[i], s.comp[i] = 0, 0
+	}
+	s.n, s.mass = 0, 0
+}
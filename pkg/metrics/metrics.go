@@ -0,0 +1,321 @@
+/*
+This pkg contains a small metrics registry with counters, gauges and
+histograms (all with labels), which can be written in the Prometheus text
+exposition format (see Registry.WriteText and Registry.Handler). Packages in
+this system register their metrics with Default, e.g:
+
+	var calls = metrics.Default.Counter("x_calls_total", "Calls.", "method")
+	...
+	calls.Inc("someMethod")
+
+Values that are cheaper to compute when scraped than to keep up to date (e.g
+the amount of datapoints in a node) can be set by funcs registered with
+Registry.OnScrape.
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is the registry used by all packages in this system.
+var Default = NewRegistry()
+
+// DefBuckets are histogram buckets for latencies in seconds (1ms to 10s).
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Kinds of metrics, as written in '# TYPE' lines.
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// Registry keeps metrics by name. The zero value is not usable, see
+// NewRegistry.
+type Registry struct {
+	mu         sync.Mutex
+	metrics    map[string]*metric
+	collectors map[int]func()
+	nextID     int
+	// Only one scrape at a time, such that collectors don't interleave.
+	scrapeMu sync.Mutex
+}
+
+// NewRegistry returns a new empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics:    make(map[string]*metric),
+		collectors: make(map[int]func()),
+	}
+}
+
+// metric is a named metric with all its series (one per combination of
+// label values).
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64 // Histograms only.
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // Counters and gauges.
+	counts      []uint64 // Histograms, per bucket (not cumulative).
+	sum         float64
+	count       uint64
+}
+
+// register returns the metric with 'name', creating it if it doesn't exist.
+// Panics if it exists with a different kind or labels, that's a bug.
+func (r *Registry) register(name, help, kind string, buckets []float64, labels []string) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.metrics[name]; ok {
+		if m.kind != kind || strings.Join(m.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metric %v registered twice with different kind or labels", name))
+		}
+		return m
+	}
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// with calls f with the series for 'labelValues' (created if necessary),
+// while holding the lock of the metric.
+func (m *metric) with(labelValues []string, f func(*series)) {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %v: want %v label values, got %v",
+			m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if m.kind == kindHistogram {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	f(s)
+}
+
+func (m *metric) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.series = make(map[string]*series)
+}
+
+// Counter is a value that only goes up, e.g the amount of requests.
+type Counter struct{ m *metric }
+
+// Counter returns the counter with 'name', registering it if necessary.
+// Label values are given in the same order as 'labels' when the counter
+// is used.
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, kindCounter, nil, labels)}
+}
+
+// Add adds 'v' (should be >= 0) to the series with 'labelValues'.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.m.with(labelValues, func(s *series) { s.value += v })
+}
+
+// Inc adds 1 to the series with 'labelValues'.
+func (c *Counter) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+// Gauge is a value that can go up and down, e.g the amount of datapoints.
+type Gauge struct{ m *metric }
+
+// Gauge returns the gauge with 'name', registering it if necessary.
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, kindGauge, nil, labels)}
+}
+
+// Set sets the series with 'labelValues' to 'v'.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.with(labelValues, func(s *series) { s.value = v })
+}
+
+// Reset removes all series, e.g before they're set again in OnScrape.
+func (g *Gauge) Reset() { g.m.reset() }
+
+// Histogram counts observations in buckets, e.g request latencies.
+type Histogram struct{ m *metric }
+
+// Histogram returns the histogram with 'name', registering it if necessary.
+// 'buckets' are the upper bounds of the buckets, in increasing order (an
+// implicit +Inf bucket is added).
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Histogram{r.register(name, help, kindHistogram, buckets, labels)}
+}
+
+// Observe adds 'v' to the series with 'labelValues'.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.with(labelValues, func(s *series) {
+		if i := sort.SearchFloat64s(h.m.buckets, v); i < len(s.counts) {
+			s.counts[i]++
+		}
+		s.sum += v
+		s.count++
+	})
+}
+
+// Reset removes all series, e.g before they're observed again in OnScrape.
+func (h *Histogram) Reset() { h.m.reset() }
+
+// OnScrape registers a func which is called before each scrape (see
+// WriteText), for setting values that are computed when needed. Returns a
+// func that removes it again.
+func (r *Registry) OnScrape(f func()) (remove func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := r.nextID
+	r.nextID++
+	r.collectors[id] = f
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.collectors, id)
+	}
+}
+
+// WriteText calls all OnScrape funcs, then writes all metrics to 'w' in the
+// Prometheus text exposition format (version 0.0.4), sorted by name and
+// label values.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.scrapeMu.Lock()
+	defer r.scrapeMu.Unlock()
+
+	r.mu.Lock()
+	ids := make([]int, 0, len(r.collectors))
+	for id := range r.collectors {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	collectors := make([]func(), 0, len(ids))
+	for _, id := range ids {
+		collectors = append(collectors, r.collectors[id])
+	}
+	r.mu.Unlock()
+	// Not holding the lock, collectors might register metrics.
+	for _, f := range collectors {
+		f()
+	}
+
+	r.mu.Lock()
+	metrics := make([]*metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// write writes all series of the metric.
+func (m *metric) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != kindHistogram {
+			fmt.Fprintf(w, "%v%v %v\n", m.name, m.labelString(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, le := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%v_bucket%v %v\n", m.name,
+				m.labelString(s.labelValues, formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", m.name, m.labelString(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", m.name, m.labelString(s.labelValues, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", m.name, m.labelString(s.labelValues, ""), s.count)
+	}
+}
+
+// labelString returns e.g `{a="1",b="2"}`, with an 'le' label added if it
+// isn't empty, or "" if there are no labels.
+func (m *metric) labelString(values []string, le string) string {
+	var pairs []string
+	for i, name := range m.labels {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, name, escapeLabel(values[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%v"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler returns a http.Handler which replies with WriteText.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
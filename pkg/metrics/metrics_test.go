@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_calls_total", "Calls.", "method")
+	c.Inc("b")
+	c.Add(2, "a")
+	// Registering again returns the same metric.
+	r.Counter("test_calls_total", "Calls.", "method").Inc("a")
+
+	h := r.Histogram("test_latency_seconds", "Latency.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	g := r.Gauge("test_dps", "Datapoints\nper \"ns\".", "ns")
+	calls := 0
+	remove := r.OnScrape(func() {
+		calls++
+		g.Reset()
+		g.Set(float64(calls), `x"y`)
+	})
+
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	want := strings.Join([]string{
+		`# HELP test_calls_total Calls.`,
+		`# TYPE test_calls_total counter`,
+		`test_calls_total{method="a"} 3`,
+		`test_calls_total{method="b"} 1`,
+		`# HELP test_dps Datapoints\nper "ns".`,
+		`# TYPE test_dps gauge`,
+		`test_dps{ns="x\"y"} 1`,
+		`# HELP test_latency_seconds Latency.`,
+		`# TYPE test_latency_seconds histogram`,
+		`test_latency_seconds_bucket{le="0.1"} 1`,
+		`test_latency_seconds_bucket{le="1"} 2`,
+		`test_latency_seconds_bucket{le="+Inf"} 3`,
+		`test_latency_seconds_sum 5.55`,
+		`test_latency_seconds_count 3`,
+		``,
+	}, "\n")
+	if b.String() != want {
+		t.Fatalf("unexpected output:\n%v\nwant:\n%v", b.String(), want)
+	}
+
+	remove()
+	b.Reset()
+	r.WriteText(&b)
+	if calls != 1 || !strings.Contains(b.String(), `test_dps{ns="x\"y"} 1`) {
+		t.Fatalf("removed OnScrape func was called")
+	}
+}
+
+func TestRegisterConflict(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("x", "", "a")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected a panic")
+		}
+	}()
+	r.Gauge("x", "", "a")
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("x_total", "X.").Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") ||
+		!strings.Contains(w.Body.String(), "x_total 1\n") {
+		t.Fatalf("unexpected response: %v %v", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,182 @@
+package rpcutils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Secret shared by all nodes in a network, see SetSecret.
+var secret struct {
+	sync.RWMutex
+	s string
+}
+
+// SetSecret sets the secret that is shared by all nodes in a network. When
+// it is not empty, each connection starts with a handshake where both sides
+// prove that they know the secret (with HMAC-SHA256 over random nonces, so
+// the secret itself isn't sent): Listen drops peers that fail it, and Dial
+// fails if the server does. Empty (the default) disables the handshake.
+//
+// Listen uses the secret that is set when it is called, Dial the one that
+// is set for each call. Note that clients which don't use Dial (such as the
+// arbiter client in pkg/arbiter) can't call servers with a secret.
+func SetSecret(s string) {
+	secret.Lock()
+	defer secret.Unlock()
+	secret.s = s
+}
+
+func getSecret() string {
+	secret.RLock()
+	defer secret.RUnlock()
+	return secret.s
+}
+
+// ErrAuth is returned when a peer fails the handshake (see SetSecret).
+var ErrAuth = errors.New("rpc peer failed authentication")
+
+// Default time limit for the entire handshake, such that peers which don't
+// take part in it (e.g because they have no secret) don't hold connections.
+// See ListenConfig and Dialer for setting it per server or client.
+const defaultHandshakeTimeout = time.Second * 5
+
+// handshakeTimeout returns 'd', or the default if it isn't positive.
+func handshakeTimeout(d time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultHandshakeTimeout
+	}
+	return d
+}
+
+const nonceLen = 32
+
+// handshakeMAC proves knowledge of 'key' for 'role' ("client" or "server"),
+// the nonces are ordered as (own, other) from the perspective of 'role'.
+func handshakeMAC(key, role string, own, other []byte) []byte {
+	m := hmac.New(sha256.New, []byte(key))
+	m.Write([]byte(role))
+	m.Write(own)
+	m.Write(other)
+	return m.Sum(nil)
+}
+
+// serverHandshake authenticates the client at the other end of 'conn':
+//
+//	server -> client: server nonce
+//	client -> server: client nonce, client MAC
+//	server -> client: server MAC
+func serverHandshake(conn net.Conn, key string, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, nonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return err
+	}
+	buf := make([]byte, nonceLen+sha256.Size)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	clientNonce := buf[:nonceLen]
+	if !hmac.Equal(buf[nonceLen:], handshakeMAC(key, "client", clientNonce, nonce)) {
+		return ErrAuth
+	}
+	_, err := conn.Write(handshakeMAC(key, "server", nonce, clientNonce))
+	return err
+}
+
+// authenticate runs the TLS handshake (if 'conn' uses TLS) and then the
+// server side of the secret handshake (if 'key' isn't empty) for a
+// connection accepted by Listen. Both are limited by 'timeout'.
+func authenticate(conn net.Conn, key string, timeout time.Duration) error {
+	if tc, ok := conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(timeout))
+		err := tc.Handshake()
+		tc.SetDeadline(time.Time{})
+		if err != nil {
+			return err
+		}
+	}
+	if key == "" {
+		return nil
+	}
+	return serverHandshake(conn, key, timeout)
+}
+
+// clientHandshake authenticates the server at the other end of 'conn', see
+// serverHandshake.
+func clientHandshake(conn net.Conn, key string, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	serverNonce := make([]byte, nonceLen)
+	if _, err := io.ReadFull(conn, serverNonce); err != nil {
+		return err
+	}
+	nonce := make([]byte, nonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	msg := append(nonce, handshakeMAC(key, "client", nonce, serverNonce)...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, mac); err != nil {
+		// The server closes the connection if it rejects this client.
+		return ErrAuth
+	}
+	if !hmac.Equal(mac, handshakeMAC(key, "server", serverNonce, nonce)) {
+		return ErrAuth
+	}
+	return nil
+}
+
+// Dialer holds options for dialing servers started with Listen, the zero
+// value uses the defaults.
+type Dialer struct {
+	// HandshakeTimeout limits the TLS and secret handshakes, the default
+	// (when not positive) is 5s.
+	HandshakeTimeout time.Duration
+}
+
+// Dial connects to a server started with Listen, like rpc.Dial, over TLS if
+// it is set up (see SetTLS) and with a handshake if a secret is set (see
+// SetSecret). Uses the default Dialer.
+func Dial(addr string) (*rpc.Client, error) {
+	return Dialer{}.Dial(addr)
+}
+
+// Dial is like the Dial func in this pkg, but uses the options in 'd'.
+func (d Dialer) Dial(addr string) (*rpc.Client, error) {
+	timeout := handshakeTimeout(d.HandshakeTimeout)
+	var conn net.Conn
+	var err error
+	if _, client := getTLS(); client != nil {
+		dialer := net.Dialer{Timeout: timeout}
+		conn, err = tls.DialWithDialer(&dialer, "tcp", addr, client)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key := getSecret(); key != "" {
+		if err := clientHandshake(conn, key, timeout); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rpc.NewClient(conn), nil
+}
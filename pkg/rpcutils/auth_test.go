@@ -0,0 +1,77 @@
+package rpcutils
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+const addr = "localhost:3080"
+
+// Echo is a receiver for the test server.
+type Echo struct{}
+
+func (e *Echo) Echo(s string, r *string) error {
+	*r = s
+	return nil
+}
+
+// call dials addr with the current secret and makes one call.
+func call() error {
+	c, err := Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var r string
+	return c.Call("Echo.Echo", "hi", &r)
+}
+
+func TestHandshake(t *testing.T) {
+	defer SetSecret("")
+	SetSecret("s3cret")
+	stop, err := Listen(addr, &Echo{})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer stop()
+
+	if err := call(); err != nil {
+		t.Fatalf("call with the secret failed: %v", err)
+	}
+	SetSecret("wrong")
+	if err := call(); err != ErrAuth {
+		t.Fatalf("unexpected err with a wrong secret: %v", err)
+	}
+	// Plain net/rpc clients don't pass the handshake.
+	SetSecret("")
+	if c, err := rpc.Dial("tcp", addr); err == nil {
+		var r string
+		if c.Call("Echo.Echo", "hi", &r) == nil {
+			t.Fatalf("call without the secret succeeded")
+		}
+		c.Close()
+	}
+}
+
+func TestNoSecret(t *testing.T) {
+	stop, err := Listen(addr, &Echo{})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer stop()
+	if err := call(); err != nil {
+		t.Fatalf("call without handshake failed: %v", err)
+	}
+
+	// A server without a secret never sends a nonce, so the client gives up.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	if err := clientHandshake(conn, "s3cret", time.Millisecond*100); err == nil {
+		t.Fatalf("handshake with a server without secret succeeded")
+	}
+}
@@ -0,0 +1,116 @@
+/*
+This pkg contains utils for net/rpc servers, shared by the different kinds of
+servers in this system (pkg/kmeans/rpc, pkg/arbiter).
+*/
+package rpcutils
+
+import (
+	"crypto/tls"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+	"trypo/pkg/logging"
+)
+
+// ListenConfig holds options for servers started with Listen or Serve, the
+// zero value uses the defaults.
+type ListenConfig struct {
+	// HandshakeTimeout limits the TLS and secret handshakes of each
+	// connection, the default (when not positive) is 5s.
+	HandshakeTimeout time.Duration
+}
+
+// Listen starts serving the receivers 'rcvrs' (see rpc.Server.Register) on a
+// TCP address, in a new goroutine. Returns a func that stops the server; it
+// closes the listener and all open connections, then waits for the accept
+// loop to return. The stop func can be called more than once, and from any
+// goroutine. Connections use TLS if it is set up with SetTLS, and peers must
+// pass a handshake before any call if a secret is set, see SetSecret.
+func Listen(addr string, rcvrs ...interface{}) (stop func(), err error) {
+	return ListenConfig{}.Listen(addr, rcvrs...)
+}
+
+// Listen is like the Listen func in this pkg, but uses the options in 'lc'.
+func (lc ListenConfig) Listen(addr string, rcvrs ...interface{}) (stop func(), err error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	stop, err = lc.Serve(ln, rcvrs...)
+	if err != nil {
+		ln.Close()
+	}
+	return stop, err
+}
+
+// Serve is like Listen, but serves on a listener that is already set up (e.g
+// on port 0, where the address is only known after listening). The listener
+// is closed by the stop func.
+func Serve(ln net.Listener, rcvrs ...interface{}) (stop func(), err error) {
+	return ListenConfig{}.Serve(ln, rcvrs...)
+}
+
+// Serve is like the Serve func in this pkg, but uses the options in 'lc'.
+func (lc ListenConfig) Serve(ln net.Listener, rcvrs ...interface{}) (stop func(), err error) {
+	handler := rpc.NewServer()
+	for _, rcvr := range rcvrs {
+		if err := handler.Register(rcvr); err != nil {
+			return nil, err
+		}
+	}
+
+	if server, _ := getTLS(); server != nil {
+		ln = tls.NewListener(ln, server)
+	}
+
+	key := getSecret()
+	timeout := handshakeTimeout(lc.HandshakeTimeout)
+	var mu sync.Mutex
+	conns := make(map[net.Conn]bool)
+	stopped := false
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			if stopped {
+				mu.Unlock()
+				conn.Close()
+				return
+			}
+			conns[conn] = true
+			mu.Unlock()
+
+			go func() {
+				if err := authenticate(conn, key, timeout); err == nil {
+					handler.ServeConn(conn)
+				} else {
+					logging.Default().Warn("rejected rpc peer",
+						logging.Peer(conn.RemoteAddr().String()), logging.Err(err))
+					conn.Close()
+				}
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+			}()
+		}
+	}()
+
+	stop = func() {
+		mu.Lock()
+		stopped = true
+		ln.Close()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		<-done
+	}
+	return stop, nil
+}
@@ -0,0 +1,39 @@
+package rpcutils
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// TLS configs for Listen and Dial, see SetTLS.
+var tlsConfigs struct {
+	sync.RWMutex
+	server *tls.Config
+	client *tls.Config
+}
+
+// SetTLS sets the TLS configs for servers (Listen) and clients (Dial) in this
+// process, see pkg/tlsutils. Nil disables TLS for that side, which is the
+// default. All nodes in a network must agree on whether TLS is used. Like
+// with SetSecret, Listen uses the config that is set when it is called.
+func SetTLS(server, client *tls.Config) {
+	tlsConfigs.Lock()
+	defer tlsConfigs.Unlock()
+	tlsConfigs.server = server
+	tlsConfigs.client = client
+}
+
+func getTLS() (server, client *tls.Config) {
+	tlsConfigs.RLock()
+	defer tlsConfigs.RUnlock()
+	return tlsConfigs.server, tlsConfigs.client
+}
+
+// Plain returns true if servers started now (with Listen or Serve) send
+// plain net/rpc (gob) messages, i.e without TLS (see SetTLS) and without a
+// handshake (see SetSecret). Intended for tools that inspect the messages,
+// such as the test network in core/testutils.
+func Plain() bool {
+	server, _ := getTLS()
+	return server == nil && getSecret() == ""
+}
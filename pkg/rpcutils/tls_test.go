@@ -0,0 +1,46 @@
+package rpcutils
+
+import (
+	"testing"
+	"time"
+	"trypo/pkg/tlsutils"
+)
+
+func TestTLS(t *testing.T) {
+	files, err := tlsutils.SelfSigned(t.TempDir(), "localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to generate certs: %v", err)
+	}
+	files.ClientAuth = true
+	server, _ := files.ServerConfig()
+	client, _ := files.ClientConfig()
+	defer SetTLS(nil, nil)
+	defer SetSecret("")
+
+	// TLS and the secret handshake together.
+	SetTLS(server, client)
+	SetSecret("s3cret")
+	// Short handshake timeout, for the failing calls below.
+	lc := ListenConfig{HandshakeTimeout: time.Millisecond * 100}
+	stop, err := lc.Listen(addr, &Echo{})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer stop()
+	if err := call(); err != nil {
+		t.Fatalf("call over tls failed: %v", err)
+	}
+
+	// Without TLS (both sides wait for the other to start a handshake), and
+	// with TLS but no client certificate.
+	SetTLS(nil, nil)
+	if err := call(); err == nil {
+		t.Fatalf("call without tls succeeded")
+	}
+	noCert := client.Clone()
+	noCert.Certificates = nil
+	SetTLS(nil, noCert)
+	if err := call(); err == nil {
+		t.Fatalf("call without a client certificate succeeded")
+	}
+}
@@ -0,0 +1,191 @@
+/*
+This pkg sets up TLS from PEM files, for the API (core/api) and the RPC
+network (see pkg/rpcutils). Nodes use the same certificate when serving and
+when calling other nodes (which is then a client certificate).
+*/
+package tlsutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// Files are the paths of PEM files for TLS. TLS is disabled if Cert is empty.
+type Files struct {
+	// Certificate (chain) and private key of this node.
+	Cert string
+	Key  string
+	// CA certificates for verifying peers, i.e servers when this node is a
+	// client, and clients if ClientAuth is set. Empty means the system roots.
+	CA string
+	// If true, servers require a client certificate signed by CA.
+	ClientAuth bool
+}
+
+// Enabled returns true if f is set.
+func (f Files) Enabled() bool {
+	return f.Cert != ""
+}
+
+// Check returns an error if f is set partially.
+func (f Files) Check() error {
+	if (f.Cert == "") != (f.Key == "") {
+		return errors.New("cert and key must be set together")
+	}
+	if !f.Enabled() && (f.CA != "" || f.ClientAuth) {
+		return errors.New("ca and client_auth require cert and key")
+	}
+	if f.ClientAuth && f.CA == "" {
+		return errors.New("client_auth requires ca")
+	}
+	return nil
+}
+
+// load reads the certificate and the CA pool (nil if f.CA is empty).
+func (f Files) load() (tls.Certificate, *x509.CertPool, error) {
+	if err := f.Check(); err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+	if err != nil {
+		return cert, nil, err
+	}
+	if f.CA == "" {
+		return cert, nil, nil
+	}
+	b, err := ioutil.ReadFile(f.CA)
+	if err != nil {
+		return cert, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return cert, nil, fmt.Errorf("no certificates in %v", f.CA)
+	}
+	return cert, pool, nil
+}
+
+// ServerConfig returns a config for listeners, nil if f isn't enabled.
+func (f Files) ServerConfig() (*tls.Config, error) {
+	if !f.Enabled() {
+		return nil, f.Check()
+	}
+	cert, pool, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if f.ClientAuth {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// ClientConfig returns a config for connecting to servers that use
+// f.ServerConfig (or another config with the same CA), nil if f isn't
+// enabled. The certificate in f is offered as a client certificate.
+func (f Files) ClientConfig() (*tls.Config, error) {
+	if !f.Enabled() {
+		return nil, f.Check()
+	}
+	cert, pool, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// SelfSigned generates a CA, and a certificate for 'hosts' (names or IPs)
+// signed by it, then writes them as PEM files into 'dir' (ca.pem, cert.pem
+// and key.pem). It is meant for tests and local setups, the certificates
+// are valid for a day.
+func SelfSigned(dir string, hosts ...string) (Files, error) {
+	files := Files{
+		Cert: filepath.Join(dir, "cert.pem"),
+		Key:  filepath.Join(dir, "key.pem"),
+		CA:   filepath.Join(dir, "ca.pem"),
+	}
+	now := time.Now()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return files, err
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "trypo test ca"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(time.Hour * 24),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return files, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return files, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "trypo"},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(time.Hour * 24),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		// Same certificate for serving and as a client.
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caTmpl, &key.PublicKey, caKey)
+	if err != nil {
+		return files, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return files, err
+	}
+
+	pems := []struct {
+		path, typ string
+		der       []byte
+	}{
+		{files.CA, "CERTIFICATE", caDER},
+		{files.Cert, "CERTIFICATE", der},
+		{files.Key, "EC PRIVATE KEY", keyDER},
+	}
+	for _, p := range pems {
+		data := pem.EncodeToMemory(&pem.Block{Type: p.typ, Bytes: p.der})
+		if err := ioutil.WriteFile(p.path, data, 0600); err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
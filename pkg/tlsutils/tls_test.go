@@ -0,0 +1,58 @@
+package tlsutils
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		files Files
+		ok    bool
+	}{
+		{Files{}, true},
+		{Files{Cert: "c", Key: "k"}, true},
+		{Files{Cert: "c", Key: "k", CA: "ca", ClientAuth: true}, true},
+		{Files{Cert: "c"}, false},
+		{Files{CA: "ca"}, false},
+		{Files{Cert: "c", Key: "k", ClientAuth: true}, false},
+	}
+	for _, test := range tests {
+		if err := test.files.Check(); (err == nil) != test.ok {
+			t.Fatalf("unexpected result for %+v: %v", test.files, err)
+		}
+	}
+}
+
+func TestSelfSigned(t *testing.T) {
+	files, err := SelfSigned(t.TempDir(), "localhost", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+	files.ClientAuth = true
+	server, err := files.ServerConfig()
+	if err != nil {
+		t.Fatalf("failed to load server config: %v", err)
+	}
+	client, err := files.ClientConfig()
+	if err != nil {
+		t.Fatalf("failed to load client config: %v", err)
+	}
+	client.ServerName = "localhost"
+
+	// Handshake, where both sides verify each other.
+	a, b := net.Pipe()
+	errs := make(chan error, 1)
+	go func() { errs <- tls.Server(a, server).Handshake() }()
+	if err := tls.Client(b, client).Handshake(); err != nil {
+		t.Fatalf("client handshake failed: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("server handshake failed: %v", err)
+	}
+
+	if c, err := (Files{}).ServerConfig(); c != nil || err != nil {
+		t.Fatalf("expected no config when disabled: %v, %v", c, err)
+	}
+}